@@ -8,6 +8,7 @@ package k8sutil
 
 import (
 	"fmt"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -25,3 +26,17 @@ func NewInClusterClient() (kubernetes.Interface, error) {
 	}
 	return client, nil
 }
+
+// NewInClusterDynamicClient does the same for resources which have no
+// typed client, like the ones defined by CRDs.
+func NewInClusterDynamicClient() (dynamic.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("build in-cluster Kubernetes client configuration: %v", err)
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("create dynamic Kubernetes client: %v", err)
+	}
+	return client, nil
+}
@@ -1,3 +1,5 @@
+// +build cgo,!sysfs
+
 package ndctl
 
 //#cgo pkg-config: libndctl
@@ -5,7 +7,6 @@ package ndctl
 //#include <ndctl/libndctl.h>
 //#include <ndctl/ndctl.h>
 import "C"
-import "encoding/json"
 
 //Bus go wrapper for ndctl_bus
 type Bus C.struct_ndctl_bus
@@ -32,16 +33,6 @@ func (b *Bus) Dimms() []*Dimm {
 	return dimms
 }
 
-//ActiveRegions returns all active regions in the bus
-func (b *Bus) ActiveRegions() []*Region {
-	return b.regions(true)
-}
-
-//AllRegions returns all regions in the bus including disabled regions
-func (b *Bus) AllRegions() []*Region {
-	return b.regions(false)
-}
-
 //GetRegionByPhysicalAddress Find region by physical address
 func (b *Bus) GetRegionByPhysicalAddress(address uint64) *Region {
 	ndbus := (*C.struct_ndctl_bus)(b)
@@ -49,16 +40,6 @@ func (b *Bus) GetRegionByPhysicalAddress(address uint64) *Region {
 	return (*Region)(ndr)
 }
 
-//MarshalJSON returns the encoded value of bus
-func (b *Bus) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
-		"provider": b.Provider(),
-		"dev":      b.DeviceName(),
-		"regions":  b.ActiveRegions(),
-		"dimms":    b.Dimms(),
-	})
-}
-
 func (b *Bus) regions(onlyActive bool) []*Region {
 	var regions []*Region
 	ndbus := (*C.struct_ndctl_bus)(b)
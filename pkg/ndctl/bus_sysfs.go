@@ -0,0 +1,54 @@
+// +build !cgo sysfs
+
+package ndctl
+
+import "path/filepath"
+
+//Bus is a ndbus directory in sysfs
+type Bus struct {
+	ctx  *Context
+	path string
+}
+
+//Provider returns bus provider
+func (b *Bus) Provider() string {
+	return readAttr(b.path, "provider")
+}
+
+//DeviceName returns bus device name
+func (b *Bus) DeviceName() string {
+	return filepath.Base(b.path)
+}
+
+//Dimms returns dimms provided by the bus
+func (b *Bus) Dimms() []*Dimm {
+	var dimms []*Dimm
+	for _, name := range listDevices(b.path, "nmem") {
+		dimms = append(dimms, &Dimm{bus: b, path: filepath.Join(b.path, name)})
+	}
+	return dimms
+}
+
+//GetRegionByPhysicalAddress Find region by physical address
+func (b *Bus) GetRegionByPhysicalAddress(address uint64) *Region {
+	for _, r := range b.AllRegions() {
+		// The resource is unknown when the attribute cannot be read.
+		start := readAttrUint(r.path, "resource")
+		if start != 0 && address >= start && address < start+r.Size() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (b *Bus) regions(onlyActive bool) []*Region {
+	var regions []*Region
+	for _, name := range listDevices(b.path, "region") {
+		r := &Region{bus: b, path: filepath.Join(b.path, name)}
+		if !onlyActive || r.Enabled() {
+			regions = append(regions, r)
+		}
+	}
+
+	return regions
+}
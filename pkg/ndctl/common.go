@@ -0,0 +1,265 @@
+package ndctl
+
+// The functions in this file are implemented on top of the
+// backend-specific methods and therefore work with both the libndctl
+// and the sysfs implementation.
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+//CreateNamespace create new namespace with given opts
+func (ctx *Context) CreateNamespace(opts CreateNamespaceOpts) (*Namespace, error) {
+	var regions []*Region
+	for _, bus := range ctx.GetBuses() {
+		regions = append(regions, bus.ActiveRegions()...)
+	}
+	placement := opts.Placement
+	if placement == nil {
+		placement = FirstFit
+	}
+	err := errors.New("no active region")
+	for _, r := range placement.Order(regions, opts.Size) {
+		var ns *Namespace
+		if ns, err = r.CreateNamespace(opts); err == nil {
+			klog.V(3).Infof("Namespace %s created in %s", ns.Name(), r.DeviceName())
+			return ns, nil
+		}
+		// Failing in some region is normal when the namespace
+		// only fits into some other region.
+		klog.V(3).Infof("Namespace creation failure in %s: %s", r.DeviceName(), err.Error())
+	}
+	return nil, err
+}
+
+//DestroyNamespaceByName deletes namespace with given name
+func (ctx *Context) DestroyNamespaceByName(name string) error {
+	ns, err := ctx.GetNamespaceByName(name)
+	if err != nil {
+		return err
+	}
+
+	r := ns.Region()
+	return r.DestroyNamespace(ns, true)
+}
+
+//GetNamespaceByName gets namespace details for given name
+func (ctx *Context) GetNamespaceByName(name string) (*Namespace, error) {
+	for _, bus := range ctx.GetBuses() {
+		for _, r := range bus.AllRegions() {
+			for _, ns := range r.AllNamespaces() {
+				if ns.Name() == name {
+					return ns, nil
+				}
+			}
+		}
+	}
+	return nil, ErrNotExist
+}
+
+//GetActiveNamespaces returns list of all active namespaces in all regions
+func (ctx *Context) GetActiveNamespaces() []*Namespace {
+	var list []*Namespace
+	for _, bus := range ctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			nss := r.ActiveNamespaces()
+			list = append(list, nss...)
+		}
+	}
+
+	return list
+}
+
+//GetAllNamespaces returns list of all namespaces in all regions including idle namespaces
+func (ctx *Context) GetAllNamespaces() []*Namespace {
+	var list []*Namespace
+	for _, bus := range ctx.GetBuses() {
+		for _, r := range bus.AllRegions() {
+			nss := r.AllNamespaces()
+			list = append(list, nss...)
+		}
+	}
+
+	return list
+}
+
+//IsSpaceAvailable checks if a region available with given free size
+func (ctx *Context) IsSpaceAvailable(size uint64) bool {
+	for _, bus := range ctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if r.MaxAvailableExtent() >= size && NamespaceType(r.Type()) == PmemNamespace {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//ActiveRegions returns all active regions in the bus
+func (b *Bus) ActiveRegions() []*Region {
+	return b.regions(true)
+}
+
+//AllRegions returns all regions in the bus including disabled regions
+func (b *Bus) AllRegions() []*Region {
+	return b.regions(false)
+}
+
+//MarshalJSON returns the encoded value of bus
+func (b *Bus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"provider": b.Provider(),
+		"dev":      b.DeviceName(),
+		"regions":  b.ActiveRegions(),
+		"dimms":    b.Dimms(),
+	})
+}
+
+//ActiveNamespaces returns all active namespaces in the region
+func (r *Region) ActiveNamespaces() []*Namespace {
+	return r.namespaces(true)
+}
+
+//AllNamespaces returns all non-zero sized namespaces in the region
+//as sometime a deleted namespace also lies around with size zero, we can ignore
+//such namespace
+func (r *Region) AllNamespaces() []*Namespace {
+	return r.namespaces(false)
+}
+
+//MarshalJSON returns json encoding of the region
+func (r *Region) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":                 r.Type(),
+		"dev":                  r.DeviceName(),
+		"size":                 r.Size(),
+		"available_size":       r.AvailableSize(),
+		"max_available_extent": r.MaxAvailableExtent(),
+		"numa_node":            r.NumaNode(),
+		"namespaces":           r.ActiveNamespaces(),
+		"mappings":             r.Mappings(),
+	})
+}
+
+//MarshalJSON returns json encoding of namespace
+func (ns *Namespace) MarshalJSON() ([]byte, error) {
+
+	props := map[string]interface{}{
+		"id":      ns.ID(),
+		"dev":     ns.DeviceName(),
+		"mode":    ns.Mode(),
+		"size":    ns.Size(),
+		"enabled": ns.Enabled(),
+		"uuid":    ns.UUID(),
+		"name":    ns.Name(),
+	}
+
+	if mode := ns.Mode(); mode != DaxMode {
+		props["blockdev"] = ns.BlockDeviceName()
+	} else {
+		props["chardev"] = ns.CharDeviceName()
+	}
+
+	if location := ns.Location(); location != "none" {
+		props["map"] = location
+	}
+
+	return json.Marshal(props)
+}
+
+//MarshalJSON returns the encoding of dimm
+func (d *Dimm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"id":      d.ID(),
+		"dev":     d.DeviceName(),
+		"handle":  d.Handle(),
+		"phys_id": d.PhysicalID(),
+		"enabled": d.Enabled(),
+	})
+}
+
+//MarshalJSON returns json encoding of the mapping
+func (m *Mapping) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"dimm":     m.Dimm().DeviceName(),
+		"offset":   m.Offset(),
+		"length":   m.Length(),
+		"position": m.Position(),
+	})
+}
+
+//SizeAlign returns the granularity of namespace sizes in the region
+//for namespaces with the given alignment. Besides the alignment times
+//the interleave ways, kernels >= 5.7 enforce a minimum alignment for
+//all namespaces in the region.
+func (r *Region) SizeAlign(align uint64) uint64 {
+	ways := r.InterleaveWays()
+	if ways == 0 {
+		ways = 1
+	}
+	sizeAlign := align * ways
+	if regionAlign := r.Align(); regionAlign != 0 {
+		sizeAlign = lcm(sizeAlign, regionAlign)
+	}
+	return sizeAlign
+}
+
+func lcm(a, b uint64) uint64 {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
+
+// badblockSectorSize is the unit in which the kernel reports bad blocks
+const badblockSectorSize uint64 = 512
+
+//ParseBadblocks parses the content of a badblocks file in sysfs, as
+//provided for regions and block devices. Each line contains the first
+//sector and the number of sectors of a bad range.
+func ParseBadblocks(content string) []Badblock {
+	var badblocks []Badblock
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		sector, err1 := strconv.ParseUint(fields[0], 10, 64)
+		count, err2 := strconv.ParseUint(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			klog.Warningf("invalid bad block entry: %q", line)
+			continue
+		}
+		badblocks = append(badblocks, Badblock{
+			Offset: sector * badblockSectorSize,
+			Length: count * badblockSectorSize,
+		})
+	}
+	return badblocks
+}
+
+// IntersectBadblocks returns those parts of the bad blocks which fall
+// into [start, start+size), with offsets relative to start
+func IntersectBadblocks(badblocks []Badblock, start, size uint64) []Badblock {
+	var result []Badblock
+	for _, bb := range badblocks {
+		from, to := bb.Offset, bb.Offset+bb.Length
+		if from < start {
+			from = start
+		}
+		if to > start+size {
+			to = start + size
+		}
+		if from < to {
+			result = append(result, Badblock{Offset: from - start, Length: to - from})
+		}
+	}
+	return result
+}
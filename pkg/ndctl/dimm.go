@@ -1,3 +1,5 @@
+// +build cgo,!sysfs
+
 package ndctl
 
 //#cgo pkg-config: libndctl
@@ -5,7 +7,7 @@ package ndctl
 //#include <ndctl/libndctl.h>
 //#include <ndctl/ndctl.h>
 import "C"
-import "encoding/json"
+import "fmt"
 
 // Dimm go wrapper for ndctl_dimm
 type Dimm C.struct_ndctl_dimm
@@ -46,13 +48,44 @@ func (d *Dimm) Handle() int16 {
 	return int16(C.ndctl_dimm_get_handle(ndd))
 }
 
-//MarshalJSON returns the encoding of dimm
-func (d *Dimm) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
-		"id":      d.ID(),
-		"dev":     d.DeviceName(),
-		"handle":  d.Handle(),
-		"phys_id": d.PhysicalID(),
-		"enabled": d.Enabled(),
-	})
+//Health returns the SMART health information of the dimm,
+//ErrNotSupported if the dimm does not provide it
+func (d *Dimm) Health() (*DimmHealth, error) {
+	ndd := (*C.struct_ndctl_dimm)(d)
+	cmd := C.ndctl_dimm_cmd_new_smart(ndd)
+	if cmd == nil {
+		return nil, fmt.Errorf("%s: health information: %w", d.DeviceName(), ErrNotSupported)
+	}
+	defer C.ndctl_cmd_unref(cmd)
+
+	if rc := C.ndctl_cmd_submit(cmd); rc < 0 {
+		return nil, fmt.Errorf("%s: failed to get health information: %s", d.DeviceName(), cErrorString(rc))
+	}
+
+	flags := uint(C.ndctl_cmd_smart_get_flags(cmd))
+	health := &DimmHealth{State: HealthUnknown}
+	if flags&smartHealthValid != 0 {
+		health.State = healthState(uint(C.ndctl_cmd_smart_get_health(cmd)))
+	}
+	if flags&smartTempValid != 0 {
+		temperature := decodeTemperature(uint(C.ndctl_cmd_smart_get_temperature(cmd)))
+		health.Temperature = &temperature
+	}
+	if flags&smartSparesValid != 0 {
+		spares := uint(C.ndctl_cmd_smart_get_spares(cmd))
+		health.SpareBlocks = &spares
+	}
+	if flags&smartUsedValid != 0 {
+		used := uint(C.ndctl_cmd_smart_get_life_used(cmd))
+		health.PercentageUsed = &used
+	}
+	if flags&smartShutdownCountValid != 0 {
+		count := uint64(C.ndctl_cmd_smart_get_shutdown_count(cmd))
+		health.ShutdownCount = &count
+	}
+	if flags&smartShutdownValid != 0 {
+		dirty := C.ndctl_cmd_smart_get_shutdown_state(cmd) != 0
+		health.LastShutdownDirty = &dirty
+	}
+	return health, nil
 }
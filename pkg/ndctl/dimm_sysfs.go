@@ -0,0 +1,130 @@
+// +build !cgo sysfs
+
+package ndctl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants for the ND_CMD_CALL ioctl, see ndctl.h in the kernel.
+const (
+	// _IOWR('N', ND_CMD_CALL, struct nd_cmd_pkg)
+	ndIoctlCall       = 0xc0404e0a
+	ndCmdPkgSize      = 64
+	nvdimmFamilyIntel = 0
+	ndIntelSmart      = 1
+	ndIntelSmartSize  = 128
+)
+
+//Dimm is a nmem directory in sysfs
+type Dimm struct {
+	bus  *Bus
+	path string
+}
+
+//Enabled returns if the dimm is enabled
+func (d *Dimm) Enabled() bool {
+	return isEnabled(d.path)
+}
+
+//Active returns if the the device is active
+func (d *Dimm) Active() bool {
+	return readAttr(d.path, "state") == "active"
+}
+
+//ID returns unique dimm id
+func (d *Dimm) ID() string {
+	return readAttr(d.path, "nfit/id")
+}
+
+//PhysicalID returns dimm physical id
+func (d *Dimm) PhysicalID() int {
+	return readAttrInt(d.path, "nfit/phys_id", -1)
+}
+
+//DeviceName returns dimm device name
+func (d *Dimm) DeviceName() string {
+	return filepath.Base(d.path)
+}
+
+//Handle returns dimm handle
+func (d *Dimm) Handle() int16 {
+	return int16(readAttrInt(d.path, "nfit/handle", -1))
+}
+
+//Health returns the SMART health information of the dimm,
+//ErrNotSupported if the dimm does not provide it. Only dimms which
+//implement the Intel DSM are supported.
+func (d *Dimm) Health() (*DimmHealth, error) {
+	if readAttrInt(d.path, "nfit/family", -1) != nvdimmFamilyIntel {
+		return nil, fmt.Errorf("%s: health information: %w", d.DeviceName(), ErrNotSupported)
+	}
+	payload, err := d.call(nvdimmFamilyIntel, ndIntelSmart, ndIntelSmartSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to get health information: %v", d.DeviceName(), err)
+	}
+	return parseIntelSmart(payload)
+}
+
+// call sends a command to the dimm and returns the output payload
+func (d *Dimm) call(family, command uint64, sizeOut uint32) ([]byte, error) {
+	f, err := os.OpenFile(filepath.Join("/dev", d.DeviceName()), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+
+	// struct nd_cmd_pkg followed by the payload, no input
+	buf := make([]byte, ndCmdPkgSize+int(sizeOut))
+	binary.LittleEndian.PutUint64(buf[0:], family)
+	binary.LittleEndian.PutUint64(buf[8:], command)
+	binary.LittleEndian.PutUint32(buf[16:], 0)
+	binary.LittleEndian.PutUint32(buf[20:], sizeOut)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), ndIoctlCall, uintptr(unsafe.Pointer(&buf[0]))); errno != 0 {
+		return nil, errno
+	}
+	return buf[ndCmdPkgSize:], nil
+}
+
+// parseIntelSmart decodes struct nd_intel_smart
+func parseIntelSmart(payload []byte) (*DimmHealth, error) {
+	if len(payload) < 36 {
+		return nil, fmt.Errorf("SMART payload too short: %d bytes", len(payload))
+	}
+	if status := binary.LittleEndian.Uint32(payload[0:]); status != 0 {
+		return nil, fmt.Errorf("SMART command failed with status %#x", status)
+	}
+
+	flags := uint(binary.LittleEndian.Uint32(payload[4:]))
+	health := &DimmHealth{State: HealthUnknown}
+	if flags&smartHealthValid != 0 {
+		health.State = healthState(uint(payload[12]))
+	}
+	if flags&smartSparesValid != 0 {
+		spares := uint(payload[13])
+		health.SpareBlocks = &spares
+	}
+	if flags&smartUsedValid != 0 {
+		used := uint(payload[14])
+		health.PercentageUsed = &used
+	}
+	if flags&smartTempValid != 0 {
+		temperature := decodeTemperature(uint(binary.LittleEndian.Uint16(payload[16:])))
+		health.Temperature = &temperature
+	}
+	if flags&smartShutdownCountValid != 0 {
+		count := uint64(binary.LittleEndian.Uint32(payload[20:]))
+		health.ShutdownCount = &count
+	}
+	if flags&smartShutdownValid != 0 {
+		dirty := payload[35] != 0
+		health.LastShutdownDirty = &dirty
+	}
+	return health, nil
+}
@@ -0,0 +1,57 @@
+// +build !cgo sysfs
+
+package ndctl
+
+import (
+	"encoding/binary"
+
+	"github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Not a dot import because of the Context type in this package.
+var _ = ginkgo.Describe("Intel SMART payload", func() {
+	payload := func(flags uint32) []byte {
+		data := make([]byte, 128)
+		binary.LittleEndian.PutUint32(data[4:], flags)
+		data[12] = smartCriticalHealth
+		data[13] = 90                                          // spares
+		data[14] = 3                                           // life used
+		binary.LittleEndian.PutUint16(data[16:], 0x8000|0x1a8) // -26.5 C
+		binary.LittleEndian.PutUint32(data[20:], 7)            // shutdown count
+		data[35] = 1                                           // dirty
+		return data
+	}
+
+	ginkgo.It("decodes all valid fields", func() {
+		health, err := parseIntelSmart(payload(smartHealthValid | smartSparesValid | smartUsedValid |
+			smartTempValid | smartShutdownCountValid | smartShutdownValid))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(health.State).To(Equal(HealthCritical))
+		Expect(*health.SpareBlocks).To(Equal(uint(90)))
+		Expect(*health.PercentageUsed).To(Equal(uint(3)))
+		Expect(*health.Temperature).To(Equal(-26.5))
+		Expect(*health.ShutdownCount).To(Equal(uint64(7)))
+		Expect(*health.LastShutdownDirty).To(BeTrue())
+	})
+
+	ginkgo.It("ignores invalid fields", func() {
+		health, err := parseIntelSmart(payload(smartSparesValid))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(health.State).To(Equal(HealthUnknown))
+		Expect(*health.SpareBlocks).To(Equal(uint(90)))
+		Expect(health.Temperature).To(BeNil())
+		Expect(health.PercentageUsed).To(BeNil())
+		Expect(health.ShutdownCount).To(BeNil())
+		Expect(health.LastShutdownDirty).To(BeNil())
+	})
+
+	ginkgo.It("rejects failed commands", func() {
+		data := payload(smartHealthValid)
+		data[0] = 1
+		_, err := parseIntelSmart(data)
+		Expect(err).To(HaveOccurred())
+		_, err = parseIntelSmart(data[:10])
+		Expect(err).To(HaveOccurred())
+	})
+})
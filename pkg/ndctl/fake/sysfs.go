@@ -0,0 +1,209 @@
+/*
+Copyright 2020  Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package fake creates a synthetic sysfs tree which mimics
+// /sys/bus/nd. The pure Go implementation of the ndctl package (no
+// cgo or "sysfs" build tag) can operate on it, so code using PMEM
+// can be tested without root privileges and real PMEM.
+package fake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NamespaceName is the name of the active namespace in region0.
+const NamespaceName = "pmem-csi-test-volume"
+
+// Sysfs is a synthetic /sys with one bus, one DIMM and two regions.
+// region0 is enabled and has an active fsdax namespace with block
+// device pmem0 plus the seed devices, region1 is disabled.
+type Sysfs struct {
+	// Root replaces /sys.
+	Root string
+	// Bus is the directory of the nd bus.
+	Bus string
+}
+
+// NewSysfs creates the tree under the given root directory, which
+// must exist.
+func NewSysfs(root string) (*Sysfs, error) {
+	s := &Sysfs{Root: root, Bus: filepath.Join(root, "devices", "platform", "ndbus0")}
+	if err := s.populate(); err != nil {
+		return nil, fmt.Errorf("create sysfs tree in %s: %v", root, err)
+	}
+	return s, nil
+}
+
+func (s *Sysfs) populate() error {
+	drivers := filepath.Join(s.Root, "bus", "nd", "drivers", "nd_pmem")
+	if err := s.Attrs(drivers, map[string]string{"bind": "", "unbind": ""}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.Root, "bus", "nd", "devices"), 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink(s.Bus, filepath.Join(s.Root, "bus", "nd", "devices", "ndbus0")); err != nil {
+		return err
+	}
+
+	for _, step := range []func() error{
+		func() error { return s.Attrs(s.Bus, map[string]string{"provider": "ACPI.NFIT"}) },
+		func() error {
+			return s.Attrs(s.Dir("nmem0"), map[string]string{
+				"state":        "active",
+				"nfit/id":      "8089-a2-1740-00000001",
+				"nfit/handle":  "0x1",
+				"nfit/phys_id": "0x10",
+			})
+		},
+		func() error { return s.Enable("nmem0") },
+		func() error {
+			return s.Attrs(s.Dir("region0"), map[string]string{
+				"size":                 "17179869184",
+				"available_size":       "16106127360",
+				"max_available_extent": "16106127360",
+				"nstype":               "5",
+				"mappings":             "1",
+				"mapping0":             "nmem0,0,17179869184,0",
+				"numa_node":            "1",
+				"ro":                   "0",
+				"resource":             "0x240000000",
+				"namespace_seed":       "namespace0.1",
+				"pfn_seed":             "pfn0.1",
+				"btt_seed":             "btt0.0",
+				"dax_seed":             "dax0.0",
+			})
+		},
+		func() error { return s.Enable("region0") },
+		func() error {
+			return s.Attrs(s.Dir("region0", "namespace0.0"), map[string]string{
+				"alt_name":     NamespaceName,
+				"uuid":         "ec3a6f3c-0a6e-4b3a-9d2b-0d7c3ff6e5a1",
+				"size":         "1073741824",
+				"nstype":       "5",
+				"mode":         "fsdax",
+				"holder":       "pfn0.0",
+				"holder_class": "pfn",
+				"sector_size":  "[512] 4096",
+			})
+		},
+		func() error { return s.Enable("region0", "namespace0.0") },
+		func() error {
+			return s.Attrs(s.Dir("region0", "pfn0.0"), map[string]string{
+				"uuid":      "5a4b2e0e-2f5e-4f0b-8a77-46c3b1d9e1f2",
+				"mode":      "pmem",
+				"align":     "2097152",
+				"namespace": "namespace0.0",
+				"size":      "1054867456",
+			})
+		},
+		func() error { return s.Enable("region0", "pfn0.0") },
+		func() error { return s.AddBlockDevice("pmem0", "region0", "pfn0.0") },
+		func() error {
+			return s.Attrs(s.Dir("region0", "namespace0.1"), map[string]string{
+				"alt_name":     "",
+				"uuid":         "",
+				"size":         "0",
+				"nstype":       "5",
+				"mode":         "raw",
+				"holder":       "",
+				"holder_class": "",
+				"sector_size":  "[512] 4096",
+			})
+		},
+		func() error {
+			return s.Attrs(s.Dir("region0", "pfn0.1"), map[string]string{
+				"uuid":                 "",
+				"mode":                 "",
+				"align":                "2097152",
+				"supported_alignments": "4096 2097152 1073741824",
+				"namespace":            "",
+				"size":                 "0",
+			})
+		},
+		func() error {
+			return s.Attrs(s.Dir("region0", "btt0.0"), map[string]string{
+				"uuid":        "",
+				"sector_size": "512 [4096]",
+				"namespace":   "",
+				"size":        "0",
+			})
+		},
+		func() error {
+			return s.Attrs(s.Dir("region0", "dax0.0"), map[string]string{
+				"uuid":      "",
+				"mode":      "",
+				"align":     "2097152",
+				"namespace": "",
+				"size":      "0",
+			})
+		},
+		func() error {
+			return s.Attrs(s.Dir("region1"), map[string]string{
+				"size":           "17179869184",
+				"available_size": "17179869184",
+				"nstype":         "5",
+				"mappings":       "0",
+				"numa_node":      "0",
+				"ro":             "0",
+			})
+		},
+	} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	// Like the bus, the devices are also listed under /sys/bus/nd/devices.
+	for _, name := range []string{"nmem0", "region0", "region1"} {
+		if err := os.Symlink(s.Dir(name), filepath.Join(s.Root, "bus", "nd", "devices", name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dir returns the path of a device below the bus.
+func (s *Sysfs) Dir(elem ...string) string {
+	return filepath.Join(append([]string{s.Bus}, elem...)...)
+}
+
+// Attrs writes attribute files into the directory, creating
+// it and sub directories as needed.
+func (s *Sysfs) Attrs(dir string, attrs map[string]string) error {
+	for name, value := range attrs {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enable binds the device below the bus to the nd_pmem driver.
+func (s *Sysfs) Enable(elem ...string) error {
+	driver := filepath.Join(s.Root, "bus", "nd", "drivers", "nd_pmem")
+	return os.Symlink(driver, filepath.Join(s.Dir(elem...), "driver"))
+}
+
+// AddBlockDevice creates the block device with the given name for
+// the device below the bus, including the /sys/class/block entry.
+func (s *Sysfs) AddBlockDevice(name string, elem ...string) error {
+	dir := filepath.Join(s.Dir(elem...), "block", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	class := filepath.Join(s.Root, "class", "block")
+	if err := os.MkdirAll(class, 0755); err != nil {
+		return err
+	}
+	return os.Symlink(dir, filepath.Join(class, name))
+}
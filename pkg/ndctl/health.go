@@ -0,0 +1,66 @@
+package ndctl
+
+//HealthState summarizes the SMART health status of a dimm
+type HealthState string
+
+const (
+	HealthOK          HealthState = "ok"
+	HealthNonCritical HealthState = "non-critical"
+	HealthCritical    HealthState = "critical"
+	HealthFatal       HealthState = "fatal"
+	HealthUnknown     HealthState = "unknown"
+)
+
+// Validity flags and health bits of the SMART payload, the same for
+// libndctl (ND_SMART_*) and the Intel DSM (ND_INTEL_SMART_*).
+const (
+	smartHealthValid        = 1 << 0
+	smartSparesValid        = 1 << 1
+	smartUsedValid          = 1 << 2
+	smartTempValid          = 1 << 3
+	smartShutdownCountValid = 1 << 5
+	smartShutdownValid      = 1 << 10
+
+	smartNonCriticalHealth = 1 << 0
+	smartCriticalHealth    = 1 << 1
+	smartFatalHealth       = 1 << 2
+)
+
+//DimmHealth is the health information reported by a dimm. Fields
+//which the dimm does not report are nil.
+type DimmHealth struct {
+	//State is HealthUnknown if not reported
+	State HealthState
+	//Temperature of the media in degrees Celsius
+	Temperature *float64
+	//SpareBlocks is the remaining spare capacity in percent
+	SpareBlocks *uint
+	//PercentageUsed is the estimated percentage of the life span which is used up
+	PercentageUsed *uint
+	//ShutdownCount is the number of dirty shutdowns
+	ShutdownCount *uint64
+	//LastShutdownDirty is true if data might have been lost during the last shutdown
+	LastShutdownDirty *bool
+}
+
+func healthState(health uint) HealthState {
+	switch {
+	case health&smartFatalHealth != 0:
+		return HealthFatal
+	case health&smartCriticalHealth != 0:
+		return HealthCritical
+	case health&smartNonCriticalHealth != 0:
+		return HealthNonCritical
+	}
+	return HealthOK
+}
+
+// decodeTemperature converts the SMART encoding (sign bit plus 1/16
+// degrees Celsius) to degrees Celsius.
+func decodeTemperature(raw uint) float64 {
+	t := float64(raw&0x7fff) / 16
+	if raw&(1<<15) != 0 {
+		t = -t
+	}
+	return t
+}
@@ -1,9 +1,10 @@
+// +build cgo,!sysfs
+
 package ndctl
 
 //#cgo pkg-config: libndctl
 //#include <ndctl/libndctl.h>
 import "C"
-import "encoding/json"
 
 // Mapping go wrapper for ndctl_mapping
 type Mapping C.struct_ndctl_mapping
@@ -37,13 +38,3 @@ func (m *Mapping) Dimm() *Dimm {
 	ndm := (*C.struct_ndctl_mapping)(m)
 	return (*Dimm)(C.ndctl_mapping_get_dimm(ndm))
 }
-
-//MarshalJSON returns json encoding of the mapping
-func (m *Mapping) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
-		"dimm":     m.Dimm().DeviceName(),
-		"offset":   m.Offset(),
-		"length":   m.Length(),
-		"position": m.Position(),
-	})
-}
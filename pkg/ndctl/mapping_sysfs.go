@@ -0,0 +1,61 @@
+// +build !cgo sysfs
+
+package ndctl
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mapping is one of the mapping<N> attributes of a region
+type Mapping struct {
+	region   *Region
+	dimm     string
+	offset   uint64
+	length   uint64
+	position int
+}
+
+// parseMapping parses "<dimm>,<offset>,<length>,<position>"
+func parseMapping(r *Region, value string) *Mapping {
+	fields := strings.Split(value, ",")
+	if len(fields) < 3 {
+		return nil
+	}
+	m := &Mapping{region: r, dimm: fields[0], position: -1}
+	m.offset, _ = strconv.ParseUint(fields[1], 0, 64)
+	m.length, _ = strconv.ParseUint(fields[2], 0, 64)
+	if len(fields) > 3 {
+		if position, err := strconv.Atoi(fields[3]); err == nil {
+			m.position = position
+		}
+	}
+	return m
+}
+
+//Offset returns offset within the region
+func (m *Mapping) Offset() uint64 {
+	return m.offset
+}
+
+//Length returns mapping length
+func (m *Mapping) Length() uint64 {
+	return m.length
+}
+
+//Position returns mapping position
+func (m *Mapping) Position() int {
+	return m.position
+}
+
+//Region get associated Region
+func (m *Mapping) Region() *Region {
+	return m.region
+}
+
+//Dimm get associated Dimm
+func (m *Mapping) Dimm() *Dimm {
+	bus := m.region.bus
+	return &Dimm{bus: bus, path: filepath.Join(bus.path, m.dimm)}
+}
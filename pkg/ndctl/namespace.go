@@ -1,3 +1,5 @@
+// +build cgo,!sysfs
+
 package ndctl
 
 //#cgo pkg-config: libndctl
@@ -8,7 +10,6 @@ package ndctl
 //#include <ndctl/ndctl.h>
 import "C"
 import (
-	"encoding/json"
 	"fmt"
 	/* needed for nullify
 	"os"
@@ -16,39 +17,9 @@ import (
 	"unsafe"
 
 	"github.com/google/uuid"
+	"k8s.io/klog"
 )
 
-const (
-	//PmemNamespace pmem type namespace
-	PmemNamespace NamespaceType = "pmem"
-	//BlockNamespace block type namespace
-	BlockNamespace NamespaceType = "blk"
-	//IoNamespace io type namespace
-	IoNamespace NamespaceType = "io"
-	//UnknownType unknown namespace
-	UnknownType NamespaceType = "unknown"
-)
-
-const (
-	DaxMode     NamespaceMode = "dax"   //DevDax
-	FsdaxMode   NamespaceMode = "fsdax" //Memory
-	RawMode     NamespaceMode = "raw"
-	SectorMode  NamespaceMode = "sector"
-	UnknownMode NamespaceMode = "unknown"
-)
-
-const (
-	MemoryMap MapLocation = "mem" // RAM
-	DeviceMap MapLocation = "dev" // Block Device
-	NoneMap   MapLocation = "none"
-)
-
-//NamespaceType type to represent namespace type
-type NamespaceType string
-
-//NamespaceMode represents mode of the namespace
-type NamespaceMode string
-
 func (mode NamespaceMode) toCMode() C.enum_ndctl_namespace_mode {
 	switch mode {
 	case DaxMode:
@@ -63,8 +34,6 @@ func (mode NamespaceMode) toCMode() C.enum_ndctl_namespace_mode {
 	return C.NDCTL_NS_MODE_UNKNOWN
 }
 
-type MapLocation string
-
 func (loc MapLocation) toCPfnLocation() C.enum_ndctl_pfn_loc {
 	if loc == MemoryMap {
 		return C.NDCTL_PFN_LOC_RAM
@@ -147,6 +116,87 @@ func (ns *Namespace) Size() uint64 {
 	return uint64(size)
 }
 
+//RawSize returns the size of the namespace including the meta data
+//of its personality
+func (ns *Namespace) RawSize() uint64 {
+	ndns := (*C.struct_ndctl_namespace)(ns)
+	return uint64(C.ndctl_namespace_get_size(ndns))
+}
+
+//Align returns the alignment of a fsdax or devdax namespace, 0 for
+//all other modes
+func (ns *Namespace) Align() uint64 {
+	ndns := (*C.struct_ndctl_namespace)(ns)
+
+	switch ns.Mode() {
+	case FsdaxMode:
+		if pfn := C.ndctl_namespace_get_pfn(ndns); pfn != nil {
+			return uint64(C.ndctl_pfn_get_align(pfn))
+		}
+	case DaxMode:
+		if dax := C.ndctl_namespace_get_dax(ndns); dax != nil {
+			return uint64(C.ndctl_dax_get_align(dax))
+		}
+	}
+	return 0
+}
+
+//AdjacentAvailableSize returns the free space directly behind the
+//namespace, which is how much the namespace can grow
+func (ns *Namespace) AdjacentAvailableSize() uint64 {
+	ndns := (*C.struct_ndctl_namespace)(ns)
+	ndr := C.ndctl_namespace_get_region(ndns)
+	start := uint64(C.ndctl_namespace_get_resource(ndns))
+	regionStart := uint64(C.ndctl_region_get_resource(ndr))
+	if start == uint64(C.ULLONG_MAX) || regionStart == uint64(C.ULLONG_MAX) {
+		/* location of the namespace is unknown */
+		return 0
+	}
+	end := start + ns.RawSize()
+	limit := regionStart + uint64(C.ndctl_region_get_size(ndr))
+	for other := C.ndctl_namespace_get_first(ndr); other != nil; other = C.ndctl_namespace_get_next(other) {
+		if C.ndctl_namespace_get_size(other) == 0 {
+			continue
+		}
+		resource := uint64(C.ndctl_namespace_get_resource(other))
+		if resource != uint64(C.ULLONG_MAX) && resource >= end && resource < limit {
+			limit = resource
+		}
+	}
+	if limit < end {
+		return 0
+	}
+	return limit - end
+}
+
+//Badblocks returns the known bad ranges of the namespace. For fsdax
+//and raw namespaces the offsets are relative to the block device, for
+//all other modes relative to the start of the namespace.
+func (ns *Namespace) Badblocks() []Badblock {
+	ndns := (*C.struct_ndctl_namespace)(ns)
+	var badblocks []Badblock
+
+	switch ns.Mode() {
+	case FsdaxMode, RawMode:
+		for bb := C.ndctl_namespace_get_first_badblock(ndns); bb != nil; bb = C.ndctl_namespace_get_next_badblock(ndns) {
+			badblocks = append(badblocks, Badblock{
+				Offset: uint64(bb.offset) * badblockSectorSize,
+				Length: uint64(bb.len) * badblockSectorSize,
+			})
+		}
+		return badblocks
+	}
+
+	ndr := C.ndctl_namespace_get_region(ndns)
+	start := uint64(C.ndctl_namespace_get_resource(ndns))
+	regionStart := uint64(C.ndctl_region_get_resource(ndr))
+	if start == uint64(C.ULLONG_MAX) || regionStart == uint64(C.ULLONG_MAX) {
+		/* location of the namespace is unknown */
+		return nil
+	}
+	return IntersectBadblocks(ns.Region().Badblocks(), start-regionStart, uint64(C.ndctl_namespace_get_size(ndns)))
+}
+
 //Mode returns namespace mode
 func (ns *Namespace) Mode() NamespaceMode {
 	ndns := (*C.struct_ndctl_namespace)(ns)
@@ -220,7 +270,7 @@ func (ns *Namespace) UUID() uuid.UUID {
 	uidbytes := C.GoBytes(unsafe.Pointer(&cuid[0]), C.sizeof_uuid_t)
 	_uuid, err := uuid.FromBytes(uidbytes)
 	if err != nil {
-		fmt.Printf("WARN: wrong uuid: %s", err.Error())
+		klog.Warningf("%s: wrong uuid: %v", ns.DeviceName(), err)
 		return uuid.UUID{}
 	}
 
@@ -327,28 +377,62 @@ func (ns *Namespace) Enable() error {
 	return nil
 }
 
-//MarshalJSON returns json encoding of namespace
-func (ns *Namespace) MarshalJSON() ([]byte, error) {
+//Resize changes the size of an active namespace. The namespace gets
+//disabled temporarily, therefore it must not be in use. The personality
+//(fsdax, devdax, sector, raw) and its info block are preserved.
+func (ns *Namespace) Resize(size uint64) error {
+	ndns := (*C.struct_ndctl_namespace)(ns)
+	pfn := C.ndctl_namespace_get_pfn(ndns)
+	dax := C.ndctl_namespace_get_dax(ndns)
+	btt := C.ndctl_namespace_get_btt(ndns)
 
-	props := map[string]interface{}{
-		"id":      ns.ID(),
-		"dev":     ns.DeviceName(),
-		"mode":    ns.Mode(),
-		"size":    ns.Size(),
-		"enabled": ns.Enabled(),
-		"uuid":    ns.UUID(),
-		"name":    ns.Name(),
+	if rc := C.ndctl_namespace_disable_safe(ndns); rc < 0 {
+		return fmt.Errorf("failed to disable namespace: %s", cErrorString(rc))
 	}
-
-	if mode := ns.Mode(); mode != DaxMode {
-		props["blockdev"] = ns.BlockDeviceName()
+	// The personality device holds a claim on the namespace which
+	// prevents changing its size.
+	switch {
+	case pfn != nil:
+		C.ndctl_pfn_set_namespace(pfn, nil)
+	case dax != nil:
+		C.ndctl_dax_set_namespace(dax, nil)
+	case btt != nil:
+		C.ndctl_btt_set_namespace(btt, nil)
 	}
 
-	if location := ns.Location(); location != "none" {
-		props["map"] = location
+	// Even if this fails, the namespace must be brought back
+	// with its old size.
+	err := ns.SetSize(size)
+
+	switch {
+	case pfn != nil:
+		if rc := C.ndctl_pfn_set_namespace(pfn, ndns); rc < 0 {
+			return fmt.Errorf("pfn: failed to set namespace: %s", cErrorString(rc))
+		}
+		if rc := C.ndctl_pfn_enable(pfn); rc < 0 {
+			return fmt.Errorf("pfn: failed to enable: %s", cErrorString(rc))
+		}
+	case dax != nil:
+		if rc := C.ndctl_dax_set_namespace(dax, ndns); rc < 0 {
+			return fmt.Errorf("dax: failed to set namespace: %s", cErrorString(rc))
+		}
+		if rc := C.ndctl_dax_enable(dax); rc < 0 {
+			return fmt.Errorf("dax: failed to enable: %s", cErrorString(rc))
+		}
+	case btt != nil:
+		if rc := C.ndctl_btt_set_namespace(btt, ndns); rc < 0 {
+			return fmt.Errorf("btt: failed to set namespace: %s", cErrorString(rc))
+		}
+		if rc := C.ndctl_btt_enable(btt); rc < 0 {
+			return fmt.Errorf("btt: failed to enable: %s", cErrorString(rc))
+		}
+	default:
+		if e := ns.Enable(); e != nil {
+			return e
+		}
 	}
 
-	return json.Marshal(props)
+	return err
 }
 
 func (ns *Namespace) setPfnSeed(loc MapLocation, align uint64) error {
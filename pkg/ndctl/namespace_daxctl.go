@@ -0,0 +1,28 @@
+// +build cgo,!sysfs,!nodaxctl
+
+package ndctl
+
+//#cgo pkg-config: libndctl libdaxctl
+//#include <ndctl/libndctl.h>
+//#include <daxctl/libdaxctl.h>
+import "C"
+
+//CharDeviceName returns the name of the character device of a devdax
+//namespace, empty for all other namespace modes
+func (ns *Namespace) CharDeviceName() string {
+	ndns := (*C.struct_ndctl_namespace)(ns)
+	dax := C.ndctl_namespace_get_dax(ndns)
+	if dax == nil {
+		return ""
+	}
+	region := C.ndctl_dax_get_daxctl_region(dax)
+	if region == nil {
+		return ""
+	}
+	/* A namespace in devdax mode has exactly one dax device */
+	dev := C.daxctl_dev_get_first(region)
+	if dev == nil {
+		return ""
+	}
+	return C.GoString(C.daxctl_dev_get_devname(dev))
+}
@@ -0,0 +1,38 @@
+// +build cgo,!sysfs,nodaxctl
+
+package ndctl
+
+// Without libdaxctl, the character device of a devdax namespace is
+// looked up in sysfs, like the pure Go implementation does.
+
+//#cgo pkg-config: libndctl
+//#include <ndctl/libndctl.h>
+import "C"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//CharDeviceName returns the name of the character device of a devdax
+//namespace, empty for all other namespace modes
+func (ns *Namespace) CharDeviceName() string {
+	ndns := (*C.struct_ndctl_namespace)(ns)
+	dax := C.ndctl_namespace_get_dax(ndns)
+	if dax == nil {
+		return ""
+	}
+	dir := filepath.Join("/sys/bus/nd/devices", C.GoString(C.ndctl_dax_get_devname(dax)))
+	entries, _ := ioutil.ReadDir(dir)
+	/* A namespace in devdax mode has exactly one dax device */
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "dax") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), "dev")); err == nil {
+			return entry.Name()
+		}
+	}
+	return ""
+}
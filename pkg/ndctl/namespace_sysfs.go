@@ -0,0 +1,459 @@
+// +build !cgo sysfs
+
+package ndctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"k8s.io/klog"
+)
+
+// Namespace is a namespace directory in sysfs
+type Namespace struct {
+	region *Region
+	path   string
+}
+
+//ID returns namespace id
+func (ns *Namespace) ID() uint {
+	return deviceID(ns.DeviceName(), "namespace")
+}
+
+//Name returns name of the namespace
+func (ns *Namespace) Name() string {
+	return readAttr(ns.path, "alt_name")
+}
+
+//DeviceName returns namespace device name
+func (ns *Namespace) DeviceName() string {
+	return filepath.Base(ns.path)
+}
+
+// holder returns the directory of the btt, pfn or dax device which
+// claims the namespace, empty if there is none
+func (ns *Namespace) holder() string {
+	holder := readAttr(ns.path, "holder")
+	if holder == "" {
+		return ""
+	}
+	return filepath.Join(ns.region.path, holder)
+}
+
+//BlockDeviceName return namespace block device name
+func (ns *Namespace) BlockDeviceName() string {
+	if ns.Mode() == DaxMode {
+		/* Chardevice */
+		return ""
+	}
+	dir := ns.holder()
+	if dir == "" {
+		dir = ns.path
+	}
+	devices, _ := ioutil.ReadDir(filepath.Join(dir, "block"))
+	if len(devices) == 0 {
+		return ""
+	}
+	return devices[0].Name()
+}
+
+//CharDeviceName returns the name of the character device of a devdax
+//namespace, empty for all other namespace modes
+func (ns *Namespace) CharDeviceName() string {
+	if ns.Mode() != DaxMode {
+		return ""
+	}
+	dax := ns.holder()
+	if dax == "" {
+		return ""
+	}
+	/* A namespace in devdax mode has exactly one dax device */
+	for _, name := range listDevices(dax, "dax") {
+		if hasAttr(filepath.Join(dax, name), "dev") {
+			return name
+		}
+	}
+	return ""
+}
+
+//Size returns size of the namespace
+func (ns *Namespace) Size() uint64 {
+	switch ns.Mode() {
+	case FsdaxMode, DaxMode, SectorMode:
+		if holder := ns.holder(); holder != "" {
+			return readAttrUint(holder, "size")
+		}
+		if ns.Mode() == FsdaxMode {
+			return readAttrUint(ns.path, "size")
+		}
+	case RawMode:
+		return readAttrUint(ns.path, "size")
+	}
+
+	return 0
+}
+
+//RawSize returns the size of the namespace including the meta data
+//of its personality
+func (ns *Namespace) RawSize() uint64 {
+	return readAttrUint(ns.path, "size")
+}
+
+//Align returns the alignment of a fsdax or devdax namespace, 0 for
+//all other modes
+func (ns *Namespace) Align() uint64 {
+	switch ns.Mode() {
+	case FsdaxMode, DaxMode:
+		if holder := ns.holder(); holder != "" {
+			return readAttrUint(holder, "align")
+		}
+	}
+	return 0
+}
+
+//AdjacentAvailableSize returns the free space directly behind the
+//namespace, which is how much the namespace can grow
+func (ns *Namespace) AdjacentAvailableSize() uint64 {
+	start := readAttrUint(ns.path, "resource")
+	regionStart := readAttrUint(ns.region.path, "resource")
+	if start == 0 || regionStart == 0 {
+		/* location of the namespace is unknown */
+		return 0
+	}
+	end := start + ns.RawSize()
+	limit := regionStart + ns.region.Size()
+	for _, name := range listDevices(ns.region.path, "namespace") {
+		dir := filepath.Join(ns.region.path, name)
+		if readAttrUint(dir, "size") == 0 {
+			continue
+		}
+		if other := readAttrUint(dir, "resource"); other >= end && other < limit {
+			limit = other
+		}
+	}
+	if limit < end {
+		return 0
+	}
+	return limit - end
+}
+
+//Badblocks returns the known bad ranges of the namespace. For fsdax
+//and raw namespaces the offsets are relative to the block device, for
+//all other modes relative to the start of the namespace.
+func (ns *Namespace) Badblocks() []Badblock {
+	switch ns.Mode() {
+	case FsdaxMode, RawMode:
+		dev := ns.BlockDeviceName()
+		if dev == "" {
+			return nil
+		}
+		return ParseBadblocks(readAttr(filepath.Join(ns.region.bus.ctx.root, "block", dev), "badblocks"))
+	}
+
+	start := readAttrUint(ns.path, "resource")
+	regionStart := readAttrUint(ns.region.path, "resource")
+	if start == 0 || regionStart == 0 {
+		/* location of the namespace is unknown */
+		return nil
+	}
+	return IntersectBadblocks(ns.region.Badblocks(), start-regionStart, readAttrUint(ns.path, "size"))
+}
+
+//Mode returns namespace mode
+func (ns *Namespace) Mode() NamespaceMode {
+	switch readAttr(ns.path, "mode") {
+	case "dax", "devdax":
+		return DaxMode
+	case "memory", "fsdax":
+		return FsdaxMode
+	case "raw":
+		return RawMode
+	case "safe", "sector":
+		return SectorMode
+	}
+
+	return UnknownMode
+}
+
+//Type returns namespace type
+func (ns *Namespace) Type() NamespaceType {
+	switch readAttrInt(ns.path, "nstype", 0) {
+	case ndDeviceNamespacePmem:
+		return PmemNamespace
+	case ndDeviceNamespaceBlk:
+		return BlockNamespace
+	case ndDeviceNamespaceIO:
+		return IoNamespace
+	}
+
+	return UnknownType
+}
+
+//Enabled return if namespace is enabled
+func (ns *Namespace) Enabled() bool {
+	return isEnabled(ns.path)
+}
+
+//Active return if namespace is active
+func (ns *Namespace) Active() bool {
+	if holder := ns.holder(); holder != "" {
+		return isEnabled(holder)
+	}
+	return ns.Enabled()
+}
+
+//UUID returns uuid of the namespace
+func (ns *Namespace) UUID() uuid.UUID {
+	var value string
+	if holder := ns.holder(); holder != "" {
+		value = readAttr(holder, "uuid")
+	} else if ns.Type() != IoNamespace {
+		value = readAttr(ns.path, "uuid")
+	}
+	if value == "" {
+		return uuid.UUID{}
+	}
+
+	_uuid, err := uuid.Parse(value)
+	if err != nil {
+		klog.Warningf("%s: wrong uuid: %v", ns.DeviceName(), err)
+		return uuid.UUID{}
+	}
+
+	return _uuid
+}
+
+//Location returns namespace mapping location
+func (ns *Namespace) Location() MapLocation {
+	switch ns.Mode() {
+	case FsdaxMode:
+		if holder := ns.holder(); holder != "" {
+			return parseLocation(readAttr(holder, "mode"))
+		}
+		return MemoryMap
+	case DaxMode:
+		if holder := ns.holder(); holder != "" {
+			return parseLocation(readAttr(holder, "mode"))
+		}
+	}
+
+	return NoneMap
+}
+
+//Region returns reference to Region that this namespace is part of
+func (ns *Namespace) Region() *Region {
+	return ns.region
+}
+
+func (ns *Namespace) SetAltName(name string) error {
+	if err := writeAttr(ns.path, "alt_name", name); err != nil {
+		return fmt.Errorf("Failed to set namespace name: %v", err)
+	}
+
+	return nil
+}
+
+func (ns *Namespace) SetSize(size uint64) error {
+	if err := writeAttr(ns.path, "size", strconv.FormatUint(size, 10)); err != nil {
+		return fmt.Errorf("Failed to set namespace size: %v", err)
+	}
+
+	return nil
+}
+
+func (ns *Namespace) SetUUID(uid uuid.UUID) error {
+	if err := writeAttr(ns.path, "uuid", uid.String()); err != nil {
+		return fmt.Errorf("Failed to set namespace uid: %v", err)
+	}
+	return nil
+}
+
+func (ns *Namespace) SetSectorSize(sectorSize uint64) error {
+	// Only some namespace types support choosing the sector size.
+	if !hasAttr(ns.path, "sector_size") {
+		return nil
+	}
+
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+
+	if !supportsSectorSize(readAttr(ns.path, "sector_size"), sectorSize) {
+		return fmt.Errorf("Sector size %v not supported", sectorSize)
+	}
+	if err := writeAttr(ns.path, "sector_size", strconv.FormatUint(sectorSize, 10)); err != nil {
+		return fmt.Errorf("Failed to set namespace sector size: %v", err)
+	}
+	return nil
+}
+
+func (ns *Namespace) SetEnforceMode(mode NamespaceMode) error {
+	if err := writeAttr(ns.path, "holder_class", mode.holderClass()); err != nil {
+		return fmt.Errorf("Failed to set enforce mode: %v", err)
+	}
+
+	return nil
+}
+
+func (ns *Namespace) Enable() error {
+	// The namespace gets activated by enabling the device which
+	// claims it, if there is one.
+	dir := ns.holder()
+	if dir == "" {
+		dir = ns.path
+	}
+	if err := ns.region.bus.ctx.bind(dir); err != nil {
+		return fmt.Errorf("failed to enable namespace:%v", err)
+	}
+
+	return nil
+}
+
+//Resize changes the size of an active namespace. The namespace gets
+//disabled temporarily, therefore it must not be in use. The personality
+//(fsdax, devdax, sector, raw) and its info block are preserved.
+func (ns *Namespace) Resize(size uint64) error {
+	holder := ns.holder()
+
+	if err := ns.disable(); err != nil {
+		return fmt.Errorf("failed to disable namespace: %v", err)
+	}
+	// The personality device holds a claim on the namespace which
+	// prevents changing its size.
+	if holder != "" {
+		if err := writeAttr(holder, "namespace", ""); err != nil {
+			return fmt.Errorf("%s: failed to release namespace: %v", filepath.Base(holder), err)
+		}
+	}
+
+	// Even if this fails, the namespace must be brought back
+	// with its old size.
+	err := ns.SetSize(size)
+
+	if holder != "" {
+		if e := writeAttr(holder, "namespace", ns.DeviceName()); e != nil {
+			return fmt.Errorf("%s: failed to set namespace: %v", filepath.Base(holder), e)
+		}
+	}
+	if e := ns.Enable(); e != nil {
+		return e
+	}
+
+	return err
+}
+
+// setPersonality configures the btt, pfn or dax seed device such that
+// it claims the namespace and enables it.
+func (ns *Namespace) setPersonality(seed, kind string, loc MapLocation, align, sectorSize uint64) error {
+	if seed == "" {
+		return fmt.Errorf("%s: no seed", kind)
+	}
+	uid, _ := uuid.NewUUID()
+	if err := writeAttr(seed, "uuid", uid.String()); err != nil {
+		return fmt.Errorf("%s: failed to set uuid", kind)
+	}
+	if loc != NoneMap {
+		if err := writeAttr(seed, "mode", loc.sysfsMode()); err != nil {
+			return fmt.Errorf("%s: failed to set location", kind)
+		}
+	}
+	if align != 0 && hasAttr(seed, "align") {
+		if err := writeAttr(seed, "align", strconv.FormatUint(align, 10)); err != nil {
+			return fmt.Errorf("%s: failed to set alignment: %v", kind, err)
+		}
+	}
+	if sectorSize != 0 {
+		if err := writeAttr(seed, "sector_size", strconv.FormatUint(sectorSize, 10)); err != nil {
+			return fmt.Errorf("%s: failed to set sector size", kind)
+		}
+	}
+	if err := writeAttr(seed, "namespace", ns.DeviceName()); err != nil {
+		return fmt.Errorf("%s: failed to set namespace", kind)
+	}
+	if err := ns.region.bus.ctx.bind(seed); err != nil {
+		// reset seed in failure case
+		writeAttr(seed, "namespace", "") // nolint: errcheck
+		return fmt.Errorf("%s: failed to enable", kind)
+	}
+
+	return nil
+}
+
+// disable disables the namespace and the device which claims it
+func (ns *Namespace) disable() error {
+	ctx := ns.region.bus.ctx
+	if holder := ns.holder(); holder != "" {
+		if err := ctx.unbind(holder); err != nil {
+			return err
+		}
+	}
+	return ctx.unbind(ns.path)
+}
+
+// invalidate releases the claim of the btt, pfn or dax device
+func (ns *Namespace) invalidate() error {
+	holder := ns.holder()
+	if holder == "" {
+		return nil
+	}
+	if err := writeAttr(holder, "namespace", ""); err != nil {
+		return err
+	}
+	return writeAttr(holder, "uuid", "")
+}
+
+// delete frees the space of a disabled namespace
+func (ns *Namespace) delete() error {
+	if ns.Type() == IoNamespace {
+		return nil
+	}
+	return ns.SetSize(0)
+}
+
+// holderClass returns the value of the holder_class attribute which
+// enforces the mode
+func (mode NamespaceMode) holderClass() string {
+	switch mode {
+	case DaxMode:
+		return "dax"
+	case FsdaxMode:
+		return "pfn"
+	case SectorMode:
+		return "btt"
+	}
+	return ""
+}
+
+// sysfsMode returns the value of the mode attribute of pfn and dax
+// devices for the location
+func (loc MapLocation) sysfsMode() string {
+	if loc == MemoryMap {
+		return "ram"
+	}
+	return "pmem"
+}
+
+func parseLocation(mode string) MapLocation {
+	switch mode {
+	case "ram":
+		return MemoryMap
+	case "pmem":
+		return DeviceMap
+	}
+	return NoneMap
+}
+
+// supportsSectorSize checks a sector_size attribute of the form
+// "512 [4096]", where the current size is in brackets
+func supportsSectorSize(sizes string, sectorSize uint64) bool {
+	for _, size := range strings.Fields(sizes) {
+		if value, err := strconv.ParseUint(strings.Trim(size, "[]"), 10, 64); err == nil && value == sectorSize {
+			return true
+		}
+	}
+	return false
+}
@@ -1,3 +1,5 @@
+// +build cgo,!sysfs
+
 package ndctl
 
 //#cgo pkg-config: libndctl
@@ -8,36 +10,10 @@ package ndctl
 import "C"
 
 import (
-	"errors"
 	"fmt"
-
-	"k8s.io/klog"
+	"path/filepath"
 )
 
-const (
-	kib  uint64 = 1024
-	kib4 uint64 = kib * 4
-	mib  uint64 = kib * 1024
-	mib2 uint64 = mib * 2
-	gib  uint64 = mib * 1024
-	tib  uint64 = gib * 1024
-)
-
-var (
-	ErrNotExist = errors.New("namespace not found")
-)
-
-//CreateNamespaceOpts options to create a namespace
-type CreateNamespaceOpts struct {
-	Name       string
-	Size       uint64
-	SectorSize uint64
-	Align      uint64
-	Type       NamespaceType
-	Mode       NamespaceMode
-	Location   MapLocation
-}
-
 // Context go wrapper for ndctl context
 type Context C.struct_ndctl_ctx
 
@@ -52,6 +28,16 @@ func NewContext() (*Context, error) {
 	return (*Context)(ctx), nil
 }
 
+// NewSysfsContext initializes a new context for the sysfs tree under
+// the given root directory. libndctl always uses /sys, other roots
+// need the pure Go implementation (no cgo or "sysfs" build tag).
+func NewSysfsContext(root string) (*Context, error) {
+	if filepath.Clean(root) != DefaultSysfsRoot {
+		return nil, fmt.Errorf("sysfs root %q not supported by libndctl", root)
+	}
+	return NewContext()
+}
+
 // Free destroy context
 func (ctx *Context) Free() {
 	if ctx != nil {
@@ -70,87 +56,6 @@ func (ctx *Context) GetBuses() []*Bus {
 	return buses
 }
 
-//CreateNamespace create new namespace with given opts
-func (ctx *Context) CreateNamespace(opts CreateNamespaceOpts) (*Namespace, error) {
-	var err error
-	var ns *Namespace
-	for _, bus := range ctx.GetBuses() {
-		for _, r := range bus.ActiveRegions() {
-			if ns, err = r.CreateNamespace(opts); err == nil {
-				klog.V(3).Infof("Namespace %s created in %s", ns.Name(), r.DeviceName())
-				return ns, nil
-			} else {
-				klog.Errorf("Namespace creation failure in %s: %s", r.DeviceName(), err.Error())
-			}
-		}
-	}
-	return nil, err
-}
-
-//DestroyNamespaceByName deletes namespace with given name
-func (ctx *Context) DestroyNamespaceByName(name string) error {
-	ns, err := ctx.GetNamespaceByName(name)
-	if err != nil {
-		return err
-	}
-
-	r := ns.Region()
-	return r.DestroyNamespace(ns, true)
-}
-
-//GetNamespaceByName gets namespace details for given name
-func (ctx *Context) GetNamespaceByName(name string) (*Namespace, error) {
-	for _, bus := range ctx.GetBuses() {
-		for _, r := range bus.AllRegions() {
-			for _, ns := range r.AllNamespaces() {
-				if ns.Name() == name {
-					return ns, nil
-				}
-			}
-		}
-	}
-	return nil, ErrNotExist
-}
-
-//GetActiveNamespaces returns list of all active namespaces in all regions
-func (ctx *Context) GetActiveNamespaces() []*Namespace {
-	var list []*Namespace
-	for _, bus := range ctx.GetBuses() {
-		for _, r := range bus.ActiveRegions() {
-			nss := r.ActiveNamespaces()
-			list = append(list, nss...)
-		}
-	}
-
-	return list
-}
-
-//GetAllNamespaces returns list of all namespaces in all regions including idle namespaces
-func (ctx *Context) GetAllNamespaces() []*Namespace {
-	var list []*Namespace
-	for _, bus := range ctx.GetBuses() {
-		for _, r := range bus.AllRegions() {
-			nss := r.AllNamespaces()
-			list = append(list, nss...)
-		}
-	}
-
-	return list
-}
-
-//IsSpaceAvailable checks if a region available with given free size
-func (ctx *Context) IsSpaceAvailable(size uint64) bool {
-	for _, bus := range ctx.GetBuses() {
-		for _, r := range bus.ActiveRegions() {
-			if r.MaxAvailableExtent() >= size && NamespaceType(r.Type()) == PmemNamespace {
-				return true
-			}
-		}
-	}
-
-	return false
-}
-
 func cErrorString(errno C.int) string {
 	if errno < 0 {
 		errno = -errno
@@ -0,0 +1,90 @@
+package ndctl
+
+import (
+	"fmt"
+	"sort"
+)
+
+//PlacementStrategy decides in which order regions get tried when
+//creating a new namespace. Namespaces cannot span regions, so the
+//order determines how the free space of the regions fragments over time.
+type PlacementStrategy interface {
+	//Order returns the regions in the order in which they should be
+	//tried for a namespace of the given size. It must not modify
+	//the input slice.
+	Order(regions []*Region, size uint64) []*Region
+}
+
+var (
+	//FirstFit tries regions in bus order. This is the default.
+	FirstFit PlacementStrategy = firstFit{}
+
+	//BestFit prefers the region with the smallest free extent that
+	//is large enough, which keeps large extents available for
+	//large namespaces.
+	BestFit PlacementStrategy = extentFit{best: true}
+
+	//WorstFit prefers the region with the largest free extent, which
+	//spreads namespaces evenly across regions.
+	WorstFit PlacementStrategy = extentFit{}
+)
+
+//PlacementStrategies maps the names of the builtin placement strategies
+//to their implementation. "spread" is an alias for "worst-fit".
+var PlacementStrategies = map[string]PlacementStrategy{
+	"first-fit": FirstFit,
+	"best-fit":  BestFit,
+	"worst-fit": WorstFit,
+	"spread":    WorstFit,
+}
+
+//ParsePlacementStrategy returns the builtin placement strategy with the
+//given name. The empty string selects FirstFit.
+func ParsePlacementStrategy(name string) (PlacementStrategy, error) {
+	if name == "" {
+		return FirstFit, nil
+	}
+	if strategy, ok := PlacementStrategies[name]; ok {
+		return strategy, nil
+	}
+	return nil, fmt.Errorf("unknown placement strategy %q", name)
+}
+
+type firstFit struct{}
+
+func (firstFit) Order(regions []*Region, size uint64) []*Region {
+	return regions
+}
+
+type extentFit struct {
+	best bool
+}
+
+func (s extentFit) Order(regions []*Region, size uint64) []*Region {
+	type candidate struct {
+		region *Region
+		extent uint64
+	}
+	candidates := make([]candidate, 0, len(regions))
+	for _, r := range regions {
+		candidates = append(candidates, candidate{r, r.MaxAvailableExtent()})
+	}
+	// Regions which are too small are still tried, but only after
+	// all others. The size is only an estimate, the actual size
+	// of the namespace depends on the region.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		fitsI, fitsJ := candidates[i].extent >= size, candidates[j].extent >= size
+		if fitsI != fitsJ {
+			return fitsI
+		}
+		if s.best {
+			return candidates[i].extent < candidates[j].extent
+		}
+		return candidates[i].extent > candidates[j].extent
+	})
+	ordered := make([]*Region, 0, len(candidates))
+	for _, c := range candidates {
+		ordered = append(ordered, c.region)
+	}
+	return ordered
+}
@@ -1,3 +1,5 @@
+// +build cgo,!sysfs
+
 package ndctl
 
 //#cgo pkg-config: libndctl
@@ -7,21 +9,16 @@ package ndctl
 //#include <ndctl/ndctl.h>
 import "C"
 import (
-	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 	"k8s.io/klog"
 )
 
-type RegionType string
-
-const (
-	PmemRegion    RegionType = "pmem" //C.ND_DEVICE_REGION_PMEM
-	BlockRegion   RegionType = "blk"  //C.ND_DEVICE_REGION_BLK
-	UnknownRegion RegionType = "unknown"
-)
-
 // Region go wrapper for ndctl_region
 type Region C.struct_ndctl_region
 
@@ -88,16 +85,10 @@ func (r *Region) InterleaveWays() uint64 {
 	return uint64(C.ndctl_region_get_interleave_ways(ndr))
 }
 
-//ActiveNamespaces returns all active namespaces in the region
-func (r *Region) ActiveNamespaces() []*Namespace {
-	return r.namespaces(true)
-}
-
-//AllNamespaces returns all non-zero sized namespaces in the region
-//as sometime a deleted namespace also lies around with size zero, we can ignore
-//such namespace
-func (r *Region) AllNamespaces() []*Namespace {
-	return r.namespaces(false)
+//NumaNode returns the NUMA node of the region, -1 if unknown
+func (r *Region) NumaNode() int {
+	ndr := (*C.struct_ndctl_region)(r)
+	return int(C.ndctl_region_get_numa_node(ndr))
 }
 
 //Bus get associated bus
@@ -117,6 +108,59 @@ func (r *Region) Mappings() []*Mapping {
 	return mappings
 }
 
+//Align returns the minimum alignment of namespace sizes in the
+//region, 0 if the kernel does not have such a requirement
+func (r *Region) Align() uint64 {
+	// Not available in libndctl v68.
+	data, err := ioutil.ReadFile(filepath.Join("/sys/bus/nd/devices", r.DeviceName(), "align"))
+	if err != nil {
+		return 0
+	}
+	align, err := strconv.ParseUint(strings.TrimSpace(string(data)), 0, 64)
+	if err != nil {
+		return 0
+	}
+	return align
+}
+
+//SupportedAlignments returns the alignments which the kernel supports
+//for namespaces with the given mode, empty if unknown. Only fsdax and
+//devdax namespaces have an alignment.
+func (r *Region) SupportedAlignments(mode NamespaceMode) []uint64 {
+	ndr := (*C.struct_ndctl_region)(r)
+	var alignments []uint64
+	switch mode {
+	case FsdaxMode:
+		if pfn := C.ndctl_region_get_pfn_seed(ndr); pfn != nil {
+			for i := C.int(0); i < C.ndctl_pfn_get_num_alignments(pfn); i++ {
+				alignments = append(alignments, uint64(C.ndctl_pfn_get_supported_alignment(pfn, i)))
+			}
+		}
+	case DaxMode:
+		if dax := C.ndctl_region_get_dax_seed(ndr); dax != nil {
+			for i := C.int(0); i < C.ndctl_dax_get_num_alignments(dax); i++ {
+				alignments = append(alignments, uint64(C.ndctl_dax_get_supported_alignment(dax, i)))
+			}
+		}
+	}
+
+	return alignments
+}
+
+//Badblocks returns the known bad ranges of the region
+func (r *Region) Badblocks() []Badblock {
+	ndr := (*C.struct_ndctl_region)(r)
+	var badblocks []Badblock
+	for bb := C.ndctl_region_get_first_badblock(ndr); bb != nil; bb = C.ndctl_region_get_next_badblock(ndr) {
+		badblocks = append(badblocks, Badblock{
+			Offset: uint64(bb.offset) * badblockSectorSize,
+			Length: uint64(bb.len) * badblockSectorSize,
+		})
+	}
+
+	return badblocks
+}
+
 func (r *Region) SeedNamespace() *Namespace {
 	ndr := (*C.struct_ndctl_region)(r)
 	return (*Namespace)(C.ndctl_region_get_namespace_seed(ndr))
@@ -192,13 +236,12 @@ func (r *Region) CreateNamespace(opts CreateNamespaceOpts) (*Namespace, error) {
 	}
 
 	if opts.Size != 0 {
-		ways := uint64(C.ndctl_region_get_interleave_ways(ndr))
-		align := opts.Align * ways
+		align := r.SizeAlign(opts.Align)
 		if opts.Size%align != 0 {
 			// Round up size to align with next block boundary.
 			opts.Size = (opts.Size/align + 1) * align
-			klog.V(4).Infof("%s: namespace size must align to interleave-width:%d * alignment:%d, force-align to %d",
-				regionName, ways, opts.Align, opts.Size)
+			klog.V(4).Infof("%s: namespace size must align to %d (alignment:%d), force-align to %d",
+				regionName, align, opts.Align, opts.Size)
 		}
 	}
 
@@ -283,7 +326,7 @@ func (r *Region) DestroyNamespace(ns *Namespace, force bool) error {
 	}
 
 	if err := ns.SetEnforceMode(RawMode); err != nil {
-		return nil
+		return fmt.Errorf("failed to set raw mode: %v", err)
 	}
 
 	/* originally here we try to clear 4k at start of block device,
@@ -302,19 +345,6 @@ func (r *Region) DestroyNamespace(ns *Namespace, force bool) error {
 	return nil
 }
 
-//MarshalJSON returns json encoding of the region
-func (r *Region) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
-		"type":                 r.Type(),
-		"dev":                  r.DeviceName(),
-		"size":                 r.Size(),
-		"available_size":       r.AvailableSize(),
-		"max_available_extent": r.MaxAvailableExtent(),
-		"namespaces":           r.ActiveNamespaces(),
-		"mappings":             r.Mappings(),
-	})
-}
-
 func (r *Region) namespaces(onlyActive bool) []*Namespace {
 	var namespaces []*Namespace
 	ndr := (*C.struct_ndctl_region)(r)
@@ -0,0 +1,342 @@
+// +build !cgo sysfs
+
+package ndctl
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"k8s.io/klog"
+)
+
+// nstype values of the kernel, see ND_DEVICE_NAMESPACE_* in ndctl.h
+const (
+	ndDeviceNamespaceIO   = 4
+	ndDeviceNamespacePmem = 5
+	ndDeviceNamespaceBlk  = 6
+)
+
+// Region is a region directory in sysfs
+type Region struct {
+	bus  *Bus
+	path string
+}
+
+//ID returns region id
+func (r *Region) ID() uint {
+	return deviceID(r.DeviceName(), "region")
+}
+
+//DeviceName returns region name
+func (r *Region) DeviceName() string {
+	return filepath.Base(r.path)
+}
+
+//Size returns total size of the region
+func (r *Region) Size() uint64 {
+	return readAttrUint(r.path, "size")
+}
+
+//AvailableSize returns size available in the region
+func (r *Region) AvailableSize() uint64 {
+	return readAttrUint(r.path, "available_size")
+}
+
+//MaxAvailableExtent returns max available extent size in the region
+func (r *Region) MaxAvailableExtent() uint64 {
+	// Older kernels do not have this attribute.
+	if !hasAttr(r.path, "max_available_extent") {
+		return r.AvailableSize()
+	}
+	return readAttrUint(r.path, "max_available_extent")
+}
+
+func (r *Region) Type() RegionType {
+	switch readAttrInt(r.path, "nstype", 0) {
+	case ndDeviceNamespacePmem, ndDeviceNamespaceIO:
+		return PmemRegion
+	case ndDeviceNamespaceBlk:
+		return BlockRegion
+	}
+
+	return UnknownRegion
+}
+
+//TypeName returns region type
+func (r *Region) TypeName() string {
+	return string(r.Type())
+}
+
+func (r *Region) Enabled() bool {
+	return isEnabled(r.path)
+}
+
+func (r *Region) Readonly() bool {
+	return readAttrInt(r.path, "ro", 0) != 0
+}
+
+func (r *Region) InterleaveWays() uint64 {
+	return readAttrUint(r.path, "mappings")
+}
+
+//NumaNode returns the NUMA node of the region, -1 if unknown
+func (r *Region) NumaNode() int {
+	return readAttrInt(r.path, "numa_node", -1)
+}
+
+//Bus get associated bus
+func (r *Region) Bus() *Bus {
+	return r.bus
+}
+
+//Mappings return available mappings in the region
+func (r *Region) Mappings() []*Mapping {
+	var mappings []*Mapping
+	for i := uint64(0); i < r.InterleaveWays(); i++ {
+		if m := parseMapping(r, readAttr(r.path, "mapping"+strconv.FormatUint(i, 10))); m != nil {
+			mappings = append(mappings, m)
+		}
+	}
+
+	return mappings
+}
+
+//Align returns the minimum alignment of namespace sizes in the
+//region, 0 if the kernel does not have such a requirement
+func (r *Region) Align() uint64 {
+	return readAttrUint(r.path, "align")
+}
+
+//SupportedAlignments returns the alignments which the kernel supports
+//for namespaces with the given mode, empty if unknown. Only fsdax and
+//devdax namespaces have an alignment.
+func (r *Region) SupportedAlignments(mode NamespaceMode) []uint64 {
+	var seed string
+	switch mode {
+	case FsdaxMode:
+		seed = r.seed("pfn_seed")
+	case DaxMode:
+		seed = r.seed("dax_seed")
+	}
+	if seed == "" {
+		return nil
+	}
+	var alignments []uint64
+	for _, field := range strings.Fields(readAttr(seed, "supported_alignments")) {
+		if align, err := strconv.ParseUint(field, 10, 64); err == nil {
+			alignments = append(alignments, align)
+		}
+	}
+	return alignments
+}
+
+//Badblocks returns the known bad ranges of the region
+func (r *Region) Badblocks() []Badblock {
+	return ParseBadblocks(readAttr(r.path, "badblocks"))
+}
+
+func (r *Region) SeedNamespace() *Namespace {
+	seed := readAttr(r.path, "namespace_seed")
+	if seed == "" {
+		return nil
+	}
+	return &Namespace{region: r, path: filepath.Join(r.path, seed)}
+}
+
+// seed returns the directory of the btt, pfn or dax seed device
+func (r *Region) seed(attr string) string {
+	seed := readAttr(r.path, attr)
+	if seed == "" {
+		return ""
+	}
+	return filepath.Join(r.path, seed)
+}
+
+func (r *Region) CreateNamespace(opts CreateNamespaceOpts) (*Namespace, error) {
+	defaultAlign := mib2
+	var err error
+	/* Set defaults */
+	if opts.Type == "" {
+		opts.Type = PmemNamespace
+	}
+	if opts.Mode == "" {
+		if opts.Type == PmemNamespace {
+			opts.Mode = FsdaxMode // == MemoryMode
+		} else {
+			opts.Mode = SectorMode
+		}
+	}
+	if opts.Location == "" {
+		opts.Location = DeviceMap
+	}
+
+	if opts.SectorSize == 0 {
+		if opts.Type == BlockNamespace || opts.Mode == SectorMode {
+			// default sector size for blk-type or safe-mode
+			opts.SectorSize = kib4
+		}
+	}
+
+	/* Sanity checks */
+
+	regionName := r.DeviceName()
+	if !r.Enabled() {
+		return nil, fmt.Errorf("Region not enabled")
+	}
+	if r.Readonly() {
+		return nil, fmt.Errorf("Cannot create namspace in readonly region")
+	}
+
+	if r.Type() == BlockRegion {
+		if opts.Mode == FsdaxMode || opts.Mode == DaxMode {
+			return nil, fmt.Errorf("Block regions does not support %s mode namespace", opts.Mode)
+		}
+	}
+
+	if opts.Size != 0 {
+		if opts.Size > r.MaxAvailableExtent() {
+			return nil, fmt.Errorf("Not enough space to create namespace with size %v", opts.Size)
+		}
+	}
+
+	if opts.Align != 0 {
+		if opts.Mode == SectorMode || opts.Mode == RawMode {
+			klog.V(4).Infof("%s mode does not support setting an alignment, hence ignoring alignment", opts.Mode)
+		} else {
+			// The resource is only visible to root, it is
+			// unknown when the attribute cannot be read.
+			resource := readAttrUint(r.path, "resource")
+			if resource != 0 && resource&(mib2-1) != 0 {
+				klog.V(4).Infof("%s: falling back to a 4K alignment", regionName)
+				opts.Align = kib4
+			}
+			if opts.Align != kib4 && opts.Align != mib2 && opts.Align != gib {
+				return nil, fmt.Errorf("unsupported alignment: %v", opts.Align)
+			}
+		}
+	} else {
+		opts.Align = defaultAlign
+	}
+
+	if opts.Size != 0 {
+		align := r.SizeAlign(opts.Align)
+		if opts.Size%align != 0 {
+			// Round up size to align with next block boundary.
+			opts.Size = (opts.Size/align + 1) * align
+			klog.V(4).Infof("%s: namespace size must align to %d (alignment:%d), force-align to %d",
+				regionName, align, opts.Align, opts.Size)
+		}
+	}
+
+	/* setup_namespace */
+
+	ns := r.SeedNamespace()
+	if ns == nil {
+		return nil, fmt.Errorf("Failed to get seed namespace in region %s", r.DeviceName())
+	}
+	if ns.Active() {
+		return nil, fmt.Errorf("Seed namespace is active in region %s", r.DeviceName())
+	}
+
+	if ns.Type() != IoNamespace {
+		uid, _ := uuid.NewUUID()
+		err = ns.SetUUID(uid)
+		if err == nil {
+			err = ns.SetSize(opts.Size)
+		}
+		if err == nil && opts.Name != "" {
+			err = ns.SetAltName(opts.Name)
+		}
+	}
+
+	if err == nil {
+		klog.V(5).Infof("setting namespace sector size: %v", opts.SectorSize)
+		err = ns.SetSectorSize(opts.SectorSize)
+	}
+	if err == nil {
+		err = ns.SetEnforceMode(opts.Mode)
+	}
+
+	if err == nil {
+		switch opts.Mode {
+		case FsdaxMode:
+			klog.V(5).Info("setting pfn")
+			err = ns.setPersonality(r.seed("pfn_seed"), "pfn", opts.Location, opts.Align, 0)
+		case DaxMode:
+			klog.V(5).Info("setting dax")
+			err = ns.setPersonality(r.seed("dax_seed"), "dax", opts.Location, opts.Align, 0)
+		case SectorMode:
+			klog.V(5).Info("setting btt")
+			err = ns.setPersonality(r.seed("btt_seed"), "btt", NoneMap, 0, opts.SectorSize)
+		}
+	}
+	if err == nil {
+		klog.V(5).Info("enabling namespace")
+		err = ns.Enable()
+	}
+
+	if err != nil {
+		// reset seed on failure
+		ns.SetEnforceMode(RawMode) // nolint: errcheck
+		ns.delete()                // nolint: errcheck
+		return nil, err
+	}
+
+	return ns, nil
+}
+
+//DestroyNamespace destroys the given namespace ns in the region
+func (r *Region) DestroyNamespace(ns *Namespace, force bool) error {
+	if ns == nil {
+		return fmt.Errorf("null namespace")
+	}
+	devname := ns.DeviceName()
+
+	if r.Readonly() {
+		return fmt.Errorf("namespace %s is in readonly region", devname)
+	}
+
+	if ns.Active() && !force {
+		return fmt.Errorf("namespace is active, use force deletion")
+	}
+
+	if err := ns.disable(); err != nil {
+		return fmt.Errorf("failed to disable namespace: %v", err)
+	}
+
+	if err := ns.SetEnforceMode(RawMode); err != nil {
+		return fmt.Errorf("failed to set raw mode: %v", err)
+	}
+
+	if err := ns.invalidate(); err != nil {
+		return fmt.Errorf("failed to release namespace: %v", err)
+	}
+
+	if err := ns.delete(); err != nil {
+		return fmt.Errorf("failed to reclaim namespace: %v", err)
+	}
+
+	return nil
+}
+
+func (r *Region) namespaces(onlyActive bool) []*Namespace {
+	var namespaces []*Namespace
+
+	for _, name := range listDevices(r.path, "namespace") {
+		ns := &Namespace{region: r, path: filepath.Join(r.path, name)}
+		// If asked for only active namespaces return it regardless of it size
+		// if not, return only valid namespaces, i.e, non-zero sized.
+		if onlyActive {
+			if ns.Active() {
+				namespaces = append(namespaces, ns)
+			}
+		} else if ns.Size() > 0 {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	return namespaces
+}
@@ -0,0 +1,178 @@
+// +build !cgo sysfs
+
+package ndctl
+
+// This is the pure Go implementation of the package. Instead of
+// calling libndctl it reads and writes the attributes of the nd bus
+// in sysfs directly, which is what libndctl does internally. It gets
+// used when building without cgo or with the "sysfs" build tag.
+//
+// The sysfs root is configurable, so the code can also operate on a
+// synthetic tree which mimics /sys/bus/nd.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Context gives access to all nd buses under a sysfs root
+type Context struct {
+	root string
+}
+
+// NewContext Initializes new context for /sys
+func NewContext() (*Context, error) {
+	return NewSysfsContext(DefaultSysfsRoot)
+}
+
+// NewSysfsContext initializes a new context which uses the sysfs tree
+// under the given root directory
+func NewSysfsContext(root string) (*Context, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, fmt.Errorf("Create context failed with error: %v", err)
+	}
+	return &Context{root: root}, nil
+}
+
+// Free destroy context
+func (ctx *Context) Free() {
+}
+
+// GetBuses returns available buses
+func (ctx *Context) GetBuses() []*Bus {
+	var buses []*Bus
+	devices := filepath.Join(ctx.root, "bus", "nd", "devices")
+	for _, name := range listDevices(devices, "ndbus") {
+		// The entries are symlinks into the device hierarchy,
+		// the bus directory contains the other devices.
+		path, err := filepath.EvalSymlinks(filepath.Join(devices, name))
+		if err != nil {
+			continue
+		}
+		buses = append(buses, &Bus{ctx: ctx, path: path})
+	}
+	return buses
+}
+
+// bind enables the device in the given directory by binding it to
+// the first nd driver which accepts it, like ndctl_bind does.
+func (ctx *Context) bind(dir string) error {
+	if isEnabled(dir) {
+		return nil
+	}
+	name := filepath.Base(dir)
+	binds, _ := filepath.Glob(filepath.Join(ctx.root, "bus", "nd", "drivers", "*", "bind"))
+	for _, bind := range binds {
+		if err := writeFile(bind, name); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: no driver accepted the device", name)
+}
+
+// unbind disables the device in the given directory
+func (ctx *Context) unbind(dir string) error {
+	if !isEnabled(dir) {
+		return nil
+	}
+	return writeAttr(filepath.Join(dir, "driver"), "unbind", filepath.Base(dir))
+}
+
+// listDevices returns the names of all entries in dir which start with
+// the prefix, ordered by their numeric suffix.
+func listDevices(dir, prefix string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) {
+			names = append(names, entry.Name())
+		}
+	}
+	// All names have the same prefix, so shorter numbers come first.
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) < len(names[j])
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// deviceID returns the number after the last dot or, if there is
+// none, after the prefix of a device name like "region1" or
+// "namespace1.0".
+func deviceID(name, prefix string) uint {
+	id := strings.TrimPrefix(name, prefix)
+	if i := strings.LastIndex(id, "."); i >= 0 {
+		id = id[i+1:]
+	}
+	value, _ := strconv.ParseUint(id, 10, 32)
+	return uint(value)
+}
+
+func isEnabled(dir string) bool {
+	_, err := os.Lstat(filepath.Join(dir, "driver"))
+	return err == nil
+}
+
+func hasAttr(dir, attr string) bool {
+	_, err := os.Stat(filepath.Join(dir, attr))
+	return err == nil
+}
+
+// readAttr returns the content of an attribute without the trailing
+// newline, empty if it cannot be read
+func readAttr(dir, attr string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readAttrUint parses decimal and hex (0x prefix) attributes,
+// 0 if the attribute cannot be read
+func readAttrUint(dir, attr string) uint64 {
+	value, err := strconv.ParseUint(readAttr(dir, attr), 0, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// readAttrInt parses decimal and hex (0x prefix) attributes,
+// the default if the attribute cannot be read
+func readAttrInt(dir, attr string, def int) int {
+	value, err := strconv.ParseInt(readAttr(dir, attr), 0, 64)
+	if err != nil {
+		return def
+	}
+	return int(value)
+}
+
+func writeAttr(dir, attr, value string) error {
+	return writeFile(filepath.Join(dir, attr), value)
+}
+
+func writeFile(path, value string) error {
+	// Truncating has no effect in sysfs, but is needed for
+	// regular files in a synthetic tree.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	// The kernel strips the newline, like after "echo value >attr".
+	if _, err := f.WriteString(value + "\n"); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	return f.Close()
+}
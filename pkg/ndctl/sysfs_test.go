@@ -0,0 +1,312 @@
+// +build !cgo sysfs
+
+package ndctl_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	"github.com/intel/pmem-csi/pkg/ndctl/fake"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSysfs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ndctl sysfs Suite")
+}
+
+const (
+	gib      = 1024 * 1024 * 1024
+	volumeID = fake.NamespaceName
+)
+
+// sysfsTree adds test assertions to the synthetic /sys, see fake.Sysfs.
+type sysfsTree struct {
+	*fake.Sysfs
+}
+
+func newSysfsTree(root string) *sysfsTree {
+	s, err := fake.NewSysfs(root)
+	Expect(err).NotTo(HaveOccurred())
+	return &sysfsTree{Sysfs: s}
+}
+
+func (t *sysfsTree) dir(elem ...string) string {
+	return t.Dir(elem...)
+}
+
+func (t *sysfsTree) attrs(dir string, attrs map[string]string) {
+	Expect(t.Attrs(dir, attrs)).To(Succeed())
+}
+
+func (t *sysfsTree) attr(path ...string) string {
+	data, err := ioutil.ReadFile(filepath.Join(path...))
+	Expect(err).NotTo(HaveOccurred())
+	return strings.TrimSpace(string(data))
+}
+
+var _ = Describe("sysfs", func() {
+	var (
+		tmp  string
+		tree *sysfsTree
+		ctx  *ndctl.Context
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "ndctl-sysfs")
+		Expect(err).NotTo(HaveOccurred())
+		tree = newSysfsTree(tmp)
+		ctx, err = ndctl.NewSysfsContext(tmp)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		ctx.Free()
+		os.RemoveAll(tmp)
+	})
+
+	It("rejects a missing root", func() {
+		_, err := ndctl.NewSysfsContext(filepath.Join(tmp, "no-such-dir"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("lists buses, DIMMs and regions", func() {
+		buses := ctx.GetBuses()
+		Expect(buses).To(HaveLen(1))
+		bus := buses[0]
+		Expect(bus.DeviceName()).To(Equal("ndbus0"))
+		Expect(bus.Provider()).To(Equal("ACPI.NFIT"))
+
+		dimms := bus.Dimms()
+		Expect(dimms).To(HaveLen(1))
+		Expect(dimms[0].DeviceName()).To(Equal("nmem0"))
+		Expect(dimms[0].ID()).To(Equal("8089-a2-1740-00000001"))
+		Expect(dimms[0].Handle()).To(Equal(int16(1)))
+		Expect(dimms[0].PhysicalID()).To(Equal(16))
+		Expect(dimms[0].Enabled()).To(BeTrue())
+		Expect(dimms[0].Active()).To(BeTrue())
+		_, err := dimms[0].Health()
+		Expect(errors.Is(err, ndctl.ErrNotSupported)).To(BeTrue(), "not an Intel DIMM: %v", err)
+
+		Expect(bus.AllRegions()).To(HaveLen(2))
+		regions := bus.ActiveRegions()
+		Expect(regions).To(HaveLen(1))
+		r := regions[0]
+		Expect(r.ID()).To(Equal(uint(0)))
+		Expect(r.DeviceName()).To(Equal("region0"))
+		Expect(r.Type()).To(Equal(ndctl.PmemRegion))
+		Expect(r.Size()).To(Equal(uint64(16 * gib)))
+		Expect(r.AvailableSize()).To(Equal(uint64(15 * gib)))
+		Expect(r.MaxAvailableExtent()).To(Equal(uint64(15 * gib)))
+		Expect(r.InterleaveWays()).To(Equal(uint64(1)))
+		Expect(r.NumaNode()).To(Equal(1))
+		Expect(r.Readonly()).To(BeFalse())
+		Expect(r.Bus().DeviceName()).To(Equal("ndbus0"))
+		Expect(bus.GetRegionByPhysicalAddress(0x240000000 + gib).DeviceName()).To(Equal("region0"))
+		Expect(bus.GetRegionByPhysicalAddress(0x1000)).To(BeNil())
+
+		mappings := r.Mappings()
+		Expect(mappings).To(HaveLen(1))
+		Expect(mappings[0].Dimm().DeviceName()).To(Equal("nmem0"))
+		Expect(mappings[0].Length()).To(Equal(uint64(16 * gib)))
+		Expect(mappings[0].Position()).To(Equal(0))
+
+		// Without max_available_extent, the available size is used.
+		disabled := bus.AllRegions()[1]
+		Expect(disabled.Enabled()).To(BeFalse())
+		Expect(disabled.MaxAvailableExtent()).To(Equal(uint64(16 * gib)))
+		Expect(disabled.NumaNode()).To(Equal(0))
+
+		_, err = json.Marshal(buses)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("finds namespaces", func() {
+		Expect(ctx.GetAllNamespaces()).To(HaveLen(1))
+		Expect(ctx.GetActiveNamespaces()).To(HaveLen(1))
+
+		ns, err := ctx.GetNamespaceByName(volumeID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ns.DeviceName()).To(Equal("namespace0.0"))
+		Expect(ns.ID()).To(Equal(uint(0)))
+		Expect(ns.Mode()).To(Equal(ndctl.FsdaxMode))
+		Expect(ns.Type()).To(Equal(ndctl.PmemNamespace))
+		Expect(ns.Size()).To(Equal(uint64(1054867456)))
+		Expect(ns.BlockDeviceName()).To(Equal("pmem0"))
+		Expect(ns.CharDeviceName()).To(BeEmpty())
+		Expect(ns.Location()).To(Equal(ndctl.DeviceMap))
+		Expect(ns.UUID().String()).To(Equal("5a4b2e0e-2f5e-4f0b-8a77-46c3b1d9e1f2"))
+		Expect(ns.Active()).To(BeTrue())
+		Expect(ns.Region().DeviceName()).To(Equal("region0"))
+
+		_, err = ctx.GetNamespaceByName("no-such-volume")
+		Expect(err).To(Equal(ndctl.ErrNotExist))
+	})
+
+	It("reports devdax namespaces", func() {
+		tree.attrs(tree.dir("region0", "namespace0.0"), map[string]string{"mode": "devdax", "holder": "dax0.1"})
+		tree.attrs(tree.dir("region0", "dax0.1"), map[string]string{
+			"mode":          "pmem",
+			"size":          "1054867456",
+			"namespace":     "namespace0.0",
+			"dax0.1/dev":    "252:0",
+			"dax_region/id": "0",
+		})
+
+		ns, err := ctx.GetNamespaceByName(volumeID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ns.Mode()).To(Equal(ndctl.DaxMode))
+		Expect(ns.CharDeviceName()).To(Equal("dax0.1"))
+		Expect(ns.BlockDeviceName()).To(BeEmpty())
+		Expect(ns.Size()).To(Equal(uint64(1054867456)))
+	})
+
+	It("reports bad blocks", func() {
+		// One range inside namespace0.0, one in the free space behind it.
+		tree.attrs(tree.dir("region0"), map[string]string{"badblocks": "1024 8\n4194304 16"})
+		tree.attrs(filepath.Join(tmp, "block", "pmem0"), map[string]string{"badblocks": "1000 8"})
+		tree.attrs(tree.dir("region0", "namespace0.0"), map[string]string{"resource": "0x240000000"})
+
+		r := ctx.GetBuses()[0].ActiveRegions()[0]
+		Expect(r.Badblocks()).To(Equal([]ndctl.Badblock{
+			{Offset: 1024 * 512, Length: 8 * 512},
+			{Offset: 2 * gib, Length: 16 * 512},
+		}))
+		Expect(ctx.GetBuses()[0].AllRegions()[1].Badblocks()).To(BeEmpty())
+
+		// fsdax: as reported by the block device
+		ns, err := ctx.GetNamespaceByName(volumeID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ns.Badblocks()).To(Equal([]ndctl.Badblock{{Offset: 1000 * 512, Length: 8 * 512}}))
+
+		// devdax: the part of the region which is used by the namespace
+		tree.attrs(tree.dir("region0", "namespace0.0"), map[string]string{"mode": "devdax", "holder": "dax0.1"})
+		tree.attrs(tree.dir("region0", "dax0.1"), map[string]string{"namespace": "namespace0.0"})
+		Expect(ns.Badblocks()).To(Equal([]ndctl.Badblock{{Offset: 1024 * 512, Length: 8 * 512}}))
+	})
+
+	It("reports the space behind a namespace", func() {
+		ns, err := ctx.GetNamespaceByName(volumeID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ns.RawSize()).To(Equal(uint64(gib)))
+		Expect(ns.Align()).To(Equal(uint64(2097152)))
+		// Location unknown.
+		Expect(ns.AdjacentAvailableSize()).To(Equal(uint64(0)))
+
+		tree.attrs(tree.dir("region0", "namespace0.0"), map[string]string{"resource": "0x240000000"})
+		Expect(ns.AdjacentAvailableSize()).To(Equal(uint64(15 * gib)))
+
+		// Another namespace 4 GiB behind the first one.
+		tree.attrs(tree.dir("region0", "namespace0.2"), map[string]string{
+			"size":     "1073741824",
+			"resource": "0x380000000",
+			"nstype":   "5",
+			"mode":     "raw",
+		})
+		Expect(ns.AdjacentAvailableSize()).To(Equal(uint64(4 * gib)))
+	})
+
+	It("creates fsdax namespaces", func() {
+		r := ctx.GetBuses()[0].ActiveRegions()[0]
+		ns, err := r.CreateNamespace(ndctl.CreateNamespaceOpts{
+			Name:  "new-volume",
+			Size:  gib + 1,
+			Align: gib,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ns.DeviceName()).To(Equal("namespace0.1"))
+
+		seed := tree.dir("region0", "namespace0.1")
+		Expect(tree.attr(seed, "alt_name")).To(Equal("new-volume"))
+		Expect(tree.attr(seed, "size")).To(Equal("2147483648"), "size aligned")
+		Expect(tree.attr(seed, "uuid")).NotTo(BeEmpty())
+		Expect(tree.attr(seed, "holder_class")).To(Equal("pfn"))
+
+		pfn := tree.dir("region0", "pfn0.1")
+		Expect(tree.attr(pfn, "namespace")).To(Equal("namespace0.1"))
+		Expect(tree.attr(pfn, "mode")).To(Equal("pmem"))
+		Expect(tree.attr(pfn, "align")).To(Equal("1073741824"))
+		Expect(tree.attr(pfn, "uuid")).NotTo(BeEmpty())
+		Expect(tree.attr(tmp, "bus", "nd", "drivers", "nd_pmem", "bind")).NotTo(BeEmpty())
+	})
+
+	It("creates sector namespaces", func() {
+		r := ctx.GetBuses()[0].ActiveRegions()[0]
+		_, err := r.CreateNamespace(ndctl.CreateNamespaceOpts{
+			Size: gib,
+			Mode: ndctl.SectorMode,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tree.attr(tree.dir("region0", "namespace0.1"), "sector_size")).To(Equal("4096"))
+		Expect(tree.attr(tree.dir("region0", "namespace0.1"), "holder_class")).To(Equal("btt"))
+		btt := tree.dir("region0", "btt0.0")
+		Expect(tree.attr(btt, "sector_size")).To(Equal("4096"))
+		Expect(tree.attr(btt, "namespace")).To(Equal("namespace0.1"))
+	})
+
+	It("aligns namespace sizes", func() {
+		r := ctx.GetBuses()[0].ActiveRegions()[0]
+		Expect(r.SupportedAlignments(ndctl.FsdaxMode)).To(Equal([]uint64{4096, 2 * 1024 * 1024, gib}))
+		Expect(r.SupportedAlignments(ndctl.DaxMode)).To(BeEmpty(), "kernel without supported_alignments")
+		Expect(r.SupportedAlignments(ndctl.SectorMode)).To(BeEmpty(), "no alignment")
+
+		Expect(r.Align()).To(Equal(uint64(0)))
+		Expect(r.SizeAlign(4096)).To(Equal(uint64(4096)))
+		tree.attrs(tree.dir("region0"), map[string]string{"align": "16777216"})
+		Expect(r.SizeAlign(4096)).To(Equal(uint64(16 * 1024 * 1024)))
+		Expect(r.SizeAlign(gib)).To(Equal(uint64(gib)))
+
+		_, err := r.CreateNamespace(ndctl.CreateNamespaceOpts{
+			Size:  100 * 1024 * 1024,
+			Align: 4096,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tree.attr(tree.dir("region0", "namespace0.1"), "size")).To(Equal("117440512"), "size aligned to region")
+		Expect(tree.attr(tree.dir("region0", "pfn0.1"), "align")).To(Equal("4096"))
+	})
+
+	It("orders regions for placement", func() {
+		// region0 has a 15 GiB extent, region1 16 GiB.
+		regions := ctx.GetBuses()[0].AllRegions()
+		r0, r1 := regions[0], regions[1]
+		Expect(ndctl.FirstFit.Order(regions, gib)).To(Equal([]*ndctl.Region{r0, r1}))
+		Expect(ndctl.BestFit.Order(regions, gib)).To(Equal([]*ndctl.Region{r0, r1}))
+		Expect(ndctl.BestFit.Order(regions, 15*gib+1)).To(Equal([]*ndctl.Region{r1, r0}), "too small region last")
+		Expect(ndctl.WorstFit.Order(regions, gib)).To(Equal([]*ndctl.Region{r1, r0}))
+		Expect(regions).To(Equal([]*ndctl.Region{r0, r1}), "input unchanged")
+
+		Expect(ndctl.ParsePlacementStrategy("")).To(Equal(ndctl.FirstFit))
+		Expect(ndctl.ParsePlacementStrategy("spread")).To(Equal(ndctl.WorstFit))
+		_, err := ndctl.ParsePlacementStrategy("random")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects invalid namespaces", func() {
+		regions := ctx.GetBuses()[0].AllRegions()
+		_, err := regions[0].CreateNamespace(ndctl.CreateNamespaceOpts{Size: 16 * gib})
+		Expect(err).To(HaveOccurred(), "too large")
+		_, err = regions[0].CreateNamespace(ndctl.CreateNamespaceOpts{Size: gib, Align: 12345})
+		Expect(err).To(HaveOccurred(), "bad alignment")
+		_, err = regions[1].CreateNamespace(ndctl.CreateNamespaceOpts{Size: gib})
+		Expect(err).To(HaveOccurred(), "disabled region")
+	})
+
+	It("destroys namespaces", func() {
+		Expect(ctx.DestroyNamespaceByName(volumeID)).To(Succeed())
+
+		ns := tree.dir("region0", "namespace0.0")
+		Expect(tree.attr(ns, "size")).To(Equal("0"))
+		Expect(tree.attr(ns, "holder_class")).To(BeEmpty())
+		Expect(tree.attr(tree.dir("region0", "pfn0.0"), "namespace")).To(BeEmpty())
+		Expect(tree.attr(tmp, "bus", "nd", "drivers", "nd_pmem", "unbind")).To(Equal("namespace0.0"))
+	})
+})
@@ -0,0 +1,85 @@
+package ndctl
+
+import "errors"
+
+const (
+	kib  uint64 = 1024
+	kib4 uint64 = kib * 4
+	mib  uint64 = kib * 1024
+	mib2 uint64 = mib * 2
+	gib  uint64 = mib * 1024
+	tib  uint64 = gib * 1024
+)
+
+// DefaultSysfsRoot is the sysfs root used by NewContext.
+const DefaultSysfsRoot = "/sys"
+
+var (
+	ErrNotExist = errors.New("namespace not found")
+
+	//ErrNotSupported the hardware or kernel does not support the operation
+	ErrNotSupported = errors.New("not supported")
+)
+
+//CreateNamespaceOpts options to create a namespace
+type CreateNamespaceOpts struct {
+	Name       string
+	Size       uint64
+	SectorSize uint64
+	Align      uint64
+	Type       NamespaceType
+	Mode       NamespaceMode
+	Location   MapLocation
+	//Placement determines the order in which Context.CreateNamespace
+	//tries the regions, nil for FirstFit.
+	Placement PlacementStrategy
+}
+
+type RegionType string
+
+const (
+	PmemRegion    RegionType = "pmem" //C.ND_DEVICE_REGION_PMEM
+	BlockRegion   RegionType = "blk"  //C.ND_DEVICE_REGION_BLK
+	UnknownRegion RegionType = "unknown"
+)
+
+const (
+	//PmemNamespace pmem type namespace
+	PmemNamespace NamespaceType = "pmem"
+	//BlockNamespace block type namespace
+	BlockNamespace NamespaceType = "blk"
+	//IoNamespace io type namespace
+	IoNamespace NamespaceType = "io"
+	//UnknownType unknown namespace
+	UnknownType NamespaceType = "unknown"
+)
+
+const (
+	DaxMode     NamespaceMode = "dax"   //DevDax
+	FsdaxMode   NamespaceMode = "fsdax" //Memory
+	RawMode     NamespaceMode = "raw"
+	SectorMode  NamespaceMode = "sector"
+	UnknownMode NamespaceMode = "unknown"
+)
+
+const (
+	MemoryMap MapLocation = "mem" // RAM
+	DeviceMap MapLocation = "dev" // Block Device
+	NoneMap   MapLocation = "none"
+)
+
+//NamespaceType type to represent namespace type
+type NamespaceType string
+
+//NamespaceMode represents mode of the namespace
+type NamespaceMode string
+
+type MapLocation string
+
+//Badblock is a range of PMEM with known media errors
+type Badblock struct {
+	//Offset in bytes, relative to the start of the region or namespace
+	Offset uint64
+	//Length in bytes
+	Length uint64
+}
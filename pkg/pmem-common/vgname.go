@@ -10,10 +10,19 @@ import (
 	"github.com/intel/pmem-csi/pkg/ndctl"
 )
 
-func VgName(bus *ndctl.Bus, region *ndctl.Region) string {
-	// Hard-coded string to indicate all namespaces are in "FSDAX" mode.
-	nsmode := "fsdax"
-	// This is present to avoid API break: names used to indicate nsmode
-	// before the sector-mode support was dropped.
-	return bus.DeviceName() + region.DeviceName() + nsmode
+// ThinPoolName is the name of the thin pool inside each volume group
+// when thin provisioning is used.
+const ThinPoolName = "pmem-csi-thinpool"
+
+// VgName returns the name of the volume group which holds the namespaces
+// of the region with the given mode. Only fsdax and sector mode are used.
+func VgName(bus *ndctl.Bus, region *ndctl.Region, nsmode ndctl.NamespaceMode) string {
+	return bus.DeviceName() + region.DeviceName() + string(nsmode)
+}
+
+// VgNameAllRegions returns the name of the volume group which holds the
+// namespaces of all regions with the given mode, for volumes that span
+// regions.
+func VgNameAllRegions(nsmode ndctl.NamespaceMode) string {
+	return "pmem-csi-" + string(nsmode)
 }
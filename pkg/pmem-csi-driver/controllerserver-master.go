@@ -11,10 +11,13 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -46,13 +49,32 @@ type pmemVolume struct {
 	// ID of nodes where the volume provisioned/attached
 	// It would be one if simple volume, else would be more than one for "cached" volume
 	nodeIDs map[string]VolumeStatus
+	// NUMA node of the volume as reported by the node(s), nil if unknown
+	numaNode *int
+	// Snapshot or volume from which the volume was created, nil if none
+	contentSource *csi.VolumeContentSource
+}
+
+type pmemSnapshot struct {
+	// Snapshot as reported by the node
+	*csi.Snapshot
+	// ID of the node which has the snapshot
+	nodeID string
 }
 
 type masterController struct {
 	*DefaultControllerServer
-	rs          *registryserver.RegistryServer
-	pmemVolumes map[string]*pmemVolume //map of reqID:pmemVolume
-	mutex       sync.Mutex             // mutex for pmemVolumes
+	rs            *registryserver.RegistryServer
+	pmemVolumes   map[string]*pmemVolume   //map of reqID:pmemVolume
+	pmemSnapshots map[string]*pmemSnapshot //map of snapshotID:pmemSnapshot
+	mutex         sync.Mutex               // mutex for pmemVolumes, pmemSnapshots and pendingNodes
+	// pendingNodes are the nodes with volumes which have not registered
+	// since the controller started, nil until reconcile was called.
+	pendingNodes map[string]bool
+	// ready gets closed once the volumes that existed before
+	// the controller started are known.
+	ready     chan struct{}
+	readyOnce sync.Once
 }
 
 var _ csi.ControllerServer = &masterController{}
@@ -60,6 +82,10 @@ var _ PmemService = &masterController{}
 var _ registryserver.RegistryListener = &masterController{}
 var volumeMutex = keymutex.NewHashed(-1)
 
+// snapshotNameMutex serializes CreateSnapshot by name. It is locked
+// before volumeMutex, for the same reason as nodeNameMutex.
+var snapshotNameMutex = keymutex.NewHashed(-1)
+
 func GenerateVolumeID(caller string, name string) string {
 	// VolumeID is hashed from Volume Name.
 	// Hashing guarantees same ID for repeated requests.
@@ -86,16 +112,24 @@ func GenerateVolumeID(caller string, name string) string {
 	return id
 }
 
+// NewMasterControllerServer creates the controller. It does not
+// create or delete volumes until reconcile was called.
 func NewMasterControllerServer(rs *registryserver.RegistryServer) *masterController {
 	serverCaps := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 	}
 	cs := &masterController{
 		DefaultControllerServer: NewDefaultControllerServer(serverCaps),
 		rs:                      rs,
 		pmemVolumes:             map[string]*pmemVolume{},
+		pmemSnapshots:           map[string]*pmemSnapshot{},
+		ready:                   make(chan struct{}),
 	}
 
 	rs.AddListener(cs)
@@ -107,8 +141,8 @@ func (cs *masterController) RegisterService(rpcServer *grpc.Server) {
 	csi.RegisterControllerServer(rpcServer, cs)
 }
 
-// OnNodeAdded retrieves the existing volumes at recently added Node.
-// It uses ControllerServer.ListVolume() CSI call to retrieve volumes.
+// OnNodeAdded retrieves the existing volumes and snapshots at recently added Node.
+// It uses ControllerServer.ListVolume() and ListSnapshots() CSI calls to retrieve them.
 func (cs *masterController) OnNodeAdded(ctx context.Context, node *registryserver.NodeInfo) error {
 	conn, err := cs.rs.ConnectToNodeController(node.NodeID)
 	if err != nil {
@@ -124,28 +158,61 @@ func (cs *masterController) OnNodeAdded(ctx context.Context, node *registryserve
 
 	klog.V(5).Infof("Found Volumes at %s: %v", node.NodeID, resp.Entries)
 
+	// Nodes without snapshot support return an error here, which
+	// is not a problem.
+	snapshotsResp, err := csiClient.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	if err != nil {
+		klog.V(5).Infof("Node %s did not report snapshots: %v", node.NodeID, err)
+		snapshotsResp = &csi.ListSnapshotsResponse{}
+	}
+
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
 
+	for _, entry := range snapshotsResp.Entries {
+		if s := entry.GetSnapshot(); s != nil {
+			cs.pmemSnapshots[s.SnapshotId] = &pmemSnapshot{
+				Snapshot: s,
+				nodeID:   node.NodeID,
+			}
+		}
+	}
+
 	for _, entry := range resp.Entries {
 		v := entry.GetVolume()
 		if v == nil { /* this shouldn't happen */
 			continue
 		}
+		numaNode := contextNumaNode(v.VolumeContext)
 		if vol, ok := cs.pmemVolumes[v.VolumeId]; ok && vol != nil {
 			// This is possibly Cache volume, so just add this node id.
+			// Such a volume only has a NUMA node if it is the same
+			// everywhere.
+			if _, known := vol.nodeIDs[node.NodeID]; !known && len(vol.nodeIDs) > 0 &&
+				(vol.numaNode == nil || numaNode == nil || *vol.numaNode != *numaNode) {
+				vol.numaNode = nil
+			} else if len(vol.nodeIDs) == 0 && vol.numaNode == nil {
+				vol.numaNode = numaNode
+			}
 			vol.nodeIDs[node.NodeID] = Created
+			// Not known for volumes from PersistentVolumes.
+			if vol.contentSource == nil {
+				vol.contentSource = v.ContentSource
+			}
 		} else {
 			cs.pmemVolumes[v.VolumeId] = &pmemVolume{
 				id:   v.VolumeId,
 				size: v.CapacityBytes,
-				name: v.VolumeContext["Name"],
+				name: v.VolumeContext[parameters.Name],
 				nodeIDs: map[string]VolumeStatus{
 					node.NodeID: Created,
 				},
+				contentSource: v.ContentSource,
+				numaNode:      numaNode,
 			}
 		}
 	}
+	cs.nodeReconciled(node.NodeID)
 
 	return nil
 }
@@ -153,6 +220,15 @@ func (cs *masterController) OnNodeAdded(ctx context.Context, node *registryserve
 func (cs *masterController) OnNodeDeleted(ctx context.Context, node *registryserver.NodeInfo) {
 }
 
+// contextNumaNode returns the NUMA node recorded in a volume context,
+// nil if unknown.
+func contextNumaNode(volumeContext map[string]string) *int {
+	if n, err := strconv.Atoi(volumeContext[parameters.NumaNode]); err == nil {
+		return &n
+	}
+	return nil
+}
+
 func (cs *masterController) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	var vol *pmemVolume
 	chosenNodes := map[string]VolumeStatus{}
@@ -170,11 +246,22 @@ func (cs *masterController) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
 
+	// A volume with the same name might exist on a node which
+	// has not registered yet.
+	if !cs.isReady() {
+		return nil, status.Error(codes.Unavailable, "volumes from before the controller restart are not known yet")
+	}
+
 	asked := req.GetCapacityRange().GetRequiredBytes()
 	p, err := parameters.Parse(parameters.CreateVolumeOrigin, req.Parameters)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	for _, cap := range req.GetVolumeCapabilities() {
+		if msg := unsupportedCapability(p, cap); msg != "" {
+			return nil, status.Error(codes.InvalidArgument, msg)
+		}
+	}
 
 	outTopology := []*csi.Topology{}
 	klog.V(3).Infof("Controller CreateVolume: Name:%v required_bytes:%v limit_bytes:%v", req.Name, asked, req.GetCapacityRange().GetLimitBytes())
@@ -184,6 +271,9 @@ func (cs *masterController) CreateVolume(ctx context.Context, req *csi.CreateVol
 		if vol.size < asked {
 			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Smaller volume with the same name:%s already exists", req.Name))
 		}
+		if !proto.Equal(vol.contentSource, req.GetVolumeContentSource()) {
+			return nil, status.Errorf(codes.AlreadyExists, "Volume with the same name:%s but different content source already exists", req.Name)
+		}
 
 		chosenNodes = vol.nodeIDs
 	} else {
@@ -206,6 +296,28 @@ func (cs *masterController) CreateVolume(ctx context.Context, req *csi.CreateVol
 			}
 		}
 
+		if source := req.GetVolumeContentSource(); source != nil {
+			// The content gets copied on the node, so the new
+			// volume has to be created where the source is.
+			node, err := cs.getContentSourceNode(source)
+			if err != nil {
+				return nil, err
+			}
+			if p.GetPersistency() == parameters.PersistencyCache {
+				return nil, status.Error(codes.InvalidArgument, "cache volumes cannot be created from a volume content source")
+			}
+			if !topologyAllowsNode(req.GetAccessibilityRequirements().GetRequisite(), node) {
+				return nil, status.Errorf(codes.ResourceExhausted, "volume content source is on node %s, which is not allowed by the accessibility requirements", node)
+			}
+			inTopology = []*csi.Topology{
+				{
+					Segments: map[string]string{
+						PmemDriverTopologyKey: node,
+					},
+				},
+			}
+		}
+
 		if len(inTopology) == 0 {
 			// No topology provided, so we are free to choose from all available
 			// nodes
@@ -225,6 +337,7 @@ func (cs *masterController) CreateVolume(ctx context.Context, req *csi.CreateVol
 		if p.GetPersistency() == parameters.PersistencyCache {
 			numVolumes = p.GetCacheSize()
 		}
+		numaNodes := map[string]bool{}
 		for _, top := range inTopology {
 			if numVolumes == 0 {
 				break
@@ -240,12 +353,14 @@ func (cs *masterController) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 			csiClient := csi.NewControllerClient(conn)
 
-			if _, err := csiClient.CreateVolume(ctx, req); err != nil {
+			resp, err := csiClient.CreateVolume(ctx, req)
+			if err != nil {
 				klog.Warningf("failed to create volume name:%s id:%s on %s: %s", node, req.Name, volumeID, err.Error())
 				continue
 			}
 			numVolumes = numVolumes - 1
 			chosenNodes[node] = Created
+			numaNodes[resp.GetVolume().GetVolumeContext()[parameters.NumaNode]] = true
 		}
 
 		if len(chosenNodes) == 0 {
@@ -255,10 +370,20 @@ func (cs *masterController) CreateVolume(ctx context.Context, req *csi.CreateVol
 		klog.V(3).Infof("Chosen nodes: %v", chosenNodes)
 
 		vol = &pmemVolume{
-			id:      volumeID,
-			name:    req.Name,
-			size:    asked,
-			nodeIDs: chosenNodes,
+			id:            volumeID,
+			name:          req.Name,
+			size:          asked,
+			nodeIDs:       chosenNodes,
+			contentSource: req.GetVolumeContentSource(),
+		}
+		// A cache volume only has a NUMA node if it is the
+		// same everywhere.
+		if len(numaNodes) == 1 {
+			for numaNode := range numaNodes {
+				if n, err := strconv.Atoi(numaNode); err == nil {
+					vol.numaNode = &n
+				}
+			}
 		}
 		cs.mutex.Lock()
 		defer cs.mutex.Unlock()
@@ -278,6 +403,9 @@ func (cs *masterController) CreateVolume(ctx context.Context, req *csi.CreateVol
 	// name in the volume context for logging purposes.
 	name := req.GetName()
 	p.Name = &name
+	if vol.numaNode != nil {
+		p.NumaNode = vol.numaNode
+	}
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
@@ -285,6 +413,7 @@ func (cs *masterController) CreateVolume(ctx context.Context, req *csi.CreateVol
 			CapacityBytes:      asked,
 			AccessibleTopology: outTopology,
 			VolumeContext:      p.ToContext(),
+			ContentSource:      req.GetVolumeContentSource(),
 		},
 	}, nil
 }
@@ -300,6 +429,12 @@ func (cs *masterController) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
 
+	// Unknown volumes are treated as deleted, which is only
+	// correct once all volumes are known.
+	if !cs.isReady() {
+		return nil, status.Error(codes.Unavailable, "volumes from before the controller restart are not known yet")
+	}
+
 	// Serialize by VolumeId
 	volumeMutex.LockKey(req.VolumeId)
 	defer volumeMutex.UnlockKey(req.VolumeId) //nolint: errcheck
@@ -346,6 +481,11 @@ func (cs *masterController) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
 
+	// The volume context replicates the CreateVolume parameters.
+	p, err := parameters.Parse(parameters.PersistentVolumeOrigin, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "volume context: "+err.Error())
+	}
 	for _, cap := range req.VolumeCapabilities {
 		if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
 			return &csi.ValidateVolumeCapabilitiesResponse{
@@ -353,6 +493,12 @@ func (cs *masterController) ValidateVolumeCapabilities(ctx context.Context, req
 				Message:   "Driver does not support '" + cap.AccessMode.Mode.String() + "' mode",
 			}, nil
 		}
+		if msg := unsupportedCapability(p, cap); msg != "" {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Confirmed: nil,
+				Message:   msg,
+			}, nil
+		}
 	}
 
 	/*
@@ -505,6 +651,45 @@ func (cs *masterController) getVolumeByID(volumeID string) *pmemVolume {
 	return nil
 }
 
+// getContentSourceNode returns the node which has the volume or
+// snapshot that a new volume is supposed to be created from.
+func (cs *masterController) getContentSourceNode(source *csi.VolumeContentSource) (string, error) {
+	if snapshot := source.GetSnapshot(); snapshot != nil {
+		s := cs.getSnapshotByID(snapshot.SnapshotId)
+		if s == nil {
+			return "", status.Errorf(codes.NotFound, "source snapshot %q not found", snapshot.SnapshotId)
+		}
+		return s.nodeID, nil
+	}
+	if volume := source.GetVolume(); volume != nil {
+		vol := cs.getVolumeByID(volume.VolumeId)
+		if vol == nil {
+			return "", status.Errorf(codes.NotFound, "source volume %q not found", volume.VolumeId)
+		}
+		if len(vol.nodeIDs) != 1 {
+			return "", status.Error(codes.InvalidArgument, "cache volumes cannot be cloned")
+		}
+		for node := range vol.nodeIDs {
+			return node, nil
+		}
+	}
+	return "", status.Error(codes.InvalidArgument, "unsupported volume content source")
+}
+
+// topologyAllowsNode checks whether the node is part of the required
+// topology. An empty topology allows all nodes.
+func topologyAllowsNode(topology []*csi.Topology, node string) bool {
+	if len(topology) == 0 {
+		return true
+	}
+	for _, top := range topology {
+		if top.Segments[PmemDriverTopologyKey] == node {
+			return true
+		}
+	}
+	return false
+}
+
 func (cs *masterController) getVolumeByName(Name string) *pmemVolume {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
@@ -516,6 +701,258 @@ func (cs *masterController) getVolumeByName(Name string) *pmemVolume {
 	return nil
 }
 
-func (cs *masterController) ControllerExpandVolume(context.Context, *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (cs *masterController) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		klog.Errorf("invalid expand volume req: %v", req)
+		return nil, err
+	}
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetCapacityRange().GetRequiredBytes() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "required bytes missing in request")
+	}
+
+	// A volume might not be known yet, or only some of the
+	// nodes of a cache volume.
+	if !cs.isReady() {
+		return nil, status.Error(codes.Unavailable, "volumes from before the controller restart are not known yet")
+	}
+
+	// Serialize by VolumeId
+	volumeMutex.LockKey(req.VolumeId)
+	defer volumeMutex.UnlockKey(req.VolumeId) //nolint: errcheck
+
+	klog.V(4).Infof("ControllerExpandVolume: requested volumeID: %v", req.GetVolumeId())
+	vol := cs.getVolumeByID(req.GetVolumeId())
+	if vol == nil {
+		return nil, status.Error(codes.NotFound, "Volume not created by this controller")
+	}
+
+	resp := &csi.ControllerExpandVolumeResponse{}
+	for node := range vol.nodeIDs {
+		conn, err := cs.rs.ConnectToNodeController(node)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Failed to connect to node "+node+": "+err.Error())
+		}
+		klog.V(4).Infof("Asking node %s to expand volume name:%s id:%s", node, vol.name, vol.id)
+		resp, err = csi.NewControllerClient(conn).ControllerExpandVolume(ctx, req)
+		conn.Close() // nolint:errcheck
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if vol.size < resp.CapacityBytes {
+		vol.size = resp.CapacityBytes
+	}
+	klog.V(4).Infof("Controller ControllerExpandVolume: volume name:%s id:%s expanded to %v", vol.name, vol.id, vol.size)
+
+	return resp, nil
+}
+
+func (cs *masterController) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		klog.Errorf("invalid create snapshot req: %v", req)
+		return nil, err
+	}
+
+	// Check arguments
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source volume ID missing in request")
+	}
+	for key := range req.GetParameters() {
+		// Metadata added by the external-snapshotter is okay,
+		// there are no other snapshot parameters.
+		if !strings.HasPrefix(key, parameters.PodInfoPrefix) {
+			return nil, status.Errorf(codes.InvalidArgument, "parameter %q invalid in this context", key)
+		}
+	}
+
+	// The source volume might not be known yet.
+	if !cs.isReady() {
+		return nil, status.Error(codes.Unavailable, "volumes from before the controller restart are not known yet")
+	}
+
+	// Serialize by name and source VolumeId
+	snapshotNameMutex.LockKey(req.Name)
+	defer snapshotNameMutex.UnlockKey(req.Name) //nolint: errcheck
+	volumeMutex.LockKey(req.SourceVolumeId)
+	defer volumeMutex.UnlockKey(req.SourceVolumeId) //nolint: errcheck
+
+	klog.V(4).Infof("CreateSnapshot: Name:%v source volume:%v", req.Name, req.SourceVolumeId)
+	// Nodes derive the snapshot ID from the name, so a snapshot
+	// with that ID has the same name, possibly on some other node.
+	snapshotID := GenerateVolumeID("Controller CreateSnapshot", req.Name)
+	if snapshot := cs.getSnapshotByID(snapshotID); snapshot != nil {
+		if snapshot.SourceVolumeId != req.SourceVolumeId {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot with the same name %q but different source volume already exists", req.Name)
+		}
+		// Idempotent call.
+		return &csi.CreateSnapshotResponse{Snapshot: snapshot.Snapshot}, nil
+	}
+	vol := cs.getVolumeByID(req.SourceVolumeId)
+	if vol == nil {
+		return nil, status.Error(codes.NotFound, "Source volume not created by this controller")
+	}
+	if len(vol.nodeIDs) != 1 {
+		return nil, status.Error(codes.InvalidArgument, "snapshots of cache volumes are not supported")
+	}
+
+	// The node is responsible for choosing the snapshot ID and
+	// for detecting repeated calls.
+	var resp *csi.CreateSnapshotResponse
+	for node := range vol.nodeIDs {
+		conn, err := cs.rs.ConnectToNodeController(node)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Failed to connect to node "+node+": "+err.Error())
+		}
+		defer conn.Close() // nolint:errcheck
+		klog.V(4).Infof("Asking node %s to create snapshot name:%s of volume %s", node, req.Name, vol.id)
+		resp, err = csi.NewControllerClient(conn).CreateSnapshot(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		cs.mutex.Lock()
+		defer cs.mutex.Unlock()
+		cs.pmemSnapshots[resp.Snapshot.SnapshotId] = &pmemSnapshot{
+			Snapshot: resp.Snapshot,
+			nodeID:   node,
+		}
+		klog.V(3).Infof("Controller CreateSnapshot: Record new snapshot as %v", resp.Snapshot)
+	}
+
+	return resp, nil
+}
+
+func (cs *masterController) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		klog.Errorf("invalid delete snapshot req: %v", req)
+		return nil, err
+	}
+
+	// Check arguments
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+
+	// Unknown snapshots are treated as deleted, which is only
+	// correct once all snapshots are known.
+	if !cs.isReady() {
+		return nil, status.Error(codes.Unavailable, "snapshots from before the controller restart are not known yet")
+	}
+
+	// Serialize by SnapshotId
+	volumeMutex.LockKey(req.SnapshotId)
+	defer volumeMutex.UnlockKey(req.SnapshotId) //nolint: errcheck
+
+	klog.V(4).Infof("DeleteSnapshot: requested snapshotID: %v", req.GetSnapshotId())
+	snapshot := cs.getSnapshotByID(req.SnapshotId)
+	if snapshot == nil {
+		klog.Warningf("Snapshot %s not created by this controller", req.GetSnapshotId())
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	conn, err := cs.rs.ConnectToNodeController(snapshot.nodeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to connect to node "+snapshot.nodeID+": "+err.Error())
+	}
+	defer conn.Close() // nolint:errcheck
+	klog.V(4).Infof("Asking node %s to delete snapshot id:%s", snapshot.nodeID, req.SnapshotId)
+	if _, err := csi.NewControllerClient(conn).DeleteSnapshot(ctx, req); err != nil {
+		return nil, err
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.pmemSnapshots, req.SnapshotId)
+	klog.V(4).Infof("Controller DeleteSnapshot: snapshot id:%s deleted", req.SnapshotId)
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *masterController) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	klog.V(5).Info("ListSnapshots")
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		klog.Errorf("invalid list snapshots req: %v", req)
+		return nil, err
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	// Copy from map into array for pagination, filtered as requested.
+	snapshots := make([]*csi.Snapshot, 0, len(cs.pmemSnapshots))
+	for _, snapshot := range cs.pmemSnapshots {
+		if req.SnapshotId != "" && req.SnapshotId != snapshot.SnapshotId ||
+			req.SourceVolumeId != "" && req.SourceVolumeId != snapshot.SourceVolumeId {
+			continue
+		}
+		snapshots = append(snapshots, snapshot.Snapshot)
+	}
+	// Stable order across calls.
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].SnapshotId < snapshots[j].SnapshotId
+	})
+
+	// Same pagination as in ListVolumes.
+	var (
+		ulenSnapshots = int32(len(snapshots))
+		maxEntries    = req.MaxEntries
+		startingToken int32
+	)
+
+	if v := req.StartingToken; v != "" {
+		i, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Aborted,
+				"startingToken=%d !< int32=%d",
+				startingToken, math.MaxUint32)
+		}
+		startingToken = int32(i)
+	}
+
+	if startingToken > ulenSnapshots {
+		return nil, status.Errorf(
+			codes.Aborted,
+			"startingToken=%d > len(snapshots)=%d",
+			startingToken, ulenSnapshots)
+	}
+
+	rem := ulenSnapshots - startingToken
+	if maxEntries == 0 || maxEntries > rem {
+		maxEntries = rem
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, maxEntries)
+	for i := range entries {
+		entries[i] = &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snapshots[startingToken+int32(i)],
+		}
+	}
+
+	var nextToken string
+	if n := startingToken + maxEntries; n < ulenSnapshots {
+		nextToken = fmt.Sprintf("%d", n)
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (cs *masterController) getSnapshotByID(snapshotID string) *pmemSnapshot {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.pmemSnapshots[snapshotID]
 }
@@ -0,0 +1,51 @@
+/*
+Copyright 2020 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/pmem-csi/pkg/registryserver"
+)
+
+func TestMasterCreateSnapshotName(t *testing.T) {
+	ctx := context.Background()
+	cs := NewMasterControllerServer(registryserver.New(nil))
+	require.NoError(t, cs.reconcile(ctx, nil, nil, "pmem-csi.intel.com", time.Hour), "reconcile")
+
+	// Two volumes on different nodes, the first one with a
+	// snapshot as reported by its node.
+	for _, vol := range []*pmemVolume{
+		{id: "vol-a", name: "pvc-a", size: 1024, nodeIDs: map[string]VolumeStatus{"node-a": Created}},
+		{id: "vol-b", name: "pvc-b", size: 1024, nodeIDs: map[string]VolumeStatus{"node-b": Created}},
+	} {
+		cs.pmemVolumes[vol.id] = vol
+	}
+	snapshotID := GenerateVolumeID("test", "snapshot-1")
+	existing := &csi.Snapshot{SnapshotId: snapshotID, SourceVolumeId: "vol-a", SizeBytes: 1024, ReadyToUse: true}
+	cs.pmemSnapshots[snapshotID] = &pmemSnapshot{Snapshot: existing, nodeID: "node-a"}
+
+	resp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "vol-a"})
+	require.NoError(t, err, "same name and source")
+	assert.Equal(t, existing, resp.Snapshot, "existing snapshot")
+
+	_, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "vol-b"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "same name, different source: %v", err)
+	snapshot := cs.getSnapshotByID(snapshotID)
+	if assert.NotNil(t, snapshot, "snapshot still known") {
+		assert.Equal(t, "node-a", snapshot.nodeID, "node of snapshot")
+		assert.Equal(t, "vol-a", snapshot.SourceVolumeId, "source of snapshot")
+	}
+}
@@ -10,7 +10,10 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -29,15 +32,46 @@ type nodeVolume struct {
 	ID     string            `json:"id"`
 	Size   int64             `json:"size"`
 	Params map[string]string `json:"parameters"`
+	// SourceSnapshotID or SourceVolumeID is set when the volume
+	// was created from a volume content source.
+	SourceSnapshotID string `json:"sourceSnapshotId,omitempty"`
+	SourceVolumeID   string `json:"sourceVolumeId,omitempty"`
+}
+
+type nodeSnapshot struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	Size           int64     `json:"size"`
+	CreationTime   time.Time `json:"creationTime"`
+	// ErasePolicy and EraseVerify are inherited from the source volume.
+	ErasePolicy parameters.Erase `json:"erasePolicy,omitempty"`
+	EraseVerify bool             `json:"eraseVerify,omitempty"`
+	// EraseAfter is only set in state written by older releases
+	// which did not store the policy.
+	EraseAfter bool `json:"eraseafter,omitempty"`
 }
 
 type nodeControllerServer struct {
 	*DefaultControllerServer
-	nodeID      string
-	dm          pmdmanager.PmemDeviceManager
-	sm          pmemstate.StateManager
-	pmemVolumes map[string]*nodeVolume // map of reqID:nodeVolume
-	mutex       sync.Mutex             // lock for pmemVolumes
+	nodeID        string
+	dm            pmdmanager.PmemDeviceManager
+	sm            pmemstate.StateManager
+	pmemVolumes   map[string]*nodeVolume         // map of reqID:nodeVolume
+	mutex         sync.Mutex                     // lock for pmemVolumes and pmemSnapshots
+	snapshots     pmdmanager.PmemSnapshotManager // nil if the device manager has no snapshot support
+	ssm           pmemstate.StateManager         // state of snapshots
+	pmemSnapshots map[string]*nodeSnapshot       // map of snapshotID:nodeSnapshot
+	// avoidBadblocks keeps new volumes away from PMEM with known bad blocks
+	avoidBadblocks bool
+	// eraseQueue erases volumes which get wiped entirely after DeleteVolume
+	// returned, nil if that happens synchronously
+	eraseQueue *eraseQueue
+	// orphans finds devices without volume
+	orphans *orphanReconciler
+	// stateRecovered is set when the state could not be restored
+	// completely on startup, so it may lack some volumes
+	stateRecovered bool
 }
 
 var _ csi.ControllerServer = &nodeControllerServer{}
@@ -45,11 +79,27 @@ var _ PmemService = &nodeControllerServer{}
 
 var nodeVolumeMutex = keymutex.NewHashed(-1)
 
-func NewNodeControllerServer(nodeID string, dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager) *nodeControllerServer {
+// nodeNameMutex serializes by volume or snapshot name. Keys of a hashed
+// mutex may share the same lock, so an operation which needs a name and
+// an ID locks them in different mutexes, always the name first.
+var nodeNameMutex = keymutex.NewHashed(-1)
+
+// NewNodeControllerServer restores the volumes and snapshots from sm and ssm.
+// If esm is not nil, it is used to queue volumes for erasing in the background.
+func NewNodeControllerServer(nodeID string, dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager, ssm pmemstate.StateManager, esm pmemstate.StateManager) *nodeControllerServer {
 	serverCaps := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+	}
+	snapshots, _ := dm.(pmdmanager.PmemSnapshotManager)
+	if snapshots != nil {
+		serverCaps = append(serverCaps,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		)
 	}
 
 	ncs := &nodeControllerServer{
@@ -58,27 +108,45 @@ func NewNodeControllerServer(nodeID string, dm pmdmanager.PmemDeviceManager, sm
 		dm:                      dm,
 		sm:                      sm,
 		pmemVolumes:             map[string]*nodeVolume{},
+		snapshots:               snapshots,
+		ssm:                     ssm,
+		pmemSnapshots:           map[string]*nodeSnapshot{},
+	}
+	if esm != nil {
+		ncs.eraseQueue = newEraseQueue(dm, esm)
 	}
 
 	// Restore provisioned volumes from state.
 	if sm != nil {
 		// Get actual devices at DeviceManager
 		devices, err := dm.ListDevices()
+		// Without the devices, it is unknown which ones are gone.
+		listed := err == nil
 		if err != nil {
 			klog.Warningf("Failed to get volumes: %v", err)
+			ncs.stateRecovered = true
 		}
 		cleanupList := []string{}
 		ids, err := sm.GetAll()
 		if err != nil {
 			klog.Warningf("Failed to load state: %v", err)
+			ncs.stateRecovered = true
 		}
 
 		for _, id := range ids {
 			found := false
+			// A volume which was deleted shortly before a restart
+			// may still be waiting for erasing.
+			if ncs.eraseQueue != nil && ncs.eraseQueue.isPending(id) {
+				cleanupList = append(cleanupList, id)
+				continue
+			}
 			// See if the device data stored at StateManager is still valid
+			var device *pmdmanager.PmemDeviceInfo
 			for _, devInfo := range devices {
 				if devInfo.VolumeId == id {
 					found = true
+					device = devInfo
 					break
 				}
 			}
@@ -86,11 +154,17 @@ func NewNodeControllerServer(nodeID string, dm pmdmanager.PmemDeviceManager, sm
 			if found {
 				// retrieve volume info
 				vol := &nodeVolume{}
+				store := false
 				if err := sm.Get(id, vol); err != nil {
 					klog.Warningf("Failed to retrieve volume info for id %q from state: %v", id, err)
+					vol = recoverVolume(device)
+					ncs.stateRecovered = true
+					// The unreadable entry is gone, so store
+					// what is known about the volume.
+					store = errors.Is(err, pmemstate.ErrCorrupted)
 				}
-				ncs.pmemVolumes[id] = vol
-			} else {
+				ncs.restoreVolume(vol, device, store)
+			} else if listed {
 				// if not found in DeviceManager's list, add to cleanupList
 				cleanupList = append(cleanupList, id)
 			}
@@ -103,9 +177,108 @@ func NewNodeControllerServer(nodeID string, dm pmdmanager.PmemDeviceManager, sm
 		}
 	}
 
+	// Same for snapshots.
+	if ssm != nil && snapshots != nil {
+		ids, err := ssm.GetAll()
+		if err != nil {
+			klog.Warningf("Failed to load snapshot state: %v", err)
+		}
+		for _, id := range ids {
+			if _, err := snapshots.GetSnapshot(id); err != nil {
+				if err := ssm.Delete(id); err != nil {
+					klog.Warningf("Failed to delete stale snapshot %s from state: %s", id, err.Error())
+				}
+				continue
+			}
+			snapshot := &nodeSnapshot{}
+			if err := ssm.Get(id, snapshot); err != nil {
+				klog.Warningf("Failed to retrieve snapshot info for id %q from state: %v", id, err)
+				if info, e := snapshots.GetSnapshot(id); e == nil {
+					snapshot = &nodeSnapshot{ID: id, Size: int64(info.Size)}
+				}
+				if errors.Is(err, pmemstate.ErrCorrupted) {
+					if err := ssm.Update(id, snapshot); err != nil {
+						klog.Warningf("Failed to store recovered snapshot info for id %q: %v", id, err)
+					}
+				}
+			}
+			ncs.pmemSnapshots[id] = snapshot
+		}
+	}
+
+	if ncs.eraseQueue != nil {
+		ncs.eraseQueue.start()
+	}
+
+	// Volumes whose state got lost are restored if their
+	// device has metadata from this node, other devices are orphans.
+	ncs.orphans = newOrphanReconciler(ncs)
+	ncs.orphans.reconcile()
+
 	return ncs
 }
 
+// restoreVolume adds a volume which was found without creating it
+// and optionally stores it in the state.
+func (cs *nodeControllerServer) restoreVolume(vol *nodeVolume, device *pmdmanager.PmemDeviceInfo, store bool) {
+	// State written by older releases does not
+	// record the device manager.
+	if backends, ok := cs.dm.(pmdmanager.PmemBackendManager); ok && vol.Params != nil && vol.Params[parameters.DeviceMode] == "" {
+		if backend, err := backends.DeviceBackend(vol.ID); err == nil {
+			vol.Params[parameters.DeviceMode] = backend
+		}
+	}
+	// Nor the NUMA node, unless it was requested.
+	if recordNumaNode(vol, device) && cs.sm != nil {
+		store = true
+	}
+	if store {
+		if err := cs.sm.Update(vol.ID, vol); err != nil {
+			klog.Warningf("Failed to store recovered volume info for id %q: %v", vol.ID, err)
+		}
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.pmemVolumes[vol.ID] = vol
+}
+
+// recordNumaNode adds the NUMA node of the device to the volume
+// parameters. The master controller learns it from ListVolumes when
+// rebuilding its state. Returns true if the parameters changed.
+func recordNumaNode(vol *nodeVolume, device *pmdmanager.PmemDeviceInfo) bool {
+	if vol.Params == nil || device == nil || device.NumaNode < 0 {
+		return false
+	}
+	numaNode := fmt.Sprintf("%d", device.NumaNode)
+	if vol.Params[parameters.NumaNode] == numaNode {
+		return false
+	}
+	vol.Params[parameters.NumaNode] = numaNode
+	return true
+}
+
+// recoverVolume reconstructs the state of a volume from its device
+// when the stored state is unreadable or missing. Without metadata
+// on the device, the original parameters are lost and the volume
+// uses the defaults.
+func recoverVolume(device *pmdmanager.PmemDeviceInfo) *nodeVolume {
+	klog.Infof("Recovering state of volume %s from device %s", device.VolumeId, device.Path)
+	vol := &nodeVolume{
+		ID:     device.VolumeId,
+		Size:   int64(device.Size),
+		Params: map[string]string{},
+	}
+	if device.Metadata != nil {
+		for key, value := range device.Metadata.Parameters {
+			vol.Params[key] = value
+		}
+		if device.Metadata.Name != "" {
+			vol.Params[parameters.Name] = device.Metadata.Name
+		}
+	}
+	return vol
+}
+
 func (cs *nodeControllerServer) RegisterService(rpcServer *grpc.Server) {
 	csi.RegisterControllerServer(rpcServer, cs)
 }
@@ -133,14 +306,15 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 		return nil, status.Error(codes.InvalidArgument, "persistent volume: "+err.Error())
 	}
 
-	nodeVolumeMutex.LockKey(req.Name)
-	defer nodeVolumeMutex.UnlockKey(req.Name)
+	nodeNameMutex.LockKey(req.Name)
+	defer nodeNameMutex.UnlockKey(req.Name)
 
 	volumeID, size, err := cs.createVolumeInternal(ctx,
 		p,
 		req.Name,
 		req.GetVolumeCapabilities(),
 		req.GetCapacityRange(),
+		req.GetVolumeContentSource(),
 	)
 	if err != nil {
 		// This is already a status error.
@@ -153,11 +327,22 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 		},
 	})
 
+	// Report where the volume ended up, so that pods can be
+	// pinned to the same NUMA node.
+	if device, err := cs.dm.GetDevice(volumeID); err == nil && device.NumaNode >= 0 {
+		numaNode := device.NumaNode
+		p.NumaNode = &numaNode
+	}
+	name := req.GetName()
+	p.Name = &name
+
 	resp = &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:           volumeID,
 			CapacityBytes:      size,
 			AccessibleTopology: topology,
+			VolumeContext:      p.ToContext(),
+			ContentSource:      req.GetVolumeContentSource(),
 		},
 	}
 
@@ -169,6 +354,7 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 	volumeName string,
 	volumeCapabilities []*csi.VolumeCapability,
 	capacity *csi.CapacityRange,
+	contentSource *csi.VolumeContentSource,
 ) (volumeID string, actual int64, statusErr error) {
 	// Keep volume name as part of volume parameters for use in
 	// getVolumeByName.
@@ -182,6 +368,10 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 			statusErr = status.Error(codes.AlreadyExists, fmt.Sprintf("smaller volume with the same name %q already exists", volumeName))
 			return
 		}
+		if !proto.Equal(vol.contentSource(), contentSource) {
+			statusErr = status.Errorf(codes.AlreadyExists, "volume with the same name %q but different content source already exists", volumeName)
+			return
+		}
 		// Use existing volume, it's the one the caller asked
 		// for earlier (idempotent call):
 		volumeID = vol.ID
@@ -190,6 +380,40 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 	}
 
 	klog.V(4).Infof("Node CreateVolume: Name:%q req.Required:%v req.Limit:%v", volumeName, asked, capacity.GetLimitBytes())
+
+	for _, cap := range volumeCapabilities {
+		if msg := unsupportedCapability(p, cap); msg != "" {
+			statusErr = status.Error(codes.InvalidArgument, msg)
+			return
+		}
+	}
+
+	var source *pmdmanager.PmemDeviceInfo
+	if contentSource != nil {
+		// The source must not get deleted while copying it.
+		sourceID := contentSourceID(contentSource)
+		nodeVolumeMutex.LockKey(sourceID)
+		defer nodeVolumeMutex.UnlockKey(sourceID) //nolint: errcheck
+
+		var sourceSize int64
+		source, sourceSize, statusErr = cs.getContentSource(contentSource)
+		if statusErr != nil {
+			return
+		}
+		if asked == 0 {
+			asked = sourceSize
+		} else if asked < sourceSize {
+			statusErr = status.Errorf(codes.OutOfRange, "requested size %d is smaller than the size %d of the volume content source", asked, sourceSize)
+			return
+		}
+		// The new device must be able to hold the entire source
+		// device, which may be larger than the size of the
+		// source volume because of alignment.
+		if int64(source.Size) > asked {
+			asked = int64(source.Size)
+		}
+	}
+
 	volumeID = p.GetVolumeID()
 	if volumeID == "" {
 		volumeID = GenerateVolumeID("Node CreateVolume", volumeName)
@@ -205,10 +429,24 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 		}
 	}
 
+	if cs.eraseQueue != nil && cs.eraseQueue.isPending(volumeID) {
+		// The device of a previous volume with the same name
+		// still exists. The caller has to try again later.
+		statusErr = status.Errorf(codes.Aborted, "previous volume with ID %s is still getting erased", volumeID)
+		return
+	}
+
+	// Record the device manager, so that ListVolumes reports it.
+	if statusErr = cs.selectDeviceMode(&p); statusErr != nil {
+		return
+	}
+
 	vol := &nodeVolume{
-		ID:     volumeID,
-		Size:   asked,
-		Params: p.ToContext(),
+		ID:               volumeID,
+		Size:             asked,
+		Params:           p.ToContext(),
+		SourceSnapshotID: contentSource.GetSnapshot().GetSnapshotId(),
+		SourceVolumeID:   contentSource.GetVolume().GetVolumeId(),
 	}
 	if cs.sm != nil {
 		// Persist new volume state *before* actually creating the volume.
@@ -234,10 +472,52 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 		// It will get rounded up by below layer to meet the alignment.
 		asked = 1
 	}
-	if err := cs.dm.CreateDevice(volumeID, uint64(asked)); err != nil {
-		statusErr = status.Errorf(codes.Internal, "Node CreateVolume: device creation failed: %v", err)
+	opts := pmdmanager.CreateDeviceOpts{
+		Mode:      pmdmanager.NamespaceMode(p.GetNamespaceMode()),
+		Layout:    pmdmanager.VolumeLayout(p.GetLayout()),
+		NumaNode:  p.NumaNode,
+		Alignment: p.GetAlignment(),
+		// Refusing bad blocks is a policy of the node.
+		AvoidBadblocks: cs.avoidBadblocks,
+		Backend:        p.GetDeviceMode(),
+		// Allows restoring the volume without the state.
+		Metadata: &pmdmanager.VolumeMetadata{
+			Name:       volumeName,
+			Parameters: vol.Params,
+			Created:    time.Now(),
+			Owner:      cs.nodeID,
+		},
+	}
+	if p.ErasePolicy != nil {
+		opts.ErasePolicy = pmdmanager.ErasePolicy(*p.ErasePolicy)
+	}
+	if err := cs.dm.CreateDevice(volumeID, uint64(asked), opts); err != nil {
+		code := codes.Internal
+		if errors.Is(err, pmdmanager.ErrInvalid) {
+			code = codes.InvalidArgument
+		}
+		statusErr = status.Errorf(code, "Node CreateVolume: device creation failed: %v", err)
 		return
 	}
+	if source != nil {
+		if err := cs.dm.CopyDevice(volumeID, source); err != nil {
+			if err := cs.dm.DeleteDevice(volumeID, pmdmanager.EraseOpts{}); err != nil {
+				klog.Warningf("Node CreateVolume: removing volume %s after failed copy: %v", volumeID, err)
+			}
+			code := codes.Internal
+			if errors.Is(err, pmdmanager.ErrDeviceInUse) {
+				code = codes.FailedPrecondition
+			}
+			statusErr = status.Errorf(code, "Node CreateVolume: copying volume content source failed: %v", err)
+			return
+		}
+		klog.V(4).Infof("Node CreateVolume: copied %s into volume %s", source.Path, volumeID)
+	}
+	if device, err := cs.dm.GetDevice(volumeID); err == nil && recordNumaNode(vol, device) && cs.sm != nil {
+		if err := cs.sm.Update(volumeID, vol); err != nil {
+			klog.Warningf("Node CreateVolume: storing NUMA node of volume %s failed: %v", volumeID, err)
+		}
+	}
 	// TODO(?): determine and return actual size here?
 	actual = asked
 
@@ -249,6 +529,63 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 	return
 }
 
+// contentSourceID returns the ID of the snapshot or volume from which a
+// new volume gets created.
+func contentSourceID(contentSource *csi.VolumeContentSource) string {
+	if snapshot := contentSource.GetSnapshot(); snapshot != nil {
+		return snapshot.SnapshotId
+	}
+	return contentSource.GetVolume().GetVolumeId()
+}
+
+// contentSource returns the volume content source from which the
+// volume was created, nil if none.
+func (v *nodeVolume) contentSource() *csi.VolumeContentSource {
+	switch {
+	case v.SourceSnapshotID != "":
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: v.SourceSnapshotID},
+			},
+		}
+	case v.SourceVolumeID != "":
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: v.SourceVolumeID},
+			},
+		}
+	}
+	return nil
+}
+
+// getContentSource looks up the device for the content of a new
+// volume and the size that the new volume must have at least.
+func (cs *nodeControllerServer) getContentSource(contentSource *csi.VolumeContentSource) (*pmdmanager.PmemDeviceInfo, int64, error) {
+	if snapshot := contentSource.GetSnapshot(); snapshot != nil {
+		s := cs.getSnapshotByID(snapshot.SnapshotId)
+		if s == nil || cs.snapshots == nil {
+			return nil, 0, status.Errorf(codes.NotFound, "source snapshot %q not found", snapshot.SnapshotId)
+		}
+		device, err := cs.snapshots.GetSnapshot(s.ID)
+		if err != nil {
+			return nil, 0, status.Errorf(codes.NotFound, "source snapshot %q: %v", s.ID, err)
+		}
+		return device, s.Size, nil
+	}
+	if volume := contentSource.GetVolume(); volume != nil {
+		vol := cs.getVolumeByID(volume.VolumeId)
+		if vol == nil {
+			return nil, 0, status.Errorf(codes.NotFound, "source volume %q not found", volume.VolumeId)
+		}
+		device, err := cs.dm.GetDevice(vol.ID)
+		if err != nil {
+			return nil, 0, status.Errorf(codes.NotFound, "source volume %q: %v", vol.ID, err)
+		}
+		return device, vol.Size, nil
+	}
+	return nil, 0, status.Error(codes.InvalidArgument, "unsupported volume content source")
+}
+
 func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 
 	// Check arguments
@@ -279,7 +616,14 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 		return nil, status.Errorf(codes.Internal, "previously stored volume parameters for volume with ID %q: %v", req.VolumeId, err)
 	}
 
-	if err := cs.dm.DeleteDevice(req.VolumeId, p.GetEraseAfter()); err != nil {
+	erase := eraseOpts(p.GetErasePolicy(), p.GetEraseVerify())
+	if erasesEntireDevice(erase.Policy) && cs.eraseQueue != nil {
+		// Erasing the entire device may take minutes. The
+		// device gets deleted by the erase queue afterwards.
+		if err := cs.eraseQueue.add(req.VolumeId, vol.Size, erase); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to queue volume for erasing: %s", err.Error())
+		}
+	} else if err := cs.dm.DeleteDevice(req.VolumeId, erase); err != nil {
 		if errors.Is(err, pmdmanager.ErrDeviceInUse) {
 			return nil, status.Errorf(codes.FailedPrecondition, err.Error())
 		}
@@ -313,6 +657,10 @@ func (cs *nodeControllerServer) ValidateVolumeCapabilities(ctx context.Context,
 	if vol == nil {
 		return nil, status.Error(codes.NotFound, "Volume not created by this controller")
 	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "volume parameters: "+err.Error())
+	}
 	for _, cap := range req.VolumeCapabilities {
 		if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
 			return &csi.ValidateVolumeCapabilitiesResponse{
@@ -320,6 +668,12 @@ func (cs *nodeControllerServer) ValidateVolumeCapabilities(ctx context.Context,
 				Message:   "Driver does not support '" + cap.AccessMode.Mode.String() + "' mode",
 			}, nil
 		}
+		if msg := unsupportedCapability(p, cap); msg != "" {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Confirmed: nil,
+				Message:   msg,
+			}, nil
+		}
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
@@ -329,6 +683,24 @@ func (cs *nodeControllerServer) ValidateVolumeCapabilities(ctx context.Context,
 	}, nil
 }
 
+// unsupportedCapability explains why a volume with the given parameters
+// cannot be used with the capability. The result is empty if it can.
+func unsupportedCapability(p parameters.Volume, cap *csi.VolumeCapability) string {
+	switch p.GetNamespaceMode() {
+	case parameters.ModeDevdax:
+		if cap.GetMount() != nil {
+			return fmt.Sprintf("%s volumes can only be used as raw block volumes", parameters.ModeDevdax)
+		}
+	case parameters.ModeSector:
+		for _, flag := range cap.GetMount().GetMountFlags() {
+			if flag == "dax" {
+				return fmt.Sprintf("%s volumes cannot be mounted with -o dax", parameters.ModeSector)
+			}
+		}
+	}
+	return ""
+}
+
 func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
 	klog.V(5).Info("ListVolumes")
 	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
@@ -345,6 +717,7 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 				VolumeId:      vol.ID,
 				CapacityBytes: vol.Size,
 				VolumeContext: vol.Params,
+				ContentSource: vol.contentSource(),
 			},
 		})
 	}
@@ -355,20 +728,70 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 }
 
 func (cs *nodeControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	var capacity int64
-
-	cap, err := cs.dm.GetCapacity()
+	p, err := parameters.Parse(parameters.CreateVolumeOrigin, req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "capacity parameters: "+err.Error())
+	}
+	var cap pmdmanager.Capacity
+	opts := pmdmanager.CapacityOpts{
+		Layout:   pmdmanager.VolumeLayout(p.GetLayout()),
+		NumaNode: p.NumaNode,
+	}
+	if mode := p.GetDeviceMode(); mode != "" {
+		backends, ok := cs.dm.(pmdmanager.PmemBackendManager)
+		if !ok || !hasBackend(backends, mode) {
+			// Volumes with that device mode cannot be created here.
+			klog.V(4).Infof("GetCapacity: device mode %s not available", mode)
+			return &csi.GetCapacityResponse{}, nil
+		}
+		cap, err = backends.GetBackendCapacity(mode, opts)
+	} else {
+		cap, err = cs.dm.GetCapacity(opts)
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
+	klog.V(4).Infof("GetCapacity: device mode %q, layout %q: total free %d, largest allocatable %d", p.GetDeviceMode(), opts.Layout, cap.Total, cap.Largest)
 
-	capacity = int64(cap)
-
+	// Scheduling decisions are about a single volume, so
+	// report what can be allocated in one piece. Deleted volumes
+	// which still get erased keep their device until then and
+	// thus are not part of it, the erase queue metrics report
+	// their size.
 	return &csi.GetCapacityResponse{
-		AvailableCapacity: capacity,
+		AvailableCapacity: int64(cap.Largest),
 	}, nil
 }
 
+// selectDeviceMode checks that the requested device manager is
+// available and picks the default one if none was requested.
+func (cs *nodeControllerServer) selectDeviceMode(p *parameters.Volume) error {
+	backends, ok := cs.dm.(pmdmanager.PmemBackendManager)
+	if !ok {
+		if p.DeviceMode != nil {
+			return status.Errorf(codes.InvalidArgument, "device mode %q not available on node %s", p.GetDeviceMode(), cs.nodeID)
+		}
+		return nil
+	}
+	mode := p.GetDeviceMode()
+	if mode == "" {
+		mode = backends.Backends()[0]
+	} else if !hasBackend(backends, mode) {
+		return status.Errorf(codes.InvalidArgument, "device mode %q not available on node %s, only %v", mode, cs.nodeID, backends.Backends())
+	}
+	p.DeviceMode = &mode
+	return nil
+}
+
+func hasBackend(backends pmdmanager.PmemBackendManager, name string) bool {
+	for _, backend := range backends.Backends() {
+		if backend == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (cs *nodeControllerServer) getVolumeByID(volumeID string) *nodeVolume {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
@@ -389,6 +812,288 @@ func (cs *nodeControllerServer) getVolumeByName(volumeName string) *nodeVolume {
 	return nil
 }
 
-func (cs *nodeControllerServer) ControllerExpandVolume(context.Context, *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (cs *nodeControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		klog.Errorf("invalid expand volume req: %v", req)
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	asked := req.GetCapacityRange().GetRequiredBytes()
+	if asked <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "required bytes missing in request")
+	}
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && limit < asked {
+		return nil, status.Error(codes.InvalidArgument, "limit bytes smaller than required bytes")
+	}
+
+	// Serialize by VolumeId
+	nodeVolumeMutex.LockKey(req.VolumeId)
+	defer nodeVolumeMutex.UnlockKey(req.VolumeId) //nolint: errcheck
+
+	klog.V(4).Infof("Node ControllerExpandVolume: volumeID: %v required: %v", req.VolumeId, asked)
+	vol := cs.getVolumeByID(req.VolumeId)
+	if vol == nil {
+		return nil, status.Error(codes.NotFound, "Volume not created by this controller")
+	}
+
+	if err := cs.dm.ResizeDevice(req.VolumeId, uint64(asked)); err != nil {
+		switch {
+		case errors.Is(err, pmdmanager.ErrNotEnoughSpace):
+			return nil, status.Errorf(codes.OutOfRange, "Node ControllerExpandVolume: %v", err)
+		case errors.Is(err, pmdmanager.ErrDeviceInUse):
+			// Happens in direct device mode, which does not
+			// support online expansion.
+			return nil, status.Errorf(codes.FailedPrecondition, "Node ControllerExpandVolume: volume must not be in use while expanding it: %v", err)
+		case errors.Is(err, pmdmanager.ErrDeviceNotFound):
+			return nil, status.Errorf(codes.NotFound, "Node ControllerExpandVolume: %v", err)
+		default:
+			return nil, status.Errorf(codes.Internal, "Node ControllerExpandVolume: %v", err)
+		}
+	}
+
+	if vol.Size < asked {
+		resized := *vol
+		resized.Size = asked
+		if cs.sm != nil {
+			// The device itself is already resized, so a
+			// failure here only means that a restarted
+			// driver reports the old size.
+			if err := cs.sm.Update(vol.ID, resized); err != nil {
+				klog.Warningf("Node ControllerExpandVolume: store new state of %s: %v", vol.ID, err)
+			}
+		}
+		cs.mutex.Lock()
+		cs.pmemVolumes[vol.ID] = &resized
+		cs.mutex.Unlock()
+		vol = &resized
+	}
+
+	// Raw block volumes need no further work on the node, file
+	// systems get extended by NodeExpandVolume.
+	nodeExpansion := req.GetVolumeCapability().GetBlock() == nil
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         vol.Size,
+		NodeExpansionRequired: nodeExpansion,
+	}, nil
+}
+
+func (cs *nodeControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		klog.Errorf("invalid create snapshot req: %v", req)
+		return nil, err
+	}
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source volume ID missing in request")
+	}
+
+	// Serialize by name, then by source VolumeId. The name lock
+	// prevents creating the same snapshot twice from different
+	// sources, the source lock prevents deleting the volume while
+	// it gets copied.
+	nodeNameMutex.LockKey(snapshotNameKey(req.Name))
+	defer nodeNameMutex.UnlockKey(snapshotNameKey(req.Name)) //nolint: errcheck
+	nodeVolumeMutex.LockKey(req.SourceVolumeId)
+	defer nodeVolumeMutex.UnlockKey(req.SourceVolumeId) //nolint: errcheck
+
+	klog.V(4).Infof("Node CreateSnapshot: Name:%q source volume:%s", req.Name, req.SourceVolumeId)
+	if snapshot := cs.getSnapshotByName(req.Name); snapshot != nil {
+		if snapshot.SourceVolumeID != req.SourceVolumeId {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot with the same name %q but different source volume already exists", req.Name)
+		}
+		// Idempotent call.
+		return &csi.CreateSnapshotResponse{Snapshot: snapshot.toCSI()}, nil
+	}
+	vol := cs.getVolumeByID(req.SourceVolumeId)
+	if vol == nil {
+		return nil, status.Error(codes.NotFound, "Source volume not created by this controller")
+	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "previously stored volume parameters for volume with ID %q: %v", req.SourceVolumeId, err)
+	}
+
+	snapshotID := GenerateVolumeID("Node CreateSnapshot", req.Name)
+	if cs.getSnapshotByID(snapshotID) != nil || cs.getVolumeByID(snapshotID) != nil {
+		return nil, status.Error(codes.Internal, "SnapshotID/hash collision, can not create unique Snapshot")
+	}
+	snapshot := &nodeSnapshot{
+		ID:             snapshotID,
+		Name:           req.Name,
+		SourceVolumeID: req.SourceVolumeId,
+		Size:           vol.Size,
+		CreationTime:   time.Now(),
+		ErasePolicy:    p.GetErasePolicy(),
+		EraseVerify:    p.GetEraseVerify(),
+	}
+	if cs.ssm != nil {
+		// Persist state before creating the snapshot, for the same
+		// reasons as in createVolumeInternal.
+		if err := cs.ssm.Create(snapshotID, snapshot); err != nil {
+			return nil, status.Error(codes.Internal, "Node CreateSnapshot: "+err.Error())
+		}
+	}
+	if err := cs.snapshots.CreateSnapshot(snapshotID, req.SourceVolumeId); err != nil {
+		if cs.ssm != nil {
+			if err := cs.ssm.Delete(snapshotID); err != nil {
+				klog.Warningf("Delete snapshot state for id '%s' failed with error: %v", snapshotID, err)
+			}
+		}
+		if errors.Is(err, pmdmanager.ErrNotEnoughSpace) {
+			return nil, status.Errorf(codes.ResourceExhausted, "Node CreateSnapshot: %v", err)
+		}
+		if errors.Is(err, pmdmanager.ErrInvalid) {
+			return nil, status.Errorf(codes.InvalidArgument, "Node CreateSnapshot: %v", err)
+		}
+		if errors.Is(err, pmdmanager.ErrDeviceInUse) {
+			return nil, status.Errorf(codes.FailedPrecondition, "Node CreateSnapshot: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "Node CreateSnapshot: snapshot creation failed: %v", err)
+	}
+	if device, err := cs.snapshots.GetSnapshot(snapshotID); err == nil {
+		snapshot.Size = int64(device.Size)
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.pmemSnapshots[snapshotID] = snapshot
+	klog.V(3).Infof("Node CreateSnapshot: Record new snapshot as %v", *snapshot)
+
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot.toCSI()}, nil
+}
+
+func (cs *nodeControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		klog.Errorf("invalid delete snapshot req: %v", req)
+		return nil, err
+	}
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+
+	// Serialize by SnapshotId
+	nodeVolumeMutex.LockKey(req.SnapshotId)
+	defer nodeVolumeMutex.UnlockKey(req.SnapshotId) //nolint: errcheck
+
+	klog.V(4).Infof("Node DeleteSnapshot: snapshotID: %v", req.SnapshotId)
+	snapshot := cs.getSnapshotByID(req.SnapshotId)
+	if snapshot == nil {
+		// Already deleted.
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if err := cs.snapshots.DeleteSnapshot(req.SnapshotId, snapshot.eraseOpts()); err != nil {
+		if errors.Is(err, pmdmanager.ErrDeviceInUse) {
+			return nil, status.Errorf(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to delete snapshot: %s", err.Error())
+	}
+	if cs.ssm != nil {
+		if err := cs.ssm.Delete(req.SnapshotId); err != nil {
+			klog.Warning("Failed to remove snapshot from state: ", err)
+		}
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.pmemSnapshots, req.SnapshotId)
+
+	klog.V(4).Infof("Node DeleteSnapshot: snapshot %s deleted", req.SnapshotId)
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *nodeControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	klog.V(5).Info("ListSnapshots")
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		klog.Errorf("invalid list snapshots req: %v", req)
+		return nil, err
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	// Only the master controller implements pagination.
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snapshot := range cs.pmemSnapshots {
+		if req.SnapshotId != "" && req.SnapshotId != snapshot.ID ||
+			req.SourceVolumeId != "" && req.SourceVolumeId != snapshot.SourceVolumeID {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snapshot.toCSI(),
+		})
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries: entries,
+	}, nil
+}
+
+func (cs *nodeControllerServer) getSnapshotByID(snapshotID string) *nodeSnapshot {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.pmemSnapshots[snapshotID]
+}
+
+// snapshotNameKey separates snapshot names from volume names in
+// nodeNameMutex.
+func snapshotNameKey(name string) string {
+	return "snapshot-name/" + name
+}
+
+func (cs *nodeControllerServer) getSnapshotByName(name string) *nodeSnapshot {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	for _, snapshot := range cs.pmemSnapshots {
+		if snapshot.Name == name {
+			return snapshot
+		}
+	}
+	return nil
+}
+
+// eraseOpts also handles snapshots from older releases.
+func (s *nodeSnapshot) eraseOpts() pmdmanager.EraseOpts {
+	policy := s.ErasePolicy
+	if policy == "" {
+		policy = parameters.EraseHeader
+		if s.EraseAfter {
+			policy = parameters.EraseRandom
+		}
+	}
+	return eraseOpts(policy, s.EraseVerify)
+}
+
+func eraseOpts(policy parameters.Erase, verify bool) pmdmanager.EraseOpts {
+	return pmdmanager.EraseOpts{
+		Policy: pmdmanager.ErasePolicy(policy),
+		Verify: verify,
+	}
+}
+
+// erasesEntireDevice is true for policies which may take a long time.
+func erasesEntireDevice(policy pmdmanager.ErasePolicy) bool {
+	switch policy {
+	case pmdmanager.EraseNone, pmdmanager.EraseHeader:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *nodeSnapshot) toCSI() *csi.Snapshot {
+	creationTime, err := ptypes.TimestampProto(s.CreationTime)
+	if err != nil {
+		klog.Warningf("Snapshot %s: invalid creation time: %v", s.ID, err)
+	}
+	return &csi.Snapshot{
+		SnapshotId:     s.ID,
+		SourceVolumeId: s.SourceVolumeID,
+		SizeBytes:      s.Size,
+		CreationTime:   creationTime,
+		// The copy is complete when CreateSnapshot returns.
+		ReadyToUse: true,
+	}
 }
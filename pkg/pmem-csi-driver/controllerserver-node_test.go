@@ -0,0 +1,235 @@
+/*
+Copyright 2020 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+func TestCreateVolumeDeviceMode(t *testing.T) {
+	lvm := newFakeDeviceManager()
+	direct := newFakeDeviceManager()
+	direct.capacity = 1 << 20
+	dm, err := pmdmanager.NewPmemDeviceManagerMulti([]pmdmanager.Backend{
+		{Name: "lvm", DeviceManager: lvm},
+		{Name: "direct", DeviceManager: direct},
+	})
+	require.NoError(t, err, "create device manager")
+	cs := NewNodeControllerServer("node", dm, nil, nil, nil)
+
+	ctx := context.Background()
+	createVolume := func(name string, params map[string]string) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024},
+			VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+			Parameters:         params,
+		})
+	}
+
+	resp, err := createVolume("pvc-default", nil)
+	require.NoError(t, err, "create volume with default device mode")
+	assert.True(t, lvm.hasDevice(resp.Volume.VolumeId), "volume in default device manager")
+	resp, err = createVolume("pvc-direct", map[string]string{"deviceMode": "direct"})
+	require.NoError(t, err, "create volume in direct mode")
+	assert.True(t, direct.hasDevice(resp.Volume.VolumeId), "volume in direct device manager")
+	_, err = createVolume("pvc-simulated", map[string]string{"deviceMode": "simulated"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "unavailable device mode: %v", err)
+
+	list, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err, "list volumes")
+	modes := map[string]string{}
+	for _, entry := range list.Entries {
+		modes[entry.Volume.VolumeContext["name"]] = entry.Volume.VolumeContext["deviceMode"]
+	}
+	assert.Equal(t, map[string]string{"pvc-default": "lvm", "pvc-direct": "direct"}, modes, "device modes")
+
+	// Each device manager has one volume.
+	for mode, expected := range map[string]int64{
+		"":          1<<30 - 1024,
+		"lvm":       1<<30 - 1024,
+		"direct":    1<<20 - 1024,
+		"simulated": 0,
+	} {
+		req := &csi.GetCapacityRequest{}
+		if mode != "" {
+			req.Parameters = map[string]string{"deviceMode": mode}
+		}
+		capacity, err := cs.GetCapacity(ctx, req)
+		if assert.NoError(t, err, "capacity for device mode %q", mode) {
+			assert.Equal(t, expected, capacity.AvailableCapacity, "capacity for device mode %q", mode)
+		}
+	}
+}
+
+func TestCreateVolumeContentSource(t *testing.T) {
+	cs := NewNodeControllerServer("node", newFakeDeviceManager(), nil, nil, nil)
+	ctx := context.Background()
+	createVolume := func(name string, source *csi.VolumeContentSource) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: 1024},
+			VolumeCapabilities:  []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+			VolumeContentSource: source,
+		})
+	}
+	volumeSource := func(id string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: id},
+			},
+		}
+	}
+
+	src1, err := createVolume("pvc-src-1", nil)
+	require.NoError(t, err, "create first source")
+	src2, err := createVolume("pvc-src-2", nil)
+	require.NoError(t, err, "create second source")
+	clone, err := createVolume("pvc-clone", volumeSource(src1.Volume.VolumeId))
+	require.NoError(t, err, "create clone")
+
+	again, err := createVolume("pvc-clone", volumeSource(src1.Volume.VolumeId))
+	require.NoError(t, err, "create clone again")
+	assert.Equal(t, clone.Volume.VolumeId, again.Volume.VolumeId, "idempotent call")
+	_, err = createVolume("pvc-clone", volumeSource(src2.Volume.VolumeId))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "different source: %v", err)
+	_, err = createVolume("pvc-clone", nil)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "without source: %v", err)
+	_, err = createVolume("pvc-src-1", volumeSource(src2.Volume.VolumeId))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "source added: %v", err)
+
+	list, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err, "list volumes")
+	sources := map[string]string{}
+	for _, entry := range list.Entries {
+		sources[entry.Volume.VolumeContext["name"]] = entry.Volume.ContentSource.GetVolume().GetVolumeId()
+	}
+	assert.Equal(t, map[string]string{"pvc-src-1": "", "pvc-src-2": "", "pvc-clone": src1.Volume.VolumeId}, sources, "content sources")
+}
+
+func TestCreateVolumeNumaNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "numa-node")
+	require.NoError(t, err, "create temp dir")
+	defer os.RemoveAll(dir)
+
+	dm := newFakeDeviceManager()
+	dm.numaNode = 1
+	sm := newTestState(t, filepath.Join(dir, "volumes"))
+	cs := NewNodeControllerServer("node", dm, sm, nil, nil)
+	ctx := context.Background()
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+	})
+	require.NoError(t, err, "create volume")
+	assert.Equal(t, "1", resp.Volume.VolumeContext["numaNode"], "NUMA node in response")
+
+	// The master controller rebuilds its state from ListVolumes
+	// after a restart of the node.
+	cs = NewNodeControllerServer("node", dm, sm, nil, nil)
+	list, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err, "list volumes")
+	require.Len(t, list.Entries, 1, "volumes")
+	assert.Equal(t, "1", list.Entries[0].Volume.VolumeContext["numaNode"], "NUMA node in volume context")
+}
+
+func TestRestoreCorruptedState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore-state")
+	require.NoError(t, err, "create temp dir")
+	defer os.RemoveAll(dir)
+
+	dm := newFakeDeviceManager()
+	for _, name := range []string{"vol1", "vol2"} {
+		require.NoError(t, dm.CreateDevice(name, 4096, pmdmanager.CreateDeviceOpts{}), "create %s", name)
+	}
+	sm := newTestState(t, filepath.Join(dir, "volumes"))
+	esm := newTestState(t, filepath.Join(dir, "erase"))
+	params := map[string]string{"name": "pvc-1", "erasePolicy": "zero"}
+	require.NoError(t, sm.Create("vol1", &nodeVolume{ID: "vol1", Size: 1024, Params: params}), "vol1 state")
+	require.NoError(t, sm.Create("vol2", &nodeVolume{ID: "vol2", Size: 2048}), "vol2 state")
+	require.NoError(t, esm.Create("vol3", &eraseEntry{ID: "vol3", Size: 1024, Policy: pmdmanager.EraseZero}), "vol3 state")
+	// Simulates files that were only partially written.
+	for _, file := range []string{
+		filepath.Join(dir, "volumes", "vol2.json"),
+		filepath.Join(dir, "erase", "vol3.json"),
+	} {
+		require.NoError(t, os.Truncate(file, 10), "truncate %s", file)
+	}
+
+	q := newEraseQueue(dm, esm)
+	assert.True(t, q.isPending("vol3"), "erase entry kept")
+	entry := &eraseEntry{}
+	if assert.NoError(t, esm.Get("vol3", entry), "erase entry stored again") {
+		assert.Equal(t, pmdmanager.EraseRandom, entry.Policy, "erase policy of recovered entry")
+	}
+
+	cs := NewNodeControllerServer("node", dm, sm, nil, nil)
+	assert.Equal(t, &nodeVolume{ID: "vol1", Size: 1024, Params: params}, cs.getVolumeByID("vol1"), "intact volume")
+	recovered := &nodeVolume{ID: "vol2", Size: 4096, Params: map[string]string{}}
+	assert.Equal(t, recovered, cs.getVolumeByID("vol2"), "recovered volume")
+	vol := &nodeVolume{}
+	if assert.NoError(t, sm.Get("vol2", vol), "recovered volume stored again") {
+		assert.Equal(t, recovered, vol, "stored volume")
+	}
+	quarantined, err := ioutil.ReadDir(filepath.Join(dir, "volumes", "quarantine"))
+	require.NoError(t, err, "read quarantine directory")
+	assert.Len(t, quarantined, 1, "quarantined files")
+}
+
+func TestRestoreFromMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore-metadata")
+	require.NoError(t, err, "create temp dir")
+	defer os.RemoveAll(dir)
+
+	dm := newFakeDeviceManager()
+	cs := NewNodeControllerServer("node", dm, newTestState(t, filepath.Join(dir, "old")), nil, nil)
+	ctx := context.Background()
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+		Parameters:         map[string]string{"erasePolicy": "zero"},
+	})
+	require.NoError(t, err, "create volume")
+	volumeID := resp.Volume.VolumeId
+	dev, err := dm.GetDevice(volumeID)
+	require.NoError(t, err, "get device")
+	require.NotNil(t, dev.Metadata, "device metadata")
+	assert.Equal(t, "pvc-1", dev.Metadata.Name, "name in metadata")
+	assert.Equal(t, "node", dev.Metadata.Owner, "owner in metadata")
+	assert.False(t, dev.Metadata.Created.IsZero(), "creation time in metadata")
+	// A device without metadata, for example from an older release.
+	require.NoError(t, dm.CreateDevice("vol-old", 4096, pmdmanager.CreateDeviceOpts{}), "create old device")
+
+	// Restart with empty state directory.
+	sm := newTestState(t, filepath.Join(dir, "new"))
+	cs = NewNodeControllerServer("node", dm, sm, nil, nil)
+	expected := &nodeVolume{
+		ID:     volumeID,
+		Size:   1024,
+		Params: map[string]string{"name": "pvc-1", "erasePolicy": "zero"},
+	}
+	assert.Equal(t, expected, cs.getVolumeByID(volumeID), "restored volume")
+	assert.Nil(t, cs.getVolumeByID("vol-old"), "device without metadata")
+	vol := &nodeVolume{}
+	if assert.NoError(t, sm.Get(volumeID, vol), "restored volume stored") {
+		assert.Equal(t, expected, vol, "stored volume")
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2020 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+const (
+	// Delay before erasing a device again after a failure,
+	// doubled for each further failure up to eraseMaxRetryDelay.
+	eraseRetryDelay    = 10 * time.Second
+	eraseMaxRetryDelay = 10 * time.Minute
+)
+
+var (
+	pendingEraseBytes = prometheus.NewDesc(
+		"pmem_erase_pending_bytes",
+		"Size of the deleted volumes which still get erased. The space becomes free once that is done.",
+		nil, nil,
+	)
+	pendingEraseVolumes = prometheus.NewDesc(
+		"pmem_erase_pending_volumes",
+		"Number of deleted volumes which still get erased.",
+		nil, nil,
+	)
+)
+
+// eraseEntry is persisted for each deleted volume until its device
+// has been erased and removed.
+type eraseEntry struct {
+	ID    string    `json:"id"`
+	Size  int64     `json:"size"`
+	Since time.Time `json:"since"`
+	// Policy is empty for entries written by older releases,
+	// which always overwrote with random data.
+	Policy pmdmanager.ErasePolicy `json:"policy,omitempty"`
+	Verify bool                   `json:"verify,omitempty"`
+
+	// failures counts failed attempts since the driver started.
+	failures int
+	// retryAfter is the earliest time for the next attempt.
+	retryAfter time.Time
+}
+
+// eraseQueue erases and removes the devices of deleted volumes in the
+// background, one at a time and oldest first. Entries are stored in
+// the state manager before DeleteVolume returns, so erasing resumes
+// after a restart of the driver.
+type eraseQueue struct {
+	dm pmdmanager.PmemDeviceManager
+	sm pmemstate.StateManager
+	// retryDelay is eraseRetryDelay, except in tests.
+	retryDelay time.Duration
+
+	mutex   sync.Mutex
+	pending map[string]*eraseEntry
+
+	wakeup  chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+var _ prometheus.Collector = &eraseQueue{}
+
+// newEraseQueue loads the entries which were left behind by a previous
+// instance of the driver. The worker must be started with start.
+func newEraseQueue(dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager) *eraseQueue {
+	q := &eraseQueue{
+		dm:         dm,
+		sm:         sm,
+		retryDelay: eraseRetryDelay,
+		pending:    map[string]*eraseEntry{},
+		wakeup:     make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	ids, err := sm.GetAll()
+	if err != nil {
+		klog.Warningf("Failed to load erase queue: %v", err)
+	}
+	for _, id := range ids {
+		entry := &eraseEntry{}
+		if err := sm.Get(id, entry); err != nil {
+			// Better erase too much than leaking data,
+			// so keep the entry without a size.
+			klog.Warningf("Failed to retrieve erase queue entry for id %q: %v", id, err)
+			entry = &eraseEntry{ID: id, Since: time.Now()}
+			if errors.Is(err, pmemstate.ErrCorrupted) {
+				// Must be stored again, otherwise the
+				// entry is lost after the next restart.
+				entry.Policy = pmdmanager.EraseRandom
+				if err := sm.Update(id, entry); err != nil {
+					klog.Warningf("Failed to store recovered erase queue entry for id %q: %v", id, err)
+				}
+			}
+		}
+		if entry.Policy == "" {
+			entry.Policy = pmdmanager.EraseRandom
+		}
+		q.pending[id] = entry
+	}
+	if len(q.pending) > 0 {
+		klog.V(2).Infof("Erase queue: resuming with %d device(s)", len(q.pending))
+	}
+	return q
+}
+
+func (q *eraseQueue) start() {
+	go q.run()
+}
+
+// shutdown stops the worker after it is done with the current device.
+func (q *eraseQueue) shutdown() {
+	close(q.stop)
+	<-q.stopped
+}
+
+// add persists a new entry for the volume.
+func (q *eraseQueue) add(id string, size int64, erase pmdmanager.EraseOpts) error {
+	entry := &eraseEntry{
+		ID:     id,
+		Size:   size,
+		Since:  time.Now(),
+		Policy: erase.Policy,
+		Verify: erase.Verify,
+	}
+	if err := q.sm.Create(id, entry); err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	q.pending[id] = entry
+	q.mutex.Unlock()
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	klog.V(3).Infof("Erase queue: volume %s of size %d added with policy %s", id, size, erase.Policy)
+	return nil
+}
+
+// isPending checks whether the device of the volume still exists
+// because it waits for erasing.
+func (q *eraseQueue) isPending(id string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, ok := q.pending[id]
+	return ok
+}
+
+// pendingSize returns the number of pending entries and their total size.
+func (q *eraseQueue) pendingSize() (int, int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var size int64
+	for _, entry := range q.pending {
+		size += entry.Size
+	}
+	return len(q.pending), size
+}
+
+func (q *eraseQueue) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingEraseBytes
+	ch <- pendingEraseVolumes
+}
+
+func (q *eraseQueue) Collect(ch chan<- prometheus.Metric) {
+	count, size := q.pendingSize()
+	ch <- prometheus.MustNewConstMetric(pendingEraseBytes, prometheus.GaugeValue, float64(size))
+	ch <- prometheus.MustNewConstMetric(pendingEraseVolumes, prometheus.GaugeValue, float64(count))
+}
+
+func (q *eraseQueue) run() {
+	defer close(q.stopped)
+	for {
+		entry, delay := q.next()
+		if entry == nil {
+			var timeout <-chan time.Time
+			if delay > 0 {
+				timeout = time.After(delay)
+			}
+			select {
+			case <-q.stop:
+				return
+			case <-q.wakeup:
+			case <-timeout:
+			}
+			continue
+		}
+		q.erase(entry)
+
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+	}
+}
+
+// next returns the oldest entry which may be erased now. Otherwise it
+// returns how long to wait for the next retry, zero if there is
+// nothing to do.
+func (q *eraseQueue) next() (*eraseEntry, time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	var next *eraseEntry
+	var delay time.Duration
+	for _, entry := range q.pending {
+		if entry.retryAfter.After(now) {
+			if d := entry.retryAfter.Sub(now); delay == 0 || d < delay {
+				delay = d
+			}
+			continue
+		}
+		if next == nil || entry.Since.Before(next.Since) {
+			next = entry
+		}
+	}
+	return next, delay
+}
+
+func (q *eraseQueue) erase(entry *eraseEntry) {
+	klog.V(3).Infof("Erase queue: erasing volume %s", entry.ID)
+	start := time.Now()
+	erase := pmdmanager.EraseOpts{Policy: entry.Policy, Verify: entry.Verify}
+	if err := q.dm.DeleteDevice(entry.ID, erase); err != nil {
+		q.mutex.Lock()
+		entry.failures++
+		delay := q.retryDelay << uint(entry.failures-1)
+		if delay > eraseMaxRetryDelay || delay <= 0 {
+			delay = eraseMaxRetryDelay
+		}
+		entry.retryAfter = time.Now().Add(delay)
+		q.mutex.Unlock()
+		klog.Warningf("Erase queue: erasing volume %s failed, trying again in %v: %v", entry.ID, delay, err)
+		return
+	}
+	if err := q.sm.Delete(entry.ID); err != nil {
+		// The device is gone, so the stale entry
+		// only causes a no-op after a restart.
+		klog.Warningf("Erase queue: failed to remove volume %s from state: %v", entry.ID, err)
+	}
+
+	q.mutex.Lock()
+	delete(q.pending, entry.ID)
+	q.mutex.Unlock()
+	klog.V(3).Infof("Erase queue: volume %s erased and deleted in %v", entry.ID, time.Since(start))
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2020 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// fakeDeviceManager keeps devices in memory. deleteDevice, if set,
+// gets called by DeleteDevice before removing a device. New devices
+// end up on numaNode unless a NUMA node is requested. Their size is
+// not included in the free capacity.
+type fakeDeviceManager struct {
+	mutex        sync.Mutex
+	capacity     uint64
+	numaNode     int
+	devices      map[string]*pmdmanager.PmemDeviceInfo
+	deleteDevice func(name string, erase pmdmanager.EraseOpts) error
+}
+
+var _ pmdmanager.PmemDeviceManager = &fakeDeviceManager{}
+
+func newFakeDeviceManager() *fakeDeviceManager {
+	return &fakeDeviceManager{capacity: 1 << 30, numaNode: -1, devices: map[string]*pmdmanager.PmemDeviceInfo{}}
+}
+
+func (dm *fakeDeviceManager) GetCapacity(opts pmdmanager.CapacityOpts) (pmdmanager.Capacity, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	free := dm.capacity
+	for _, dev := range dm.devices {
+		free -= dev.Size
+	}
+	return pmdmanager.Capacity{Total: free, Largest: free}, nil
+}
+
+func (dm *fakeDeviceManager) CreateDevice(name string, size uint64, opts pmdmanager.CreateDeviceOpts) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if _, ok := dm.devices[name]; ok {
+		return pmdmanager.ErrDeviceExists
+	}
+	numaNode := dm.numaNode
+	if opts.NumaNode != nil {
+		numaNode = *opts.NumaNode
+	}
+	dm.devices[name] = &pmdmanager.PmemDeviceInfo{VolumeId: name, Path: "/dev/" + name, Size: size, NumaNode: numaNode, Metadata: opts.Metadata}
+	return nil
+}
+
+func (dm *fakeDeviceManager) GetDevice(name string) (*pmdmanager.PmemDeviceInfo, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if dev, ok := dm.devices[name]; ok {
+		return dev, nil
+	}
+	return nil, pmdmanager.ErrDeviceNotFound
+}
+
+func (dm *fakeDeviceManager) ResizeDevice(name string, size uint64) error {
+	return errors.New("not implemented")
+}
+
+func (dm *fakeDeviceManager) CopyDevice(name string, source *pmdmanager.PmemDeviceInfo) error {
+	if !dm.hasDevice(name) {
+		return pmdmanager.ErrDeviceNotFound
+	}
+	return nil
+}
+
+func (dm *fakeDeviceManager) DeleteDevice(name string, erase pmdmanager.EraseOpts) error {
+	if dm.deleteDevice != nil {
+		if err := dm.deleteDevice(name, erase); err != nil {
+			return err
+		}
+	}
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	delete(dm.devices, name)
+	return nil
+}
+
+func (dm *fakeDeviceManager) ListDevices() ([]*pmdmanager.PmemDeviceInfo, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	devices := []*pmdmanager.PmemDeviceInfo{}
+	for _, dev := range dm.devices {
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+func (dm *fakeDeviceManager) hasDevice(name string) bool {
+	_, err := dm.GetDevice(name)
+	return err == nil
+}
+
+func newTestState(t *testing.T, dir string) pmemstate.StateManager {
+	sm, err := pmemstate.NewFileState(dir)
+	require.NoError(t, err, "create state in %s", dir)
+	return sm
+}
+
+// waitFor polls until the condition is true and fails the test
+// after a timeout.
+func waitFor(t *testing.T, condition func() bool, what string) {
+	for start := time.Now(); !condition(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			require.FailNow(t, "timed out waiting: "+what)
+		}
+	}
+}
+
+func TestEraseQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "erase-queue")
+	require.NoError(t, err, "create temp dir")
+	defer os.RemoveAll(dir)
+
+	dm := newFakeDeviceManager()
+	for _, name := range []string{"vol1", "vol2", "vol3"} {
+		require.NoError(t, dm.CreateDevice(name, 1024, pmdmanager.CreateDeviceOpts{}), "create %s", name)
+	}
+	failures := 1
+	policies := map[string]pmdmanager.EraseOpts{}
+	dm.deleteDevice = func(name string, erase pmdmanager.EraseOpts) error {
+		policies[name] = erase
+		if name == "vol2" && failures > 0 {
+			failures--
+			return pmdmanager.ErrDeviceInUse
+		}
+		return nil
+	}
+
+	// An entry left behind by a previous instance.
+	sm := newTestState(t, dir)
+	require.NoError(t, sm.Create("vol1", &eraseEntry{ID: "vol1", Size: 1024, Since: time.Now()}), "old entry")
+
+	q := newEraseQueue(dm, sm)
+	q.retryDelay = time.Millisecond
+	count, size := q.pendingSize()
+	assert.Equal(t, 1, count, "resumed entries")
+	assert.Equal(t, int64(1024), size, "resumed size")
+	require.NoError(t, q.add("vol2", 2048, pmdmanager.EraseOpts{Policy: pmdmanager.EraseRandom}), "add vol2")
+	require.NoError(t, q.add("vol3", 4096, pmdmanager.EraseOpts{Policy: pmdmanager.EraseZero, Verify: true}), "add vol3")
+	assert.True(t, q.isPending("vol3"), "vol3 pending")
+	assert.NoError(t, testutil.CollectAndCompare(q, strings.NewReader(`
+# HELP pmem_erase_pending_bytes Size of the deleted volumes which still get erased. The space becomes free once that is done.
+# TYPE pmem_erase_pending_bytes gauge
+pmem_erase_pending_bytes 7168
+# HELP pmem_erase_pending_volumes Number of deleted volumes which still get erased.
+# TYPE pmem_erase_pending_volumes gauge
+pmem_erase_pending_volumes 3
+`)), "metrics")
+
+	q.start()
+	defer q.shutdown()
+	waitFor(t, func() bool {
+		count, _ := q.pendingSize()
+		return count == 0
+	}, "all devices erased")
+	assert.Zero(t, failures, "vol2 failed once")
+	assert.Equal(t, map[string]pmdmanager.EraseOpts{
+		"vol1": {Policy: pmdmanager.EraseRandom},
+		"vol2": {Policy: pmdmanager.EraseRandom},
+		"vol3": {Policy: pmdmanager.EraseZero, Verify: true},
+	}, policies, "erase options")
+	for _, name := range []string{"vol1", "vol2", "vol3"} {
+		assert.False(t, dm.hasDevice(name), "%s deleted", name)
+	}
+	ids, err := sm.GetAll()
+	require.NoError(t, err, "get state")
+	assert.Empty(t, ids, "state after erasing")
+}
+
+func TestDeleteVolumeErase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delete-volume")
+	require.NoError(t, err, "create temp dir")
+	defer os.RemoveAll(dir)
+
+	dm := newFakeDeviceManager()
+	erasing := make(chan string, 10)
+	finishErase := make(chan struct{})
+	deleted := make(chan pmdmanager.EraseOpts, 10)
+	dm.deleteDevice = func(name string, erase pmdmanager.EraseOpts) error {
+		deleted <- erase
+		if erase.Policy != pmdmanager.EraseHeader {
+			erasing <- name
+			<-finishErase
+		}
+		return nil
+	}
+	sm := newTestState(t, filepath.Join(dir, "volumes"))
+	esm := newTestState(t, filepath.Join(dir, "erase"))
+	cs := NewNodeControllerServer("node", dm, sm, nil, esm)
+	defer cs.eraseQueue.shutdown()
+
+	ctx := context.Background()
+	createReq := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+		Parameters:         map[string]string{"eraseafter": "true"},
+	}
+	resp, err := cs.CreateVolume(ctx, createReq)
+	require.NoError(t, err, "create volume")
+	volumeID := resp.Volume.VolumeId
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err, "delete volume")
+	assert.Equal(t, volumeID, <-erasing, "erasing in the background")
+	assert.Equal(t, pmdmanager.EraseOpts{Policy: pmdmanager.EraseRandom}, <-deleted, "eraseafter=true")
+	assert.Nil(t, cs.getVolumeByID(volumeID), "volume removed")
+	count, size := cs.eraseQueue.pendingSize()
+	assert.Equal(t, 1, count, "pending volumes")
+	assert.Equal(t, int64(1024), size, "pending size")
+	capacity, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	require.NoError(t, err, "get capacity while erasing")
+	assert.Equal(t, int64(dm.capacity)-1024, capacity.AvailableCapacity, "capacity without the volume which gets erased")
+
+	_, err = cs.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.Aborted, status.Code(err), "recreate while erasing: %v", err)
+
+	close(finishErase)
+	waitFor(t, func() bool {
+		return !cs.eraseQueue.isPending(volumeID)
+	}, "volume erased")
+	assert.False(t, dm.hasDevice(volumeID), "device deleted")
+	capacity, err = cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	require.NoError(t, err, "get capacity after erasing")
+	assert.Equal(t, int64(dm.capacity), capacity.AvailableCapacity, "capacity after erasing")
+	_, err = cs.CreateVolume(ctx, createReq)
+	assert.NoError(t, err, "recreate after erasing")
+
+	// The erase policy replaces eraseafter.
+	createReq.Name = "pvc-3"
+	createReq.Parameters = map[string]string{"erasePolicy": "discard", "eraseVerify": "true"}
+	resp, err = cs.CreateVolume(ctx, createReq)
+	require.NoError(t, err, "create volume")
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	require.NoError(t, err, "delete volume")
+	assert.Equal(t, resp.Volume.VolumeId, <-erasing, "erasing in the background")
+	assert.Equal(t, pmdmanager.EraseOpts{Policy: pmdmanager.EraseDiscard, Verify: true}, <-deleted, "erasePolicy=discard")
+
+	// Without eraseafter, the device gets deleted immediately.
+	createReq.Name = "pvc-2"
+	createReq.Parameters = map[string]string{"eraseafter": "false"}
+	resp, err = cs.CreateVolume(ctx, createReq)
+	require.NoError(t, err, "create volume")
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	require.NoError(t, err, "delete volume")
+	assert.False(t, dm.hasDevice(resp.Volume.VolumeId), "device deleted")
+	assert.Equal(t, pmdmanager.EraseOpts{Policy: pmdmanager.EraseHeader}, <-deleted, "eraseafter=false")
+}
@@ -8,6 +8,7 @@ package pmemcsidriver
 
 import (
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
@@ -16,6 +17,8 @@ type identityServer struct {
 	name       string
 	version    string
 	pluginCaps []*csi.PluginCapability
+	// ready is reported by Probe, if set.
+	ready func() bool
 }
 
 var _ PmemService = &identityServer{}
@@ -39,6 +42,13 @@ func NewIdentityServer(name, version string) (*identityServer, error) {
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -55,7 +65,11 @@ func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 }
 
 func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	resp := &csi.ProbeResponse{}
+	if ids.ready != nil {
+		resp.Ready = &wrappers.BoolValue{Value: ids.ready()}
+	}
+	return resp, nil
 }
 
 func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
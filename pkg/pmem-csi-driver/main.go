@@ -11,6 +11,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"time"
 
 	"k8s.io/klog"
 
@@ -22,6 +23,7 @@ var (
 	config = Config{
 		Mode:          Controller,
 		DeviceManager: LVM,
+		StateStore:    FileStore,
 	}
 	showVersion = flag.Bool("version", false, "Show release version and exit")
 	version     = "unknown" // Set version during build time
@@ -42,8 +44,24 @@ func init() {
 	flag.StringVar(&config.ClientKeyFile, "clientKeyFile", "", "Client private key associated to client certificate, defaults to 'keyFile'")
 	/* Node mode options */
 	flag.StringVar(&config.ControllerEndpoint, "controllerEndpoint", "", "internal node controller endpoint")
-	flag.Var(&config.DeviceManager, "deviceManager", "device manager to use to manage pmem devices, supported types: 'lvm' or 'direct' (= 'ndctl')")
+	flag.Var(&config.DeviceManager, "deviceManager", "device manager to use to manage pmem devices, supported types: 'lvm', 'direct' (= 'ndctl') or 'simulated'")
+	flag.Var(&config.DeviceManagerRegions, "deviceManagerRegions", "<device manager>=<region>[,<region>...]: restricts a device manager to the listed regions and, if it is not the one selected with -deviceManager, runs it in addition, can be repeated")
+	flag.BoolVar(&config.LVMThin, "lvmThin", false, "create thin volumes in the thin pools prepared with 'pmem-vgm -thinpool' in 'lvm' device mode")
+	flag.Float64Var(&config.LVMThinOpts.Overcommit, "lvmThinOvercommit", 1, "how much larger the total size of the volumes in a thin pool may be than the pool itself, 1 for no overcommitment")
+	flag.Float64Var(&config.LVMThinOpts.WarningWatermark, "lvmThinWarningWatermark", 75, "usage of a thin pool in percent above which an alarm gets raised")
+	flag.Float64Var(&config.LVMThinOpts.HighWatermark, "lvmThinHighWatermark", 90, "usage of a thin pool in percent above which no new volumes get created in it")
 	flag.StringVar(&config.StateBasePath, "statePath", "", "Directory path where to persist the state of the driver running on a node, defaults to /var/lib/<drivername>")
+	flag.Var(&config.StateStore, "stateStore", "where to persist the state of the driver running on a node in addition to <statePath>: 'file' (nowhere else) or 'configmap' (per-node ConfigMaps)")
+	flag.StringVar(&config.StateNamespace, "stateNamespace", "default", "namespace of the ConfigMaps for '-stateStore=configmap'")
+	flag.StringVar(&config.SimulatedPath, "simulatedPath", "", "Directory for the files backing the loop devices in 'simulated' device mode, defaults to <statePath>/simulated")
+	flag.StringVar(&config.SimulatedCapacity, "simulatedCapacity", "4Gi", "Total size of the PMEM that is provided in 'simulated' device mode")
+	flag.BoolVar(&config.AvoidBadblocks, "avoidBadblocks", false, "do not create new volumes in regions (direct mode) or physical volumes (LVM mode) with known bad blocks")
+	flag.DurationVar(&config.OrphanGracePeriod, "orphanGracePeriod", 0, "remove devices which were created by this node and belong to no volume after they were found for this long, 0 for never")
+	flag.BoolVar(&config.OrphanEvents, "orphanEvents", false, "report orphaned and adopted devices as events for the Node object, needs access to the API server")
+	flag.BoolVar(&config.ReconcilePVs, "reconcilePVs", false, "reconstruct the volumes and snapshots known to the controller from PersistentVolumes and VolumeSnapshotContents after a restart, needs access to the API server")
+	flag.DurationVar(&config.ReconcileTimeout, "reconcileTimeout", 2*time.Minute, "how long the controller refuses to create and delete volumes and snapshots after a restart while nodes with the driver have not registered")
+	flag.StringVar(&config.Placement, "placement", "first-fit", "placement strategy for new volumes in 'direct' device mode: 'first-fit', 'best-fit' or 'worst-fit' (= 'spread')")
+	flag.StringVar(&config.SysfsRoot, "sysfsRoot", "/sys", "directory where sysfs is mounted, other directories need a driver built without cgo or with the 'sysfs' build tag")
 
 	/* scheduler options */
 	flag.StringVar(&config.schedulerListen, "schedulerListen", "", "listen address (like :8000) for scheduler extender and mutating webhook, disabled by default")
@@ -75,6 +93,52 @@ func Main() int {
 		}
 		config.client = c
 	}
+	if config.ReconcilePVs {
+		if config.Mode != Controller {
+			pmemcommon.ExitError("reconciling PersistentVolumes", errors.New("only supported in the controller"))
+			return 1
+		}
+		if config.client == nil {
+			c, err := k8sutil.NewInClusterClient()
+			if err != nil {
+				pmemcommon.ExitError("reconcile setup", err)
+				return 1
+			}
+			config.client = c
+		}
+		c, err := k8sutil.NewInClusterDynamicClient()
+		if err != nil {
+			pmemcommon.ExitError("reconcile setup", err)
+			return 1
+		}
+		config.dynamicClient = c
+	}
+	if config.StateStore == ConfigMapStore {
+		if config.Mode != Node {
+			pmemcommon.ExitError("state store", errors.New("only supported on nodes"))
+			return 1
+		}
+		c, err := k8sutil.NewInClusterClient()
+		if err != nil {
+			pmemcommon.ExitError("state store setup", err)
+			return 1
+		}
+		config.client = c
+	}
+	if config.OrphanEvents {
+		if config.Mode != Node {
+			pmemcommon.ExitError("orphan events", errors.New("only supported on nodes"))
+			return 1
+		}
+		if config.client == nil {
+			c, err := k8sutil.NewInClusterClient()
+			if err != nil {
+				pmemcommon.ExitError("orphan events setup", err)
+				return 1
+			}
+			config.client = c
+		}
+	}
 
 	config.Version = version
 	driver, err := GetPMEMDriver(config)
@@ -26,6 +26,7 @@ import (
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
 	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -63,6 +64,27 @@ func NewNodeServer(cs *nodeControllerServer) *nodeServer {
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 		cs:      cs,
 		mounter: mount.New(""),
@@ -92,7 +114,67 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 }
 
 func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	// Serialize by VolumeId
+	volumeMutex.LockKey(req.GetVolumeId())
+	defer volumeMutex.UnlockKey(req.GetVolumeId())
+
+	device, err := ns.cs.dm.GetDevice(req.VolumeId)
+	if err != nil {
+		if errors.Is(err, pmdmanager.ErrDeviceNotFound) {
+			return nil, status.Errorf(codes.NotFound, "no device found with volume id '%s': %s", req.VolumeId, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id '%s': %s", req.VolumeId, err.Error())
+	}
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats: %v", err)
+	}
+
+	resp := &csi.NodeGetVolumeStatsResponse{
+		VolumeCondition: volumeCondition(device),
+	}
+	if !info.IsDir() {
+		// Raw block volume, only the size is known.
+		resp.Usage = []*csi.VolumeUsage{
+			{
+				Unit:  csi.VolumeUsage_BYTES,
+				Total: int64(device.Size),
+			},
+		}
+		return resp, nil
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(volumePath, &st); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats: statfs %s: %v", volumePath, err)
+	}
+	resp.Usage = []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(st.Blocks) * int64(st.Bsize),
+			Available: int64(st.Bavail) * int64(st.Bsize),
+			Used:      int64(st.Blocks-st.Bfree) * int64(st.Bsize),
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(st.Files),
+			Available: int64(st.Ffree),
+			Used:      int64(st.Files - st.Ffree),
+		},
+	}
+	return resp, nil
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -153,7 +235,9 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return nil, err
 		}
 		srcPath = device.Path
-		mountFlags = append(mountFlags, "dax")
+		if device.Dax {
+			mountFlags = append(mountFlags, "dax")
+		}
 	} else {
 		// Validate parameters. We don't actually use any of them here, but a sanity check is worthwhile anyway.
 		if _, err := parameters.Parse(parameters.PersistentVolumeOrigin, req.GetVolumeContext()); err != nil {
@@ -180,7 +264,9 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 
 	switch req.VolumeCapability.GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
-		// For block volumes, source path is the actual Device path
+		// For block volumes, source path is the actual Device path.
+		// For devdax volumes, that is a character device, which
+		// gets bind-mounted the same way.
 		srcPath = device.Path
 		targetDir := filepath.Dir(targetPath)
 		// Make sure that parent directory of target path is existing, otherwise create it
@@ -202,6 +288,9 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		if !ephemeral && len(srcPath) == 0 {
 			return nil, status.Error(codes.FailedPrecondition, "Staging target path missing in request")
 		}
+		if device.CharDev {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %q is a character device and cannot be mounted", req.VolumeId)
+		}
 
 		notMnt, err := mount.IsNotMountPoint(ns.mounter, targetPath)
 		if err != nil && !os.IsNotExist(err) {
@@ -351,6 +440,9 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		}
 		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", req.VolumeId, err)
 	}
+	if device.CharDev {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %q is a character device and cannot hold a filesystem", req.VolumeId)
+	}
 
 	// Check does devicepath already contain a filesystem?
 	existingFsType, err := determineFilesystemType(device.Path)
@@ -372,7 +464,9 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		}
 	}
 
-	mountOptions = append(mountOptions, "dax")
+	if device.Dax {
+		mountOptions = append(mountOptions, "dax")
+	}
 
 	if err = ns.mount(device.Path, stagingtargetPath, mountOptions); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -428,8 +522,86 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	// Serialize by VolumeId
+	volumeMutex.LockKey(req.GetVolumeId())
+	defer volumeMutex.UnlockKey(req.GetVolumeId())
+
+	klog.V(4).Infof("NodeExpandVolume: VolumeID:%v volume path:%v", req.GetVolumeId(), volumePath)
+
+	device, err := ns.cs.dm.GetDevice(req.VolumeId)
+	if err != nil {
+		if errors.Is(err, pmdmanager.ErrDeviceNotFound) {
+			return nil, status.Errorf(codes.NotFound, "no device found with volume id '%s': %s", req.VolumeId, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id '%s': %s", req.VolumeId, err.Error())
+	}
+	resp := &csi.NodeExpandVolumeResponse{
+		CapacityBytes: int64(device.Size),
+	}
+
+	// Nothing to do for raw block volumes, the device itself
+	// was already resized by ControllerExpandVolume.
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return resp, nil
+	}
+
+	fsType, err := determineFilesystemType(device.Path)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeExpandVolume: %v", err)
+	}
+	// Both file systems support growing while mounted, so the
+	// existing (dax) mount remains in place.
+	switch fsType {
+	case "ext4":
+		_, err = pmemexec.RunCommand("resize2fs", device.Path)
+	case "xfs":
+		// xfs_growfs operates on the mount point. The staging
+		// path is where the file system really gets mounted,
+		// the volume path is just a bind mount.
+		mountPoint := volumePath
+		if stagingPath := req.GetStagingTargetPath(); stagingPath != "" {
+			mountPoint = stagingPath
+		}
+		_, err = pmemexec.RunCommand("xfs_growfs", mountPoint)
+	case "":
+		return nil, status.Errorf(codes.FailedPrecondition, "NodeExpandVolume: no file system found on %s", device.Path)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "NodeExpandVolume: resizing file system %q is not supported", fsType)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeExpandVolume: resize %s file system: %v", fsType, err)
+	}
+
+	klog.V(3).Infof("NodeExpandVolume: %s file system on %s resized to %v", fsType, device.Path, device.Size)
+	return resp, nil
+}
+
+// volumeCondition reports a volume as abnormal when the device
+// has known bad blocks. Applications which access them through a DAX
+// mapping get killed with SIGBUS.
+func volumeCondition(device *pmdmanager.PmemDeviceInfo) *csi.VolumeCondition {
+	if len(device.Badblocks) == 0 {
+		return &csi.VolumeCondition{}
+	}
+	var bad uint64
+	for _, bb := range device.Badblocks {
+		bad += bb.Length
+	}
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf("%d bytes in %d ranges of %s have media errors", bad, len(device.Badblocks), device.Path),
+	}
 }
 
 // createEphemeralDevice creates new pmem device for given req.
@@ -445,6 +617,7 @@ func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePu
 	volumeID, _, err := ns.cs.createVolumeInternal(ctx, p, req.VolumeId,
 		[]*csi.VolumeCapability{req.VolumeCapability},
 		&csi.CapacityRange{RequiredBytes: p.GetSize()},
+		nil,
 	)
 	if err != nil {
 		// This is already a status error.
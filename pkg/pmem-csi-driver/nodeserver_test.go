@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	"github.com/intel/pmem-csi/pkg/pmem-exec/fake"
+)
+
+func TestProvisionDevice(t *testing.T) {
+	const devicePath = "/dev/pmem-fake0"
+
+	cases := map[string]struct {
+		fsType     string
+		failure    string
+		expectedFs string
+		expectErr  bool
+	}{
+		"default": {
+			expectedFs: "ext4",
+		},
+		"ext4": {
+			fsType:     "ext4",
+			expectedFs: "ext4",
+		},
+		"xfs": {
+			fsType:     "xfs",
+			expectedFs: "xfs",
+		},
+		"unsupported": {
+			fsType:    "btrfs",
+			expectErr: true,
+		},
+		"mkfs failure": {
+			fsType:    "ext4",
+			failure:   "mkfs.ext4: Device size reported to be zero.",
+			expectErr: true,
+		},
+	}
+
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			executor := fake.New()
+			executor.AddDevice(devicePath, 1024*1024*1024)
+			defer pmemexec.SetExecutor(pmemexec.SetExecutor(executor))
+			if c.failure != "" {
+				executor.Fail("mkfs."+c.fsType, c.failure)
+			}
+
+			fsType, err := determineFilesystemType(devicePath)
+			require.NoError(t, err, "file system type before provisioning")
+			assert.Empty(t, fsType, "no file system before provisioning")
+
+			ns := &nodeServer{}
+			err = ns.provisionDevice(&pmdmanager.PmemDeviceInfo{VolumeId: "vol", Path: devicePath}, c.fsType)
+			if c.expectErr {
+				require.Error(t, err, "provision device")
+				if c.failure != "" {
+					assert.Contains(t, err.Error(), c.failure, "mkfs output in error")
+				}
+				assert.Empty(t, executor.Filesystem(devicePath), "no file system")
+				return
+			}
+			require.NoError(t, err, "provision device")
+			fsType, err = determineFilesystemType(devicePath)
+			require.NoError(t, err, "file system type after provisioning")
+			assert.Equal(t, c.expectedFs, fsType, "file system type")
+		})
+	}
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2020 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+const (
+	// How often the devices get checked for orphans.
+	orphanCheckInterval = 10 * time.Minute
+)
+
+var (
+	orphanedVolumes = prometheus.NewDesc(
+		"pmem_orphaned_volumes",
+		"Number of devices which belong to no known volume.",
+		nil, nil,
+	)
+	orphanedBytes = prometheus.NewDesc(
+		"pmem_orphaned_bytes",
+		"Size of the devices which belong to no known volume.",
+		nil, nil,
+	)
+	adoptedVolumes = prometheus.NewDesc(
+		"pmem_adopted_volumes_total",
+		"Number of devices without state which were added as volumes because of their metadata.",
+		nil, nil,
+	)
+	deletedOrphans = prometheus.NewDesc(
+		"pmem_deleted_orphans_total",
+		"Number of orphaned devices which were removed after the grace period.",
+		nil, nil,
+	)
+)
+
+// Reasons of the events for the Node object.
+const (
+	eventOrphanedDevice     = "OrphanedDevice"
+	eventAdoptedDevice      = "AdoptedDevice"
+	eventRemovedOrphan      = "RemovedOrphan"
+	eventRemoveOrphanFailed = "RemoveOrphanFailed"
+)
+
+// orphan is a device for which there is no volume.
+type orphan struct {
+	size uint64
+	// since is when the device was first found to be an orphan.
+	since time.Time
+}
+
+// orphanEvent is an event which was found before events could be
+// recorded.
+type orphanEvent struct {
+	eventtype, reason, message string
+}
+
+// orphanReconciler looks for devices which exist without a volume,
+// for example because the driver stopped between creating a device
+// and recording it or because deleting a device failed after the
+// volume was already removed.
+//
+// Only devices whose metadata names this node as owner are known to
+// be PMEM-CSI volumes of this node. When the state cannot be trusted
+// because it is empty or had to be recovered, such devices get added
+// as volumes again. Otherwise they are orphans which, if a grace
+// period is set, get removed once that has passed. Devices without
+// metadata or from some other node are orphans which are only
+// reported, never removed.
+type orphanReconciler struct {
+	cs *nodeControllerServer
+	// gracePeriod is zero if orphans are never removed.
+	gracePeriod time.Duration
+	// interval is orphanCheckInterval, except in tests.
+	interval time.Duration
+	// recorder is nil when events are not recorded.
+	recorder record.EventRecorder
+	node     *v1.ObjectReference
+
+	mutex   sync.Mutex
+	orphans map[string]*orphan
+	adopted int
+	deleted int
+	// pending holds events until start is called.
+	pending []orphanEvent
+	started bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+var _ prometheus.Collector = &orphanReconciler{}
+
+func newOrphanReconciler(cs *nodeControllerServer) *orphanReconciler {
+	return &orphanReconciler{
+		cs:       cs,
+		interval: orphanCheckInterval,
+		// The kubelet uses the name also as UID when it records
+		// events for its node.
+		node: &v1.ObjectReference{
+			Kind: "Node",
+			Name: cs.nodeID,
+			UID:  types.UID(cs.nodeID),
+		},
+		orphans: map[string]*orphan{},
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// start checks the devices periodically in the background. Orphans
+// get removed after the grace period, zero disables that. Events get
+// recorded for the Node object if a recorder is given, including
+// those from checks before start.
+func (r *orphanReconciler) start(gracePeriod time.Duration, recorder record.EventRecorder) {
+	r.mutex.Lock()
+	r.gracePeriod = gracePeriod
+	r.recorder = recorder
+	r.started = true
+	if recorder != nil {
+		for _, e := range r.pending {
+			recorder.Event(r.node, e.eventtype, e.reason, e.message)
+		}
+	}
+	r.pending = nil
+	r.mutex.Unlock()
+	go r.run()
+}
+
+// shutdown stops the background checks.
+func (r *orphanReconciler) shutdown() {
+	close(r.stop)
+	<-r.stopped
+}
+
+func (r *orphanReconciler) run() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.reconcile()
+		}
+	}
+}
+
+// reconcile classifies all devices which have no volume.
+func (r *orphanReconciler) reconcile() {
+	cs := r.cs
+	devices, err := cs.dm.ListDevices()
+	if err != nil {
+		klog.Warningf("Orphan check: failed to get devices: %v", err)
+		return
+	}
+	// CreateVolume records a new volume in the state before it
+	// creates the device, so a device with a state entry is not
+	// an orphan, even when CreateVolume is still running.
+	known := map[string]bool{}
+	if cs.sm != nil {
+		ids, err := cs.sm.GetAll()
+		if err != nil {
+			klog.Warningf("Orphan check: failed to load state: %v", err)
+			return
+		}
+		for _, id := range ids {
+			known[id] = true
+		}
+	}
+	// A device without state entry is only known to be stale when
+	// the state is complete. It might not be when it is empty, for
+	// example because the state directory was lost, or when it
+	// had to be recovered on startup.
+	trusted := len(known) > 0 && !cs.stateRecovered
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	found := map[string]bool{}
+	for _, device := range devices {
+		id := device.VolumeId
+		if known[id] || cs.getVolumeByID(id) != nil ||
+			cs.eraseQueue != nil && cs.eraseQueue.isPending(id) {
+			continue
+		}
+		owned := device.Metadata != nil && device.Metadata.Owner == cs.nodeID
+		if owned && !trusted {
+			klog.Infof("Orphan check: adopting device %s as volume %q", id, device.Metadata.Name)
+			cs.restoreVolume(recoverVolume(device), device, cs.sm != nil)
+			r.adopted++
+			r.event(v1.EventTypeNormal, eventAdoptedDevice, "device %s added as volume %q because of its metadata", id, device.Metadata.Name)
+			continue
+		}
+
+		found[id] = true
+		o := r.orphans[id]
+		if o == nil {
+			o = &orphan{size: device.Size, since: now}
+			r.orphans[id] = o
+			var why string
+			switch {
+			case device.Metadata == nil:
+				why = "has no metadata"
+			case !owned:
+				why = fmt.Sprintf("was created by node %q", device.Metadata.Owner)
+			default:
+				why = "has no state entry"
+			}
+			klog.Warningf("Orphan check: device %s with size %d belongs to no volume and %s", id, device.Size, why)
+			r.event(v1.EventTypeWarning, eventOrphanedDevice, "device %s with size %d belongs to no volume and %s", id, device.Size, why)
+		}
+		// Devices which are not known to be volumes of this
+		// node are left alone.
+		if !owned || r.gracePeriod == 0 || now.Sub(o.since) < r.gracePeriod {
+			continue
+		}
+		if err := r.remove(id, device.Size); err != nil {
+			klog.Warningf("Orphan check: removing device %s failed: %v", id, err)
+			r.event(v1.EventTypeWarning, eventRemoveOrphanFailed, "removing device %s failed: %v", id, err)
+			continue
+		}
+		klog.Infof("Orphan check: removed device %s after %v", id, now.Sub(o.since))
+		r.event(v1.EventTypeNormal, eventRemovedOrphan, "device %s removed after %v", id, now.Sub(o.since))
+		r.deleted++
+		delete(found, id)
+	}
+	for id := range r.orphans {
+		if !found[id] {
+			delete(r.orphans, id)
+		}
+	}
+}
+
+// event records an event for the Node object, or keeps it until
+// start is called. The caller must hold the mutex.
+func (r *orphanReconciler) event(eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	switch {
+	case r.recorder != nil:
+		r.recorder.Event(r.node, eventtype, reason, message)
+	case !r.started:
+		r.pending = append(r.pending, orphanEvent{eventtype: eventtype, reason: reason, message: message})
+	}
+}
+
+// remove erases the device in the background if possible.
+func (r *orphanReconciler) remove(id string, size uint64) error {
+	// Nothing is known about the content, so better
+	// overwrite it.
+	erase := pmdmanager.EraseOpts{Policy: pmdmanager.EraseRandom}
+	if r.cs.eraseQueue != nil {
+		return r.cs.eraseQueue.add(id, int64(size), erase)
+	}
+	return r.cs.dm.DeleteDevice(id, erase)
+}
+
+// orphanedSize returns the number of orphans and their total size.
+func (r *orphanReconciler) orphanedSize() (int, uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var size uint64
+	for _, o := range r.orphans {
+		size += o.size
+	}
+	return len(r.orphans), size
+}
+
+func (r *orphanReconciler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- orphanedVolumes
+	ch <- orphanedBytes
+	ch <- adoptedVolumes
+	ch <- deletedOrphans
+}
+
+func (r *orphanReconciler) Collect(ch chan<- prometheus.Metric) {
+	count, size := r.orphanedSize()
+	r.mutex.Lock()
+	adopted, deleted := r.adopted, r.deleted
+	r.mutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(orphanedVolumes, prometheus.GaugeValue, float64(count))
+	ch <- prometheus.MustNewConstMetric(orphanedBytes, prometheus.GaugeValue, float64(size))
+	ch <- prometheus.MustNewConstMetric(adoptedVolumes, prometheus.CounterValue, float64(adopted))
+	ch <- prometheus.MustNewConstMetric(deletedOrphans, prometheus.CounterValue, float64(deleted))
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/record"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+func TestOrphanReconciler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orphans")
+	require.NoError(t, err, "create temp dir")
+	defer os.RemoveAll(dir)
+
+	dm := newFakeDeviceManager()
+	owned := func(name string) *pmdmanager.VolumeMetadata {
+		return &pmdmanager.VolumeMetadata{Name: name, Parameters: map[string]string{"name": name}, Owner: "node"}
+	}
+	for name, metadata := range map[string]*pmdmanager.VolumeMetadata{
+		"vol1": nil,
+		"vol2": owned("pvc-2"),
+		"vol3": {Name: "pvc-3", Owner: "other-node"},
+	} {
+		require.NoError(t, dm.CreateDevice(name, 1024, pmdmanager.CreateDeviceOpts{Metadata: metadata}), "create %s", name)
+	}
+
+	// Without state, devices from this node get adopted.
+	sm := newTestState(t, dir)
+	cs := NewNodeControllerServer("node", dm, sm, nil, nil)
+	r := cs.orphans
+	assert.Equal(t, &nodeVolume{ID: "vol2", Size: 1024, Params: map[string]string{"name": "pvc-2"}}, cs.getVolumeByID("vol2"), "adopted volume")
+	assert.Nil(t, cs.getVolumeByID("vol1"), "orphan without metadata")
+	assert.Nil(t, cs.getVolumeByID("vol3"), "orphan from other node")
+	count, size := r.orphanedSize()
+	assert.Equal(t, 2, count, "orphans")
+	assert.Equal(t, uint64(2048), size, "orphaned size")
+	assert.Equal(t, 1, r.adopted, "adopted")
+
+	// Same when the state had to be recovered.
+	cs.stateRecovered = true
+	require.NoError(t, dm.CreateDevice("vol6", 1024, pmdmanager.CreateDeviceOpts{Metadata: owned("pvc-6")}), "create vol6")
+	r.reconcile()
+	assert.NotNil(t, cs.getVolumeByID("vol6"), "adopted after recovery")
+	assert.Equal(t, 2, r.adopted, "adopted after recovery")
+	cs.stateRecovered = false
+
+	// Now the state has an entry, so a device from this node
+	// without one is an orphan.
+	require.NoError(t, dm.CreateDevice("vol4", 1024, pmdmanager.CreateDeviceOpts{Metadata: owned("pvc-4")}), "create vol4")
+	r.reconcile()
+	count, _ = r.orphanedSize()
+	assert.Equal(t, 3, count, "orphans with state")
+	assert.Nil(t, cs.getVolumeByID("vol4"), "orphan from this node")
+
+	// A device which is in the state is not an orphan,
+	// even if the volume is not known yet.
+	require.NoError(t, sm.Create("vol5", &nodeVolume{ID: "vol5", Size: 1024}), "vol5 state")
+	require.NoError(t, dm.CreateDevice("vol5", 1024, pmdmanager.CreateDeviceOpts{}), "create vol5")
+	r.reconcile()
+	count, _ = r.orphanedSize()
+	assert.Equal(t, 3, count, "orphans while creating a volume")
+
+	// Only the orphan from this node gets removed after the grace period.
+	recorder := record.NewFakeRecorder(100)
+	r.interval = time.Millisecond
+	r.start(10*time.Millisecond, recorder)
+	defer r.shutdown()
+	waitFor(t, func() bool {
+		return !dm.hasDevice("vol4")
+	}, "orphan removed")
+	waitFor(t, func() bool {
+		count, _ := r.orphanedSize()
+		return count == 2
+	}, "remaining orphans")
+	r.mutex.Lock()
+	assert.Equal(t, 1, r.deleted, "deleted orphans")
+	r.mutex.Unlock()
+	for _, name := range []string{"vol1", "vol2", "vol3", "vol5", "vol6"} {
+		assert.True(t, dm.hasDevice(name), "%s kept", name)
+	}
+
+	// Events from before start are recorded, too.
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	assert.ElementsMatch(t, []string{
+		"Normal AdoptedDevice device vol2 added as volume \"pvc-2\" because of its metadata",
+		"Normal AdoptedDevice device vol6 added as volume \"pvc-6\" because of its metadata",
+		"Warning OrphanedDevice device vol1 with size 1024 belongs to no volume and has no metadata",
+		"Warning OrphanedDevice device vol3 with size 1024 belongs to no volume and was created by node \"other-node\"",
+		"Warning OrphanedDevice device vol4 with size 1024 belongs to no volume and has no state entry",
+		"Normal RemovedOrphan device vol4 removed after",
+	}, trimEvents(events), "events")
+}
+
+// trimEvents removes the varying duration from the RemovedOrphan events.
+func trimEvents(events []string) []string {
+	for i, event := range events {
+		if index := strings.Index(event, " removed after "); index >= 0 {
+			events[i] = event[:index+len(" removed after")]
+		}
+	}
+	return events
+}
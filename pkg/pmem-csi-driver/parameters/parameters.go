@@ -15,13 +15,23 @@ import (
 )
 
 type Persistency string
+type Mode string
+type VolumeLayout string
+type Erase string
 type Origin int
 
 // Beware of API and backwards-compatibility breaking when changing these string constants!
 const (
+	Alignment        = "alignment"
 	CacheSize        = "cacheSize"
-	EraseAfter       = "eraseafter"
+	DeviceMode       = "deviceMode"
+	EraseAfter       = "eraseafter" // legacy alias for ErasePolicy, either "random" (true) or "header" (false)
+	ErasePolicy      = "erasePolicy"
+	EraseVerify      = "eraseVerify"
+	Layout           = "layout"
 	Name             = "name"
+	NamespaceMode    = "namespaceMode"
+	NumaNode         = "numaNode"
 	PersistencyModel = "persistencyModel"
 	VolumeID         = "_id"
 	Size             = "size"
@@ -40,6 +50,20 @@ const (
 	PersistencyCache     Persistency = "cache"
 	PersistencyEphemeral Persistency = "ephemeral" // only used internally
 
+	ModeFsdax  Mode = "fsdax"  // block device with DAX capable filesystem, the default
+	ModeDevdax Mode = "devdax" // character device, only usable as raw block volume
+	ModeSector Mode = "sector" // block device with atomic sector updates, no DAX
+
+	LayoutRegion  VolumeLayout = "region"  // inside a single region, the default
+	LayoutLinear  VolumeLayout = "linear"  // concatenated from several regions if needed
+	LayoutStriped VolumeLayout = "striped" // striped across all regions
+
+	EraseNone    Erase = "none"    // data is left on the device
+	EraseHeader  Erase = "header"  // first 4 KiB get zeroed
+	EraseZero    Erase = "zero"    // entire device gets zeroed
+	EraseRandom  Erase = "random"  // entire device gets overwritten once with random data, the default
+	EraseDiscard Erase = "discard" // entire device gets zeroed with a zero-range request, if supported
+
 	//CreateVolumeOrigin is for parameters from the storage class in controller CreateVolume.
 	CreateVolumeOrigin Origin = iota
 	// CreateVolumeInternalOrigin is for the node CreateVolume parameters.
@@ -56,15 +80,29 @@ const (
 var valid = map[Origin][]string{
 	// Parameters from Kubernetes and users for a persistent volume.
 	CreateVolumeOrigin: []string{
+		Alignment,
 		CacheSize,
+		DeviceMode,
 		EraseAfter,
+		ErasePolicy,
+		EraseVerify,
+		Layout,
+		NamespaceMode,
+		NumaNode,
 		PersistencyModel,
 	},
 
 	// These parameters are prepared by the master controller.
 	CreateVolumeInternalOrigin: []string{
+		Alignment,
 		CacheSize,
+		DeviceMode,
 		EraseAfter,
+		ErasePolicy,
+		EraseVerify,
+		Layout,
+		NamespaceMode,
+		NumaNode,
 		PersistencyModel,
 
 		VolumeID,
@@ -72,7 +110,12 @@ var valid = map[Origin][]string{
 
 	// Parameters from Kubernetes and users.
 	EphemeralVolumeOrigin: []string{
+		Alignment,
+		DeviceMode,
 		EraseAfter,
+		ErasePolicy,
+		EraseVerify,
+		NumaNode,
 		PodInfoPrefix,
 		Size,
 	},
@@ -83,8 +126,15 @@ var valid = map[Origin][]string{
 	// doesn't) and add the volume name for logging purposes.
 	// Kubernetes adds pod info and provisioner ID.
 	PersistentVolumeOrigin: []string{
+		Alignment,
 		CacheSize,
+		DeviceMode,
 		EraseAfter,
+		ErasePolicy,
+		EraseVerify,
+		Layout,
+		NamespaceMode,
+		NumaNode,
 		PersistencyModel,
 
 		Name,
@@ -95,9 +145,16 @@ var valid = map[Origin][]string{
 	// Internally we store everything except the volume ID,
 	// which is handled separately.
 	NodeVolumeOrigin: []string{
+		Alignment,
 		CacheSize,
+		DeviceMode,
 		EraseAfter,
+		ErasePolicy,
+		EraseVerify,
+		Layout,
 		Name,
+		NamespaceMode,
+		NumaNode,
 		PersistencyModel,
 		Size,
 	},
@@ -108,12 +165,18 @@ var valid = map[Origin][]string{
 // The accessor functions always return a value, if unset
 // the default.
 type Volume struct {
-	CacheSize   *uint
-	EraseAfter  *bool
-	Name        *string
-	Persistency *Persistency
-	Size        *int64
-	VolumeID    *string
+	Alignment     *uint64
+	CacheSize     *uint
+	DeviceMode    *string
+	ErasePolicy   *Erase
+	EraseVerify   *bool
+	Layout        *VolumeLayout
+	Name          *string
+	NamespaceMode *Mode
+	NumaNode      *int
+	Persistency   *Persistency
+	Size          *int64
+	VolumeID      *string
 }
 
 // VolumeContext represents the same settings as a string map.
@@ -126,6 +189,7 @@ type VolumeContext map[string]string
 // combinations of parameters.
 func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 	var result Volume
+	var eraseAfter *bool
 	validKeys := valid[origin]
 	for key, value := range stringmap {
 		valid := false
@@ -164,6 +228,41 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 			default:
 				return result, fmt.Errorf("parameter %q: unknown value: %q", key, value)
 			}
+		case Layout:
+			l := VolumeLayout(value)
+			switch l {
+			case LayoutRegion, LayoutLinear, LayoutStriped:
+				result.Layout = &l
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %q", key, value)
+			}
+		case NamespaceMode:
+			m := Mode(value)
+			switch m {
+			case ModeFsdax, ModeDevdax, ModeSector:
+				result.NamespaceMode = &m
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %q", key, value)
+			}
+		case NumaNode:
+			n, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as NUMA node number: %v", key, value, err)
+			}
+			i := int(n)
+			result.NumaNode = &i
+		case Alignment:
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as alignment: %v", key, value, err)
+			}
+			a := uint64(quantity.Value())
+			switch a {
+			case 4 * 1024, 2 * 1024 * 1024, 1024 * 1024 * 1024:
+				result.Alignment = &a
+			default:
+				return result, fmt.Errorf("parameter %q: unsupported alignment %q, must be 4Ki, 2Mi or 1Gi", key, value)
+			}
 		case CacheSize:
 			c, err := strconv.ParseUint(value, 10, 32)
 			if err != nil {
@@ -171,6 +270,17 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 			}
 			u := uint(c)
 			result.CacheSize = &u
+		case DeviceMode:
+			switch value {
+			case "lvm", "direct", "simulated":
+				result.DeviceMode = &value
+			case "ndctl":
+				// Alias for "direct", like in the -deviceManager parameter.
+				d := "direct"
+				result.DeviceMode = &d
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %q", key, value)
+			}
 		case Size:
 			quantity, err := resource.ParseQuantity(value)
 			if err != nil {
@@ -183,7 +293,21 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 			if err != nil {
 				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
 			}
-			result.EraseAfter = &b
+			eraseAfter = &b
+		case ErasePolicy:
+			e := Erase(value)
+			switch e {
+			case EraseNone, EraseHeader, EraseZero, EraseRandom, EraseDiscard:
+				result.ErasePolicy = &e
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %q", key, value)
+			}
+		case EraseVerify:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
+			}
+			result.EraseVerify = &b
 		case Ephemeral:
 			b, err := strconv.ParseBool(value)
 			if err != nil {
@@ -201,10 +325,27 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 		}
 	}
 
+	if eraseAfter != nil {
+		if result.ErasePolicy != nil {
+			return result, fmt.Errorf("parameter %q: invalid in combination with %q", EraseAfter, ErasePolicy)
+		}
+		e := EraseHeader
+		if *eraseAfter {
+			e = EraseRandom
+		}
+		result.ErasePolicy = &e
+	}
+
 	// Some sanity checks.
 	if result.CacheSize != nil && result.GetPersistency() != PersistencyCache {
 		return result, fmt.Errorf("parameter %q: invalid for %q = %q", CacheSize, PersistencyModel, result.GetPersistency())
 	}
+	if result.Alignment != nil && result.GetNamespaceMode() == ModeSector {
+		return result, fmt.Errorf("parameter %q: invalid for %q = %q", Alignment, NamespaceMode, ModeSector)
+	}
+	if result.GetEraseVerify() && result.GetErasePolicy() == EraseNone {
+		return result, fmt.Errorf("parameter %q: invalid for %q = %q", EraseVerify, ErasePolicy, EraseNone)
+	}
 	if origin == EphemeralVolumeOrigin && result.Size == nil {
 		return result, fmt.Errorf("required parameter %q not specified", Size)
 	}
@@ -225,15 +366,33 @@ func (v Volume) ToContext() VolumeContext {
 	// Intentionally not stored:
 	// - volumeID
 
+	if v.Alignment != nil {
+		result[Alignment] = fmt.Sprintf("%d", *v.Alignment)
+	}
 	if v.CacheSize != nil {
 		result[CacheSize] = fmt.Sprintf("%d", *v.CacheSize)
 	}
-	if v.EraseAfter != nil {
-		result[EraseAfter] = fmt.Sprintf("%v", *v.EraseAfter)
+	if v.DeviceMode != nil {
+		result[DeviceMode] = *v.DeviceMode
+	}
+	if v.ErasePolicy != nil {
+		result[ErasePolicy] = string(*v.ErasePolicy)
+	}
+	if v.EraseVerify != nil {
+		result[EraseVerify] = fmt.Sprintf("%v", *v.EraseVerify)
+	}
+	if v.Layout != nil {
+		result[Layout] = string(*v.Layout)
 	}
 	if v.Name != nil {
 		result[Name] = *v.Name
 	}
+	if v.NamespaceMode != nil {
+		result[NamespaceMode] = string(*v.NamespaceMode)
+	}
+	if v.NumaNode != nil {
+		result[NumaNode] = fmt.Sprintf("%d", *v.NumaNode)
+	}
 	if v.Persistency != nil {
 		result[PersistencyModel] = string(*v.Persistency)
 	}
@@ -244,6 +403,15 @@ func (v Volume) ToContext() VolumeContext {
 	return result
 }
 
+// GetAlignment returns 0 if unset, which means that the
+// device manager picks the alignment.
+func (v Volume) GetAlignment() uint64 {
+	if v.Alignment != nil {
+		return *v.Alignment
+	}
+	return 0
+}
+
 func (v Volume) GetCacheSize() uint {
 	if v.CacheSize != nil {
 		return *v.CacheSize
@@ -251,11 +419,27 @@ func (v Volume) GetCacheSize() uint {
 	return 1
 }
 
-func (v Volume) GetEraseAfter() bool {
-	if v.EraseAfter != nil {
-		return *v.EraseAfter
+// GetDeviceMode returns an empty string if unset, which means that
+// the default device manager of the node is used.
+func (v Volume) GetDeviceMode() string {
+	if v.DeviceMode != nil {
+		return *v.DeviceMode
 	}
-	return true
+	return ""
+}
+
+func (v Volume) GetErasePolicy() Erase {
+	if v.ErasePolicy != nil {
+		return *v.ErasePolicy
+	}
+	return EraseRandom
+}
+
+func (v Volume) GetEraseVerify() bool {
+	if v.EraseVerify != nil {
+		return *v.EraseVerify
+	}
+	return false
 }
 
 func (v Volume) GetPersistency() Persistency {
@@ -265,6 +449,20 @@ func (v Volume) GetPersistency() Persistency {
 	return PersistencyNormal
 }
 
+func (v Volume) GetLayout() VolumeLayout {
+	if v.Layout != nil {
+		return *v.Layout
+	}
+	return LayoutRegion
+}
+
+func (v Volume) GetNamespaceMode() Mode {
+	if v.NamespaceMode != nil {
+		return *v.NamespaceMode
+	}
+	return ModeFsdax
+}
+
 func (v Volume) GetName() string {
 	if v.Name != nil {
 		return *v.Name
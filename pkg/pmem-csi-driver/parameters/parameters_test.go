@@ -8,6 +8,7 @@ package parameters
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -19,13 +20,22 @@ import (
 func TestParameters(t *testing.T) {
 	five := uint(5)
 	yes := true
-	no := false
 	cache := PersistencyCache
 	normal := PersistencyNormal
 	foo := "foo"
 	gig := "1Gi"
 	gigNum := int64(1 * 1024 * 1024 * 1024)
 	name := "joe"
+	devdax := ModeDevdax
+	sector := ModeSector
+	striped := LayoutStriped
+	linear := LayoutLinear
+	one := 1
+	align2M := uint64(2 * 1024 * 1024)
+	header := EraseHeader
+	random := EraseRandom
+	discard := EraseDiscard
+	direct := "direct"
 
 	tests := []struct {
 		name       string
@@ -44,10 +54,101 @@ func TestParameters(t *testing.T) {
 			},
 			parameters: Volume{
 				CacheSize:   &five,
-				EraseAfter:  &no,
+				ErasePolicy: &header,
 				Persistency: &cache,
 			},
 		},
+		{
+			name:   "createvolume-devdax",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NamespaceMode: "devdax",
+			},
+			parameters: Volume{
+				NamespaceMode: &devdax,
+			},
+		},
+		{
+			name:   "createvolume-sector",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NamespaceMode: "sector",
+			},
+			parameters: Volume{
+				NamespaceMode: &sector,
+			},
+		},
+		{
+			name:   "createvolume-striped",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Layout: "striped",
+			},
+			parameters: Volume{
+				Layout: &striped,
+			},
+		},
+		{
+			name:   "createvolume-numa",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NumaNode: "1",
+			},
+			parameters: Volume{
+				NumaNode: &one,
+			},
+		},
+		{
+			name:   "bad-numa",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NumaNode: "-1",
+			},
+			err: `parameter "numaNode": failed to parse "-1" as NUMA node number: strconv.ParseUint: parsing "-1": invalid syntax`,
+		},
+		{
+			name:   "createvolume-alignment",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Alignment: "2Mi",
+			},
+			parameters: Volume{
+				Alignment: &align2M,
+			},
+		},
+		{
+			name:   "bad-alignment",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Alignment: "64Ki",
+			},
+			err: `parameter "alignment": unsupported alignment "64Ki", must be 4Ki, 2Mi or 1Gi`,
+		},
+		{
+			name:   "bad-alignment-sector",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Alignment:     "4Ki",
+				NamespaceMode: "sector",
+			},
+			err: `parameter "alignment": invalid for "namespaceMode" = "sector"`,
+		},
+		{
+			name:   "bad-layout",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Layout: "mirrored",
+			},
+			err: `parameter "layout": unknown value: "mirrored"`,
+		},
+		{
+			name:   "bad-namespacemode",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NamespaceMode: "raw",
+			},
+			err: `parameter "namespaceMode": unknown value: "raw"`,
+		},
 		{
 			name:   "bad-volumeid",
 			origin: CreateVolumeOrigin,
@@ -77,7 +178,7 @@ func TestParameters(t *testing.T) {
 			},
 			parameters: Volume{
 				CacheSize:   &five,
-				EraseAfter:  &no,
+				ErasePolicy: &header,
 				Persistency: &cache,
 				VolumeID:    &foo,
 			},
@@ -86,13 +187,17 @@ func TestParameters(t *testing.T) {
 			name:   "ephemeral",
 			origin: EphemeralVolumeOrigin,
 			stringmap: VolumeContext{
+				Alignment:                "2097152",
 				EraseAfter:               "true",
+				NumaNode:                 "1",
 				Size:                     gig,
 				"csi.storage.k8s.io/foo": "bar",
 			},
 			parameters: Volume{
-				EraseAfter: &yes,
-				Size:       &gigNum,
+				Alignment:   &align2M,
+				ErasePolicy: &random,
+				NumaNode:    &one,
+				Size:        &gigNum,
 			},
 		},
 		{
@@ -109,7 +214,7 @@ func TestParameters(t *testing.T) {
 			},
 			parameters: Volume{
 				CacheSize:   &five,
-				EraseAfter:  &no,
+				ErasePolicy: &header,
 				Persistency: &cache,
 				Name:        &name,
 			},
@@ -120,16 +225,46 @@ func TestParameters(t *testing.T) {
 			stringmap: VolumeContext{
 				CacheSize:        "5",
 				EraseAfter:       "false",
+				Layout:           "linear",
+				NamespaceMode:    "devdax",
 				PersistencyModel: "cache",
 				Size:             gig,
 				Name:             name,
 			},
 			parameters: Volume{
-				CacheSize:   &five,
-				EraseAfter:  &no,
-				Persistency: &cache,
-				Size:        &gigNum,
-				Name:        &name,
+				CacheSize:     &five,
+				ErasePolicy:   &header,
+				Layout:        &linear,
+				NamespaceMode: &devdax,
+				Persistency:   &cache,
+				Size:          &gigNum,
+				Name:          &name,
+			},
+		},
+
+		{
+			name:   "erase-policy",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				ErasePolicy: "discard",
+				EraseVerify: "true",
+			},
+			parameters: Volume{
+				ErasePolicy: &discard,
+				EraseVerify: &yes,
+			},
+		},
+
+		{
+			name:   "device-mode",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode: "direct",
+				Size:       gig,
+			},
+			parameters: Volume{
+				DeviceMode: &direct,
+				Size:       &gigNum,
 			},
 		},
 
@@ -158,6 +293,15 @@ func TestParameters(t *testing.T) {
 			},
 			err: "parameter \"cacheSize\" invalid in this context",
 		},
+		{
+			name:   "invalid-ephemeral-devdax",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				NamespaceMode: "devdax",
+				Size:          gig,
+			},
+			err: "parameter \"namespaceMode\" invalid in this context",
+		},
 		{
 			name:   "invalid-persistent-context",
 			origin: PersistentVolumeOrigin,
@@ -193,7 +337,54 @@ func TestParameters(t *testing.T) {
 			err: "parameter \"size\": failed to parse \"foo\" as int64: quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'",
 		},
 
+		{
+			name:   "invalid-device-mode",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode: "tmpfs",
+			},
+			err: "parameter \"deviceMode\": unknown value: \"tmpfs\"",
+		},
+
+		// Invalid erase settings.
+		{
+			name:   "invalid-erase-policy",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				ErasePolicy: "fire",
+			},
+			err: "parameter \"erasePolicy\": unknown value: \"fire\"",
+		},
+		{
+			name:   "invalid-erase-combination",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				EraseAfter:  "true",
+				ErasePolicy: "zero",
+			},
+			err: "parameter \"eraseafter\": invalid in combination with \"erasePolicy\"",
+		},
+		{
+			name:   "invalid-erase-verify",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				ErasePolicy: "none",
+				EraseVerify: "true",
+			},
+			err: "parameter \"eraseVerify\": invalid for \"erasePolicy\" = \"none\"",
+		},
+
 		// Legacy state files.
+		{
+			name:   "device-mode-ndctl",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode: "ndctl",
+			},
+			parameters: Volume{
+				DeviceMode: &direct,
+			},
+		},
 		{
 			name:   "model-none",
 			origin: NodeVolumeOrigin,
@@ -211,13 +402,24 @@ func TestParameters(t *testing.T) {
 			result := VolumeContext{}
 			for key, value := range tt.stringmap {
 				switch key {
-				case Size:
+				case Size, Alignment:
 					quantity := resource.MustParse(value)
 					value = fmt.Sprintf("%d", quantity.Value())
 				case PersistencyModel:
 					if value == "none" {
 						value = "normal"
 					}
+				case DeviceMode:
+					if value == "ndctl" {
+						value = "direct"
+					}
+				case EraseAfter:
+					key = ErasePolicy
+					if eraseAfter, _ := strconv.ParseBool(value); eraseAfter {
+						value = string(EraseRandom)
+					} else {
+						value = string(EraseHeader)
+					}
 				}
 				if key != VolumeID &&
 					key != ProvisionerID &&
@@ -16,9 +16,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/intel/pmem-csi/pkg/ndctl"
 	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
 	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
 	registry "github.com/intel/pmem-csi/pkg/pmem-registry"
@@ -32,8 +36,14 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 )
 
@@ -64,7 +74,7 @@ type DeviceMode string
 
 func (mode *DeviceMode) Set(value string) error {
 	switch value {
-	case string(LVM), string(Direct):
+	case string(LVM), string(Direct), string(Simulated):
 		*mode = DeviceMode(value)
 	case "ndctl":
 		// For backwards-compatibility.
@@ -80,6 +90,53 @@ func (mode *DeviceMode) String() string {
 	return string(*mode)
 }
 
+// StateStore selects where the node driver keeps its state.
+type StateStore string
+
+func (store *StateStore) Set(value string) error {
+	switch value {
+	case string(FileStore), string(ConfigMapStore):
+		*store = StateStore(value)
+	default:
+		// The flag package will add the value to the final output, no need to do it here.
+		return errors.New("invalid state store")
+	}
+	return nil
+}
+
+func (store *StateStore) String() string {
+	return string(*store)
+}
+
+// DeviceRegions assigns regions to device managers. Each value of
+// the -deviceManagerRegions flag adds one entry.
+type DeviceRegions map[DeviceMode][]string
+
+func (regions *DeviceRegions) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return errors.New("expected <device manager>=<region>[,<region>...]")
+	}
+	var mode DeviceMode
+	if err := mode.Set(parts[0]); err != nil {
+		return err
+	}
+	if *regions == nil {
+		*regions = DeviceRegions{}
+	}
+	(*regions)[mode] = append((*regions)[mode], strings.Split(parts[1], ",")...)
+	return nil
+}
+
+func (regions *DeviceRegions) String() string {
+	var values []string
+	for mode, r := range *regions {
+		values = append(values, string(mode)+"="+strings.Join(r, ","))
+	}
+	sort.Strings(values)
+	return strings.Join(values, " ")
+}
+
 const (
 	//Controller definition for controller driver mode
 	Controller DriverMode = "controller"
@@ -91,6 +148,15 @@ const (
 
 	// Direct manages PMEM through libndctl.
 	Direct DeviceMode = "direct"
+
+	// Simulated uses loop devices backed by sparse files instead of PMEM.
+	Simulated DeviceMode = "simulated"
+
+	// FileStore keeps the state only in files below StateBasePath.
+	FileStore StateStore = "file"
+
+	// ConfigMapStore keeps the state in ConfigMaps, with the files as local cache.
+	ConfigMapStore StateStore = "configmap"
 )
 
 var (
@@ -139,16 +205,45 @@ type Config struct {
 	ClientKeyFile string
 	//ControllerEndpoint exported node controller endpoint
 	ControllerEndpoint string
-	//DeviceManager device manager to use
+	//DeviceManager device manager to use, the default one if there are several
 	DeviceManager DeviceMode
+	//DeviceManagerRegions regions of DeviceManager and of additional device managers
+	DeviceManagerRegions DeviceRegions
+	//LVMThin creates thin volumes in the thin pools prepared by pmem-vgm in LVM mode
+	LVMThin bool
+	//LVMThinOpts overcommit ratio and watermarks for the thin pools
+	LVMThinOpts pmdmanager.ThinOpts
 	//Directory where to persist the node driver state
 	StateBasePath string
+	//StateStore where to persist the node driver state in addition to StateBasePath
+	StateStore StateStore
+	//StateNamespace namespace of the ConfigMaps for ConfigMapStore
+	StateNamespace string
+	//SimulatedPath directory for the files which back simulated PMEM
+	SimulatedPath string
+	//SimulatedCapacity total size of the simulated PMEM as quantity string (e.g. 4Gi)
+	SimulatedCapacity string
+	//AvoidBadblocks do not create new volumes on PMEM with known bad blocks
+	AvoidBadblocks bool
+	//OrphanGracePeriod after which devices without volume get removed, zero for never
+	OrphanGracePeriod time.Duration
+	//OrphanEvents reports orphaned and adopted devices as events for the Node object
+	OrphanEvents bool
+	//ReconcilePVs reconstructs the volumes known to the controller from PersistentVolumes
+	ReconcilePVs bool
+	//ReconcileTimeout how long the controller waits for nodes with volumes after a restart
+	ReconcileTimeout time.Duration
+	//Placement strategy for new namespaces in direct mode
+	Placement string
+	//SysfsRoot directory where sysfs is mounted, /sys if empty
+	SysfsRoot string
 	//Version driver release version
 	Version string
 
 	// parameters for Kubernetes scheduler extender
 	schedulerListen string
 	client          kubernetes.Interface
+	dynamicClient   dynamic.Interface
 
 	// parameters for Prometheus metrics
 	metricsListen string
@@ -186,6 +281,18 @@ func GetPMEMDriver(cfg Config) (*pmemDriver, error) {
 	if cfg.Mode == Node && cfg.StateBasePath == "" {
 		cfg.StateBasePath = "/var/lib/" + cfg.DriverName
 	}
+	if cfg.Mode == Node && cfg.StateStore == ConfigMapStore && cfg.client == nil {
+		return nil, fmt.Errorf("state store %q needs a Kubernetes client", cfg.StateStore)
+	}
+	if cfg.Mode == Node && cfg.OrphanEvents && cfg.client == nil {
+		return nil, fmt.Errorf("orphan events need a Kubernetes client")
+	}
+	if cfg.Mode == Controller && cfg.ReconcilePVs && cfg.client == nil {
+		return nil, fmt.Errorf("reconciling PersistentVolumes needs a Kubernetes client")
+	}
+	if cfg.Mode == Node && cfg.SimulatedPath == "" {
+		cfg.SimulatedPath = filepath.Join(cfg.StateBasePath, "simulated")
+	}
 
 	peerName := "pmem-registry"
 	if cfg.Mode == Controller {
@@ -246,6 +353,16 @@ func (pmemd *pmemDriver) Run() error {
 	if pmemd.cfg.Mode == Controller {
 		rs := registryserver.New(pmemd.clientTLSConfig)
 		cs := NewMasterControllerServer(rs)
+		ids.ready = cs.isReady
+		var client kubernetes.Interface
+		var snapshotClient dynamic.Interface
+		if pmemd.cfg.ReconcilePVs {
+			client = pmemd.cfg.client
+			snapshotClient = pmemd.cfg.dynamicClient
+		}
+		if err := cs.reconcile(ctx, client, snapshotClient, pmemd.cfg.DriverName, pmemd.cfg.ReconcileTimeout); err != nil {
+			return err
+		}
 
 		if pmemd.cfg.Endpoint != pmemd.cfg.RegistryEndpoint {
 			if err := s.Start(pmemd.cfg.Endpoint, nil, ids, cs); err != nil {
@@ -271,17 +388,64 @@ func (pmemd *pmemDriver) Run() error {
 		}
 		klog.V(2).Infof("Prometheus endpoint started at https://%s%s", addr, pmemd.cfg.metricsPath)
 	} else if pmemd.cfg.Mode == Node {
-		dm, err := newDeviceManager(pmemd.cfg.DeviceManager)
+		dm, err := newDeviceManagers(pmemd.cfg)
 		if err != nil {
 			return err
 		}
-		sm, err := pmemstate.NewFileState(pmemd.cfg.StateBasePath)
+		sm, err := pmemd.newStateManager("volumes", pmemd.cfg.StateBasePath)
 		if err != nil {
 			return err
 		}
-		cs := NewNodeControllerServer(pmemd.cfg.NodeID, dm, sm)
+		// Snapshots are tracked separately from the volumes.
+		ssm, err := pmemd.newStateManager("snapshots", filepath.Join(pmemd.cfg.StateBasePath, "snapshots"))
+		if err != nil {
+			return err
+		}
+		// Volumes which are waiting to be erased.
+		esm, err := pmemd.newStateManager("erase", filepath.Join(pmemd.cfg.StateBasePath, "erase"))
+		if err != nil {
+			return err
+		}
+		cs := NewNodeControllerServer(pmemd.cfg.NodeID, dm, sm, ssm, esm)
+		cs.avoidBadblocks = pmemd.cfg.AvoidBadblocks
 		ns := NewNodeServer(cs)
 
+		// Report the health of the PMEM hardware, if there is any.
+		if pmemd.cfg.DeviceManager != Simulated {
+			prometheus.MustRegister(pmdmanager.NewDimmHealthCollector())
+			prometheus.MustRegister(pmdmanager.NewBadblocksCollector(dm, func(volumeID string) bool {
+				return cs.getVolumeByID(volumeID) != nil
+			}))
+		}
+		prometheus.MustRegister(pmdmanager.NewCapacityCollector(dm))
+		if pools, ok := dm.(pmdmanager.PmemThinPoolManager); ok && pmemd.cfg.LVMThin {
+			prometheus.MustRegister(pmdmanager.NewThinPoolCollector(pools))
+		}
+		if cs.eraseQueue != nil {
+			prometheus.MustRegister(cs.eraseQueue)
+			// Let the worker finish the current device before
+			// the driver exits.
+			defer cs.eraseQueue.shutdown()
+		}
+		var recorder record.EventRecorder
+		if pmemd.cfg.OrphanEvents {
+			broadcaster := record.NewBroadcaster()
+			broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: pmemd.cfg.client.CoreV1().Events("")})
+			defer broadcaster.Shutdown()
+			recorder = broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: pmemd.cfg.DriverName, Host: pmemd.cfg.NodeID})
+		}
+		prometheus.MustRegister(cs.orphans)
+		cs.orphans.start(pmemd.cfg.OrphanGracePeriod, recorder)
+		defer cs.orphans.shutdown()
+		prometheus.MustRegister(pmdmanager.NewEraseCollector())
+		addr, err := pmemd.startMetrics(ctx, cancel)
+		if err != nil {
+			return err
+		}
+		if addr != "" {
+			klog.V(2).Infof("Prometheus endpoint started at https://%s%s", addr, pmemd.cfg.metricsPath)
+		}
+
 		if pmemd.cfg.Endpoint != pmemd.cfg.ControllerEndpoint {
 			if err := s.Start(pmemd.cfg.ControllerEndpoint, pmemd.serverTLSConfig, cs); err != nil {
 				return err
@@ -352,6 +516,26 @@ func (pmemd *pmemDriver) registerNodeController() error {
 	return nil
 }
 
+// newStateManager stores the state of the given kind in the directory
+// and, if enabled, also in a ConfigMap <drivername>-<nodeid>-<kind>.
+func (pmemd *pmemDriver) newStateManager(kind, directory string) (pmemstate.StateManager, error) {
+	fs, err := pmemstate.NewFileState(directory)
+	if err != nil {
+		return nil, err
+	}
+	if pmemd.cfg.StateStore != ConfigMapStore {
+		return fs, nil
+	}
+	name := StateConfigMapName(pmemd.cfg.DriverName, pmemd.cfg.NodeID, kind)
+	return pmemstate.NewConfigMapState(pmemd.cfg.client, pmemd.cfg.StateNamespace, name, fs)
+}
+
+// StateConfigMapName returns the name of the ConfigMap which
+// stores the state of the given kind for a node.
+func StateConfigMapName(driverName, nodeID, kind string) string {
+	return strings.ToLower(driverName + "-" + nodeID + "-" + kind)
+}
+
 // startScheduler starts the scheduler extender if it is enabled. It
 // logs errors and cancels the context when it runs into a problem,
 // either during the startup phase (blocking) or later at runtime (in
@@ -490,12 +674,97 @@ func register(ctx context.Context, conn *grpc.ClientConn, req *registry.Register
 	return nil
 }
 
-func newDeviceManager(dmType DeviceMode) (pmdmanager.PmemDeviceManager, error) {
+// newDeviceManagers creates the device manager selected with
+// -deviceManager and those which get regions assigned with
+// -deviceManagerRegions, combined into one.
+func newDeviceManagers(cfg Config) (pmdmanager.PmemDeviceManager, error) {
+	if cfg.SysfsRoot != "" {
+		pmdmanager.SetSysfsRoot(cfg.SysfsRoot)
+	}
+	modes, filters, err := deviceBackends(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var backends []pmdmanager.Backend
+	for _, mode := range modes {
+		dm, err := newDeviceManager(mode, cfg, filters[mode])
+		if err != nil {
+			return nil, fmt.Errorf("%s device manager: %v", mode, err)
+		}
+		backends = append(backends, pmdmanager.Backend{Name: string(mode), DeviceManager: dm})
+	}
+	return pmdmanager.NewPmemDeviceManagerMulti(backends)
+}
+
+// deviceBackends determines which device managers run on the node,
+// the default one first, and which regions they use. A device manager
+// without assigned regions uses all regions which are not assigned to
+// some other device manager.
+func deviceBackends(cfg Config) ([]DeviceMode, map[DeviceMode]pmdmanager.RegionFilter, error) {
+	modes := []DeviceMode{cfg.DeviceManager}
+	var additional []string
+	for mode := range cfg.DeviceManagerRegions {
+		if mode != cfg.DeviceManager {
+			additional = append(additional, string(mode))
+		}
+	}
+	sort.Strings(additional)
+	for _, mode := range additional {
+		modes = append(modes, DeviceMode(mode))
+	}
+
+	owners := map[string]DeviceMode{}
+	for _, mode := range modes {
+		if mode == Simulated && len(modes) > 1 {
+			return nil, nil, errors.New("simulated device mode cannot be combined with other device managers")
+		}
+		for _, region := range cfg.DeviceManagerRegions[mode] {
+			if owner, ok := owners[region]; ok && owner != mode {
+				return nil, nil, fmt.Errorf("region %s assigned to %s and %s device managers", region, owner, mode)
+			}
+			owners[region] = mode
+		}
+	}
+
+	filters := map[DeviceMode]pmdmanager.RegionFilter{}
+	for _, mode := range modes {
+		mode := mode
+		if _, ok := cfg.DeviceManagerRegions[mode]; ok {
+			filters[mode] = func(region string) bool {
+				return owners[region] == mode
+			}
+		} else if len(owners) > 0 {
+			filters[mode] = func(region string) bool {
+				_, ok := owners[region]
+				return !ok
+			}
+		}
+	}
+	return modes, filters, nil
+}
+
+func newDeviceManager(dmType DeviceMode, cfg Config, regions pmdmanager.RegionFilter) (pmdmanager.PmemDeviceManager, error) {
 	switch dmType {
 	case LVM:
-		return pmdmanager.NewPmemDeviceManagerLVM()
+		if cfg.LVMThin {
+			return pmdmanager.NewPmemDeviceManagerLVMThin(regions, cfg.LVMThinOpts)
+		}
+		return pmdmanager.NewPmemDeviceManagerLVMForRegions(regions)
 	case Direct:
-		return pmdmanager.NewPmemDeviceManagerNdctl()
+		placement, err := ndctl.ParsePlacementStrategy(cfg.Placement)
+		if err != nil {
+			return nil, err
+		}
+		return pmdmanager.NewPmemDeviceManagerNdctlForRegions(placement, regions)
+	case Simulated:
+		if regions != nil {
+			return nil, errors.New("simulated device mode does not use regions")
+		}
+		capacity, err := resource.ParseQuantity(cfg.SimulatedCapacity)
+		if err != nil {
+			return nil, fmt.Errorf("invalid simulated capacity %q: %v", cfg.SimulatedCapacity, err)
+		}
+		return pmdmanager.NewPmemDeviceManagerLoop(cfg.SimulatedPath, uint64(capacity.Value()))
 	}
 	return nil, fmt.Errorf("Unsupported device manager type '%s'", dmType)
 }
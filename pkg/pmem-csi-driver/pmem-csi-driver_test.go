@@ -13,10 +13,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 
 	"github.com/intel/pmem-csi/pkg/pmem-grpc"
 )
@@ -106,3 +109,112 @@ func checkResponse(t *testing.T, expected, actual *http.Response, err error, wha
 		}
 	}
 }
+
+func TestDeviceBackends(t *testing.T) {
+	type regionOwners map[DeviceMode][]string
+	cases := map[string]struct {
+		dm      DeviceMode
+		regions []string
+		modes   []DeviceMode
+		owners  regionOwners
+		err     bool
+	}{
+		"default": {
+			dm:    LVM,
+			modes: []DeviceMode{LVM},
+		},
+		"lvm only": {
+			dm:      LVM,
+			regions: []string{"lvm=region0,region1"},
+			modes:   []DeviceMode{LVM},
+			owners:  regionOwners{LVM: {"region0", "region1"}},
+		},
+		"mixed": {
+			dm:      LVM,
+			regions: []string{"direct=region1"},
+			modes:   []DeviceMode{LVM, Direct},
+			owners:  regionOwners{LVM: {"region0", "region2"}, Direct: {"region1"}},
+		},
+		"ndctl alias": {
+			dm:      Direct,
+			regions: []string{"lvm=region0", "ndctl=region1"},
+			modes:   []DeviceMode{Direct, LVM},
+			owners:  regionOwners{LVM: {"region0"}, Direct: {"region1"}},
+		},
+		"conflict": {
+			dm:      LVM,
+			regions: []string{"lvm=region0", "direct=region0"},
+			err:     true,
+		},
+		"simulated": {
+			dm:      Simulated,
+			regions: []string{"lvm=region0"},
+			err:     true,
+		},
+	}
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			cfg := Config{DeviceManager: c.dm}
+			for _, value := range c.regions {
+				require.NoError(t, cfg.DeviceManagerRegions.Set(value), "parse %q", value)
+			}
+			modes, filters, err := deviceBackends(cfg)
+			if c.err {
+				assert.Error(t, err, "device backends")
+				return
+			}
+			require.NoError(t, err, "device backends")
+			assert.Equal(t, c.modes, modes, "device managers")
+			if c.owners == nil {
+				assert.Empty(t, filters, "no region filters")
+				return
+			}
+			owners := regionOwners{}
+			for _, mode := range modes {
+				for _, region := range []string{"region0", "region1", "region2"} {
+					if filter := filters[mode]; filter == nil || filter(region) {
+						owners[mode] = append(owners[mode], region)
+					}
+				}
+			}
+			assert.Equal(t, c.owners, owners, "regions")
+		})
+	}
+}
+
+func TestDeviceRegionsFlag(t *testing.T) {
+	var regions DeviceRegions
+	assert.Error(t, regions.Set("lvm"), "missing regions")
+	assert.Error(t, regions.Set("lvm="), "empty regions")
+	assert.Error(t, regions.Set("foo=region0"), "unknown device manager")
+	require.NoError(t, regions.Set("lvm=region0,region1"), "lvm")
+	require.NoError(t, regions.Set("lvm=region2"), "lvm again")
+	assert.Equal(t, DeviceRegions{LVM: {"region0", "region1", "region2"}}, regions, "parsed flag")
+}
+
+func TestStateStore(t *testing.T) {
+	var store StateStore
+	assert.Error(t, store.Set("etcd"), "unknown state store")
+	require.NoError(t, store.Set("configmap"), "configmap")
+	assert.Equal(t, ConfigMapStore, store, "parsed flag")
+
+	dir, err := ioutil.TempDir("", "state-store")
+	require.NoError(t, err, "create temp dir")
+	defer os.RemoveAll(dir)
+	client := fake.NewSimpleClientset()
+	pmemd := &pmemDriver{cfg: Config{
+		DriverName:     "pmem-csi.intel.com",
+		NodeID:         "Node-1",
+		StateStore:     ConfigMapStore,
+		StateNamespace: "pmem-csi",
+		client:         client,
+	}}
+	sm, err := pmemd.newStateManager("volumes", filepath.Join(dir, "volumes"))
+	require.NoError(t, err, "create state manager")
+	require.NoError(t, sm.Create("vol1", &nodeVolume{ID: "vol1", Size: 1024}), "create entry")
+	cm, err := client.CoreV1().ConfigMaps("pmem-csi").Get(context.Background(), "pmem-csi.intel.com-node-1-volumes", metav1.GetOptions{})
+	require.NoError(t, err, "get ConfigMap")
+	assert.Equal(t, map[string]string{"vol1": `{"id":"vol1","size":1024,"parameters":null}`}, cm.Data, "ConfigMap content")
+	_, err = os.Stat(filepath.Join(dir, "volumes", "vol1.json"))
+	assert.NoError(t, err, "local cache")
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2020 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// volumeSnapshotContents are the snapshot objects which contain the
+// snapshot ID. They are defined by the snapshot CRDs, so there is no
+// typed client for them.
+var volumeSnapshotContents = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1beta1",
+	Resource: "volumesnapshotcontents",
+}
+
+// reconcile reconstructs the volumes and snapshots which existed
+// before the controller started. Volumes with a PersistentVolume are
+// known immediately when a client is given, snapshots of those
+// volumes when a snapshot client is given. Volumes whose
+// PersistentVolume has not been created yet are only reported by
+// their node, so the controller becomes ready once all nodes with
+// the driver according to their CSINode objects and all nodes with
+// PersistentVolumes have registered or the timeout has passed,
+// whatever happens first. Without a client, the controller is ready
+// immediately.
+//
+// Must be called before the registry server accepts nodes.
+func (cs *masterController) reconcile(ctx context.Context, client kubernetes.Interface, snapshotClient dynamic.Interface, driverName string, timeout time.Duration) error {
+	var vols []*pmemVolume
+	var nodes []string
+	var snapshots []*pmemSnapshot
+	if client != nil {
+		pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("list PersistentVolumes: %v", err)
+		}
+		for i := range pvs.Items {
+			if vol := pvToVolume(&pvs.Items[i], driverName); vol != nil {
+				vols = append(vols, vol)
+			}
+		}
+		klog.Infof("Reconcile: found %d volumes in PersistentVolumes", len(vols))
+
+		nodes, err = driverNodes(ctx, client, driverName)
+		if err != nil {
+			return err
+		}
+		klog.Infof("Reconcile: found %d nodes with the driver in CSINodes", len(nodes))
+	}
+	if snapshotClient != nil {
+		var err error
+		snapshots, err = listSnapshots(ctx, snapshotClient, driverName, vols)
+		if err != nil {
+			return err
+		}
+		klog.Infof("Reconcile: found %d snapshots in VolumeSnapshotContents", len(snapshots))
+	}
+
+	cs.mutex.Lock()
+	cs.pendingNodes = map[string]bool{}
+	for _, node := range nodes {
+		cs.pendingNodes[node] = true
+	}
+	for _, snapshot := range snapshots {
+		if _, ok := cs.pmemSnapshots[snapshot.SnapshotId]; !ok {
+			cs.pmemSnapshots[snapshot.SnapshotId] = snapshot
+		}
+	}
+	for _, vol := range vols {
+		if existing, ok := cs.pmemVolumes[vol.id]; ok {
+			for node := range vol.nodeIDs {
+				existing.nodeIDs[node] = Created
+			}
+		} else {
+			cs.pmemVolumes[vol.id] = vol
+		}
+		for node := range vol.nodeIDs {
+			cs.pendingNodes[node] = true
+		}
+	}
+	pending := len(cs.pendingNodes)
+	cs.mutex.Unlock()
+
+	if pending == 0 {
+		cs.markReady()
+		return nil
+	}
+	time.AfterFunc(timeout, func() {
+		cs.mutex.Lock()
+		var missing []string
+		for node := range cs.pendingNodes {
+			missing = append(missing, node)
+		}
+		cs.mutex.Unlock()
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			klog.Warningf("Reconcile: nodes %v have not registered after %v, continuing without their volumes", missing, timeout)
+		}
+		cs.markReady()
+	})
+	return nil
+}
+
+// nodeReconciled is called with cs.mutex locked after the volumes of
+// the node were added.
+func (cs *masterController) nodeReconciled(nodeID string) {
+	if cs.pendingNodes == nil {
+		return
+	}
+	delete(cs.pendingNodes, nodeID)
+	if len(cs.pendingNodes) == 0 {
+		cs.markReady()
+	}
+}
+
+func (cs *masterController) markReady() {
+	cs.readyOnce.Do(func() {
+		klog.Info("Reconcile: controller is ready")
+		close(cs.ready)
+	})
+}
+
+// isReady returns true once the volumes from before the start are known.
+func (cs *masterController) isReady() bool {
+	select {
+	case <-cs.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// driverNodes returns the IDs of the nodes where the driver has
+// registered with the kubelet.
+func driverNodes(ctx context.Context, client kubernetes.Interface, driverName string) ([]string, error) {
+	var nodes []string
+	csiNodes, err := client.StorageV1().CSINodes().List(ctx, metav1.ListOptions{})
+	switch {
+	case err == nil:
+		for _, csiNode := range csiNodes.Items {
+			for _, driver := range csiNode.Spec.Drivers {
+				if driver.Name == driverName && driver.NodeID != "" {
+					nodes = append(nodes, driver.NodeID)
+				}
+			}
+		}
+	case apierrors.IsNotFound(err):
+		// Kubernetes < 1.17 only has the beta API.
+		csiNodes, err := client.StorageV1beta1().CSINodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("list CSINodes: %v", err)
+		}
+		for _, csiNode := range csiNodes.Items {
+			for _, driver := range csiNode.Spec.Drivers {
+				if driver.Name == driverName && driver.NodeID != "" {
+					nodes = append(nodes, driver.NodeID)
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("list CSINodes: %v", err)
+	}
+	return nodes, nil
+}
+
+// listSnapshots returns the snapshots of the driver which are
+// recorded in VolumeSnapshotContents. Nothing is found when the
+// snapshot CRDs are not installed.
+func listSnapshots(ctx context.Context, client dynamic.Interface, driverName string, vols []*pmemVolume) ([]*pmemSnapshot, error) {
+	contents, err := client.Resource(volumeSnapshotContents).List(ctx, metav1.ListOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list VolumeSnapshotContents: %v", err)
+	}
+	volumes := map[string]*pmemVolume{}
+	for _, vol := range vols {
+		volumes[vol.id] = vol
+	}
+	var snapshots []*pmemSnapshot
+	for i := range contents.Items {
+		if snapshot := contentToSnapshot(&contents.Items[i], driverName, volumes); snapshot != nil {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+// contentToSnapshot returns the snapshot for a VolumeSnapshotContent
+// of the driver, nil for all other VolumeSnapshotContents. The node
+// of a snapshot is the one of its source volume, so snapshots of
+// volumes which are not known yet are skipped. Their node reports
+// them when it registers.
+func contentToSnapshot(content *unstructured.Unstructured, driverName string, volumes map[string]*pmemVolume) *pmemSnapshot {
+	driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+	snapshotID, _, _ := unstructured.NestedString(content.Object, "status", "snapshotHandle")
+	if driver != driverName || snapshotID == "" {
+		return nil
+	}
+	volumeID, _, _ := unstructured.NestedString(content.Object, "spec", "source", "volumeHandle")
+	vol := volumes[volumeID]
+	if vol == nil || len(vol.nodeIDs) != 1 {
+		klog.V(3).Infof("Reconcile: node of snapshot %s from VolumeSnapshotContent %s not known", snapshotID, content.GetName())
+		return nil
+	}
+	snapshot := &csi.Snapshot{
+		SnapshotId:     snapshotID,
+		SourceVolumeId: volumeID,
+	}
+	snapshot.SizeBytes, _, _ = unstructured.NestedInt64(content.Object, "status", "restoreSize")
+	snapshot.ReadyToUse, _, _ = unstructured.NestedBool(content.Object, "status", "readyToUse")
+	if created, ok, _ := unstructured.NestedInt64(content.Object, "status", "creationTime"); ok {
+		snapshot.CreationTime, _ = ptypes.TimestampProto(time.Unix(0, created))
+	}
+	var nodeID string
+	for node := range vol.nodeIDs {
+		nodeID = node
+	}
+	return &pmemSnapshot{
+		Snapshot: snapshot,
+		nodeID:   nodeID,
+	}
+}
+
+// pvToVolume returns the volume for a PersistentVolume of the driver,
+// nil for all other PersistentVolumes. The nodes are taken from the
+// node affinity which external-provisioner sets based on the
+// accessible topology of the volume.
+func pvToVolume(pv *v1.PersistentVolume, driverName string) *pmemVolume {
+	source := pv.Spec.CSI
+	if source == nil || source.Driver != driverName || source.VolumeHandle == "" {
+		return nil
+	}
+	vol := &pmemVolume{
+		id:      source.VolumeHandle,
+		name:    source.VolumeAttributes[parameters.Name],
+		nodeIDs: map[string]VolumeStatus{},
+	}
+	if vol.name == "" {
+		// external-provisioner uses the PV name as volume name.
+		vol.name = pv.Name
+	}
+	if capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+		vol.size = capacity.Value()
+	}
+	vol.numaNode = contextNumaNode(source.VolumeAttributes)
+	if affinity := pv.Spec.NodeAffinity; affinity != nil && affinity.Required != nil {
+		for _, term := range affinity.Required.NodeSelectorTerms {
+			for _, expr := range term.MatchExpressions {
+				if expr.Key != PmemDriverTopologyKey || expr.Operator != v1.NodeSelectorOpIn {
+					continue
+				}
+				for _, node := range expr.Values {
+					vol.nodeIDs[node] = Created
+				}
+			}
+		}
+	}
+	return vol
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2020 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/intel/pmem-csi/pkg/registryserver"
+)
+
+func TestReconcile(t *testing.T) {
+	const driverName = "pmem-csi.intel.com"
+	oldKey := PmemDriverTopologyKey
+	PmemDriverTopologyKey = driverName + "/node"
+	defer func() { PmemDriverTopologyKey = oldKey }()
+
+	newPV := func(name, driver string, attributes map[string]string, nodes ...string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				Capacity: v1.ResourceList{
+					v1.ResourceStorage: resource.MustParse("1Mi"),
+				},
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{
+						Driver:           driver,
+						VolumeHandle:     name + "-id",
+						VolumeAttributes: attributes,
+					},
+				},
+				NodeAffinity: &v1.VolumeNodeAffinity{
+					Required: &v1.NodeSelector{
+						NodeSelectorTerms: []v1.NodeSelectorTerm{
+							{
+								MatchExpressions: []v1.NodeSelectorRequirement{
+									{
+										Key:      PmemDriverTopologyKey,
+										Operator: v1.NodeSelectorOpIn,
+										Values:   nodes,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	newCSINode := func(name, driver string) *storagev1.CSINode {
+		return &storagev1.CSINode{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storagev1.CSINodeSpec{
+				Drivers: []storagev1.CSINodeDriver{{Name: driver, NodeID: name}},
+			},
+		}
+	}
+	newContent := func(name, driver, volumeID string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "snapshot.storage.k8s.io/v1beta1",
+				"kind":       "VolumeSnapshotContent",
+				"metadata": map[string]interface{}{
+					"name": name,
+				},
+				"spec": map[string]interface{}{
+					"driver": driver,
+					"source": map[string]interface{}{
+						"volumeHandle": volumeID,
+					},
+				},
+				"status": map[string]interface{}{
+					"snapshotHandle": name + "-id",
+					"restoreSize":    int64(1024 * 1024),
+					"readyToUse":     true,
+					"creationTime":   int64(1e9),
+				},
+			},
+		}
+	}
+	client := fake.NewSimpleClientset(
+		newPV("pvc-1", driverName, map[string]string{"name": "pvc-1", "numaNode": "1"}, "node-a"),
+		newPV("pvc-2", driverName, nil, "node-a", "node-b"),
+		newPV("pvc-3", "other-driver", nil, "node-c"),
+		// A node without volumes.
+		newCSINode("node-d", driverName),
+		newCSINode("node-e", "other-driver"),
+	)
+	snapshotClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newContent("snapshot-1", driverName, "pvc-1-id"),
+		// Snapshots of cache volumes are not supported.
+		newContent("snapshot-2", driverName, "pvc-2-id"),
+		newContent("snapshot-3", "other-driver", "pvc-3-id"),
+	)
+	createReq := &csi.CreateVolumeRequest{
+		Name: "pvc-1",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1024 * 1024,
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+	ctx := context.Background()
+
+	t.Run("nodes", func(t *testing.T) {
+		cs := NewMasterControllerServer(registryserver.New(nil))
+		require.NoError(t, cs.reconcile(ctx, client, snapshotClient, driverName, time.Hour), "reconcile")
+
+		numaNode := 1
+		assert.Equal(t, &pmemVolume{
+			id:       "pvc-1-id",
+			name:     "pvc-1",
+			size:     1024 * 1024,
+			nodeIDs:  map[string]VolumeStatus{"node-a": Created},
+			numaNode: &numaNode,
+		}, cs.getVolumeByName("pvc-1"), "pvc-1")
+		assert.Equal(t, map[string]VolumeStatus{"node-a": Created, "node-b": Created}, cs.getVolumeByName("pvc-2").nodeIDs, "cache volume")
+		assert.Nil(t, cs.getVolumeByID("pvc-3-id"), "other driver")
+
+		snapshot := cs.getSnapshotByID("snapshot-1-id")
+		if assert.NotNil(t, snapshot, "snapshot-1") {
+			assert.Equal(t, "node-a", snapshot.nodeID, "node of snapshot-1")
+			assert.Equal(t, "pvc-1-id", snapshot.SourceVolumeId, "source of snapshot-1")
+			assert.Equal(t, int64(1024*1024), snapshot.SizeBytes, "size of snapshot-1")
+			assert.True(t, snapshot.ReadyToUse, "snapshot-1 ready")
+			assert.Equal(t, int64(1), snapshot.CreationTime.GetSeconds(), "creation time of snapshot-1")
+		}
+		assert.Nil(t, cs.getSnapshotByID("snapshot-2-id"), "snapshot of cache volume")
+		assert.Nil(t, cs.getSnapshotByID("snapshot-3-id"), "other driver")
+
+		_, err := cs.CreateVolume(ctx, createReq)
+		assert.Equal(t, codes.Unavailable, status.Code(err), "CreateVolume before nodes have registered")
+		_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1-id"})
+		assert.Equal(t, codes.Unavailable, status.Code(err), "DeleteVolume before nodes have registered")
+		_, err = cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+			VolumeId:      "pvc-1-id",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024},
+		})
+		assert.Equal(t, codes.Unavailable, status.Code(err), "ControllerExpandVolume before nodes have registered")
+		_, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snapshot-4", SourceVolumeId: "pvc-1-id"})
+		assert.Equal(t, codes.Unavailable, status.Code(err), "CreateSnapshot before nodes have registered")
+		_, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snapshot-1-id"})
+		assert.Equal(t, codes.Unavailable, status.Code(err), "DeleteSnapshot before nodes have registered")
+
+		for _, node := range []string{"node-a", "node-b", "node-d"} {
+			assert.False(t, cs.isReady(), "ready before %s", node)
+			cs.mutex.Lock()
+			cs.nodeReconciled(node)
+			cs.mutex.Unlock()
+		}
+		assert.True(t, cs.isReady(), "ready after all nodes")
+
+		// The existing volume gets returned instead of
+		// creating it again.
+		resp, err := cs.CreateVolume(ctx, createReq)
+		require.NoError(t, err, "CreateVolume")
+		assert.Equal(t, "pvc-1-id", resp.Volume.VolumeId, "volume ID")
+		assert.Equal(t, []*csi.Topology{{Segments: map[string]string{PmemDriverTopologyKey: "node-a"}}}, resp.Volume.AccessibleTopology, "topology")
+
+		// The volume was not created from a snapshot.
+		cloneReq := *createReq
+		cloneReq.VolumeContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snapshot-id"},
+			},
+		}
+		_, err = cs.CreateVolume(ctx, &cloneReq)
+		assert.Equal(t, codes.AlreadyExists, status.Code(err), "CreateVolume with different content source: %v", err)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		cs := NewMasterControllerServer(registryserver.New(nil))
+		ids, err := NewIdentityServer(driverName, "v0")
+		require.NoError(t, err, "identity server")
+		ids.ready = cs.isReady
+		require.NoError(t, cs.reconcile(ctx, client, nil, driverName, time.Millisecond), "reconcile")
+		waitFor(t, func() bool {
+			resp, err := ids.Probe(ctx, &csi.ProbeRequest{})
+			require.NoError(t, err, "Probe")
+			return resp.GetReady().GetValue()
+		}, "ready after timeout")
+	})
+
+	t.Run("no client", func(t *testing.T) {
+		cs := NewMasterControllerServer(registryserver.New(nil))
+		assert.False(t, cs.isReady(), "ready before reconcile")
+		require.NoError(t, cs.reconcile(ctx, nil, nil, driverName, time.Hour), "reconcile")
+		assert.True(t, cs.isReady(), "ready")
+	})
+
+	t.Run("beta CSINodes", func(t *testing.T) {
+		client := fake.NewSimpleClientset(
+			&storagev1beta1.CSINode{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+				Spec: storagev1beta1.CSINodeSpec{
+					Drivers: []storagev1beta1.CSINodeDriver{{Name: driverName, NodeID: "node-a"}},
+				},
+			},
+		)
+		// Like a Kubernetes < 1.17 server.
+		client.PrependReactor("list", "csinodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.GetResource().Version == "v1" {
+				return true, nil, apierrors.NewNotFound(storagev1.Resource("csinodes"), "")
+			}
+			return false, nil, nil
+		})
+		cs := NewMasterControllerServer(registryserver.New(nil))
+		require.NoError(t, cs.reconcile(ctx, client, nil, driverName, time.Hour), "reconcile")
+		assert.False(t, cs.isReady(), "ready before node-a")
+		cs.mutex.Lock()
+		cs.nodeReconciled("node-a")
+		cs.mutex.Unlock()
+		assert.True(t, cs.isReady(), "ready after node-a")
+	})
+}
@@ -0,0 +1,395 @@
+package pmdmanager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+)
+
+//ErasePolicy defines how the data of a device gets wiped before deleting it
+type ErasePolicy string
+
+const (
+	//EraseNone leaves the data as it is
+	EraseNone ErasePolicy = "none"
+	//EraseHeader zeroes the first 4 KiB, enough to hide file system signatures from the next user
+	EraseHeader ErasePolicy = "header"
+	//EraseZero overwrites the entire device with zeros
+	EraseZero ErasePolicy = "zero"
+	//EraseRandom overwrites the entire device once with random data
+	EraseRandom ErasePolicy = "random"
+	//EraseDiscard zeroes the entire device with a zero-range request
+	//(blkdiscard --zeroout) which the kernel and device may implement
+	//without writing each block, with fallback to EraseZero
+	EraseDiscard ErasePolicy = "discard"
+)
+
+//EraseOpts defines how DeleteDevice and DeleteSnapshot erase data.
+//The zero value only erases the header.
+type EraseOpts struct {
+	//Policy defaults to EraseHeader
+	Policy ErasePolicy
+	//Verify reads sampled blocks after erasing and fails when one of
+	//them was not wiped
+	Verify bool
+}
+
+const (
+	// eraseHeaderSize is the amount of data cleared by EraseHeader.
+	eraseHeaderSize = 4 * 1024
+
+	// eraseSampleSize and eraseSampleCount define how much gets
+	// read for verification: the first and the last block of the
+	// erased range plus blocks at random offsets.
+	eraseSampleSize  = 4 * 1024
+	eraseSampleCount = 64
+)
+
+var (
+	eraseDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "pmem_erase_duration_seconds",
+			Help: "Time needed for erasing a device, including verification.",
+			// 10ms up to ~45 minutes.
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+		},
+		[]string{"policy"},
+	)
+	erasedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_erased_bytes_total",
+			Help: "Amount of data wiped while erasing devices.",
+		},
+		[]string{"policy"},
+	)
+	eraseVerifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_erase_verifications_total",
+			Help: "Number of erased devices which were checked by reading sampled blocks, by result (passed or failed).",
+		},
+		[]string{"policy", "result"},
+	)
+)
+
+type eraseCollector struct{}
+
+var _ prometheus.Collector = eraseCollector{}
+
+// NewEraseCollector returns a collector for the metrics that get
+// recorded while erasing devices.
+func NewEraseCollector() prometheus.Collector {
+	return eraseCollector{}
+}
+
+func (eraseCollector) Describe(ch chan<- *prometheus.Desc) {
+	eraseDuration.Describe(ch)
+	erasedBytes.Describe(ch)
+	eraseVerifications.Describe(ch)
+}
+
+func (eraseCollector) Collect(ch chan<- prometheus.Metric) {
+	eraseDuration.Collect(ch)
+	erasedBytes.Collect(ch)
+	eraseVerifications.Collect(ch)
+}
+
+// clearDevice wipes the data of a device according to the policy.
+// It fails with ErrDeviceInUse when the device is in use, also for
+// EraseNone.
+func clearDevice(dev *PmemDeviceInfo, erase EraseOpts) error {
+	policy := erase.Policy
+	if policy == "" {
+		policy = EraseHeader
+	}
+	klog.V(4).Infof("ClearDevice: path: %v policy: %v verify: %v", dev.Path, policy, erase.Verify)
+
+	// Before action, check that dev.Path exists and is device
+	fileinfo, err := os.Stat(dev.Path)
+	if err != nil {
+		klog.Errorf("clearDevice: %s does not exist", dev.Path)
+		return err
+	}
+
+	// Check if device
+	if (fileinfo.Mode() & os.ModeDevice) == 0 {
+		klog.Errorf("clearDevice: %s is not device", dev.Path)
+		return fmt.Errorf("%s is not device", dev.Path)
+	}
+
+	start := time.Now()
+	var length uint64
+	if dev.CharDev {
+		length, err = clearDaxDevice(dev, policy, erase.Verify)
+	} else {
+		length, err = clearBlockDevice(dev, policy, erase.Verify)
+	}
+	if err != nil || policy == EraseNone {
+		return err
+	}
+	eraseDuration.WithLabelValues(string(policy)).Observe(time.Since(start).Seconds())
+	erasedBytes.WithLabelValues(string(policy)).Add(float64(length))
+	return nil
+}
+
+// eraseLength returns how many bytes at the start of the device
+// get wiped by the policy.
+func eraseLength(size uint64, policy ErasePolicy) (uint64, error) {
+	switch policy {
+	case EraseNone:
+		return 0, nil
+	case EraseHeader:
+		if size > eraseHeaderSize {
+			return eraseHeaderSize, nil
+		}
+		return size, nil
+	case EraseZero, EraseRandom, EraseDiscard:
+		return size, nil
+	default:
+		return 0, fmt.Errorf("unknown erase policy %q: %w", policy, ErrInvalid)
+	}
+}
+
+func clearBlockDevice(dev *PmemDeviceInfo, policy ErasePolicy, verify bool) (uint64, error) {
+	// The device remains opened exclusively while erasing it, so
+	// it cannot get mounted in the meantime.
+	fd, err := openExclusive(dev.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if fd >= 0 {
+			unix.Close(fd) // nolint: errcheck
+		}
+	}()
+
+	length, err := eraseLength(dev.Size, policy)
+	if err != nil || length == 0 {
+		return 0, err
+	}
+	// fd changes when the device gets reopened.
+	read := func(buf []byte, offset int64) error {
+		return preadFull(fd)(buf, offset)
+	}
+	var samples *eraseSamples
+	if verify {
+		if samples, err = sampleBlocks(read, policy, length); err != nil {
+			return 0, fmt.Errorf("device %q: %v", dev.Path, err)
+		}
+	}
+
+	switch policy {
+	case EraseHeader, EraseZero:
+		err = zeroDevice(dev.Path, length)
+	case EraseRandom:
+		klog.V(5).Infof("Wiping entire device: %s", dev.Path)
+		// use one iteration instead of shred's default=3 for speed
+		if _, err = pmemexec.RunCommand("shred", "-n", "1", dev.Path); err != nil {
+			err = fmt.Errorf("device shred failure: %v", err)
+		}
+	case EraseDiscard:
+		klog.V(5).Infof("Discarding entire device: %s", dev.Path)
+		// blkdiscard also opens the device exclusively, which
+		// fails while it is open here. Other users stay out
+		// while blkdiscard runs.
+		unix.Close(fd) // nolint: errcheck
+		fd = -1
+		_, discardErr := pmemexec.RunCommand("blkdiscard", "--zeroout", dev.Path)
+		if fd, err = openExclusive(dev.Path); err != nil {
+			fd = -1
+			return 0, err
+		}
+		if discardErr != nil {
+			klog.Warningf("Zero-range request not supported for device %s, writing zeros instead: %v", dev.Path, discardErr)
+			err = zeroDevice(dev.Path, length)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if verify {
+		if err := samples.verify(read); err != nil {
+			return 0, fmt.Errorf("device %q: %v", dev.Path, err)
+		}
+	}
+	return length, nil
+}
+
+// openExclusive opens the block device for reading. It fails with
+// ErrDeviceInUse while the device is mounted or opened exclusively
+// by someone else.
+func openExclusive(path string) (int, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_EXCL|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to clear device %q: %w", path, ErrDeviceInUse)
+	}
+	return fd, nil
+}
+
+// zeroDevice writes zeros into the first length bytes of the device.
+func zeroDevice(path string, length uint64) error {
+	klog.V(5).Infof("Zeroing %d bytes at start of device: %s", length, path)
+	count := "count=" + strconv.FormatUint(length, 10)
+	if _, err := pmemexec.RunCommand("dd", "if=/dev/zero", "of="+path, "bs=1M", count, "iflag=count_bytes", "conv=fsync"); err != nil {
+		return fmt.Errorf("device zeroing failure: %v", err)
+	}
+	return nil
+}
+
+// clearDaxDevice does the same as clearDevice for a devdax character
+// device. Such a device does not support read and write, it can only
+// be accessed after mapping it into memory. The mapping must match the
+// device alignment, which is guaranteed when mapping the entire device.
+func clearDaxDevice(dev *PmemDeviceInfo, policy ErasePolicy, verify bool) (uint64, error) {
+	// Character devices cannot be opened exclusively.
+	if deviceOpenedByProcess(dev.Path) {
+		return 0, fmt.Errorf("failed to clear device %q: %w", dev.Path, ErrDeviceInUse)
+	}
+
+	length, err := eraseLength(dev.Size, policy)
+	if err != nil || length == 0 {
+		return 0, err
+	}
+
+	fd, err := unix.Open(dev.Path, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, fmt.Errorf("open device %q: %v", dev.Path, err)
+	}
+	defer unix.Close(fd) // nolint: errcheck
+
+	mem, err := unix.Mmap(fd, 0, int(dev.Size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return 0, fmt.Errorf("map device %q: %v", dev.Path, err)
+	}
+	defer unix.Munmap(mem) // nolint: errcheck
+
+	read := func(buf []byte, offset int64) error {
+		if offset+int64(len(buf)) > int64(len(mem)) {
+			return io.ErrUnexpectedEOF
+		}
+		copy(buf, mem[offset:])
+		return nil
+	}
+	var samples *eraseSamples
+	if verify {
+		if samples, err = sampleBlocks(read, policy, length); err != nil {
+			return 0, fmt.Errorf("device %q: %v", dev.Path, err)
+		}
+	}
+
+	klog.V(5).Infof("Wiping %d bytes at start of device with policy %s: %s Size %v", length, policy, dev.Path, dev.Size)
+	chunk := make([]byte, 1024*1024)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for offset := uint64(0); offset < length; offset += uint64(len(chunk)) {
+		end := offset + uint64(len(chunk))
+		if end > length {
+			end = length
+		}
+		if policy == EraseRandom {
+			random.Read(chunk) // nolint: errcheck
+		}
+		copy(mem[offset:end], chunk)
+	}
+	if err := unix.Msync(mem, unix.MS_SYNC); err != nil {
+		return 0, fmt.Errorf("device zeroing failure: %v", err)
+	}
+
+	if verify {
+		if err := samples.verify(read); err != nil {
+			return 0, fmt.Errorf("device %q: %v", dev.Path, err)
+		}
+	}
+	return length, nil
+}
+
+// readAtFunc fills the buffer with the data at the offset.
+type readAtFunc func(buf []byte, offset int64) error
+
+func preadFull(fd int) readAtFunc {
+	return func(buf []byte, offset int64) error {
+		for len(buf) > 0 {
+			n, err := unix.Pread(fd, buf, offset)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return io.ErrUnexpectedEOF
+			}
+			buf = buf[n:]
+			offset += int64(n)
+		}
+		return nil
+	}
+}
+
+// eraseSamples are blocks of the range which gets erased, read
+// before erasing it. After erasing with EraseRandom, each block must
+// differ from its old content. All other policies must have zeroed it.
+type eraseSamples struct {
+	policy  ErasePolicy
+	size    int
+	offsets []int64
+	before  [][]byte
+}
+
+// sampleBlocks picks blocks in the first length bytes of a device.
+func sampleBlocks(read readAtFunc, policy ErasePolicy, length uint64) (*eraseSamples, error) {
+	s := &eraseSamples{policy: policy, size: eraseSampleSize}
+	if length < eraseSampleSize {
+		s.size = int(length)
+	}
+	last := int64(length) - int64(s.size)
+	s.offsets = append(s.offsets, 0)
+	if last > 0 {
+		s.offsets = append(s.offsets, last)
+		for i := 2; i < eraseSampleCount; i++ {
+			s.offsets = append(s.offsets, rand.Int63n(last/eraseSampleSize+1)*eraseSampleSize)
+		}
+	}
+	if policy == EraseRandom {
+		for _, offset := range s.offsets {
+			buf := make([]byte, s.size)
+			if err := read(buf, offset); err != nil {
+				return nil, fmt.Errorf("read sample at offset %d: %v", offset, err)
+			}
+			s.before = append(s.before, buf)
+		}
+	}
+	return s, nil
+}
+
+// verify reads the sampled blocks again and checks that they were
+// wiped. The result is recorded in the metrics.
+func (s *eraseSamples) verify(read readAtFunc) error {
+	result := "failed"
+	defer func() {
+		eraseVerifications.WithLabelValues(string(s.policy), result).Inc()
+	}()
+
+	buf := make([]byte, s.size)
+	zero := make([]byte, s.size)
+	for i, offset := range s.offsets {
+		if err := read(buf, offset); err != nil {
+			return fmt.Errorf("erase verification: read sample at offset %d: %v", offset, err)
+		}
+		if s.policy == EraseRandom {
+			if bytes.Equal(buf, s.before[i]) {
+				return fmt.Errorf("erase verification: data at offset %d was not overwritten", offset)
+			}
+		} else if !bytes.Equal(buf, zero) {
+			return fmt.Errorf("erase verification: data at offset %d was not zeroed", offset)
+		}
+	}
+	klog.V(5).Infof("Erase verification: %d samples of %d bytes passed", len(s.offsets), s.size)
+	result = "passed"
+	return nil
+}
@@ -0,0 +1,210 @@
+package pmdmanager
+
+import (
+	"errors"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+)
+
+var (
+	dimmLabels = []string{"dimm", "id"}
+
+	dimmHealthState = prometheus.NewDesc(
+		"pmem_dimm_health_state",
+		"SMART health state of the PMEM DIMM: 0 = ok, 1 = non-critical, 2 = critical, 3 = fatal.",
+		dimmLabels, nil,
+	)
+	dimmTemperature = prometheus.NewDesc(
+		"pmem_dimm_temperature_celsius",
+		"Media temperature of the PMEM DIMM in degrees Celsius.",
+		dimmLabels, nil,
+	)
+	dimmSpareBlocks = prometheus.NewDesc(
+		"pmem_dimm_spare_blocks_percent",
+		"Remaining spare capacity of the PMEM DIMM in percent.",
+		dimmLabels, nil,
+	)
+	dimmPercentageUsed = prometheus.NewDesc(
+		"pmem_dimm_percentage_used",
+		"Estimated percentage of the PMEM DIMM life span which is used up.",
+		dimmLabels, nil,
+	)
+	dimmShutdownCount = prometheus.NewDesc(
+		"pmem_dimm_shutdown_count",
+		"Number of dirty shutdowns of the PMEM DIMM.",
+		dimmLabels, nil,
+	)
+	dimmLastShutdownDirty = prometheus.NewDesc(
+		"pmem_dimm_last_shutdown_dirty",
+		"1 if data might have been lost during the last shutdown of the PMEM DIMM, 0 otherwise.",
+		dimmLabels, nil,
+	)
+
+	volumeBadblocks = prometheus.NewDesc(
+		"pmem_volume_badblocks_bytes",
+		"Amount of PMEM with known media errors inside the volume.",
+		[]string{"volume_id"}, nil,
+	)
+
+	freeCapacity = prometheus.NewDesc(
+		"pmem_free_bytes",
+		"Total amount of free PMEM, including fragments too small for the largest volume.",
+		nil, nil,
+	)
+
+	largestCapacity = prometheus.NewDesc(
+		"pmem_largest_allocatable_bytes",
+		"Size of the largest volume with the default layout that currently can be created.",
+		nil, nil,
+	)
+
+	healthStateValues = map[ndctl.HealthState]float64{
+		ndctl.HealthOK:          0,
+		ndctl.HealthNonCritical: 1,
+		ndctl.HealthCritical:    2,
+		ndctl.HealthFatal:       3,
+	}
+)
+
+type dimmHealthCollector struct{}
+
+var _ prometheus.Collector = dimmHealthCollector{}
+
+//NewDimmHealthCollector returns a Prometheus collector which reports the
+//SMART health information of all PMEM DIMMs as gauges. The DIMMs get
+//queried each time the metrics are scraped.
+func NewDimmHealthCollector() prometheus.Collector {
+	return dimmHealthCollector{}
+}
+
+func (c dimmHealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dimmHealthState
+	ch <- dimmTemperature
+	ch <- dimmSpareBlocks
+	ch <- dimmPercentageUsed
+	ch <- dimmShutdownCount
+	ch <- dimmLastShutdownDirty
+}
+
+func (c dimmHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		klog.Errorf("DIMM health: %v", err)
+		return
+	}
+	defer ndctx.Free()
+
+	for _, bus := range ndctx.GetBuses() {
+		for _, dimm := range bus.Dimms() {
+			health, err := dimm.Health()
+			if err != nil {
+				if errors.Is(err, ndctl.ErrNotSupported) {
+					klog.V(5).Infof("DIMM health: %v", err)
+				} else {
+					klog.Errorf("DIMM health: %v", err)
+				}
+				continue
+			}
+			labels := []string{dimm.DeviceName(), dimm.ID()}
+			gauge := func(desc *prometheus.Desc, value float64) {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+			}
+			if value, ok := healthStateValues[health.State]; ok {
+				gauge(dimmHealthState, value)
+			}
+			if health.Temperature != nil {
+				gauge(dimmTemperature, *health.Temperature)
+			}
+			if health.SpareBlocks != nil {
+				gauge(dimmSpareBlocks, float64(*health.SpareBlocks))
+			}
+			if health.PercentageUsed != nil {
+				gauge(dimmPercentageUsed, float64(*health.PercentageUsed))
+			}
+			if health.ShutdownCount != nil {
+				gauge(dimmShutdownCount, float64(*health.ShutdownCount))
+			}
+			if health.LastShutdownDirty != nil {
+				dirty := 0.0
+				if *health.LastShutdownDirty {
+					dirty = 1
+				}
+				gauge(dimmLastShutdownDirty, dirty)
+			}
+		}
+	}
+}
+
+type badblocksCollector struct {
+	dm      PmemDeviceManager
+	managed func(volumeID string) bool
+}
+
+var _ prometheus.Collector = badblocksCollector{}
+
+//NewBadblocksCollector returns a Prometheus collector which reports
+//the amount of known bad blocks for each device of the device manager
+//for which managed returns true. Devices without bad blocks are
+//reported with zero. Other devices, like namespaces created by some
+//other software, are ignored.
+func NewBadblocksCollector(dm PmemDeviceManager, managed func(volumeID string) bool) prometheus.Collector {
+	return badblocksCollector{dm: dm, managed: managed}
+}
+
+func (c badblocksCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumeBadblocks
+}
+
+func (c badblocksCollector) Collect(ch chan<- prometheus.Metric) {
+	devices, err := c.dm.ListDevices()
+	if err != nil {
+		klog.Errorf("bad blocks: %v", err)
+		return
+	}
+	// Namespaces not created by PMEM-CSI may share the same name.
+	bad := map[string]uint64{}
+	for _, dev := range devices {
+		if !c.managed(dev.VolumeId) {
+			continue
+		}
+		total := bad[dev.VolumeId]
+		for _, bb := range dev.Badblocks {
+			total += bb.Length
+		}
+		bad[dev.VolumeId] = total
+	}
+	for volumeID, bytes := range bad {
+		ch <- prometheus.MustNewConstMetric(volumeBadblocks, prometheus.GaugeValue, float64(bytes), volumeID)
+	}
+}
+
+type capacityCollector struct {
+	dm PmemDeviceManager
+}
+
+var _ prometheus.Collector = capacityCollector{}
+
+//NewCapacityCollector returns a Prometheus collector which reports
+//the total free space of the device manager and the size of the
+//largest volume that can be created. A large difference between the
+//two indicates fragmentation.
+func NewCapacityCollector(dm PmemDeviceManager) prometheus.Collector {
+	return capacityCollector{dm: dm}
+}
+
+func (c capacityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- freeCapacity
+	ch <- largestCapacity
+}
+
+func (c capacityCollector) Collect(ch chan<- prometheus.Metric) {
+	capacity, err := c.dm.GetCapacity(CapacityOpts{})
+	if err != nil {
+		klog.Errorf("capacity: %v", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(freeCapacity, prometheus.GaugeValue, float64(capacity.Total))
+	ch <- prometheus.MustNewConstMetric(largestCapacity, prometheus.GaugeValue, float64(capacity.Largest))
+}
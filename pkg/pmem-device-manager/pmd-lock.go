@@ -0,0 +1,95 @@
+package pmdmanager
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyedMutex provides one mutex per key, for example per volume group,
+// region or volume. Operations which use different keys do not block
+// each other. The mutex for a key only exists while it is in use.
+// Each key can also be locked for reading, which only blocks writers.
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*refMutex
+}
+
+type refMutex struct {
+	sync.RWMutex
+	// refs counts the goroutines which own or wait for the mutex.
+	refs int
+}
+
+// lock blocks until the caller owns the mutex for the key and returns
+// the function which unlocks it again.
+func (k *keyedMutex) lock(key string) func() {
+	m := k.get(key)
+	m.Lock()
+	return func() {
+		m.Unlock()
+		k.put(key, m)
+	}
+}
+
+// rlock blocks until the caller shares the mutex for the key with
+// other readers and returns the function which unlocks it again.
+func (k *keyedMutex) rlock(key string) func() {
+	m := k.get(key)
+	m.RLock()
+	return func() {
+		m.RUnlock()
+		k.put(key, m)
+	}
+}
+
+func (k *keyedMutex) get(key string) *refMutex {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.locks == nil {
+		k.locks = map[string]*refMutex{}
+	}
+	m, ok := k.locks[key]
+	if !ok {
+		m = &refMutex{}
+		k.locks[key] = m
+	}
+	m.refs++
+	return m
+}
+
+func (k *keyedMutex) put(key string, m *refMutex) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	m.refs--
+	if m.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// lockAll locks several keys. They get locked in sorted order, which
+// avoids deadlocks between callers which need overlapping sets of keys.
+func (k *keyedMutex) lockAll(keys ...string) func() {
+	return k.all(k.lock, keys)
+}
+
+// rlockAll does the same as lockAll, but for reading.
+func (k *keyedMutex) rlockAll(keys ...string) func() {
+	return k.all(k.rlock, keys)
+}
+
+func (k *keyedMutex) all(lock func(key string) func(), keys []string) func() {
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+	var unlocks []func()
+	for i, key := range sorted {
+		if i > 0 && key == sorted[i-1] {
+			continue
+		}
+		unlocks = append(unlocks, lock(key))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package pmdmanager
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	"k8s.io/klog"
+)
+
+const (
+	// Loop devices use 512 byte sectors, but file systems and
+	// page mappings work better with page aligned sizes.
+	loopAlign uint64 = 4 * 1024
+
+	// Suffix of the sparse files which back the loop devices.
+	loopFileSuffix = ".img"
+)
+
+// pmemLoop simulates PMEM with sparse files that get attached as
+// loop devices. Nothing is persistent in the sense of PMEM, but it
+// provides block devices with the same life cycle as real PMEM
+// volumes and thus allows running the driver on machines without
+// NVDIMMs.
+type pmemLoop struct {
+	directory string
+	capacity  uint64
+	devices   map[string]*PmemDeviceInfo
+}
+
+var _ PmemDeviceManager = &pmemLoop{}
+
+// mutex to synchronize all losetup calls and the device map
+var loopMutex = &sync.Mutex{}
+
+// NewPmemDeviceManagerLoop Instantiates a new device manager which
+// stores volumes in files inside the given directory. The total size
+// of all volumes is limited to the given capacity.
+//
+// Volumes created by a previous instance with the same directory are
+// picked up again and get re-attached if needed, for example after a
+// reboot.
+func NewPmemDeviceManagerLoop(directory string, capacity uint64) (PmemDeviceManager, error) {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	if capacity == 0 {
+		return nil, fmt.Errorf("simulated PMEM: capacity must be larger than zero")
+	}
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		return nil, fmt.Errorf("simulated PMEM: create directory: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("simulated PMEM: read directory: %v", err)
+	}
+	devices := map[string]*PmemDeviceInfo{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), loopFileSuffix) {
+			continue
+		}
+		volumeId := strings.TrimSuffix(file.Name(), loopFileSuffix)
+		device, err := attachLoopDevice(filepath.Join(directory, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("simulated PMEM: restore volume %q: %v", volumeId, err)
+		}
+		device.VolumeId = volumeId
+		devices[volumeId] = device
+		klog.V(4).Infof("NewPmemDeviceManagerLoop: found volume %s at %s", volumeId, device.Path)
+	}
+
+	return &pmemLoop{
+		directory: directory,
+		capacity:  capacity,
+		devices:   devices,
+	}, nil
+}
+
+func (loop *pmemLoop) GetCapacity(opts CapacityOpts) (Capacity, error) {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	if opts.Layout != "" && opts.Layout != RegionLayout || opts.NumaNode != nil {
+		return Capacity{}, nil
+	}
+
+	// Sparse files do not fragment.
+	capacity := loop.getCapacity()
+	return Capacity{Total: capacity, Largest: capacity}, nil
+}
+
+func (loop *pmemLoop) CreateDevice(volumeId string, size uint64, opts CreateDeviceOpts) error {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	if volumeId == "" || strings.ContainsRune(volumeId, os.PathSeparator) {
+		return fmt.Errorf("volume id %q: %w", volumeId, ErrInvalid)
+	}
+	if opts.Mode != "" && opts.Mode != FsdaxMode {
+		return fmt.Errorf("namespace mode %q not supported in simulated mode: %w", opts.Mode, ErrInvalid)
+	}
+	if opts.Layout != "" && opts.Layout != RegionLayout {
+		return fmt.Errorf("volume layout %q not supported in simulated mode: %w", opts.Layout, ErrInvalid)
+	}
+	if opts.NumaNode != nil {
+		return fmt.Errorf("NUMA node not supported in simulated mode: %w", ErrInvalid)
+	}
+	if _, ok := loop.devices[volumeId]; ok {
+		return ErrDeviceExists
+	}
+
+	// Adjust up to next alignment boundary, if not aligned already.
+	if reminder := size % loopAlign; reminder != 0 {
+		klog.V(5).Infof("CreateDevice align size up by %v: from %v", loopAlign-reminder, size)
+		size += loopAlign - reminder
+	}
+	if size > loop.getCapacity() {
+		return ErrNotEnoughSpace
+	}
+
+	file := loop.fileName(volumeId)
+	fp, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("create backing file for %q: %v", volumeId, err)
+	}
+	fp.Close() //nolint: errcheck, gosec
+	// Sparse file, so no space is used on the host until data gets written.
+	if err := os.Truncate(file, int64(size)); err != nil {
+		os.Remove(file) //nolint: errcheck, gosec
+		return fmt.Errorf("resize backing file for %q: %v", volumeId, err)
+	}
+
+	device, err := attachLoopDevice(file)
+	if err != nil {
+		os.Remove(file) //nolint: errcheck, gosec
+		return err
+	}
+	device.VolumeId = volumeId
+	if err := waitDeviceAppears(device); err != nil {
+		loop.detach(device) //nolint: errcheck
+		return err
+	}
+	// clear start of device to avoid old data being recognized as file system
+	if err := clearDevice(device, EraseOpts{}); err != nil {
+		loop.detach(device) //nolint: errcheck
+		return fmt.Errorf("clear device %q: %v", volumeId, err)
+	}
+
+	loop.devices[volumeId] = device
+
+	return nil
+}
+
+func (loop *pmemLoop) ResizeDevice(volumeId string, size uint64) error {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	device, ok := loop.devices[volumeId]
+	if !ok {
+		return ErrDeviceNotFound
+	}
+	if reminder := size % loopAlign; reminder != 0 {
+		size += loopAlign - reminder
+	}
+	if size <= device.Size {
+		return nil
+	}
+	if size-device.Size > loop.getCapacity() {
+		return ErrNotEnoughSpace
+	}
+
+	if err := os.Truncate(loop.fileName(volumeId), int64(size)); err != nil {
+		return fmt.Errorf("resize backing file for %q: %v", volumeId, err)
+	}
+	// Tell the kernel about the new size of the backing file.
+	if _, err := pmemexec.RunCommand("losetup", "--set-capacity", device.Path); err != nil {
+		return fmt.Errorf("update size of loop device %s: %v", device.Path, err)
+	}
+	device.Size = size
+
+	return nil
+}
+
+func (loop *pmemLoop) CopyDevice(volumeId string, source *PmemDeviceInfo) error {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	device, ok := loop.devices[volumeId]
+	if !ok {
+		return ErrDeviceNotFound
+	}
+
+	return copyDevice(source, device)
+}
+
+func (loop *pmemLoop) DeleteDevice(volumeId string, erase EraseOpts) error {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	device, ok := loop.devices[volumeId]
+	if !ok {
+		return nil
+	}
+	if err := clearDevice(device, erase); err != nil {
+		if !errors.Is(err, ErrDeviceNotFound) {
+			return err
+		}
+	}
+
+	if err := loop.detach(device); err != nil {
+		return err
+	}
+
+	// Remove device from cache
+	delete(loop.devices, volumeId)
+
+	return nil
+}
+
+func (loop *pmemLoop) ListDevices() ([]*PmemDeviceInfo, error) {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	devices := []*PmemDeviceInfo{}
+	for _, dev := range loop.devices {
+		devices = append(devices, dev)
+	}
+
+	return devices, nil
+}
+
+func (loop *pmemLoop) GetDevice(volumeId string) (*PmemDeviceInfo, error) {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	if dev, ok := loop.devices[volumeId]; ok {
+		return dev, nil
+	}
+
+	return nil, ErrDeviceNotFound
+}
+
+func (loop *pmemLoop) getCapacity() uint64 {
+	var used uint64
+	for _, dev := range loop.devices {
+		used += dev.Size
+	}
+	if used >= loop.capacity {
+		return 0
+	}
+	return loop.capacity - used
+}
+
+// detach detaches the loop device and removes its backing file.
+func (loop *pmemLoop) detach(device *PmemDeviceInfo) error {
+	if _, err := pmemexec.RunCommand("losetup", "--detach", device.Path); err != nil {
+		return fmt.Errorf("detach loop device %s: %v", device.Path, err)
+	}
+	if err := os.Remove(loop.fileName(device.VolumeId)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove backing file for %q: %v", device.VolumeId, err)
+	}
+	return nil
+}
+
+func (loop *pmemLoop) fileName(volumeId string) string {
+	return filepath.Join(loop.directory, volumeId+loopFileSuffix)
+}
+
+// attachLoopDevice returns the loop device for the given file,
+// attaching it first if it is not attached yet.
+func attachLoopDevice(file string) (*PmemDeviceInfo, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Output format: /dev/loop0: [65024]:9618274 (/var/lib/pmem-csi.intel.com/simulated/foo.img)
+	output, err := pmemexec.RunCommand("losetup", "--associated", file)
+	if err != nil {
+		return nil, fmt.Errorf("losetup failure: %v", err)
+	}
+	path := ""
+	if fields := strings.SplitN(output, ":", 2); len(fields) == 2 {
+		path = strings.TrimSpace(fields[0])
+	} else {
+		output, err := pmemexec.RunCommand("losetup", "--find", "--show", file)
+		if err != nil {
+			return nil, fmt.Errorf("attach %s to loop device: %v", file, err)
+		}
+		path = strings.TrimSpace(output)
+	}
+
+	return &PmemDeviceInfo{
+		Path:     path,
+		Size:     uint64(info.Size()),
+		NumaNode: -1,
+	}, nil
+}
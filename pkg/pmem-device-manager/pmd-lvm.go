@@ -3,100 +3,210 @@ package pmdmanager
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/intel/pmem-csi/pkg/ndctl"
 	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
-	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	pmemlvm "github.com/intel/pmem-csi/pkg/pmem-lvm"
 	"k8s.io/klog"
 )
 
 const (
 	// 4 MB alignment is used by LVM
 	lvmAlign uint64 = 4 * 1024 * 1024
+
+	// LV tag which marks logical volumes that hold a snapshot
+	// instead of a volume.
+	lvmSnapshotTag = "pmem-csi.snapshot"
+
+	// Stripe size for striped volumes, large enough to keep
+	// huge pages of DAX mappings inside a single stripe.
+	lvmStripeSize = "2m"
 )
 
+// pmemLvm does not hold a global lock while working on a device.
+// LVM commands get serialized by the LVM client, erasing and copying
+// data runs concurrently with operations on other devices.
 type pmemLvm struct {
-	volumeGroups []string
-	devices      map[string]*PmemDeviceInfo
+	client             *pmemlvm.Client
+	volumeGroups       []string
+	sectorVolumeGroups []string
+	// thin is set when creating thin volumes in the thin pools of
+	// the volume groups.
+	thin *ThinOpts
+
+	// mutex protects the device and snapshot caches. It is only
+	// held briefly and never while running commands.
+	mutex     sync.Mutex
+	devices   map[string]*PmemDeviceInfo
+	snapshots map[string]*PmemDeviceInfo
+
+	// vgLocks serialize changes inside a volume group, so that
+	// placement decisions are based on the current free space.
+	vgLocks keyedMutex
+	// volumeLocks serialize operations on the same volume or
+	// snapshot. Both share the same namespace.
+	volumeLocks keyedMutex
 }
 
 var _ PmemDeviceManager = &pmemLvm{}
-var lvsArgs = []string{"--noheadings", "--nosuffix", "-o", "lv_name,lv_path,lv_size", "--units", "B"}
-var vgsArgs = []string{"--noheadings", "--nosuffix", "-o", "vg_name,vg_size,vg_free", "--units", "B"}
-
-// mutex to synchronize all LVM calls
-// The reason we chose not to support concurrent LVM calls was
-// due to LVM's inconsistent behavior when made concurrent calls
-// in our stress tests. One should revisit this and choose better
-// suitable synchronization policy.
-var lvmMutex = &sync.Mutex{}
+var _ PmemSnapshotManager = &pmemLvm{}
+var _ PmemThinPoolManager = &pmemLvm{}
 
 // NewPmemDeviceManagerLVM Instantiates a new LVM based pmem device manager
 // The pre-requisite for this manager is that all the pmem regions which should be managed by
 // this LMV manager are devided into namespaces and grouped as volume groups.
 func NewPmemDeviceManagerLVM() (PmemDeviceManager, error) {
-	lvmMutex.Lock()
-	defer lvmMutex.Unlock()
+	return NewPmemDeviceManagerLVMForRegions(nil)
+}
 
-	ctx, err := ndctl.NewContext()
+// NewPmemDeviceManagerLVMForRegions does the same as NewPmemDeviceManagerLVM,
+// but only uses the volume groups of regions which pass the filter. Volume
+// groups spanning all regions are only used without a filter.
+func NewPmemDeviceManagerLVMForRegions(regions RegionFilter) (PmemDeviceManager, error) {
+	client := pmemlvm.New(nil)
+	volumeGroups, sectorVolumeGroups, err := findVolumeGroups(client, regions)
 	if err != nil {
 		return nil, err
 	}
+	return newPmemDeviceManagerLVM(client, volumeGroups, sectorVolumeGroups)
+}
+
+// findVolumeGroups returns the existing fsdax and sector mode volume
+// groups of the regions which pass the filter.
+func findVolumeGroups(client *pmemlvm.Client, regions RegionFilter) ([]string, []string, error) {
+	ctx, err := newNdctlContext()
+	if err != nil {
+		return nil, nil, err
+	}
 	volumeGroups := []string{}
+	sectorVolumeGroups := []string{}
 	for _, bus := range ctx.GetBuses() {
 		for _, r := range bus.ActiveRegions() {
-			vgname := pmemcommon.VgName(bus, r)
-			if _, err := pmemexec.RunCommand("vgs", vgname); err != nil {
-				klog.V(5).Infof("NewPmemDeviceManagerLVM: VG %v non-existent, skip", vgname)
-			} else {
-				volumeGroups = append(volumeGroups, vgname)
+			if !regions.allows(r.DeviceName()) {
+				klog.V(5).Infof("NewPmemDeviceManagerLVM: %s not assigned to LVM, skip", r.DeviceName())
+				continue
+			}
+			for _, nsmode := range []ndctl.NamespaceMode{ndctl.FsdaxMode, ndctl.SectorMode} {
+				vgname := pmemcommon.VgName(bus, r, nsmode)
+				if _, err := client.VolumeGroups(vgname); err != nil {
+					klog.V(5).Infof("NewPmemDeviceManagerLVM: VG %v non-existent, skip", vgname)
+				} else if nsmode == ndctl.SectorMode {
+					sectorVolumeGroups = append(sectorVolumeGroups, vgname)
+				} else {
+					volumeGroups = append(volumeGroups, vgname)
+				}
 			}
 		}
 	}
 	ctx.Free()
+	// Volume groups spanning all regions, created by pmem-vgm -spanregions.
+	for _, nsmode := range []ndctl.NamespaceMode{ndctl.FsdaxMode, ndctl.SectorMode} {
+		vgname := pmemcommon.VgNameAllRegions(nsmode)
+		if regions != nil {
+			klog.V(5).Infof("NewPmemDeviceManagerLVM: VG %v spans regions, skip", vgname)
+		} else if _, err := client.VolumeGroups(vgname); err != nil {
+			klog.V(5).Infof("NewPmemDeviceManagerLVM: VG %v non-existent, skip", vgname)
+		} else if nsmode == ndctl.SectorMode {
+			sectorVolumeGroups = append(sectorVolumeGroups, vgname)
+		} else {
+			volumeGroups = append(volumeGroups, vgname)
+		}
+	}
+	return volumeGroups, sectorVolumeGroups, nil
+}
 
-	return NewPmemDeviceManagerLVMForVGs(volumeGroups)
+// NewPmemDeviceManagerLVMForVGs instantiates a LVM based pmem device manager for the
+// given volume groups. The sector volume groups must be backed by sector mode namespaces,
+// the others by fsdax mode namespaces.
+func NewPmemDeviceManagerLVMForVGs(volumeGroups []string, sectorVolumeGroups []string) (PmemDeviceManager, error) {
+	return newPmemDeviceManagerLVM(pmemlvm.New(nil), volumeGroups, sectorVolumeGroups)
 }
 
-func NewPmemDeviceManagerLVMForVGs(volumeGroups []string) (PmemDeviceManager, error) {
-	devices, err := listDevices(volumeGroups...)
+func newPmemDeviceManagerLVM(client *pmemlvm.Client, volumeGroups []string, sectorVolumeGroups []string) (*pmemLvm, error) {
+	lvm := &pmemLvm{
+		client:             client,
+		volumeGroups:       volumeGroups,
+		sectorVolumeGroups: sectorVolumeGroups,
+	}
+	devices, snapshots, err := lvm.listDevices(append(volumeGroups, sectorVolumeGroups...)...)
 	if err != nil {
 		return nil, err
 	}
+	lvm.devices = devices
+	lvm.snapshots = snapshots
 
-	return &pmemLvm{
-		volumeGroups: volumeGroups,
-		devices:      devices,
-	}, nil
-}
-
-type vgInfo struct {
-	name string
-	size uint64
-	free uint64
+	return lvm, nil
 }
 
-func (lvm *pmemLvm) GetCapacity() (uint64, error) {
-	lvmMutex.Lock()
-	defer lvmMutex.Unlock()
-	return lvm.getCapacity()
+func (lvm *pmemLvm) GetCapacity(opts CapacityOpts) (Capacity, error) {
+	if lvm.thin != nil {
+		return lvm.getThinCapacity(opts)
+	}
+	var capacity Capacity
+	vgs, err := lvm.getVolumeGroups(lvm.volumeGroups)
+	if err != nil {
+		return capacity, err
+	}
+	for _, vg := range vgs {
+		// The free space of the volume group is only usable
+		// in one piece if the layout allows spanning regions.
+		free, largest, err := lvm.vgCapacity(vg.Name, opts)
+		if err != nil {
+			return capacity, err
+		}
+		capacity.Total += free
+		if largest > capacity.Largest {
+			capacity.Largest = largest
+		}
+	}
+	return capacity, nil
 }
 
-func (lvm *pmemLvm) CreateDevice(volumeId string, size uint64) error {
-	lvmMutex.Lock()
-	defer lvmMutex.Unlock()
+func (lvm *pmemLvm) CreateDevice(volumeId string, size uint64, opts CreateDeviceOpts) error {
+	volumeGroups := lvm.volumeGroups
+	switch opts.Mode {
+	case "", FsdaxMode:
+	case SectorMode:
+		volumeGroups = lvm.sectorVolumeGroups
+		if len(volumeGroups) == 0 {
+			return fmt.Errorf("no volume groups for namespace mode %q: %w", opts.Mode, ErrNotEnoughSpace)
+		}
+	default:
+		return fmt.Errorf("namespace mode %q not supported in LVM mode: %w", opts.Mode, ErrInvalid)
+	}
+	switch opts.Layout {
+	case "", RegionLayout, LinearLayout:
+	case StripedLayout:
+		if lvm.thin != nil {
+			return fmt.Errorf("volume layout %q not supported for thin volumes: %w", opts.Layout, ErrInvalid)
+		}
+	default:
+		return fmt.Errorf("volume layout %q: %w", opts.Layout, ErrInvalid)
+	}
+	if lvm.thin != nil && overwritesThinVolume(opts.ErasePolicy) {
+		return fmt.Errorf("erase policy %q not supported for thin volumes: %w", opts.ErasePolicy, ErrInvalid)
+	}
+	tags, err := metadataTags(opts.Metadata)
+	if err != nil {
+		return err
+	}
+	unlock := lvm.volumeLocks.lock(volumeId)
+	defer unlock()
 	// Check that such volume does not exist. In certain error states, for example when
 	// namespace creation works but device zeroing fails (missing /dev/pmemX.Y in container),
 	// this function is asked to create new devices repeatedly, forcing running out of space.
 	// Avoid device filling with garbage entries by returning error.
 	// Overall, no point having more than one namespace with same volumeId.
-	if _, err := lvm.getDevice(volumeId); err == nil {
+	if lvm.isCached(volumeId) {
 		return ErrDeviceExists
 	}
-	vgs, err := getVolumeGroups(lvm.volumeGroups)
+	vgs, err := lvm.getVolumeGroups(volumeGroups)
 	if err != nil {
 		return err
 	}
@@ -110,41 +220,256 @@ func (lvm *pmemLvm) CreateDevice(volumeId string, size uint64) error {
 		size += lvmAlign - reminder
 		klog.V(5).Infof("CreateDevice align size up: to %v", size)
 	}
-	strSz := strconv.FormatUint(size, 10) + "B"
 
 	for _, vg := range vgs {
-		// use first Vgroup with enough available space
-		if vg.free >= size {
-			// In some container environments clearing device fails with race condition.
-			// So, we ask lvm not to clear(-Zn) the newly created device, instead we do ourself in later stage.
-			// lvcreate takes size in MBytes if no unit
-			if _, err := pmemexec.RunCommand("lvcreate", "-Zn", "-L", strSz, "-n", volumeId, vg.name); err != nil {
-				klog.V(3).Infof("lvcreate failed with error: %v, trying for next free region", err)
-			} else {
-				// clear start of device to avoid old data being recognized as file system
-				device, err := getUncachedDevice(volumeId, vg.name)
-				if err != nil {
-					return err
-				}
-				if err := waitDeviceAppears(device); err != nil {
-					return err
-				}
-				if err := clearDevice(device, false); err != nil {
-					return fmt.Errorf("clear device %q: %v", volumeId, err)
-				}
+		var device *PmemDeviceInfo
+		if lvm.thin != nil {
+			// The free space of the volume group does not
+			// matter, only that of its thin pool.
+			device, err = lvm.createThinLV(volumeId, vg.Name, size, tags, opts)
+		} else if vg.Free >= size {
+			// use first Vgroup with enough available space
+			device, err = lvm.createLV(volumeId, vg.Name, size, tags, opts)
+		}
+		if err != nil {
+			return err
+		}
+		if device == nil {
+			continue
+		}
+		// clear start of device to avoid old data being recognized as file system
+		if err := waitDeviceAppears(device); err != nil {
+			return err
+		}
+		if err := clearDevice(device, EraseOpts{}); err != nil {
+			return fmt.Errorf("clear device %q: %v", volumeId, err)
+		}
+
+		lvm.mutex.Lock()
+		lvm.devices[device.VolumeId] = device
+		lvm.mutex.Unlock()
+
+		return nil
+	}
+	return ErrNotEnoughSpace
+}
+
+// createLV creates the logical volume for CreateDevice inside the
+// volume group. The result is nil if it does not fit.
+func (lvm *pmemLvm) createLV(volumeId string, vgName string, size uint64, tags []string, opts CreateDeviceOpts) (*PmemDeviceInfo, error) {
+	unlock := lvm.vgLocks.lock(vgName)
+	defer unlock()
+
+	placement, err := lvm.placeLV(vgName, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	if placement == nil {
+		klog.V(5).Infof("CreateDevice: no space for %s layout in %s", opts.Layout, vgName)
+		return nil, nil
+	}
+	// In some container environments clearing device fails with race condition.
+	// So, we ask lvm not to clear the newly created device, instead we do ourself in later stage.
+	err = lvm.client.CreateLV(pmemlvm.CreateLVOpts{
+		Name:       volumeId,
+		VGName:     vgName,
+		Size:       size,
+		Tags:       tags,
+		Stripes:    placement.stripes,
+		StripeSize: lvmStripeSize,
+		PVs:        placement.pvs,
+	})
+	if errors.Is(err, pmemlvm.ErrExists) {
+		return nil, ErrDeviceExists
+	}
+	if err != nil {
+		klog.V(3).Infof("lvcreate failed with error: %v, trying for next free region", err)
+		return nil, nil
+	}
+	return lvm.getUncachedDevice(volumeId, vgName)
+}
 
-				lvm.devices[device.VolumeId] = device
+// lvPlacement holds additional lvcreate parameters.
+type lvPlacement struct {
+	// number of stripes, 0 for a linear volume
+	stripes uint64
+	// physical volumes that may be used, all if empty
+	pvs []string
+}
 
-				return nil
+// placeLV decides how a new logical volume with the given size and
+// layout gets placed inside the volume group, optionally restricted
+// to physical volumes on a certain NUMA node and without bad blocks.
+// The result is nil if the volume does not fit. The caller must have
+// checked already that the volume group has enough free space.
+func (lvm *pmemLvm) placeLV(vgName string, size uint64, opts CreateDeviceOpts) (*lvPlacement, error) {
+	allPVs, err := lvm.getPhysicalVolumes(vgName)
+	if err != nil {
+		return nil, err
+	}
+	pvs := allPVs
+	if opts.NumaNode != nil || opts.AvoidBadblocks {
+		pvs = []pmemlvm.PhysicalVolume{}
+		for _, pv := range allPVs {
+			if opts.NumaNode != nil && pvNumaNode(pv.Name) != *opts.NumaNode {
+				continue
+			}
+			if opts.AvoidBadblocks && len(lvm.getPVBadblocks(pv.Name)) > 0 {
+				klog.V(3).Infof("Skipping %s because of bad blocks", pv.Name)
+				continue
 			}
+			pvs = append(pvs, pv)
+		}
+		if len(pvs) == 0 {
+			return nil, nil
 		}
 	}
-	return ErrNotEnoughSpace
+	// Only restrict LVM if really needed.
+	usable := func(pvs []pmemlvm.PhysicalVolume) []string {
+		if len(pvs) == len(allPVs) {
+			return nil
+		}
+		names := []string{}
+		for _, pv := range pvs {
+			names = append(names, pv.Name)
+		}
+		return names
+	}
+
+	switch opts.Layout {
+	case LinearLayout:
+		// LVM concatenates as many physical volumes as needed.
+		var free uint64
+		for _, pv := range pvs {
+			free += pv.Free
+		}
+		if free < size {
+			return nil, nil
+		}
+		return &lvPlacement{pvs: usable(pvs)}, nil
+	case StripedLayout:
+		if len(pvs) <= 1 {
+			opts.Layout = LinearLayout
+			return lvm.placeLV(vgName, size, opts)
+		}
+		// One stripe per physical volume, each of them needs
+		// the same amount of free space.
+		stripes := uint64(len(pvs))
+		stripeSize := (size + stripes - 1) / stripes
+		if reminder := stripeSize % lvmAlign; reminder != 0 {
+			stripeSize += lvmAlign - reminder
+		}
+		for _, pv := range pvs {
+			if pv.Free < stripeSize {
+				return nil, nil
+			}
+		}
+		return &lvPlacement{
+			stripes: stripes,
+			pvs:     usable(pvs),
+		}, nil
+	default:
+		// Keep the volume inside a single region. This only
+		// matters for volume groups which span several regions.
+		regions := []string{}
+		regionPVs := map[string][]pmemlvm.PhysicalVolume{}
+		for _, pv := range pvs {
+			region := pvRegion(pv.Name)
+			if _, ok := regionPVs[region]; !ok {
+				regions = append(regions, region)
+			}
+			regionPVs[region] = append(regionPVs[region], pv)
+		}
+		for _, region := range regions {
+			var free uint64
+			for _, pv := range regionPVs[region] {
+				free += pv.Free
+			}
+			if free >= size {
+				return &lvPlacement{pvs: usable(regionPVs[region])}, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+func (lvm *pmemLvm) ResizeDevice(volumeId string, size uint64) error {
+	unlock := lvm.volumeLocks.lock(volumeId)
+	defer unlock()
+
+	device, err := lvm.getDevice(volumeId)
+	if err != nil {
+		return err
+	}
+	// Same alignment as in CreateDevice.
+	if reminder := size % lvmAlign; reminder != 0 {
+		size += lvmAlign - reminder
+	}
+	if size <= device.Size {
+		klog.V(4).Infof("ResizeDevice: %s already has size %v, requested %v", volumeId, device.Size, size)
+		return nil
+	}
+
+	// The LV can only grow inside its own volume group.
+	vgName := lvVolumeGroup(device)
+	unlockVG := lvm.vgLocks.lock(vgName)
+	defer unlockVG()
+	if device.pool != "" {
+		// Only the virtual size grows.
+		pool, err := lvm.getThinPool(vgName)
+		if err != nil {
+			return err
+		}
+		if !lvm.thinPoolFits(pool, size-device.Size) {
+			return ErrNotEnoughSpace
+		}
+		if err := lvm.client.ExtendLV(device.Path, size); err != nil {
+			return lvmError(err)
+		}
+	} else {
+		vgs, err := lvm.getVolumeGroups([]string{vgName})
+		if err != nil {
+			return err
+		}
+		if len(vgs) != 1 || vgs[0].Free < size-device.Size {
+			return ErrNotEnoughSpace
+		}
+
+		pvs, err := lvm.lvExtendPVs(device.Path, vgName)
+		if err != nil {
+			return err
+		}
+		if err := lvm.client.ExtendLV(device.Path, size, pvs...); err != nil {
+			return lvmError(err)
+		}
+	}
+
+	device, err = lvm.getUncachedDevice(volumeId, vgName)
+	if err != nil {
+		return err
+	}
+	lvm.mutex.Lock()
+	lvm.devices[volumeId] = device
+	lvm.mutex.Unlock()
+
+	return nil
+}
+
+func (lvm *pmemLvm) CopyDevice(volumeId string, source *PmemDeviceInfo) error {
+	unlock := lvm.volumeLocks.lock(volumeId)
+	defer unlock()
+
+	device, err := lvm.getDevice(volumeId)
+	if err != nil {
+		return err
+	}
+
+	return copyDevice(source, device)
 }
 
-func (lvm *pmemLvm) DeleteDevice(volumeId string, flush bool) error {
-	lvmMutex.Lock()
-	defer lvmMutex.Unlock()
+func (lvm *pmemLvm) DeleteDevice(volumeId string, erase EraseOpts) error {
+	unlock := lvm.volumeLocks.lock(volumeId)
+	defer unlock()
 
 	var err error
 	var device *PmemDeviceInfo
@@ -155,45 +480,196 @@ func (lvm *pmemLvm) DeleteDevice(volumeId string, flush bool) error {
 		}
 		return err
 	}
-	if err := clearDevice(device, flush); err != nil {
+	// Erasing may take minutes. Only the volume itself is locked
+	// while that happens.
+	if err := clearDevice(device, thinErase(device, erase)); err != nil {
 		if errors.Is(err, ErrDeviceNotFound) {
-			// Remove device from cache
-			delete(lvm.devices, volumeId)
+			lvm.uncache(volumeId)
 			return nil
 		}
 		return err
 	}
 
-	if _, err := pmemexec.RunCommand("lvremove", "-fy", device.Path); err != nil {
+	if err := lvm.client.RemoveLV(device.Path); err != nil && !errors.Is(err, pmemlvm.ErrNotFound) {
+		return lvmError(err)
+	}
+
+	lvm.uncache(volumeId)
+
+	return nil
+}
+
+func (lvm *pmemLvm) CreateSnapshot(name string, sourceName string) error {
+	// The source must not go away while copying it.
+	unlock := lvm.volumeLocks.lockAll(name, sourceName)
+	defer unlock()
+
+	// Volumes and snapshots share the same LV namespace.
+	if lvm.isCached(name) {
+		return ErrDeviceExists
+	}
+	source, err := lvm.getDevice(sourceName)
+	if err != nil {
 		return err
 	}
 
-	// Remove device from cache
-	delete(lvm.devices, volumeId)
+	snapshot, err := lvm.createSnapshotLV(name, source)
+	if err != nil {
+		return err
+	}
+	if err := waitDeviceAppears(snapshot); err != nil {
+		return err
+	}
+	if err := copyDevice(source, snapshot); err != nil {
+		if e := lvm.client.RemoveLV(snapshot.Path); e != nil {
+			klog.Warningf("CreateSnapshot: removing incomplete snapshot %s failed: %v", name, e)
+		}
+		return fmt.Errorf("copy %q to snapshot %q: %v", sourceName, name, err)
+	}
+
+	lvm.mutex.Lock()
+	lvm.snapshots[name] = snapshot
+	lvm.mutex.Unlock()
+
+	return nil
+}
+
+// createSnapshotLV creates the logical volume for a snapshot of the
+// source. The copy gets created in the same volume group as the
+// source, which preserves the region affinity.
+func (lvm *pmemLvm) createSnapshotLV(name string, source *PmemDeviceInfo) (*PmemDeviceInfo, error) {
+	vgName := lvVolumeGroup(source)
+	unlock := lvm.vgLocks.lock(vgName)
+	defer unlock()
+
+	if source.pool != "" {
+		// Snapshots of thin volumes are thin volumes in the
+		// same pool.
+		pool, err := lvm.getThinPool(vgName)
+		if err != nil {
+			return nil, err
+		}
+		if !lvm.thinPoolFits(pool, source.Size) {
+			return nil, ErrNotEnoughSpace
+		}
+	} else {
+		vgs, err := lvm.getVolumeGroups([]string{vgName})
+		if err != nil {
+			return nil, err
+		}
+		if len(vgs) != 1 || vgs[0].Free < source.Size {
+			return nil, ErrNotEnoughSpace
+		}
+	}
+
+	// A full copy instead of a LVM snapshot: a snapshot origin
+	// cannot be mounted with -o dax anymore and a copy-on-write
+	// snapshot would get invalid when running out of space.
+	if err := lvm.client.CreateLV(pmemlvm.CreateLVOpts{
+		Name:     name,
+		VGName:   vgName,
+		Size:     source.Size,
+		Tags:     []string{lvmSnapshotTag},
+		ThinPool: source.pool,
+	}); err != nil {
+		return nil, lvmError(err)
+	}
+	_, snapshots, err := lvm.listDevices(vgName)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, ok := snapshots[name]
+	if !ok {
+		return nil, fmt.Errorf("snapshot %q not found after creating it", name)
+	}
+	return snapshot, nil
+}
+
+func (lvm *pmemLvm) GetSnapshot(name string) (*PmemDeviceInfo, error) {
+	lvm.mutex.Lock()
+	defer lvm.mutex.Unlock()
+
+	if snapshot, ok := lvm.snapshots[name]; ok {
+		return snapshot, nil
+	}
+
+	return nil, ErrDeviceNotFound
+}
+
+func (lvm *pmemLvm) DeleteSnapshot(name string, erase EraseOpts) error {
+	unlock := lvm.volumeLocks.lock(name)
+	defer unlock()
+
+	snapshot, err := lvm.GetSnapshot(name)
+	if err != nil {
+		return nil
+	}
+	if err := clearDevice(snapshot, thinErase(snapshot, erase)); err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			lvm.uncache(name)
+			return nil
+		}
+		return err
+	}
+
+	if err := lvm.client.RemoveLV(snapshot.Path); err != nil && !errors.Is(err, pmemlvm.ErrNotFound) {
+		return lvmError(err)
+	}
+
+	lvm.uncache(name)
 
 	return nil
 }
 
+func (lvm *pmemLvm) ListSnapshots() ([]*PmemDeviceInfo, error) {
+	lvm.mutex.Lock()
+	defer lvm.mutex.Unlock()
+
+	snapshots := []*PmemDeviceInfo{}
+	for _, snapshot := range lvm.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
 func (lvm *pmemLvm) ListDevices() ([]*PmemDeviceInfo, error) {
-	lvmMutex.Lock()
-	defer lvmMutex.Unlock()
+	lvm.mutex.Lock()
+	cached := []*PmemDeviceInfo{}
+	for _, dev := range lvm.devices {
+		cached = append(cached, dev)
+	}
+	lvm.mutex.Unlock()
 
+	// Looking up bad blocks involves commands, which must not
+	// block the cache.
 	devices := []*PmemDeviceInfo{}
-	for _, dev := range lvm.devices {
-		devices = append(devices, dev)
+	for _, dev := range cached {
+		devices = append(devices, lvm.withBadblocks(dev))
 	}
 
 	return devices, nil
 }
 
 func (lvm *pmemLvm) GetDevice(volumeId string) (*PmemDeviceInfo, error) {
-	lvmMutex.Lock()
-	defer lvmMutex.Unlock()
+	dev, err := lvm.getDevice(volumeId)
+	if err != nil {
+		return nil, err
+	}
+	return lvm.withBadblocks(dev), nil
+}
 
-	return lvm.getDevice(volumeId)
+// withBadblocks returns a copy of the cached device with the current bad blocks.
+func (lvm *pmemLvm) withBadblocks(dev *PmemDeviceInfo) *PmemDeviceInfo {
+	result := *dev
+	result.Badblocks = lvm.lvBadblocks(dev)
+	return &result
 }
 
 func (lvm *pmemLvm) getDevice(volumeId string) (*PmemDeviceInfo, error) {
+	lvm.mutex.Lock()
+	defer lvm.mutex.Unlock()
+
 	if dev, ok := lvm.devices[volumeId]; ok {
 		return dev, nil
 	}
@@ -201,8 +677,27 @@ func (lvm *pmemLvm) getDevice(volumeId string) (*PmemDeviceInfo, error) {
 	return nil, ErrDeviceNotFound
 }
 
-func getUncachedDevice(volumeId string, volumeGroup string) (*PmemDeviceInfo, error) {
-	devices, err := listDevices(volumeGroup)
+// isCached checks whether a volume or snapshot with that name is known.
+func (lvm *pmemLvm) isCached(name string) bool {
+	lvm.mutex.Lock()
+	defer lvm.mutex.Unlock()
+
+	_, isDevice := lvm.devices[name]
+	_, isSnapshot := lvm.snapshots[name]
+	return isDevice || isSnapshot
+}
+
+// uncache removes a volume or snapshot from the cache.
+func (lvm *pmemLvm) uncache(name string) {
+	lvm.mutex.Lock()
+	defer lvm.mutex.Unlock()
+
+	delete(lvm.devices, name)
+	delete(lvm.snapshots, name)
+}
+
+func (lvm *pmemLvm) getUncachedDevice(volumeId string, volumeGroup string) (*PmemDeviceInfo, error) {
+	devices, _, err := lvm.listDevices(volumeGroup)
 	if err != nil {
 		return nil, err
 	}
@@ -214,71 +709,288 @@ func getUncachedDevice(volumeId string, volumeGroup string) (*PmemDeviceInfo, er
 	return nil, ErrDeviceNotFound
 }
 
-// listDevices Lists available logical devices in given volume groups
-func listDevices(volumeGroups ...string) (map[string]*PmemDeviceInfo, error) {
-	args := append(lvsArgs, volumeGroups...)
-	output, err := pmemexec.RunCommand("lvs", args...)
+// listDevices Lists available logical devices in given volume groups,
+// separated into volumes and snapshots. Logical volumes in sector mode
+// volume groups do not support DAX.
+func (lvm *pmemLvm) listDevices(volumeGroups ...string) (map[string]*PmemDeviceInfo, map[string]*PmemDeviceInfo, error) {
+	devices := map[string]*PmemDeviceInfo{}
+	snapshots := map[string]*PmemDeviceInfo{}
+	if len(volumeGroups) == 0 {
+		// Without arguments, lvs would report all logical volumes.
+		return devices, snapshots, nil
+	}
+	lvs, err := lvm.client.LogicalVolumes(volumeGroups...)
 	if err != nil {
-		return nil, fmt.Errorf("lvs failure : %v", err)
+		return nil, nil, fmt.Errorf("lvs failure: %v", err)
+	}
+	for _, lv := range lvs {
+		if lv.ThinPool {
+			// Holds thin volumes, not a volume itself.
+			continue
+		}
+		dev := lvToPmemInfo(lv)
+		for _, vg := range lvm.sectorVolumeGroups {
+			if lv.VGName == vg {
+				dev.Dax = false
+			}
+		}
+		if lv.HasTag(lvmSnapshotTag) {
+			snapshots[dev.VolumeId] = dev
+		} else {
+			devices[dev.VolumeId] = dev
+		}
 	}
-	return parseLVSOutput(output)
+	return devices, snapshots, nil
 }
 
-//lvs options "lv_name,lv_path,lv_size,lv_free"
-func parseLVSOutput(output string) (map[string]*PmemDeviceInfo, error) {
-	devices := map[string]*PmemDeviceInfo{}
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		fields := strings.Fields(strings.TrimSpace(line))
-		if len(fields) != 3 {
+func lvToPmemInfo(lv pmemlvm.LogicalVolume) *PmemDeviceInfo {
+	metadata, err := parseMetadataTags(lv.Tags)
+	if err != nil {
+		klog.Warningf("Logical volume %s: %v", lv.Name, err)
+	}
+	return &PmemDeviceInfo{
+		VolumeId: lv.Name,
+		Path:     lv.Path,
+		Size:     lv.Size,
+		NumaNode: lvNumaNode(lv.PVs()),
+		segments: lv.Segments,
+		pool:     lv.Pool,
+		Metadata: metadata,
+		// The device mapper target for thin volumes does not
+		// support DAX.
+		Dax: lv.Pool == "",
+	}
+}
+
+// lvmError maps errors of the LVM client onto the errors of the
+// device manager.
+func lvmError(err error) error {
+	switch {
+	case errors.Is(err, pmemlvm.ErrNoSpace):
+		return fmt.Errorf("%v: %w", err, ErrNotEnoughSpace)
+	case errors.Is(err, pmemlvm.ErrExists):
+		return fmt.Errorf("%v: %w", err, ErrDeviceExists)
+	case errors.Is(err, pmemlvm.ErrBusy):
+		return fmt.Errorf("%v: %w", err, ErrDeviceInUse)
+	case errors.Is(err, pmemlvm.ErrNotFound):
+		return fmt.Errorf("%v: %w", err, ErrDeviceNotFound)
+	}
+	return err
+}
+
+// segmentBadblocks maps the bad blocks of the physical volumes, with offsets
+// relative to their first physical extent, onto the segment. The
+// stripes of a striped segment are interleaved, therefore a bad block
+// in any of them marks the entire segment as bad.
+func segmentBadblocks(seg pmemlvm.Segment, pvBadblocks map[string][]Badblock) []Badblock {
+	var result []Badblock
+	if len(seg.Areas) == 0 {
+		return nil
+	}
+	areaSize := seg.Size / uint64(len(seg.Areas))
+	for _, area := range seg.Areas {
+		bad := toBadblocks(ndctl.IntersectBadblocks(fromBadblocks(pvBadblocks[area.PV]), area.Extent*seg.ExtentSize, areaSize))
+		if len(bad) == 0 {
 			continue
 		}
+		if len(seg.Areas) > 1 {
+			return []Badblock{{Offset: seg.Start, Length: seg.Size}}
+		}
+		for _, bb := range bad {
+			bb.Offset += seg.Start
+			result = append(result, bb)
+		}
+	}
+	return result
+}
 
-		dev := &PmemDeviceInfo{}
-		dev.VolumeId = fields[0]
-		dev.Path = fields[1]
-		dev.Size, _ = strconv.ParseUint(fields[2], 10, 64)
+// lvBadblocks returns the known bad blocks inside the logical volume.
+func (lvm *pmemLvm) lvBadblocks(dev *PmemDeviceInfo) []Badblock {
+	pvBadblocks := map[string][]Badblock{}
+	var badblocks []Badblock
+	for _, seg := range dev.segments {
+		for _, area := range seg.Areas {
+			if _, ok := pvBadblocks[area.PV]; !ok {
+				pvBadblocks[area.PV] = lvm.getPVBadblocks(area.PV)
+			}
+		}
+		badblocks = append(badblocks, segmentBadblocks(seg, pvBadblocks)...)
+	}
+	return badblocks
+}
 
-		devices[dev.VolumeId] = dev
+// getPVBadblocks returns the known bad blocks of the physical volume,
+// with offsets relative to its first physical extent.
+func (lvm *pmemLvm) getPVBadblocks(pvName string) []Badblock {
+	data, err := ioutil.ReadFile(filepath.Join(sysfsRoot, "class", "block", filepath.Base(pvName), "badblocks"))
+	if err != nil {
+		return nil
+	}
+	badblocks := ndctl.ParseBadblocks(string(data))
+	if len(badblocks) == 0 {
+		return nil
+	}
+	// Only look up the start of the data area when it is needed.
+	pvs, err := lvm.client.PhysicalVolumes(pvName)
+	if err != nil || len(pvs) != 1 {
+		klog.Warningf("%s has bad blocks, but the start of its data area is unknown: %v", pvName, err)
+		return nil
 	}
+	peStart := pvs[0].PEStart
+	return toBadblocks(ndctl.IntersectBadblocks(badblocks, peStart, math.MaxUint64-peStart))
+}
 
-	return devices, nil
+// lvVolumeGroup returns the name of the volume group that the logical
+// volume belongs to, based on its /dev/<vg>/<lv> path.
+func lvVolumeGroup(device *PmemDeviceInfo) string {
+	return filepath.Base(filepath.Dir(device.Path))
 }
 
-func (lvm *pmemLvm) getCapacity() (uint64, error) {
-	var capacity uint64
-	vgs, err := getVolumeGroups(lvm.volumeGroups)
+// getVolumeGroups returns the given volume groups, none if the list is empty.
+func (lvm *pmemLvm) getVolumeGroups(groups []string) ([]pmemlvm.VolumeGroup, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	vgs, err := lvm.client.VolumeGroups(groups...)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("vgs failure: %v", err)
 	}
+	return vgs, nil
+}
 
-	for _, vg := range vgs {
-		if vg.free > capacity {
-			capacity = vg.free
+// getPhysicalVolumes lists the physical volumes in the volume group.
+func (lvm *pmemLvm) getPhysicalVolumes(vgName string) ([]pmemlvm.PhysicalVolume, error) {
+	allPVs, err := lvm.client.PhysicalVolumes()
+	if err != nil {
+		return nil, fmt.Errorf("pvs failure: %v", err)
+	}
+	pvs := []pmemlvm.PhysicalVolume{}
+	for _, pv := range allPVs {
+		if pv.VGName == vgName {
+			pvs = append(pvs, pv)
 		}
 	}
+	return pvs, nil
+}
 
-	return capacity, nil
+// vgCapacity returns the free space of the volume group which is
+// usable with the given options and the size of the largest logical
+// volume that placeLV accepts for it.
+func (lvm *pmemLvm) vgCapacity(vgName string, opts CapacityOpts) (free, largest uint64, err error) {
+	allPVs, err := lvm.getPhysicalVolumes(vgName)
+	if err != nil {
+		return 0, 0, err
+	}
+	pvs := []pmemlvm.PhysicalVolume{}
+	for _, pv := range allPVs {
+		if opts.NumaNode != nil && pvNumaNode(pv.Name) != *opts.NumaNode {
+			continue
+		}
+		free += pv.Free
+		pvs = append(pvs, pv)
+	}
+	switch layout := opts.Layout; {
+	case len(pvs) == 0:
+	case layout == LinearLayout || layout == StripedLayout && len(pvs) <= 1:
+		largest = free
+	case layout == StripedLayout:
+		// All stripes have the same size.
+		stripeSize := pvs[0].Free
+		for _, pv := range pvs {
+			if pv.Free < stripeSize {
+				stripeSize = pv.Free
+			}
+		}
+		stripeSize -= stripeSize % lvmAlign
+		largest = stripeSize * uint64(len(pvs))
+	default:
+		regionFree := map[string]uint64{}
+		for _, pv := range pvs {
+			regionFree[pvRegion(pv.Name)] += pv.Free
+		}
+		for _, size := range regionFree {
+			if size > largest {
+				largest = size
+			}
+		}
+	}
+	return free, largest, nil
 }
 
-func getVolumeGroups(groups []string) ([]vgInfo, error) {
-	vgs := []vgInfo{}
-	args := append(vgsArgs, groups...)
-	output, err := pmemexec.RunCommand("vgs", args...)
+// pvRegion returns the name of the PMEM region which provides the
+// physical volume, empty if unknown. The sysfs entry of a PMEM block
+// device is a symlink to .../<bus>/<region>/<namespace>/block/<device>.
+func pvRegion(pvName string) string {
+	path, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "class", "block", filepath.Base(pvName)))
 	if err != nil {
-		return vgs, fmt.Errorf("vgs failure: %v", err)
+		return ""
 	}
-	for _, line := range strings.SplitN(output, "\n", len(groups)) {
-		fields := strings.Fields(strings.TrimSpace(line))
-		if len(fields) != 3 {
-			return vgs, fmt.Errorf("failed to parse vgs output: %q", line)
+	for _, part := range strings.Split(path, "/") {
+		if strings.HasPrefix(part, "region") {
+			return part
 		}
-		vg := vgInfo{}
-		vg.name = fields[0]
-		vg.size, _ = strconv.ParseUint(fields[1], 10, 64)
-		vg.free, _ = strconv.ParseUint(fields[2], 10, 64)
-		vgs = append(vgs, vg)
 	}
+	return ""
+}
 
-	return vgs, nil
+// lvNumaNode returns the NUMA node of the physical volumes,
+// -1 if unknown or if they are on different nodes.
+func lvNumaNode(pvs []string) int {
+	node := -1
+	for i, pv := range pvs {
+		n := pvNumaNode(pv)
+		if i > 0 && n != node {
+			return -1
+		}
+		node = n
+	}
+	return node
+}
+
+// lvExtendPVs returns the physical volumes that lvextend may use
+// for growing the logical volume without leaving the regions that
+// it already occupies, empty if there is no such restriction.
+func (lvm *pmemLvm) lvExtendPVs(lvPath string, vgName string) ([]string, error) {
+	pvs, err := lvm.getPhysicalVolumes(vgName)
+	if err != nil {
+		return nil, err
+	}
+	lvs, err := lvm.client.LogicalVolumes(lvPath)
+	if err != nil {
+		return nil, fmt.Errorf("lvs failure: %v", err)
+	}
+	regions := map[string]bool{}
+	for _, lv := range lvs {
+		for _, pv := range lv.PVs() {
+			regions[pvRegion(pv)] = true
+		}
+	}
+	names := []string{}
+	for _, pv := range pvs {
+		if regions[pvRegion(pv.Name)] {
+			names = append(names, pv.Name)
+		}
+	}
+	if len(names) == len(pvs) {
+		return nil, nil
+	}
+	return names, nil
+}
+
+// pvNumaNode returns the NUMA node of the PMEM region which provides the
+// physical volume, -1 if unknown.
+func pvNumaNode(pvName string) int {
+	region := pvRegion(pvName)
+	if region == "" {
+		return -1
+	}
+	data, err := ioutil.ReadFile(filepath.Join(sysfsRoot, "bus", "nd", "devices", region, "numa_node"))
+	if err != nil {
+		return -1
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return node
 }
@@ -3,6 +3,8 @@ package pmdmanager
 import (
 	"errors"
 	"os"
+
+	pmemlvm "github.com/intel/pmem-csi/pkg/pmem-lvm"
 )
 
 var (
@@ -36,26 +38,159 @@ type PmemDeviceInfo struct {
 	Path string
 	//Size size allocated for block device
 	Size uint64
+	//Dax true if the device supports direct access and can be mounted with -o dax
+	Dax bool
+	//CharDev true if Path is a character device which can only be used as raw block device
+	CharDev bool
+	//NumaNode is the NUMA node of the memory behind the device, -1 if unknown or more than one
+	NumaNode int
+	//Badblocks are the known bad ranges inside the device, empty if there are none
+	Badblocks []Badblock
+	//Metadata is what was stored together with the device, nil if nothing
+	Metadata *VolumeMetadata
+
+	// segments is the layout of a logical volume, only used by the LVM device manager
+	segments []pmemlvm.Segment
+	// pool is the thin pool of a thin logical volume, only used by the LVM device manager
+	pool string
+}
+
+//Badblock is a range with media errors inside a device
+type Badblock struct {
+	//Offset in bytes, relative to the start of the device
+	Offset uint64
+	//Length in bytes
+	Length uint64
+}
+
+//NamespaceMode determines how a device can be accessed
+type NamespaceMode string
+
+const (
+	//FsdaxMode block device which can hold a (DAX capable) filesystem, the default
+	FsdaxMode NamespaceMode = "fsdax"
+	//DevdaxMode character device which gets mapped directly into memory
+	DevdaxMode NamespaceMode = "devdax"
+	//SectorMode block device with atomic sector updates, without DAX support
+	SectorMode NamespaceMode = "sector"
+)
+
+//VolumeLayout determines how a device gets placed in PMEM
+type VolumeLayout string
+
+const (
+	//RegionLayout device inside a single region, the default
+	RegionLayout VolumeLayout = "region"
+	//LinearLayout device may get concatenated from several regions
+	LinearLayout VolumeLayout = "linear"
+	//StripedLayout device gets striped across all regions
+	StripedLayout VolumeLayout = "striped"
+)
+
+//Capacity describes the free space of a device manager
+type Capacity struct {
+	// Total is the sum of all free space. Fragmentation may prevent
+	// using all of it for a single volume.
+	Total uint64
+	// Largest is the size of the largest volume that can be created.
+	Largest uint64
+}
+
+//CapacityOpts describes the volumes for which the capacity gets
+//reported, the zero value means defaults
+type CapacityOpts struct {
+	//Layout is the volume layout, RegionLayout if empty
+	Layout VolumeLayout
+	//NumaNode restricts the capacity to memory on that NUMA node, any node if nil
+	NumaNode *int
+}
+
+//CreateDeviceOpts holds optional settings for a new device,
+//the zero value means defaults
+type CreateDeviceOpts struct {
+	//Mode is the namespace mode, FsdaxMode if empty
+	Mode NamespaceMode
+	//Layout is the volume layout, RegionLayout if empty
+	Layout VolumeLayout
+	//NumaNode restricts the device to memory on that NUMA node, any node if nil
+	NumaNode *int
+	//Alignment of the namespace in bytes, the default alignment of the
+	//device manager if zero. Only used in direct mode.
+	Alignment uint64
+	//AvoidBadblocks excludes regions and physical volumes with known bad blocks from the placement
+	AvoidBadblocks bool
+	//Backend selects the device manager in a PmemBackendManager, the default one if empty
+	Backend string
+	//Metadata gets stored together with the device, if the device manager supports that
+	Metadata *VolumeMetadata
+	//ErasePolicy is the policy that was requested explicitly for the volume, empty
+	//for the default. CreateDevice fails with ErrInvalid for policies which the
+	//device manager cannot honor when deleting the device.
+	ErasePolicy ErasePolicy
+}
+
+//RegionFilter decides whether a device manager may use the region with the
+//given name (like "region0"). A nil filter allows all regions.
+type RegionFilter func(region string) bool
+
+func (f RegionFilter) allows(region string) bool {
+	return f == nil || f(region)
 }
 
 //PmemDeviceManager interface to manage the PMEM block devices
 type PmemDeviceManager interface {
-	// GetCapacity returns the available maximum capacity that can be assigned to a Device/Volume
-	GetCapacity() (uint64, error)
+	// GetCapacity returns the total free space and the available maximum capacity
+	// that can be assigned to a single Device/Volume with the given options.
+	GetCapacity(opts CapacityOpts) (Capacity, error)
 
-	// CreateDevice creates a new block device with give name, size and namespace mode
+	// CreateDevice creates a new block device with give name, size and namespace mode.
+	// Device managers which do not support the requested mode return ErrInvalid.
 	// Possible errors: ErrNotEnoughSpace, ErrInvalid, ErrDeviceExists
-	CreateDevice(name string, size uint64) error
+	CreateDevice(name string, size uint64, opts CreateDeviceOpts) error
 
 	// GetDevice returns the block device information for given name
 	// Possible errors: ErrDeviceNotFound
 	GetDevice(name string) (*PmemDeviceInfo, error)
 
+	// ResizeDevice grows an existing block device with given name to at least
+	// the given size without touching its content. Shrinking is not supported,
+	// a size smaller than the current one is not an error.
+	// Possible errors: ErrDeviceNotFound, ErrNotEnoughSpace, ErrDeviceInUse
+	ResizeDevice(name string, size uint64) error
+
+	// CopyDevice copies the entire content of the source device, for
+	// example some other device or a snapshot, into the existing device
+	// with given name. That device must be at least as large as the source
+	// and must not be in use.
+	// Possible errors: ErrDeviceNotFound, ErrDeviceInUse
+	CopyDevice(name string, source *PmemDeviceInfo) error
+
 	// DeleteDevice deletes an existing block device with give name.
-	// If 'flush' is 'true', then the device data is zeroed before deleting the device
+	// The device data is erased as defined by 'erase' before deleting the device.
 	// Possible errors: ErrDeviceInUse, ErrPermission
-	DeleteDevice(name string, flush bool) error
+	DeleteDevice(name string, erase EraseOpts) error
 
 	// ListDevices returns all the block devices information that was created by this device manager
 	ListDevices() ([]*PmemDeviceInfo, error)
 }
+
+//PmemSnapshotManager is implemented by device managers which can take
+//point-in-time copies of their block devices. Snapshots are block devices
+//of their own, but are not listed by ListDevices.
+type PmemSnapshotManager interface {
+	// CreateSnapshot creates a new snapshot with given name which holds a copy
+	// of the device with the given source name.
+	// Possible errors: ErrDeviceNotFound, ErrNotEnoughSpace, ErrDeviceExists
+	CreateSnapshot(name string, sourceName string) error
+
+	// GetSnapshot returns the snapshot device information for given name
+	// Possible errors: ErrDeviceNotFound
+	GetSnapshot(name string) (*PmemDeviceInfo, error)
+
+	// DeleteSnapshot deletes an existing snapshot with give name.
+	// The snapshot data is erased as defined by 'erase' before deleting it.
+	DeleteSnapshot(name string, erase EraseOpts) error
+
+	// ListSnapshots returns information about all snapshots
+	ListSnapshots() ([]*PmemDeviceInfo, error)
+}
@@ -13,8 +13,12 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	"github.com/intel/pmem-csi/pkg/pmem-exec/fake"
+	pmemlvm "github.com/intel/pmem-csi/pkg/pmem-lvm"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -25,8 +29,9 @@ const (
 	vgname = "test-group"
 	vgsize = uint64(1) * 1024 * 1024 * 1024 // 1Gb
 
-	ModeLVM    = "lvm"
-	ModeDirect = "direct"
+	ModeLVM       = "lvm"
+	ModeDirect    = "direct"
+	ModeSimulated = "simulated"
 )
 
 func TestMain(m *testing.M) {
@@ -42,11 +47,669 @@ func TestPmd(t *testing.T) {
 var _ = Describe("DeviceManager", func() {
 	Context(ModeLVM, func() { runTests(ModeLVM) })
 	Context(ModeDirect, func() { runTests(ModeDirect) })
+	Context(ModeSimulated, func() { runTests(ModeSimulated) })
+})
+
+var _ = Describe("Namespace size", func() {
+	const (
+		kb = uint64(1024)
+		mb = 1024 * kb
+		gb = 1024 * mb
+	)
+
+	It("Should leave room for the meta data", func() {
+		for _, align := range []uint64{4 * kb, 2 * mb, gb} {
+			for _, size := range []uint64{4 * mb, 100 * mb, gb, 63 * gb, 1000 * gb} {
+				// Rounded up by libndctl, then the same calculation as in the kernel.
+				nsSize := namespaceSize(size, align)
+				if reminder := nsSize % align; reminder != 0 {
+					nsSize += align - reminder
+				}
+				dataOffset := nsSize/4096*64 + 8*kb
+				if reminder := dataOffset % align; reminder != 0 {
+					dataOffset += align - reminder
+				}
+				Expect(nsSize-dataOffset).Should(BeNumerically(">=", size), "size %d, alignment %d: usable size", size, align)
+			}
+		}
+		Expect(namespaceSize(100*mb, 4*kb)).Should(BeNumerically("<", 102*mb), "small volumes with small alignment")
+		Expect(namespaceSize(100*mb, gb)).Should(Equal(100*mb+gb), "small volumes with default alignment")
+	})
+})
+
+var _ = Describe("LVM bad blocks", func() {
+	const mb = uint64(1024 * 1024)
+
+	It("Should map bad blocks onto logical volumes", func() {
+		lvs := `{"report": [{"lv": [
+  {"lv_name":"lv1", "lv_path":"/dev/vg/lv1", "vg_name":"vg", "lv_size":"8388608", "lv_tags":"", "devices":"/dev/pmem0(0)", "seg_start":"0", "seg_size":"4194304", "vg_extent_size":"4194304"},
+  {"lv_name":"lv1", "lv_path":"/dev/vg/lv1", "vg_name":"vg", "lv_size":"8388608", "lv_tags":"", "devices":"/dev/pmem1(2)", "seg_start":"4194304", "seg_size":"4194304", "vg_extent_size":"4194304"},
+  {"lv_name":"lv2", "lv_path":"/dev/vg/lv2", "vg_name":"vg", "lv_size":"8388608", "lv_tags":"pmem-csi.test", "devices":"/dev/pmem0(1),/dev/pmem1(0)", "seg_start":"0", "seg_size":"8388608", "vg_extent_size":"4194304"}
+]}]}`
+		runner := pmemexec.ExecutorFunc(func(cmd string, args ...string) (string, string, error) {
+			Expect(cmd).Should(Equal("lvs"))
+			return lvs, "", nil
+		})
+		lvm, err := newPmemDeviceManagerLVM(pmemlvm.New(runner), []string{"vg"}, nil)
+		Expect(err).Should(BeNil(), "list logical volumes")
+		devices := lvm.devices
+		Expect(devices).Should(HaveLen(2))
+		Expect(devices["lv1"].segments).Should(HaveLen(2))
+		Expect(devices["lv2"].segments).Should(HaveLen(1))
+
+		pvBadblocks := map[string][]Badblock{
+			// extent 0 and extent 2
+			"/dev/pmem1": {{Offset: 512, Length: 1024}, {Offset: 8*mb + 4096, Length: 512}},
+		}
+		var badblocks []Badblock
+		for _, seg := range devices["lv1"].segments {
+			badblocks = append(badblocks, segmentBadblocks(seg, pvBadblocks)...)
+		}
+		Expect(badblocks).Should(Equal([]Badblock{{Offset: 4*mb + 4096, Length: 512}}), "linear")
+
+		Expect(segmentBadblocks(devices["lv2"].segments[0], pvBadblocks)).Should(Equal([]Badblock{{Offset: 0, Length: 8 * mb}}), "striped")
+		Expect(segmentBadblocks(devices["lv2"].segments[0], nil)).Should(BeEmpty(), "no bad blocks")
+	})
+})
+
+var _ = Describe("LVM with simulated commands", func() {
+	const (
+		mb = uint64(1024 * 1024)
+		gb = 1024 * mb
+	)
+	var executor *fake.Executor
+	var prevExecutor pmemexec.Executor
+	var prevProcRoot string
+	var devDir string
+	var lvm *pmemLvm
+
+	BeforeEach(func() {
+		var err error
+		devDir, err = ioutil.TempDir("", "pmd-fake-")
+		Expect(err).Should(BeNil(), "create device directory")
+		// The fake devices are symlinks to /dev/null, which
+		// other processes have open.
+		prevProcRoot = procRoot
+		procRoot = devDir
+		executor = fake.New()
+		executor.DevDir = devDir
+		executor.AddDevice("/dev/pmem-fake0", gb+mb)
+		prevExecutor = pmemexec.SetExecutor(executor)
+		_, err = pmemexec.RunCommand("vgcreate", "--force", "vg", "/dev/pmem-fake0")
+		Expect(err).Should(BeNil(), "create volume group")
+		lvm, err = newPmemDeviceManagerLVM(pmemlvm.New(nil), []string{"vg"}, nil)
+		Expect(err).Should(BeNil(), "create device manager")
+	})
+
+	AfterEach(func() {
+		pmemexec.SetExecutor(prevExecutor)
+		procRoot = prevProcRoot
+		os.RemoveAll(devDir)
+	})
+
+	It("Should create and delete devices", func() {
+		Expect(lvm.CreateDevice("vol1", 10*mb, CreateDeviceOpts{})).Should(BeNil(), "create device")
+		dev, err := lvm.GetDevice("vol1")
+		Expect(err).Should(BeNil(), "get device")
+		Expect(dev.Size).Should(Equal(12*mb), "aligned size")
+		Expect(dev.Path).Should(Equal(devDir + "/vg/vol1"))
+
+		capacity, err := lvm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "get capacity")
+		Expect(capacity).Should(Equal(Capacity{Total: gb - 12*mb, Largest: gb - 12*mb}))
+
+		Expect(lvm.DeleteDevice("vol1", EraseOpts{})).Should(BeNil(), "delete device")
+		_, err = lvm.GetDevice("vol1")
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "deleted device: %v", err)
+	})
+
+	It("Should report the capacity of the volume layout", func() {
+		executor.AddDevice("/dev/pmem-fake1", gb/2+mb)
+		executor.AddDevice("/dev/pmem-fake2", gb/4+mb)
+		_, err := pmemexec.RunCommand("vgcreate", "--force", "span", "/dev/pmem-fake1", "/dev/pmem-fake2")
+		Expect(err).Should(BeNil(), "create volume group")
+		span, err := newPmemDeviceManagerLVM(pmemlvm.New(nil), []string{"span"}, nil)
+		Expect(err).Should(BeNil(), "create device manager")
+
+		capacity, err := span.GetCapacity(CapacityOpts{Layout: LinearLayout})
+		Expect(err).Should(BeNil(), "linear capacity")
+		Expect(capacity).Should(Equal(Capacity{Total: gb/2 + gb/4, Largest: gb/2 + gb/4}))
+		capacity, err = span.GetCapacity(CapacityOpts{Layout: StripedLayout})
+		Expect(err).Should(BeNil(), "striped capacity")
+		Expect(capacity).Should(Equal(Capacity{Total: gb/2 + gb/4, Largest: gb / 2}), "two stripes")
+		Expect(span.CreateDevice("vol1", gb/2, CreateDeviceOpts{Layout: StripedLayout})).Should(BeNil(), "create largest striped device")
+	})
+
+	It("Should store metadata in tags", func() {
+		metadata := &VolumeMetadata{
+			Name:       "pvc-1",
+			Parameters: map[string]string{"name": "pvc-1", "erasePolicy": "zero", "key": strings.Repeat("x", 300)},
+			Created:    time.Date(2020, 5, 4, 3, 2, 1, 0, time.UTC),
+			Owner:      "node-1",
+		}
+		Expect(lvm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{Metadata: metadata})).Should(BeNil(), "create device")
+		dev, err := lvm.GetDevice("vol1")
+		Expect(err).Should(BeNil(), "get device")
+		Expect(dev.Metadata).Should(Equal(metadata), "cached metadata")
+		lvs, err := pmemlvm.New(nil).LogicalVolumes("vg/vol1")
+		Expect(err).Should(BeNil(), "list logical volumes")
+		Expect(len(lvs[0].Tags)).Should(BeNumerically(">", 1), "metadata split into several tags")
+		for _, tag := range lvs[0].Tags {
+			Expect(len(tag)).Should(BeNumerically("<=", 128), "tag length")
+		}
+
+		// A new instance reads the tags.
+		lvm, err = newPmemDeviceManagerLVM(pmemlvm.New(nil), []string{"vg"}, nil)
+		Expect(err).Should(BeNil(), "create device manager")
+		devices, err := lvm.ListDevices()
+		Expect(err).Should(BeNil(), "list devices")
+		Expect(devices).Should(HaveLen(1), "devices")
+		Expect(devices[0].Metadata).Should(Equal(metadata), "listed metadata")
+
+		Expect(lvm.CreateDevice("vol2", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device without metadata")
+		dev, err = lvm.GetDevice("vol2")
+		Expect(err).Should(BeNil(), "get device")
+		Expect(dev.Metadata).Should(BeNil(), "no metadata")
+
+		metadata.Parameters["key"] = strings.Repeat("x", 10000)
+		err = lvm.CreateDevice("vol3", 8*mb, CreateDeviceOpts{Metadata: metadata})
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "metadata too large: %v", err)
+	})
+
+	It("Should detect existing devices", func() {
+		_, err := pmemexec.RunCommand("lvcreate", "-Zn", "-L", "8m", "-n", "vol1", "vg")
+		Expect(err).Should(BeNil(), "create logical volume behind the back of the device manager")
+		err = lvm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{})
+		Expect(errors.Is(err, ErrDeviceExists)).Should(BeTrue(), "create existing device: %v", err)
+	})
+
+	It("Should fail without space", func() {
+		err := lvm.CreateDevice("vol1", 2*gb, CreateDeviceOpts{})
+		Expect(errors.Is(err, ErrNotEnoughSpace)).Should(BeTrue(), "too large: %v", err)
+
+		Expect(lvm.CreateDevice("vol1", gb/2, CreateDeviceOpts{})).Should(BeNil(), "create device")
+		Expect(lvm.CreateDevice("vol2", gb/4, CreateDeviceOpts{})).Should(BeNil(), "create device")
+		err = lvm.ResizeDevice("vol1", gb)
+		Expect(errors.Is(err, ErrNotEnoughSpace)).Should(BeTrue(), "resize: %v", err)
+
+		executor.Fail("lvextend", `  Insufficient suitable allocatable extents for logical volume vol1: 1 more required`)
+		err = lvm.ResizeDevice("vol1", gb/2+4*mb)
+		Expect(errors.Is(err, ErrNotEnoughSpace)).Should(BeTrue(), "lvextend failure: %v", err)
+		Expect(lvm.ResizeDevice("vol1", gb/2+4*mb)).Should(BeNil(), "resize")
+	})
+
+	It("Should not delete devices in use", func() {
+		Expect(lvm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device")
+		dev, err := lvm.GetDevice("vol1")
+		Expect(err).Should(BeNil(), "get device")
+		executor.SetInUse(dev.Path, true)
+		err = lvm.DeleteDevice("vol1", EraseOpts{})
+		Expect(errors.Is(err, ErrDeviceInUse)).Should(BeTrue(), "delete device in use: %v", err)
+		_, err = lvm.GetDevice("vol1")
+		Expect(err).Should(BeNil(), "device still exists")
+	})
+
+	It("Should not block while erasing a device", func() {
+		Expect(lvm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device")
+
+		// shred blocks until the test lets it continue.
+		shredding := make(chan struct{})
+		finishShred := make(chan struct{})
+		pmemexec.SetExecutor(pmemexec.ExecutorFunc(func(cmd string, args ...string) (string, string, error) {
+			if cmd == "shred" {
+				close(shredding)
+				<-finishShred
+			}
+			return executor.Run(cmd, args...)
+		}))
+		deleted := make(chan error)
+		go func() {
+			deleted <- lvm.DeleteDevice("vol1", EraseOpts{Policy: EraseRandom})
+		}()
+		<-shredding
+
+		Expect(lvm.CreateDevice("vol2", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create other device")
+		devices, err := lvm.ListDevices()
+		Expect(err).Should(BeNil(), "list devices")
+		Expect(devices).Should(HaveLen(2), "devices while erasing")
+		_, err = lvm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "get capacity")
+		Expect(lvm.DeleteDevice("vol2", EraseOpts{})).Should(BeNil(), "delete other device")
+
+		close(finishShred)
+		Expect(<-deleted).Should(BeNil(), "delete device")
+		_, err = lvm.GetDevice("vol1")
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "deleted device: %v", err)
+	})
+
+	It("Should erase devices according to the policy", func() {
+		erase := func(opts EraseOpts) []string {
+			Expect(lvm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device")
+			start := len(executor.Commands())
+			Expect(lvm.DeleteDevice("vol1", opts)).Should(BeNil(), "delete device with %+v", opts)
+			var commands []string
+			for _, cmd := range executor.Commands()[start:] {
+				if strings.HasPrefix(cmd, "dd ") || strings.HasPrefix(cmd, "shred ") || strings.HasPrefix(cmd, "blkdiscard ") {
+					commands = append(commands, cmd)
+				}
+			}
+			return commands
+		}
+		path := devDir + "/vg/vol1"
+
+		Expect(erase(EraseOpts{Policy: EraseNone})).Should(BeEmpty(), "none")
+		Expect(erase(EraseOpts{})).Should(Equal([]string{"dd if=/dev/zero of=" + path + " bs=1M count=4096 iflag=count_bytes conv=fsync"}), "default")
+		Expect(erase(EraseOpts{Policy: EraseZero})).Should(Equal([]string{"dd if=/dev/zero of=" + path + " bs=1M count=8388608 iflag=count_bytes conv=fsync"}), "zero")
+		Expect(erase(EraseOpts{Policy: EraseRandom})).Should(Equal([]string{"shred -n 1 " + path}), "random")
+		Expect(erase(EraseOpts{Policy: EraseDiscard})).Should(Equal([]string{"blkdiscard --zeroout " + path}), "discard")
+		executor.Fail("blkdiscard", "blkdiscard: "+path+": BLKZEROOUT ioctl failed: Operation not supported")
+		Expect(erase(EraseOpts{Policy: EraseDiscard})).Should(Equal([]string{
+			"blkdiscard --zeroout " + path,
+			"dd if=/dev/zero of=" + path + " bs=1M count=8388608 iflag=count_bytes conv=fsync",
+		}), "discard fallback")
+
+		Expect(lvm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device")
+		err := lvm.DeleteDevice("vol1", EraseOpts{Policy: "no-such-policy"})
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "unknown policy: %v", err)
+	})
+})
+
+var _ = Describe("Erase verification", func() {
+	const mb = uint64(1024 * 1024)
+	var file *os.File
+	var data []byte
+	var read readAtFunc
+
+	BeforeEach(func() {
+		var err error
+		file, err = ioutil.TempFile("", "pmd-erase-")
+		Expect(err).Should(BeNil(), "create file")
+		data = make([]byte, mb)
+		rand.Read(data) // nolint: errcheck
+		_, err = file.Write(data)
+		Expect(err).Should(BeNil(), "write file")
+		read = func(buf []byte, offset int64) error {
+			_, err := file.ReadAt(buf, offset)
+			return err
+		}
+	})
+
+	AfterEach(func() {
+		file.Close()
+		os.Remove(file.Name())
+	})
+
+	It("Should detect data that was not zeroed", func() {
+		samples, err := sampleBlocks(read, EraseZero, mb)
+		Expect(err).Should(BeNil(), "sample blocks")
+		Expect(samples.offsets).Should(HaveLen(eraseSampleCount))
+		Expect(samples.offsets).Should(ContainElement(int64(mb-eraseSampleSize)), "last block")
+		Expect(samples.verify(read)).ShouldNot(BeNil(), "not erased")
+
+		_, err = file.WriteAt(make([]byte, mb), 0)
+		Expect(err).Should(BeNil(), "zero file")
+		Expect(samples.verify(read)).Should(BeNil(), "erased")
+	})
+
+	It("Should only check the header", func() {
+		samples, err := sampleBlocks(read, EraseHeader, eraseHeaderSize)
+		Expect(err).Should(BeNil(), "sample blocks")
+		Expect(samples.offsets).Should(Equal([]int64{0}))
+		_, err = file.WriteAt(make([]byte, eraseHeaderSize), 0)
+		Expect(err).Should(BeNil(), "zero header")
+		Expect(samples.verify(read)).Should(BeNil(), "erased")
+	})
+
+	It("Should detect data that was not overwritten", func() {
+		samples, err := sampleBlocks(read, EraseRandom, mb)
+		Expect(err).Should(BeNil(), "sample blocks")
+		Expect(samples.verify(read)).ShouldNot(BeNil(), "not erased")
+
+		rand.Read(data) // nolint: errcheck
+		_, err = file.WriteAt(data, 0)
+		Expect(err).Should(BeNil(), "overwrite file")
+		Expect(samples.verify(read)).Should(BeNil(), "erased")
+	})
+})
+
+var _ = Describe("Namespace metadata", func() {
+	var path string
+
+	BeforeEach(func() {
+		file, err := ioutil.TempFile("", "pmd-metadata-")
+		Expect(err).Should(BeNil(), "create file")
+		path = file.Name()
+		_, err = file.Write(make([]byte, 3*metadataRecordSize))
+		Expect(err).Should(BeNil(), "write file")
+		file.Close()
+	})
+
+	AfterEach(func() {
+		os.Remove(path)
+	})
+
+	It("Should store one record per namespace", func() {
+		record := func(id string) *metadataRecord {
+			return &metadataRecord{ID: id, UUID: "uuid-" + id, Metadata: &VolumeMetadata{Name: "name-" + id, Owner: "node"}}
+		}
+		Expect(writeMetadataRecord(path, record("vol1"))).Should(Succeed(), "vol1")
+		Expect(writeMetadataRecord(path, record("vol2"))).Should(Succeed(), "vol2")
+		Expect(writeMetadataRecord(path, record("vol3"))).Should(Succeed(), "vol3")
+		err := writeMetadataRecord(path, record("vol4"))
+		Expect(errors.Is(err, ErrNotEnoughSpace)).Should(BeTrue(), "full: %v", err)
+		updated := record("vol1")
+		updated.UUID = "new-uuid"
+		Expect(writeMetadataRecord(path, updated)).Should(Succeed(), "vol1 again")
+
+		Expect(removeMetadataRecord(path, "vol2")).Should(Succeed(), "remove vol2")
+		Expect(writeMetadataRecord(path, record("vol4"))).Should(Succeed(), "vol4")
+		records, size, err := readMetadataRecords(path)
+		Expect(err).Should(BeNil(), "read records")
+		Expect(size).Should(Equal(3))
+		Expect(records).Should(Equal(map[int]*metadataRecord{0: updated, 1: record("vol4"), 2: record("vol3")}))
+
+		file, err := os.OpenFile(path, os.O_WRONLY, 0)
+		Expect(err).Should(BeNil(), "open file")
+		_, err = file.WriteAt([]byte("X"), int64(metadataRecordSize+metadataHeaderSize))
+		file.Close()
+		Expect(err).Should(BeNil(), "damage vol4")
+		records, _, err = readMetadataRecords(path)
+		Expect(err).Should(BeNil(), "read records")
+		Expect(records).Should(HaveLen(2), "damaged record ignored")
+
+		err = writeMetadataRecord(path, &metadataRecord{ID: "vol5", Metadata: &VolumeMetadata{Name: strings.Repeat("x", metadataRecordSize)}})
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "too large: %v", err)
+	})
+})
+
+var _ = Describe("Device usage", func() {
+	var oldProcRoot string
+
+	BeforeEach(func() {
+		oldProcRoot = procRoot
+		var err error
+		procRoot, err = ioutil.TempDir("", "pmd-proc-")
+		Expect(err).Should(BeNil(), "create proc dir")
+		Expect(os.MkdirAll(procRoot+"/1/fd", 0755)).Should(Succeed())
+		Expect(ioutil.WriteFile(procRoot+"/1/maps", []byte("00400000-00452000 r-xp 00000000 08:02 173521 /usr/bin/app\n"), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(procRoot)
+		procRoot = oldProcRoot
+	})
+
+	It("Should detect mapped devices", func() {
+		Expect(deviceOpenedByProcess("/dev/dax0.0")).Should(BeFalse(), "not used")
+		Expect(ioutil.WriteFile(procRoot+"/1/maps", []byte("7f0000000000-7f0040000000 rw-s 00000000 00:06 1234 /dev/dax0.0\n"), 0644)).Should(Succeed())
+		Expect(deviceOpenedByProcess("/dev/dax0.0")).Should(BeTrue(), "mapped")
+		Expect(deviceOpenedByProcess("/dev/dax1.0")).Should(BeFalse(), "other device")
+	})
+
+	It("Should detect open devices", func() {
+		Expect(os.Symlink("/dev/dax0.0", procRoot+"/1/fd/3")).Should(Succeed())
+		Expect(deviceOpenedByProcess("/dev/dax0.0")).Should(BeTrue(), "open")
+	})
+})
+
+var _ = Describe("Multiple backends", func() {
+	const (
+		mb = uint64(1024 * 1024)
+		gb = 1024 * mb
+	)
+	var prevExecutor pmemexec.Executor
+	var prevProcRoot string
+	var devDir string
+	var dm PmemDeviceManager
+
+	BeforeEach(func() {
+		var err error
+		devDir, err = ioutil.TempDir("", "pmd-multi-")
+		Expect(err).Should(BeNil(), "create device directory")
+		// The fake devices are symlinks to /dev/null, which
+		// other processes have open.
+		prevProcRoot = procRoot
+		procRoot = devDir
+		executor := fake.New()
+		executor.DevDir = devDir
+		executor.AddDevice("/dev/pmem-fake0", gb+mb)
+		executor.AddDevice("/dev/pmem-fake1", gb/2+mb)
+		prevExecutor = pmemexec.SetExecutor(executor)
+		for i, vg := range []string{"vg0", "vg1"} {
+			_, err = pmemexec.RunCommand("vgcreate", "--force", vg, fmt.Sprintf("/dev/pmem-fake%d", i))
+			Expect(err).Should(BeNil(), "create volume group %s", vg)
+		}
+		lvm0, err := newPmemDeviceManagerLVM(pmemlvm.New(nil), []string{"vg0"}, nil)
+		Expect(err).Should(BeNil(), "create first device manager")
+		lvm1, err := newPmemDeviceManagerLVM(pmemlvm.New(nil), []string{"vg1"}, nil)
+		Expect(err).Should(BeNil(), "create second device manager")
+		// Hide the snapshot support of the second one.
+		dm, err = NewPmemDeviceManagerMulti([]Backend{
+			{Name: "first", DeviceManager: lvm0},
+			{Name: "second", DeviceManager: struct{ PmemDeviceManager }{lvm1}},
+		})
+		Expect(err).Should(BeNil(), "combine device managers")
+	})
+
+	AfterEach(func() {
+		pmemexec.SetExecutor(prevExecutor)
+		procRoot = prevProcRoot
+		os.RemoveAll(devDir)
+	})
+
+	It("Should create devices in the selected backend", func() {
+		backends, ok := dm.(PmemBackendManager)
+		Expect(ok).Should(BeTrue(), "backend manager")
+		Expect(backends.Backends()).Should(Equal([]string{"first", "second"}))
+
+		Expect(dm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device in default backend")
+		Expect(dm.CreateDevice("vol2", 8*mb, CreateDeviceOpts{Backend: "second"})).Should(BeNil(), "create device in second backend")
+		err := dm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{Backend: "second"})
+		Expect(errors.Is(err, ErrDeviceExists)).Should(BeTrue(), "same name in other backend: %v", err)
+		err = dm.CreateDevice("vol3", 8*mb, CreateDeviceOpts{Backend: "third"})
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "unknown backend: %v", err)
+
+		backend, err := backends.DeviceBackend("vol2")
+		Expect(err).Should(BeNil(), "backend of vol2")
+		Expect(backend).Should(Equal("second"))
+		dev, err := dm.GetDevice("vol2")
+		Expect(err).Should(BeNil(), "get device")
+		Expect(dev.Path).Should(Equal(devDir + "/vg1/vol2"))
+		devices, err := dm.ListDevices()
+		Expect(err).Should(BeNil(), "list devices")
+		Expect(devices).Should(HaveLen(2), "devices of all backends")
+
+		capacity, err := backends.GetBackendCapacity("second", CapacityOpts{})
+		Expect(err).Should(BeNil(), "capacity of second backend")
+		Expect(capacity).Should(Equal(Capacity{Total: gb/2 - 8*mb, Largest: gb/2 - 8*mb}))
+		capacity, err = dm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "total capacity")
+		Expect(capacity).Should(Equal(Capacity{Total: gb - 8*mb + gb/2 - 8*mb, Largest: gb - 8*mb}))
+
+		Expect(dm.ResizeDevice("vol2", 16*mb)).Should(BeNil(), "resize device")
+		Expect(dm.DeleteDevice("vol2", EraseOpts{})).Should(BeNil(), "delete device")
+		Expect(dm.DeleteDevice("vol2", EraseOpts{})).Should(BeNil(), "delete device again")
+		_, err = backends.DeviceBackend("vol2")
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "deleted device: %v", err)
+	})
+
+	It("Should only take snapshots where supported", func() {
+		snapshots, ok := dm.(PmemSnapshotManager)
+		Expect(ok).Should(BeTrue(), "snapshot manager")
+		Expect(dm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device in default backend")
+		Expect(dm.CreateDevice("vol2", 8*mb, CreateDeviceOpts{Backend: "second"})).Should(BeNil(), "create device in second backend")
+
+		Expect(snapshots.CreateSnapshot("snap1", "vol1")).Should(BeNil(), "snapshot of vol1")
+		err := snapshots.CreateSnapshot("snap2", "vol2")
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "snapshot of vol2: %v", err)
+		list, err := snapshots.ListSnapshots()
+		Expect(err).Should(BeNil(), "list snapshots")
+		Expect(list).Should(HaveLen(1))
+		Expect(snapshots.DeleteSnapshot("snap1", EraseOpts{})).Should(BeNil(), "delete snapshot")
+		_, err = snapshots.GetSnapshot("snap1")
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "deleted snapshot: %v", err)
+	})
+})
+
+var _ = Describe("LVM thin provisioning", func() {
+	const (
+		mb = uint64(1024 * 1024)
+		gb = 1024 * mb
+	)
+	var executor *fake.Executor
+	var prevExecutor pmemexec.Executor
+	var prevProcRoot string
+	var devDir string
+	var lvm *pmemLvm
+	opts := ThinOpts{Overcommit: 2, WarningWatermark: 50, HighWatermark: 80}
+
+	BeforeEach(func() {
+		var err error
+		devDir, err = ioutil.TempDir("", "pmd-thin-")
+		Expect(err).Should(BeNil(), "create device directory")
+		// The fake devices are symlinks to /dev/null, which
+		// other processes have open.
+		prevProcRoot = procRoot
+		procRoot = devDir
+		executor = fake.New()
+		executor.DevDir = devDir
+		executor.AddDevice("/dev/pmem-fake0", gb+mb)
+		executor.AddDevice("/dev/pmem-fake1", gb+mb)
+		prevExecutor = pmemexec.SetExecutor(executor)
+		for i, vg := range []string{"vg", "nopool"} {
+			_, err = pmemexec.RunCommand("vgcreate", "--force", vg, fmt.Sprintf("/dev/pmem-fake%d", i))
+			Expect(err).Should(BeNil(), "create volume group %s", vg)
+		}
+		client := pmemlvm.New(nil)
+		Expect(client.CreateThinPool("vg", pmemcommon.ThinPoolName, 50)).Should(BeNil(), "create thin pool")
+		lvm, err = newPmemDeviceManagerLVMThin(client, []string{"vg", "nopool"}, nil, opts)
+		Expect(err).Should(BeNil(), "create device manager")
+	})
+
+	AfterEach(func() {
+		pmemexec.SetExecutor(prevExecutor)
+		procRoot = prevProcRoot
+		os.RemoveAll(devDir)
+	})
+
+	It("Should overcommit the thin pool", func() {
+		Expect(lvm.volumeGroups).Should(Equal([]string{"vg"}), "volume groups with thin pool")
+		capacity, err := lvm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "get capacity")
+		Expect(capacity).Should(Equal(Capacity{Total: gb, Largest: gb}), "twice the pool size")
+
+		Expect(lvm.CreateDevice("vol1", 600*mb, CreateDeviceOpts{})).Should(BeNil(), "create device larger than the pool")
+		dev, err := lvm.GetDevice("vol1")
+		Expect(err).Should(BeNil(), "get device")
+		Expect(dev.Size).Should(Equal(600 * mb))
+		Expect(dev.Dax).Should(BeFalse(), "thin volumes do not support DAX")
+		capacity, err = lvm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "get capacity")
+		Expect(capacity).Should(Equal(Capacity{Total: 424 * mb, Largest: 424 * mb}))
+		vgs, err := lvm.getVolumeGroups([]string{"vg"})
+		Expect(err).Should(BeNil(), "get volume group")
+		Expect(vgs[0].Free).Should(Equal(gb/2), "volume group free space unchanged")
+
+		err = lvm.CreateDevice("vol2", 500*mb, CreateDeviceOpts{})
+		Expect(errors.Is(err, ErrNotEnoughSpace)).Should(BeTrue(), "beyond overcommit ratio: %v", err)
+		err = lvm.CreateDevice("vol2", 8*mb, CreateDeviceOpts{Layout: StripedLayout})
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "striped: %v", err)
+		err = lvm.CreateDevice("vol2", 8*mb, CreateDeviceOpts{ErasePolicy: EraseZero})
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "erase policy: %v", err)
+
+		Expect(lvm.ResizeDevice("vol1", 700*mb)).Should(BeNil(), "resize")
+		err = lvm.ResizeDevice("vol1", 1100*mb)
+		Expect(errors.Is(err, ErrNotEnoughSpace)).Should(BeTrue(), "resize beyond overcommit ratio: %v", err)
+
+		Expect(lvm.CreateDevice("vol2", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device")
+		err = lvm.CreateSnapshot("snap1", "vol1")
+		Expect(errors.Is(err, ErrNotEnoughSpace)).Should(BeTrue(), "snapshot beyond overcommit ratio: %v", err)
+		Expect(lvm.CreateSnapshot("snap2", "vol2")).Should(BeNil(), "snapshot")
+		pools, err := lvm.ThinPools()
+		Expect(err).Should(BeNil(), "thin pools")
+		Expect(pools).Should(Equal([]ThinPool{{VolumeGroup: "vg", Size: gb / 2, Provisioned: 716 * mb}}))
+	})
+
+	It("Should stop at the high watermark", func() {
+		pool := "vg/" + pmemcommon.ThinPoolName
+		executor.SetThinPoolUsage(pool, 60, 5)
+		Expect(lvm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device above warning watermark")
+		pools, err := lvm.ThinPools()
+		Expect(err).Should(BeNil(), "thin pools")
+		Expect(pools[0].Alarm).Should(Equal(ThinPoolWarning))
+
+		executor.SetThinPoolUsage(pool, 10, 85)
+		err = lvm.CreateDevice("vol2", 8*mb, CreateDeviceOpts{})
+		Expect(errors.Is(err, ErrNotEnoughSpace)).Should(BeTrue(), "metadata above high watermark: %v", err)
+		capacity, err := lvm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "get capacity")
+		Expect(capacity).Should(Equal(Capacity{}), "no capacity above high watermark")
+		pools, err = lvm.ThinPools()
+		Expect(err).Should(BeNil(), "thin pools")
+		Expect(pools[0].Alarm).Should(Equal(ThinPoolFull))
+	})
+
+	It("Should not fill the pool when erasing", func() {
+		Expect(lvm.CreateDevice("vol1", 8*mb, CreateDeviceOpts{})).Should(BeNil(), "create device")
+		start := len(executor.Commands())
+		Expect(lvm.DeleteDevice("vol1", EraseOpts{Policy: EraseRandom})).Should(BeNil(), "delete device")
+		Expect(executor.Commands()[start:]).Should(ContainElement("dd if=/dev/zero of="+devDir+"/vg/vol1 bs=1M count=4096 iflag=count_bytes conv=fsync"), "only header wiped")
+	})
+
+	It("Should reject invalid configurations", func() {
+		_, err := newPmemDeviceManagerLVMThin(pmemlvm.New(nil), []string{"nopool"}, nil, opts)
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "no thin pool: %v", err)
+		_, err = newPmemDeviceManagerLVMThin(pmemlvm.New(nil), []string{"vg"}, nil, ThinOpts{Overcommit: 0.5, WarningWatermark: 50, HighWatermark: 80})
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "overcommit ratio: %v", err)
+		_, err = newPmemDeviceManagerLVMThin(pmemlvm.New(nil), []string{"vg"}, nil, ThinOpts{Overcommit: 1, WarningWatermark: 90, HighWatermark: 80})
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "watermarks: %v", err)
+	})
+})
+
+var _ = Describe("Keyed mutex", func() {
+	It("Should only serialize the same key", func() {
+		var k keyedMutex
+		unlockA := k.lock("a")
+		unlockB := k.lock("b")
+		unlockB()
+
+		locked := make(chan struct{})
+		go func() {
+			unlock := k.lockAll("b", "a")
+			close(locked)
+			unlock()
+		}()
+		Consistently(locked, "100ms").ShouldNot(BeClosed(), "a is still locked")
+		unlockA()
+		Eventually(locked).Should(BeClosed(), "a and b locked")
+		Eventually(func() int {
+			k.mutex.Lock()
+			defer k.mutex.Unlock()
+			return len(k.locks)
+		}).Should(BeZero(), "unused mutexes removed")
+	})
+
+	It("Should allow concurrent readers", func() {
+		var k keyedMutex
+		unlockRead := k.rlockAll("a", "b")
+		k.rlock("a")()
+
+		locked := make(chan struct{})
+		go func() {
+			unlock := k.lock("b")
+			close(locked)
+			unlock()
+		}()
+		Consistently(locked, "100ms").ShouldNot(BeClosed(), "b is read-locked")
+		unlockRead()
+		Eventually(locked).Should(BeClosed(), "b locked")
+	})
 })
 
 func runTests(mode string) {
 	var dm PmemDeviceManager
 	var vg *testVGS
+	var loopDir string
 	var cleanupList map[string]bool
 	var err error
 
@@ -59,9 +722,14 @@ func runTests(mode string) {
 			vg, err = createTestVGS(vgname, vgsize)
 			Expect(err).Should(BeNil(), "Failed to create volume group")
 
-			dm, err = NewPmemDeviceManagerLVMForVGs([]string{vg.name})
+			dm, err = NewPmemDeviceManagerLVMForVGs([]string{vg.name}, nil)
+		} else if mode == ModeSimulated {
+			loopDir, err = ioutil.TempDir("", "test-loop-dev")
+			Expect(err).Should(BeNil(), "Failed to create directory for loop devices")
+
+			dm, err = NewPmemDeviceManagerLoop(loopDir, vgsize)
 		} else {
-			dm, err = NewPmemDeviceManagerNdctl()
+			dm, err = NewPmemDeviceManagerNdctl(nil)
 			if err != nil && strings.Contains(err.Error(), "/sys mounted read-only") {
 				Skip("/sys mounted read-only, cannot test direct mode")
 			}
@@ -76,18 +744,22 @@ func runTests(mode string) {
 				continue
 			}
 			By("Cleaning up device: " + devName)
-			dm.DeleteDevice(devName, false)
+			dm.DeleteDevice(devName, EraseOpts{})
 		}
 		if mode == ModeLVM {
 			err := vg.Clean()
 			Expect(err).Should(BeNil(), "Failed to create LVM device manager")
 		}
+		if mode == ModeSimulated {
+			err := os.RemoveAll(loopDir)
+			Expect(err).Should(BeNil(), "Failed to remove directory for loop devices")
+		}
 	})
 
 	It("Should create a new device", func() {
 		name := "test-dev-new"
 		size := uint64(2) * 1024 * 1024 // 2Mb
-		err := dm.CreateDevice(name, size)
+		err := dm.CreateDevice(name, size, CreateDeviceOpts{})
 		Expect(err).Should(BeNil(), "Failed to create new device")
 
 		cleanupList[name] = true
@@ -99,10 +771,88 @@ func runTests(mode string) {
 		Expect(dev.Path).ShouldNot(BeNil(), "Null device path")
 	})
 
+	It("Should create devdax devices only in direct mode", func() {
+		name := "test-dev-devdax"
+		size := uint64(2) * 1024 * 1024 // 2Mb
+		err := dm.CreateDevice(name, size, CreateDeviceOpts{Mode: DevdaxMode})
+		if mode != ModeDirect {
+			Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "devdax mode must be rejected")
+			return
+		}
+		Expect(err).Should(BeNil(), "Failed to create devdax device")
+		cleanupList[name] = true
+
+		dev, err := dm.GetDevice(name)
+		Expect(err).Should(BeNil(), "Failed to retrieve device info")
+		Expect(dev.CharDev).Should(BeTrue(), "devdax device must be a character device")
+		Expect(dev.Dax).Should(BeFalse(), "devdax device cannot be mounted")
+		Expect(strings.HasPrefix(dev.Path, "/dev/dax")).Should(BeTrue(), "unexpected device path %q", dev.Path)
+		Expect(dev.Size >= size).Should(BeTrue(), "Size mismatch")
+	})
+
+	It("Should create sector devices", func() {
+		name := "test-dev-sector"
+		size := uint64(2) * 1024 * 1024 // 2Mb
+		sectorDM := dm
+		if mode == ModeLVM {
+			sectorVG, err := createTestVGS(vgname+"-sector", vgsize)
+			Expect(err).Should(BeNil(), "Failed to create sector volume group")
+			defer sectorVG.Clean() //nolint: errcheck
+			sectorDM, err = NewPmemDeviceManagerLVMForVGs([]string{vg.name}, []string{sectorVG.name})
+			Expect(err).Should(BeNil(), "Failed to create LVM device manager")
+		}
+		err := sectorDM.CreateDevice(name, size, CreateDeviceOpts{Mode: SectorMode})
+		if mode == ModeSimulated {
+			Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "sector mode must be rejected")
+			return
+		}
+		Expect(err).Should(BeNil(), "Failed to create sector device")
+		defer sectorDM.DeleteDevice(name, EraseOpts{}) //nolint: errcheck
+
+		dev, err := sectorDM.GetDevice(name)
+		Expect(err).Should(BeNil(), "Failed to retrieve device info")
+		Expect(dev.Dax).Should(BeFalse(), "sector device must not support DAX")
+		Expect(dev.Size >= size).Should(BeTrue(), "Size mismatch")
+		if mode == ModeLVM {
+			Expect(lvVolumeGroup(dev)).Should(Equal(vgname+"-sector"), "sector device in wrong volume group")
+		}
+	})
+
+	It("Should support volume layouts only in LVM mode", func() {
+		size := uint64(8) * 1024 * 1024 // 8Mb
+		for _, layout := range []VolumeLayout{LinearLayout, StripedLayout} {
+			name := "test-dev-" + string(layout)
+			err := dm.CreateDevice(name, size, CreateDeviceOpts{Layout: layout})
+			if mode != ModeLVM {
+				Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "%s layout must be rejected", layout)
+				continue
+			}
+			Expect(err).Should(BeNil(), "Failed to create device with %s layout", layout)
+			cleanupList[name] = true
+
+			dev, err := dm.GetDevice(name)
+			Expect(err).Should(BeNil(), "Failed to retrieve device info")
+			Expect(dev.Size >= size).Should(BeTrue(), "Size mismatch")
+		}
+		err := dm.CreateDevice("test-dev-bad-layout", size, CreateDeviceOpts{Layout: "mirrored"})
+		Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "unknown layout must be rejected")
+	})
+
+	It("Should place devices only on the requested NUMA node", func() {
+		// No test machine has that many NUMA nodes.
+		numaNode := 1000
+		err := dm.CreateDevice("test-dev-numa", uint64(2)*1024*1024, CreateDeviceOpts{NumaNode: &numaNode})
+		if mode == ModeSimulated {
+			Expect(errors.Is(err, ErrInvalid)).Should(BeTrue(), "NUMA node must be rejected")
+			return
+		}
+		Expect(errors.Is(err, ErrNotEnoughSpace)).Should(BeTrue(), "device must not be created on another NUMA node: %v", err)
+	})
+
 	It("Should support recreating a device", func() {
 		name := "test-dev"
 		size := uint64(2) * 1024 * 1024 // 2Mb
-		err := dm.CreateDevice(name, size)
+		err := dm.CreateDevice(name, size, CreateDeviceOpts{})
 		Expect(err).Should(BeNil(), "Failed to create new device")
 
 		cleanupList[name] = true
@@ -113,11 +863,11 @@ func runTests(mode string) {
 		Expect(dev.Size >= size).Should(BeTrue(), "Size mismatch")
 		Expect(dev.Path).ShouldNot(BeNil(), "Null device path")
 
-		err = dm.DeleteDevice(name, false)
+		err = dm.DeleteDevice(name, EraseOpts{})
 		Expect(err).Should(BeNil(), "Failed to delete device")
 		cleanupList[name] = false
 
-		err = dm.CreateDevice(name, size)
+		err = dm.CreateDevice(name, size, CreateDeviceOpts{})
 		Expect(err).Should(BeNil(), "Failed to recreate the same device")
 		cleanupList[name] = true
 	})
@@ -145,7 +895,7 @@ func runTests(mode string) {
 		for i := 1; i <= max_devices; i++ {
 			name := fmt.Sprintf("list-dev-%d", i)
 			sizes[name] = uint64(rand.Intn(15)+1) * 1024 * 1024
-			err := dm.CreateDevice(name, sizes[name])
+			err := dm.CreateDevice(name, sizes[name], CreateDeviceOpts{})
 			Expect(err).Should(BeNil(), "Failed to create new device")
 			cleanupList[name] = true
 		}
@@ -161,7 +911,7 @@ func runTests(mode string) {
 		for i := 1; i <= max_deletes; i++ {
 			name := fmt.Sprintf("list-dev-%d", i)
 			delete(sizes, name)
-			err = dm.DeleteDevice(name, false)
+			err = dm.DeleteDevice(name, EraseOpts{})
 			Expect(err).Should(BeNil(), "Error while deleting device '"+name+"'")
 			cleanupList[name] = false
 		}
@@ -185,10 +935,114 @@ func runTests(mode string) {
 		}
 	})
 
+	It("Should resize devices", func() {
+		name := "resize-dev"
+		size := uint64(4) * 1024 * 1024 // 4Mb
+		err := dm.CreateDevice(name, size, CreateDeviceOpts{})
+		Expect(err).Should(BeNil(), "Failed to create new device")
+		cleanupList[name] = true
+
+		dev, err := dm.GetDevice(name)
+		Expect(err).Should(BeNil(), "Failed to retrieve device info")
+		oldSize := dev.Size
+
+		// Shrinking is silently ignored.
+		err = dm.ResizeDevice(name, size/2)
+		Expect(err).Should(BeNil(), "Failed to resize device to smaller size")
+		dev, err = dm.GetDevice(name)
+		Expect(err).Should(BeNil(), "Failed to retrieve device info")
+		Expect(dev.Size).Should(Equal(oldSize), "Size changed")
+
+		err = dm.ResizeDevice(name, oldSize*2)
+		Expect(err).Should(BeNil(), "Failed to resize device")
+		dev, err = dm.GetDevice(name)
+		Expect(err).Should(BeNil(), "Failed to retrieve device info")
+		Expect(dev.Size).Should(BeNumerically(">=", oldSize*2), "Size mismatch")
+
+		err = dm.ResizeDevice("unknown", size)
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "expected error is device not found error")
+	})
+
+	It("Should copy devices", func() {
+		size := uint64(4) * 1024 * 1024 // 4Mb
+		for _, name := range []string{"copy-source", "copy-target", "copy-small"} {
+			s := size
+			if name == "copy-small" {
+				s = size / 2
+			}
+			err := dm.CreateDevice(name, s, CreateDeviceOpts{})
+			Expect(err).Should(BeNil(), "Failed to create new device")
+			cleanupList[name] = true
+		}
+		source, err := dm.GetDevice("copy-source")
+		Expect(err).Should(BeNil(), "Failed to retrieve device info")
+		target, err := dm.GetDevice("copy-target")
+		Expect(err).Should(BeNil(), "Failed to retrieve device info")
+
+		data := []byte("hello world")
+		err = ioutil.WriteFile(source.Path, data, 0)
+		Expect(err).Should(BeNil(), "Failed to write source device")
+
+		err = dm.CopyDevice("copy-target", source)
+		Expect(err).Should(BeNil(), "Failed to copy device")
+		fp, err := os.Open(target.Path)
+		Expect(err).Should(BeNil(), "Failed to open target device")
+		defer fp.Close()
+		buffer := make([]byte, len(data))
+		_, err = fp.Read(buffer)
+		Expect(err).Should(BeNil(), "Failed to read target device")
+		Expect(buffer).Should(Equal(data), "copied data")
+
+		if small, err := dm.GetDevice("copy-small"); err == nil && small.Size < source.Size {
+			err = dm.CopyDevice("copy-small", source)
+			Expect(err).ShouldNot(BeNil(), "Error expected when copying into smaller device")
+		}
+		err = dm.CopyDevice("unknown", source)
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "expected error is device not found error")
+	})
+
+	It("Should create snapshots", func() {
+		snapshotter, ok := dm.(PmemSnapshotManager)
+		if !ok {
+			Skip("snapshots not supported in " + mode + " mode")
+		}
+
+		name := "snapshot-source"
+		size := uint64(4) * 1024 * 1024 // 4Mb
+		err := dm.CreateDevice(name, size, CreateDeviceOpts{})
+		Expect(err).Should(BeNil(), "Failed to create new device")
+		cleanupList[name] = true
+
+		err = snapshotter.CreateSnapshot("snapshot", name)
+		Expect(err).Should(BeNil(), "Failed to create snapshot")
+		defer snapshotter.DeleteSnapshot("snapshot", EraseOpts{})
+
+		err = snapshotter.CreateSnapshot("snapshot", name)
+		Expect(errors.Is(err, ErrDeviceExists)).Should(BeTrue(), "expected error is device exists error")
+		err = snapshotter.CreateSnapshot("snapshot-2", "unknown")
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "expected error is device not found error")
+
+		snapshot, err := snapshotter.GetSnapshot("snapshot")
+		Expect(err).Should(BeNil(), "Failed to retrieve snapshot info")
+		Expect(snapshot.Size).Should(BeNumerically(">=", size), "Size mismatch")
+
+		// Snapshots are not volumes.
+		_, err = dm.GetDevice("snapshot")
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "expected error is device not found error")
+		list, err := snapshotter.ListSnapshots()
+		Expect(err).Should(BeNil(), "Failed to list snapshots")
+		Expect(len(list)).Should(Equal(1), "count mismatch")
+
+		err = snapshotter.DeleteSnapshot("snapshot", EraseOpts{})
+		Expect(err).Should(BeNil(), "Failed to delete snapshot")
+		_, err = snapshotter.GetSnapshot("snapshot")
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "expected error is device not found error")
+	})
+
 	It("Should delete devices", func() {
 		name := "delete-dev"
 		size := uint64(2) * 1024 * 1024 // 2Mb
-		err := dm.CreateDevice(name, size)
+		err := dm.CreateDevice(name, size, CreateDeviceOpts{})
 		Expect(err).Should(BeNil(), "Failed to create new device")
 		cleanupList[name] = true
 
@@ -204,7 +1058,7 @@ func runTests(mode string) {
 		defer unmount(mountPath)
 
 		// Delete should fail as the device is in use
-		err = dm.DeleteDevice(name, true)
+		err = dm.DeleteDevice(name, EraseOpts{Policy: EraseRandom})
 		Expect(err).ShouldNot(BeNil(), "Error expected when deleting device in use: %s", dev.VolumeId)
 		Expect(errors.Is(err, ErrDeviceInUse)).Should(BeTrue(), "Expected device busy error: %s", dev.VolumeId)
 		cleanupList[name] = false
@@ -213,7 +1067,7 @@ func runTests(mode string) {
 		Expect(err).Should(BeNil(), "Failed to unmount the device: %s", dev.VolumeId)
 
 		// Delete should succeed
-		err = dm.DeleteDevice(name, true)
+		err = dm.DeleteDevice(name, EraseOpts{Policy: EraseRandom})
 		Expect(err).Should(BeNil(), "Failed to delete device")
 
 		dev, err = dm.GetDevice(name)
@@ -222,7 +1076,7 @@ func runTests(mode string) {
 		Expect(dev).Should(BeNil(), "returned device should be nil")
 
 		// Delete call should not return any error on non-existing device
-		err = dm.DeleteDevice(name, true)
+		err = dm.DeleteDevice(name, EraseOpts{Policy: EraseRandom})
 		Expect(err).Should(BeNil(), "DeleteDevice() is not idempotent")
 	})
 }
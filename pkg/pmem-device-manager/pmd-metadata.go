@@ -0,0 +1,253 @@
+package pmdmanager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// lvmMetadataTag is the prefix of the tags which hold the
+	// metadata of a logical volume. It is followed by the index
+	// of the chunk and a dot.
+	lvmMetadataTag = "pmem-csi.meta."
+	// lvmMaxTagLen is the maximum length of a tag in LVM.
+	lvmMaxTagLen = 128
+	// lvmMaxMetadataTags limits the index to two digits.
+	lvmMaxMetadataTags = 100
+
+	// ndctlMetadataName is the name of the namespace which holds
+	// the metadata of all other namespaces in its region.
+	ndctlMetadataName = "pmem-csi-metadata"
+	// ndctlMetadataSize is the minimum size of that namespace.
+	ndctlMetadataSize = 16 * 1024 * 1024
+	// metadataRecordSize is the size of one record. The namespace
+	// uses sectors of that size, which the BTT writes atomically.
+	metadataRecordSize = 4096
+	// metadataMagic starts each record, followed by the length
+	// and the CRC32 checksum of the JSON data.
+	metadataMagic      = "PMEMCSI\x01"
+	metadataHeaderSize = len(metadataMagic) + 8
+)
+
+//VolumeMetadata describes a volume independently of the state of the
+//driver, so that the volume can be restored from its device alone
+type VolumeMetadata struct {
+	//Name is the name of the volume in CreateVolume
+	Name string `json:"name,omitempty"`
+	//Parameters of the volume, as stored in the state of the driver
+	Parameters map[string]string `json:"parameters,omitempty"`
+	//Created is the creation time of the volume
+	Created time.Time `json:"created"`
+	//Owner is the node which created the volume
+	Owner string `json:"owner,omitempty"`
+}
+
+// metadataTags encodes the metadata as LVM tags. Tags may only contain
+// a limited set of characters and are short, therefore the JSON
+// encoding gets stored base64-encoded in as many tags as needed.
+func metadataTags(metadata *VolumeMetadata) ([]string, error) {
+	if metadata == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("encode volume metadata: %v", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	chunkLen := lvmMaxTagLen - len(lvmMetadataTag) - len("00.")
+	tags := []string{}
+	for i := 0; len(encoded) > 0; i++ {
+		if i >= lvmMaxMetadataTags {
+			return nil, fmt.Errorf("volume metadata too large: %w", ErrInvalid)
+		}
+		n := chunkLen
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		tags = append(tags, fmt.Sprintf("%s%02d.%s", lvmMetadataTag, i, encoded[:n]))
+		encoded = encoded[n:]
+	}
+	return tags, nil
+}
+
+// parseMetadataTags reassembles the metadata from the tags of a logical
+// volume. Other tags are ignored. The result is nil if there are no
+// metadata tags.
+func parseMetadataTags(tags []string) (*VolumeMetadata, error) {
+	chunks := map[int]string{}
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, lvmMetadataTag) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(tag, lvmMetadataTag), ".", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid metadata tag %q", tag)
+		}
+		i, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata tag %q: %v", tag, err)
+		}
+		chunks[i] = parts[1]
+	}
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	indices := []int{}
+	for i := range chunks {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	var encoded strings.Builder
+	for n, i := range indices {
+		if n != i {
+			return nil, fmt.Errorf("metadata tag #%d missing", n)
+		}
+		encoded.WriteString(chunks[i])
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, fmt.Errorf("decode volume metadata: %v", err)
+	}
+	metadata := &VolumeMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("decode volume metadata: %v", err)
+	}
+	return metadata, nil
+}
+
+// metadataRecord ties the metadata to a namespace. A record is only
+// valid for the namespace with the same name and UUID, so a record
+// that was left behind for a deleted namespace does not get
+// attached to a new namespace which reuses the name.
+type metadataRecord struct {
+	ID       string          `json:"id"`
+	UUID     string          `json:"uuid"`
+	Metadata *VolumeMetadata `json:"metadata"`
+}
+
+func encodeMetadataRecord(record *metadataRecord) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("encode volume metadata: %v", err)
+	}
+	if len(data) > metadataRecordSize-metadataHeaderSize {
+		return nil, fmt.Errorf("volume metadata too large: %w", ErrInvalid)
+	}
+	buf := make([]byte, metadataRecordSize)
+	copy(buf, metadataMagic)
+	binary.LittleEndian.PutUint32(buf[len(metadataMagic):], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[len(metadataMagic)+4:], crc32.ChecksumIEEE(data))
+	copy(buf[metadataHeaderSize:], data)
+	return buf, nil
+}
+
+// decodeMetadataRecord returns nil for unused and damaged records.
+func decodeMetadataRecord(buf []byte) *metadataRecord {
+	if !bytes.HasPrefix(buf, []byte(metadataMagic)) {
+		return nil
+	}
+	length := binary.LittleEndian.Uint32(buf[len(metadataMagic):])
+	if length > uint32(len(buf)-metadataHeaderSize) {
+		return nil
+	}
+	data := buf[metadataHeaderSize : metadataHeaderSize+int(length)]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(buf[len(metadataMagic)+4:]) {
+		return nil
+	}
+	record := &metadataRecord{}
+	if err := json.Unmarshal(data, record); err != nil || record.ID == "" {
+		return nil
+	}
+	return record
+}
+
+// readMetadataRecords returns the valid records in the device or file,
+// indexed by their position, and how many records fit into it.
+func readMetadataRecords(path string) (map[int]*metadataRecord, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	records := map[int]*metadataRecord{}
+	buf := make([]byte, metadataRecordSize)
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(file, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, i, nil
+			}
+			return nil, 0, fmt.Errorf("read metadata from %s: %v", path, err)
+		}
+		if record := decodeMetadataRecord(buf); record != nil {
+			records[i] = record
+		}
+	}
+}
+
+// writeMetadataRecord replaces the record for the same ID or, if there
+// is none, stores it in the first unused position.
+func writeMetadataRecord(path string, record *metadataRecord) error {
+	buf, err := encodeMetadataRecord(record)
+	if err != nil {
+		return err
+	}
+	records, size, err := readMetadataRecords(path)
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i := 0; i < size; i++ {
+		if old, ok := records[i]; ok && old.ID == record.ID {
+			index = i
+			break
+		}
+		if _, ok := records[i]; !ok && index < 0 {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("no room for volume metadata in %s: %w", path, ErrNotEnoughSpace)
+	}
+	return writeMetadataAt(path, buf, index)
+}
+
+// removeMetadataRecord clears all records for the ID.
+func removeMetadataRecord(path, id string) error {
+	records, _, err := readMetadataRecords(path)
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		if record.ID == id {
+			if err := writeMetadataAt(path, make([]byte, metadataRecordSize), i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeMetadataAt(path string, buf []byte, index int) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(buf, int64(index)*metadataRecordSize); err != nil {
+		return fmt.Errorf("write metadata to %s: %v", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("write metadata to %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package pmdmanager
+
+import (
+	"errors"
+	"fmt"
+)
+
+//Backend is one of several device managers which run side by side on a node
+type Backend struct {
+	//Name selects the backend in CreateDeviceOpts, for example "lvm" or "direct"
+	Name string
+	//DeviceManager manages the devices of the backend
+	DeviceManager PmemDeviceManager
+}
+
+//PmemBackendManager is implemented by device managers which combine several backends
+type PmemBackendManager interface {
+	// Backends returns the names of all backends, the default backend first.
+	Backends() []string
+
+	// GetBackendCapacity returns the capacity of the backend with the given name.
+	// Possible errors: ErrInvalid
+	GetBackendCapacity(backend string, opts CapacityOpts) (Capacity, error)
+
+	// DeviceBackend returns the name of the backend which has the device.
+	// Possible errors: ErrDeviceNotFound
+	DeviceBackend(name string) (string, error)
+}
+
+// pmemMulti passes each operation on to the backend which has the
+// device. Device names are unique across all backends.
+type pmemMulti struct {
+	backends []Backend
+}
+
+// pmemMultiSnapshots is used when at least one backend supports
+// snapshots.
+type pmemMultiSnapshots struct {
+	*pmemMulti
+}
+
+var _ PmemDeviceManager = &pmemMulti{}
+var _ PmemBackendManager = &pmemMulti{}
+var _ PmemThinPoolManager = &pmemMulti{}
+var _ PmemSnapshotManager = &pmemMultiSnapshots{}
+
+//NewPmemDeviceManagerMulti combines several backends into one device manager.
+//New devices get created by the backend selected with CreateDeviceOpts.Backend,
+//the first one by default. The result also implements PmemBackendManager and,
+//if at least one backend supports it, PmemSnapshotManager.
+func NewPmemDeviceManagerMulti(backends []Backend) (PmemDeviceManager, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no device manager: %w", ErrInvalid)
+	}
+	names := map[string]bool{}
+	for _, backend := range backends {
+		if names[backend.Name] {
+			return nil, fmt.Errorf("device manager %q used more than once: %w", backend.Name, ErrInvalid)
+		}
+		names[backend.Name] = true
+	}
+
+	multi := &pmemMulti{backends: backends}
+	for _, backend := range backends {
+		if _, ok := backend.DeviceManager.(PmemSnapshotManager); ok {
+			return &pmemMultiSnapshots{multi}, nil
+		}
+	}
+	return multi, nil
+}
+
+func (multi *pmemMulti) Backends() []string {
+	var names []string
+	for _, backend := range multi.backends {
+		names = append(names, backend.Name)
+	}
+	return names
+}
+
+func (multi *pmemMulti) GetBackendCapacity(name string, opts CapacityOpts) (Capacity, error) {
+	backend, err := multi.backend(name)
+	if err != nil {
+		return Capacity{}, err
+	}
+	return backend.DeviceManager.GetCapacity(opts)
+}
+
+func (multi *pmemMulti) DeviceBackend(name string) (string, error) {
+	backend, _, err := multi.owner(name)
+	if err != nil {
+		return "", err
+	}
+	return backend.Name, nil
+}
+
+// GetCapacity returns the total free space of all backends and the
+// largest volume that one of them can create.
+func (multi *pmemMulti) GetCapacity(opts CapacityOpts) (Capacity, error) {
+	var capacity Capacity
+	for _, backend := range multi.backends {
+		c, err := backend.DeviceManager.GetCapacity(opts)
+		if err != nil {
+			return capacity, fmt.Errorf("%s: %w", backend.Name, err)
+		}
+		capacity.Total += c.Total
+		if c.Largest > capacity.Largest {
+			capacity.Largest = c.Largest
+		}
+	}
+	return capacity, nil
+}
+
+func (multi *pmemMulti) CreateDevice(name string, size uint64, opts CreateDeviceOpts) error {
+	backend, err := multi.backend(opts.Backend)
+	if err != nil {
+		return err
+	}
+	if _, _, err := multi.owner(name); err == nil {
+		return ErrDeviceExists
+	} else if !errors.Is(err, ErrDeviceNotFound) {
+		return err
+	}
+	return backend.DeviceManager.CreateDevice(name, size, opts)
+}
+
+func (multi *pmemMulti) GetDevice(name string) (*PmemDeviceInfo, error) {
+	_, device, err := multi.owner(name)
+	return device, err
+}
+
+func (multi *pmemMulti) ResizeDevice(name string, size uint64) error {
+	backend, _, err := multi.owner(name)
+	if err != nil {
+		return err
+	}
+	return backend.DeviceManager.ResizeDevice(name, size)
+}
+
+func (multi *pmemMulti) CopyDevice(name string, source *PmemDeviceInfo) error {
+	backend, _, err := multi.owner(name)
+	if err != nil {
+		return err
+	}
+	return backend.DeviceManager.CopyDevice(name, source)
+}
+
+func (multi *pmemMulti) DeleteDevice(name string, erase EraseOpts) error {
+	backend, _, err := multi.owner(name)
+	if err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			return nil
+		}
+		return err
+	}
+	return backend.DeviceManager.DeleteDevice(name, erase)
+}
+
+func (multi *pmemMulti) ListDevices() ([]*PmemDeviceInfo, error) {
+	devices := []*PmemDeviceInfo{}
+	for _, backend := range multi.backends {
+		d, err := backend.DeviceManager.ListDevices()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", backend.Name, err)
+		}
+		devices = append(devices, d...)
+	}
+	return devices, nil
+}
+
+// ThinPools returns the thin pools of all backends which have them.
+func (multi *pmemMulti) ThinPools() ([]ThinPool, error) {
+	pools := []ThinPool{}
+	for _, backend := range multi.backends {
+		if thin, ok := backend.DeviceManager.(PmemThinPoolManager); ok {
+			p, err := thin.ThinPools()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", backend.Name, err)
+			}
+			pools = append(pools, p...)
+		}
+	}
+	return pools, nil
+}
+
+// backend looks up a backend by name, the default one for an empty name.
+func (multi *pmemMulti) backend(name string) (*Backend, error) {
+	if name == "" {
+		return &multi.backends[0], nil
+	}
+	for i := range multi.backends {
+		if multi.backends[i].Name == name {
+			return &multi.backends[i], nil
+		}
+	}
+	return nil, fmt.Errorf("device manager %q not available: %w", name, ErrInvalid)
+}
+
+// owner finds the backend which has the device.
+func (multi *pmemMulti) owner(name string) (*Backend, *PmemDeviceInfo, error) {
+	for i := range multi.backends {
+		device, err := multi.backends[i].DeviceManager.GetDevice(name)
+		if err == nil {
+			return &multi.backends[i], device, nil
+		}
+		if !errors.Is(err, ErrDeviceNotFound) {
+			return nil, nil, fmt.Errorf("%s: %w", multi.backends[i].Name, err)
+		}
+	}
+	return nil, nil, ErrDeviceNotFound
+}
+
+// CreateSnapshot uses the backend of the source device, which must
+// support snapshots.
+func (multi *pmemMultiSnapshots) CreateSnapshot(name string, sourceName string) error {
+	backend, _, err := multi.owner(sourceName)
+	if err != nil {
+		return err
+	}
+	snapshots, ok := backend.DeviceManager.(PmemSnapshotManager)
+	if !ok {
+		return fmt.Errorf("device manager %q does not support snapshots: %w", backend.Name, ErrInvalid)
+	}
+	return snapshots.CreateSnapshot(name, sourceName)
+}
+
+func (multi *pmemMultiSnapshots) GetSnapshot(name string) (*PmemDeviceInfo, error) {
+	snapshots, snapshot, err := multi.snapshotOwner(name)
+	if snapshots == nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (multi *pmemMultiSnapshots) DeleteSnapshot(name string, erase EraseOpts) error {
+	snapshots, _, err := multi.snapshotOwner(name)
+	if snapshots == nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			return nil
+		}
+		return err
+	}
+	return snapshots.DeleteSnapshot(name, erase)
+}
+
+func (multi *pmemMultiSnapshots) ListSnapshots() ([]*PmemDeviceInfo, error) {
+	result := []*PmemDeviceInfo{}
+	for _, backend := range multi.backends {
+		if snapshots, ok := backend.DeviceManager.(PmemSnapshotManager); ok {
+			s, err := snapshots.ListSnapshots()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", backend.Name, err)
+			}
+			result = append(result, s...)
+		}
+	}
+	return result, nil
+}
+
+// snapshotOwner finds the backend which has the snapshot.
+func (multi *pmemMultiSnapshots) snapshotOwner(name string) (PmemSnapshotManager, *PmemDeviceInfo, error) {
+	for _, backend := range multi.backends {
+		snapshots, ok := backend.DeviceManager.(PmemSnapshotManager)
+		if !ok {
+			continue
+		}
+		snapshot, err := snapshots.GetSnapshot(name)
+		if err == nil {
+			return snapshots, snapshot, nil
+		}
+		if !errors.Is(err, ErrDeviceNotFound) {
+			return nil, nil, fmt.Errorf("%s: %w", backend.Name, err)
+		}
+	}
+	return nil, nil, ErrDeviceNotFound
+}
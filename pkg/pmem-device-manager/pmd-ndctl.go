@@ -3,7 +3,6 @@ package pmdmanager
 import (
 	"errors"
 	"fmt"
-	"sync"
 
 	"github.com/intel/pmem-csi/pkg/ndctl"
 	"k8s.io/klog"
@@ -12,65 +11,111 @@ import (
 
 const (
 	// 1 GB align in ndctl creation request has proven to be reliable.
-	// Newer kernels may allow smaller alignment but we do not want to introduce kernel depenency.
+	// It is used when the kernel does not report which alignments it
+	// supports and when a smaller alignment did not work.
 	ndctlAlign uint64 = 1024 * 1024 * 1024
+	// The default alignment on kernels which support it. It still
+	// allows huge page mappings, but wastes much less space for
+	// the meta data than ndctlAlign.
+	ndctlDefaultAlign uint64 = 2 * 1024 * 1024
 )
 
+// pmemNdctl does not hold a global lock while working on a device.
+// Each operation uses its own libndctl context. Erasing and copying
+// data runs concurrently with operations on other devices.
 type pmemNdctl struct {
+	placement ndctl.PlacementStrategy
+	// regions limits the regions in which namespaces get created
+	// and listed, nil for all regions.
+	regions RegionFilter
+
+	// regionLocks serialize changes of namespaces inside a region.
+	// Concurrent namespace creation in the same region fails
+	// (https://github.com/pmem/ndctl/issues/96). Once ndctl supports
+	// that we need to revisit our locking strategy. Enumerating
+	// namespaces locks all regions for reading, so it never sees
+	// a namespace while it gets created, resized or destroyed.
+	regionLocks keyedMutex
+	// volumeLocks serialize operations on the same volume.
+	volumeLocks keyedMutex
 }
 
 var _ PmemDeviceManager = &pmemNdctl{}
 
-// mutex to synchronize all ndctl calls
-// https://github.com/pmem/ndctl/issues/96
-// Once ndctl supports concurrent calls we need to revisit
-// our locking strategy.
-var ndctlMutex = &sync.Mutex{}
-
 //NewPmemDeviceManagerNdctl Instantiates a new ndctl based pmem device manager
-func NewPmemDeviceManagerNdctl() (PmemDeviceManager, error) {
+//which places new namespaces in regions according to the given strategy,
+//nil for ndctl.FirstFit
+func NewPmemDeviceManagerNdctl(placement ndctl.PlacementStrategy) (PmemDeviceManager, error) {
+	return NewPmemDeviceManagerNdctlForRegions(placement, nil)
+}
+
+//NewPmemDeviceManagerNdctlForRegions does the same as NewPmemDeviceManagerNdctl,
+//but only uses regions which pass the filter
+func NewPmemDeviceManagerNdctlForRegions(placement ndctl.PlacementStrategy, regions RegionFilter) (PmemDeviceManager, error) {
 	// Check is /sys writable. If not then there is no point starting
 	mounts, _ := mount.New("").List()
 	for _, mnt := range mounts {
 		klog.V(5).Infof("NewPmemDeviceManagerNdctl: Check mounts: device=%s path=%s opts=%s",
 			mnt.Device, mnt.Path, mnt.Opts)
-		if mnt.Device == "sysfs" && mnt.Path == "/sys" {
+		if mnt.Device == "sysfs" && mnt.Path == sysfsRoot {
 			for _, opt := range mnt.Opts {
 				if opt == "rw" {
-					klog.V(4).Info("NewPmemDeviceManagerNdctl: /sys mounted read-write, good")
+					klog.V(4).Infof("NewPmemDeviceManagerNdctl: %s mounted read-write, good", sysfsRoot)
 				} else if opt == "ro" {
-					return nil, fmt.Errorf("FATAL: /sys mounted read-only, can not operate")
+					return nil, fmt.Errorf("FATAL: %s mounted read-only, can not operate", sysfsRoot)
 				}
 			}
 			break
 		}
 	}
 
-	return &pmemNdctl{}, nil
+	if placement == nil {
+		placement = ndctl.FirstFit
+	}
+	return &pmemNdctl{placement: placement, regions: regions}, nil
 }
 
-func (pmem *pmemNdctl) GetCapacity() (uint64, error) {
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
-
-	ndctx, err := ndctl.NewContext()
+func (pmem *pmemNdctl) GetCapacity(opts CapacityOpts) (Capacity, error) {
+	var capacity Capacity
+	if opts.Layout != "" && opts.Layout != RegionLayout {
+		// Namespaces never span regions.
+		return capacity, nil
+	}
+	ndctx, err := newNdctlContext()
 	if err != nil {
-		return 0, err
+		return capacity, err
 	}
 	defer ndctx.Free()
+	unlock := pmem.rlockRegions(ndctx)
+	defer unlock()
 
-	var capacity uint64
 	for _, bus := range ndctx.GetBuses() {
 		for _, r := range bus.ActiveRegions() {
-			realalign := ndctlAlign * r.InterleaveWays()
-			available := r.MaxAvailableExtent()
-			// align down, avoid claiming more than what we really can serve
-			klog.V(4).Infof("GetCapacity: available before realalign: %d", available)
-			available /= realalign
-			available *= realalign
-			klog.V(4).Infof("GetCapacity: available after realalign: %d", available)
-			if available > capacity {
-				capacity = available
+			if !pmem.regions.allows(r.DeviceName()) {
+				continue
+			}
+			if opts.NumaNode != nil && r.NumaNode() != *opts.NumaNode {
+				continue
+			}
+			// The largest volume with the default alignment. Volumes
+			// with a smaller alignment need less meta data, so this
+			// is what the region can serve in any case. Space for
+			// the metadata namespace is needed when it does not
+			// exist yet.
+			var reserved uint64
+			if metadataNamespace(r) == nil {
+				reserved = metadataNamespaceSize(r)
+			}
+			available := regionCapacity(r, namespaceAlignment(r, ndctl.FsdaxMode, 0), reserved)
+			klog.V(4).Infof("GetCapacity: %s: available size %d, max available extent %d, usable %d",
+				r.DeviceName(), r.AvailableSize(), r.MaxAvailableExtent(), available)
+			// Free space outside of the largest extent is
+			// fragmented. It only becomes usable for
+			// smaller volumes or once neighboring
+			// namespaces get deleted.
+			capacity.Total += r.AvailableSize()
+			if available > capacity.Largest {
+				capacity.Largest = available
 			}
 		}
 	}
@@ -79,11 +124,27 @@ func (pmem *pmemNdctl) GetCapacity() (uint64, error) {
 	return capacity, nil
 }
 
-func (pmem *pmemNdctl) CreateDevice(volumeId string, size uint64) error {
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
+func (pmem *pmemNdctl) CreateDevice(volumeId string, size uint64, opts CreateDeviceOpts) error {
+	var mode ndctl.NamespaceMode
+	switch opts.Mode {
+	case "", FsdaxMode:
+		mode = ndctl.FsdaxMode
+	case DevdaxMode:
+		mode = ndctl.DaxMode
+	case SectorMode:
+		mode = ndctl.SectorMode
+	default:
+		return fmt.Errorf("namespace mode %q: %w", opts.Mode, ErrInvalid)
+	}
+	// A namespace cannot span regions.
+	if opts.Layout != "" && opts.Layout != RegionLayout {
+		return fmt.Errorf("volume layout %q not supported in direct mode: %w", opts.Layout, ErrInvalid)
+	}
+
+	unlock := pmem.volumeLocks.lock(volumeId)
+	defer unlock()
 
-	ndctx, err := ndctl.NewContext()
+	ndctx, err := newNdctlContext()
 	if err != nil {
 		return err
 	}
@@ -94,98 +155,481 @@ func (pmem *pmemNdctl) CreateDevice(volumeId string, size uint64) error {
 	// this function is asked to create new devices repeatedly, forcing running out of space.
 	// Avoid device filling with garbage entries by returning error.
 	// Overall, no point having more than one namespace with same name.
-	if _, err := getDevice(ndctx, volumeId); err == nil {
+	if _, err := pmem.getDevice(ndctx, volumeId); err == nil {
 		return ErrDeviceExists
 	}
 
-	// libndctl needs to store meta data and will use some of the allocated
-	// space for that (https://github.com/pmem/ndctl/issues/79).
-	// We don't know exactly how much space that is, just
-	// that it should be a small amount. But because libndctl
-	// rounds up to the alignment, in practice that means we need
-	// to request `align` additional bytes.
-	size += ndctlAlign
-	klog.V(4).Infof("Compensate for libndctl creating one alignment step smaller: increase size to %d", size)
-	ns, err := ndctx.CreateNamespace(ndctl.CreateNamespaceOpts{
-		Name:  volumeId,
-		Size:  size,
-		Align: ndctlAlign,
-		Mode:  "fsdax",
-	})
+	// The size of the namespace and its alignment depend on the
+	// region, see createNamespaceInRegion. The namespace label only
+	// has room for the name, so opts.Metadata gets stored in the
+	// metadata namespace of the region.
+	nsOpts := ndctl.CreateNamespaceOpts{
+		Name: volumeId,
+		Mode: mode,
+	}
+	ns, err := pmem.createNamespace(ndctx, size, nsOpts, opts)
 	if err != nil {
 		return err
 	}
 	data, _ := ns.MarshalJSON() //nolint: gosec
 	klog.V(3).Infof("Namespace created: %s", data)
 	// clear start of device to avoid old data being recognized as file system
-	device, err := getDevice(ndctx, volumeId)
+	device, err := pmem.getDevice(ndctx, volumeId)
 	if err != nil {
 		return err
 	}
-	if err := clearDevice(device, false); err != nil {
+	if err := clearDevice(device, EraseOpts{}); err != nil {
 		return fmt.Errorf("clear device %q: %v", volumeId, err)
 	}
 
 	return nil
 }
 
-func (pmem *pmemNdctl) DeleteDevice(volumeId string, flush bool) error {
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
+func (pmem *pmemNdctl) ResizeDevice(volumeId string, size uint64) error {
+	unlock := pmem.volumeLocks.lock(volumeId)
+	defer unlock()
+
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return err
+	}
+	defer ndctx.Free()
+
+	ns, err := getNamespace(ndctx, volumeId)
+	if err != nil {
+		return err
+	}
+	device := namespaceToPmemInfo(ns)
+	if size <= device.Size {
+		klog.V(4).Infof("ResizeDevice: %s already has size %v, requested %v", volumeId, device.Size, size)
+		return nil
+	}
+
+	// Same compensation for meta data as in CreateDevice, with the
+	// alignment that was chosen for the namespace, then align up like
+	// libndctl does during namespace creation. The namespace can only
+	// grow into the free space directly behind it.
+	r := ns.Region()
+	unlockRegion := pmem.regionLocks.lock(r.DeviceName())
+	defer unlockRegion()
+	align := ns.Align()
+	if align == 0 {
+		align = ndctlAlign
+	}
+	realalign := r.SizeAlign(align)
+	size = namespaceSize(size, align)
+	if reminder := size % realalign; reminder != 0 {
+		size += realalign - reminder
+	}
+	rawSize := ns.RawSize()
+	if size <= rawSize {
+		klog.V(4).Infof("ResizeDevice: namespace of %s already has size %v, needs %v", volumeId, rawSize, size)
+		return nil
+	}
+	if size-rawSize > ns.AdjacentAvailableSize() {
+		return ErrNotEnoughSpace
+	}
+
+	// The namespace must get disabled temporarily, which is
+	// not possible while it is in use. Therefore volumes in direct
+	// mode cannot be expanded online.
+	if deviceInUse(device) {
+		return fmt.Errorf("resize device %q: %w", device.Path, ErrDeviceInUse)
+	}
+
+	if err := ns.Resize(size); err != nil {
+		return fmt.Errorf("resize device %q: %v", volumeId, err)
+	}
+	data, _ := ns.MarshalJSON() //nolint: gosec
+	klog.V(3).Infof("Namespace resized: %s", data)
+
+	return nil
+}
+
+func (pmem *pmemNdctl) CopyDevice(volumeId string, source *PmemDeviceInfo) error {
+	unlock := pmem.volumeLocks.lock(volumeId)
+	defer unlock()
+
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return err
+	}
+	defer ndctx.Free()
+
+	device, err := pmem.getDevice(ndctx, volumeId)
+	if err != nil {
+		return err
+	}
+
+	return copyDevice(source, device)
+}
+
+func (pmem *pmemNdctl) DeleteDevice(volumeId string, erase EraseOpts) error {
+	unlock := pmem.volumeLocks.lock(volumeId)
+	defer unlock()
 
-	ndctx, err := ndctl.NewContext()
+	ndctx, err := newNdctlContext()
 	if err != nil {
 		return err
 	}
 	defer ndctx.Free()
 
-	device, err := getDevice(ndctx, volumeId)
+	device, err := pmem.getDevice(ndctx, volumeId)
 	if err != nil {
 		if errors.Is(err, ErrDeviceNotFound) {
 			return nil
 		}
 		return err
 	}
-	if err := clearDevice(device, flush); err != nil {
+	// Erasing may take minutes. Only the volume itself is locked
+	// while that happens.
+	if err := clearDevice(device, erase); err != nil {
 		if errors.Is(err, ErrDeviceNotFound) {
 			return nil
 		}
 		return err
 	}
-	return ndctx.DestroyNamespaceByName(volumeId)
+
+	ns, err := getNamespace(ndctx, volumeId)
+	if err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			return nil
+		}
+		return err
+	}
+	r := ns.Region()
+	unlockRegion := pmem.regionLocks.lock(r.DeviceName())
+	defer unlockRegion()
+	if err := r.DestroyNamespace(ns, true); err != nil {
+		return err
+	}
+	// A record that remains behind does not match any other
+	// namespace, so failing to remove it is not fatal.
+	if meta := metadataNamespace(r); meta != nil {
+		if err := removeMetadataRecord(metadataPath(meta), volumeId); err != nil {
+			klog.Warningf("Removing metadata of %s: %v", volumeId, err)
+		}
+	}
+	return nil
 }
 
 func (pmem *pmemNdctl) GetDevice(volumeId string) (*PmemDeviceInfo, error) {
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
-
-	ndctx, err := ndctl.NewContext()
+	ndctx, err := newNdctlContext()
 	if err != nil {
 		return nil, err
 	}
 	defer ndctx.Free()
+	unlock := pmem.rlockRegions(ndctx)
+	defer unlock()
 
-	return getDevice(ndctx, volumeId)
+	ns, err := getNamespace(ndctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	device := namespaceToPmemInfo(ns)
+	device.Metadata = regionMetadata(ns.Region())[volumeId].forNamespace(ns)
+	return device, nil
 }
 
 func (pmem *pmemNdctl) ListDevices() ([]*PmemDeviceInfo, error) {
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
-
-	ndctx, err := ndctl.NewContext()
+	ndctx, err := newNdctlContext()
 	if err != nil {
 		return nil, err
 	}
 	defer ndctx.Free()
+	unlock := pmem.rlockRegions(ndctx)
+	defer unlock()
 
 	devices := []*PmemDeviceInfo{}
+	metadata := map[string]map[string]*metadataRecord{}
 	for _, ns := range ndctx.GetAllNamespaces() {
-		devices = append(devices, namespaceToPmemInfo(ns))
+		r := ns.Region()
+		if !pmem.regions.allows(r.DeviceName()) || ns.Name() == ndctlMetadataName {
+			continue
+		}
+		records, ok := metadata[r.DeviceName()]
+		if !ok {
+			records = regionMetadata(r)
+			metadata[r.DeviceName()] = records
+		}
+		device := namespaceToPmemInfo(ns)
+		device.Metadata = records[ns.Name()].forNamespace(ns)
+		devices = append(devices, device)
 	}
 	return devices, nil
 }
 
+// getDevice looks up the namespace while no namespace changes.
+func (pmem *pmemNdctl) getDevice(ndctx *ndctl.Context, volumeId string) (*PmemDeviceInfo, error) {
+	unlock := pmem.rlockRegions(ndctx)
+	defer unlock()
+	return getDevice(ndctx, volumeId)
+}
+
+// rlockRegions locks all regions for reading.
+func (pmem *pmemNdctl) rlockRegions(ndctx *ndctl.Context) func() {
+	var names []string
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			names = append(names, r.DeviceName())
+		}
+	}
+	return pmem.regionLocks.rlockAll(names...)
+}
+
+// createNamespace does the same as ndctl.Context.CreateNamespace,
+// but only considers regions on the requested NUMA node and, if
+// requested, without known bad blocks. The namespace provides at least
+// the given size. Regions get locked one at a time while trying them.
+func (pmem *pmemNdctl) createNamespace(ndctx *ndctl.Context, size uint64, nsOpts ndctl.CreateNamespaceOpts, opts CreateDeviceOpts) (*ndctl.Namespace, error) {
+	var regions []*ndctl.Region
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if !pmem.regions.allows(r.DeviceName()) {
+				continue
+			}
+			if opts.NumaNode != nil && r.NumaNode() != *opts.NumaNode {
+				continue
+			}
+			if opts.AvoidBadblocks && len(r.Badblocks()) > 0 {
+				klog.V(3).Infof("Skipping %s because of bad blocks", r.DeviceName())
+				continue
+			}
+			regions = append(regions, r)
+		}
+	}
+
+	// The actual size depends on the alignment chosen for the
+	// region, the requested one is good enough for ordering.
+	align := opts.Alignment
+	if align == 0 {
+		align = ndctlAlign
+	}
+	err := fmt.Errorf("no suitable region: %w", ErrNotEnoughSpace)
+	for _, r := range pmem.placement.Order(regions, namespaceSize(size, align)) {
+		align := namespaceAlignment(r, nsOpts.Mode, opts.Alignment)
+		var ns *ndctl.Namespace
+		unlock := pmem.regionLocks.lock(r.DeviceName())
+		ns, err = createNamespaceWithMetadata(r, size, align, nsOpts, opts.Metadata)
+		unlock()
+		if err == nil {
+			klog.V(3).Infof("Namespace %s created in %s on NUMA node %d", ns.Name(), r.DeviceName(), r.NumaNode())
+			return ns, nil
+		}
+		// Expected when the namespace only fits into some other region.
+		klog.V(3).Infof("Namespace creation failure in %s: %s", r.DeviceName(), err.Error())
+	}
+	return nil, err
+}
+
+// createNamespaceWithMetadata does the same as createNamespaceInRegion
+// and then stores the metadata, if there is any. The metadata namespace
+// of the region gets created first if needed, so the new namespace
+// is not left without room for its metadata.
+func createNamespaceWithMetadata(r *ndctl.Region, size, align uint64, nsOpts ndctl.CreateNamespaceOpts, metadata *VolumeMetadata) (*ndctl.Namespace, error) {
+	if metadata == nil {
+		return createNamespaceInRegion(r, size, align, nsOpts)
+	}
+	meta := metadataNamespace(r)
+	if meta == nil {
+		var err error
+		if meta, err = createMetadataNamespace(r); err != nil {
+			return nil, err
+		}
+	}
+	ns, err := createNamespaceInRegion(r, size, align, nsOpts)
+	if err != nil {
+		return nil, err
+	}
+	record := &metadataRecord{ID: nsOpts.Name, UUID: ns.UUID().String(), Metadata: metadata}
+	if err := writeMetadataRecord(metadataPath(meta), record); err != nil {
+		if err := r.DestroyNamespace(ns, true); err != nil {
+			klog.Warningf("Removing namespace %s after failing to store its metadata: %v", nsOpts.Name, err)
+		}
+		return nil, fmt.Errorf("store volume metadata: %w", err)
+	}
+	return ns, nil
+}
+
+// metadataNamespace returns the namespace which holds the metadata of
+// the other namespaces in the region, nil if there is none.
+func metadataNamespace(r *ndctl.Region) *ndctl.Namespace {
+	for _, ns := range r.ActiveNamespaces() {
+		if ns.Name() == ndctlMetadataName {
+			return ns
+		}
+	}
+	return nil
+}
+
+func metadataPath(ns *ndctl.Namespace) string {
+	return "/dev/" + ns.BlockDeviceName()
+}
+
+// metadataNamespaceSize returns the size of the metadata namespace,
+// which has to be a multiple of the region alignment.
+func metadataNamespaceSize(r *ndctl.Region) uint64 {
+	align := r.SizeAlign(metadataRecordSize)
+	return (ndctlMetadataSize + align - 1) / align * align
+}
+
+// createMetadataNamespace creates the metadata namespace in sector
+// mode, so that writing one record is atomic.
+func createMetadataNamespace(r *ndctl.Region) (*ndctl.Namespace, error) {
+	ns, err := r.CreateNamespace(ndctl.CreateNamespaceOpts{
+		Name:       ndctlMetadataName,
+		Mode:       ndctl.SectorMode,
+		SectorSize: metadataRecordSize,
+		Size:       metadataNamespaceSize(r),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create metadata namespace in %s: %v", r.DeviceName(), err)
+	}
+	// Records of some earlier namespace must not show up.
+	if err := zeroDevice(metadataPath(ns), ns.Size()); err != nil {
+		if err := r.DestroyNamespace(ns, true); err != nil {
+			klog.Warningf("Removing metadata namespace in %s: %v", r.DeviceName(), err)
+		}
+		return nil, fmt.Errorf("clear metadata namespace in %s: %v", r.DeviceName(), err)
+	}
+	klog.V(3).Infof("Metadata namespace %s created in %s", ns.DeviceName(), r.DeviceName())
+	return ns, nil
+}
+
+// regionMetadata returns the records of the metadata namespace,
+// indexed by volume ID. Volumes are still usable without their
+// metadata, therefore errors only get logged.
+func regionMetadata(r *ndctl.Region) map[string]*metadataRecord {
+	result := map[string]*metadataRecord{}
+	meta := metadataNamespace(r)
+	if meta == nil {
+		return result
+	}
+	records, _, err := readMetadataRecords(metadataPath(meta))
+	if err != nil {
+		klog.Warningf("Reading volume metadata in %s: %v", r.DeviceName(), err)
+		return result
+	}
+	for _, record := range records {
+		result[record.ID] = record
+	}
+	return result
+}
+
+// forNamespace returns the metadata if the record belongs to the namespace.
+func (record *metadataRecord) forNamespace(ns *ndctl.Namespace) *VolumeMetadata {
+	if record == nil || record.UUID != ns.UUID().String() {
+		return nil
+	}
+	return record.Metadata
+}
+
+// createNamespaceInRegion creates a namespace with the given alignment
+// which provides at least the given size. Older kernels (< 5.3) silently
+// truncate namespaces to memory sections of 128 MiB. If that happens,
+// the namespace gets created again with the default alignment.
+func createNamespaceInRegion(r *ndctl.Region, size, align uint64, nsOpts ndctl.CreateNamespaceOpts) (*ndctl.Namespace, error) {
+	nsOpts.Align = align
+	nsOpts.Size = namespaceSize(size, align)
+	klog.V(4).Infof("Compensate for namespace meta data with alignment %d: increase size %d to %d", align, size, nsOpts.Size)
+	ns, err := r.CreateNamespace(nsOpts)
+	if err != nil {
+		return nil, err
+	}
+	if ns.Size() >= size || align == ndctlAlign {
+		return ns, nil
+	}
+	klog.V(3).Infof("Namespace %s in %s has size %d instead of %d with alignment %d, falling back to the default alignment",
+		ns.Name(), r.DeviceName(), ns.Size(), size, align)
+	if err := r.DestroyNamespace(ns, true); err != nil {
+		return nil, err
+	}
+	return createNamespaceInRegion(r, size, ndctlAlign, nsOpts)
+}
+
+// namespaceAlignment picks the alignment for a new namespace in the
+// region. The requested alignment is used if the kernel supports it,
+// otherwise the next larger supported one. Without a requested
+// alignment, ndctlDefaultAlign is used if supported. Kernels which do
+// not report the supported alignments get ndctlAlign.
+func namespaceAlignment(r *ndctl.Region, mode ndctl.NamespaceMode, align uint64) uint64 {
+	if align == ndctlAlign {
+		return ndctlAlign
+	}
+	supported := r.SupportedAlignments(mode)
+	if align == 0 {
+		for _, a := range supported {
+			if a == ndctlDefaultAlign {
+				return ndctlDefaultAlign
+			}
+		}
+		return ndctlAlign
+	}
+	fallback := ndctlAlign
+	for _, a := range supported {
+		if a == align {
+			return align
+		}
+		if a > align && a < fallback {
+			fallback = a
+		}
+	}
+	klog.V(3).Infof("%s: alignment %d not supported for %s namespaces (supported: %v), using %d instead",
+		r.DeviceName(), align, mode, supported, fallback)
+	return fallback
+}
+
+// namespaceSize returns the size of a namespace which provides at least
+// the requested size. The kernel stores a 64 byte struct page for each 4 KiB
+// page of the namespace plus an info block in front of the data and then
+// aligns the start of the data (https://github.com/pmem/ndctl/issues/79).
+// A BTT in sector mode needs less than that. Solving
+//   overhead >= (size + overhead) / 64 + 8 KiB
+// for the overhead gives a bound for the meta data.
+func namespaceSize(size, align uint64) uint64 {
+	overhead := size/63 + 16*1024
+	if reminder := overhead % align; reminder != 0 {
+		overhead += align - reminder
+	}
+	return size + overhead
+}
+
+// regionCapacity returns the size of the largest volume with the
+// given alignment that fits into the largest free extent of the region
+// after setting aside the reserved space.
+func regionCapacity(r *ndctl.Region, align, reserved uint64) uint64 {
+	realalign := r.SizeAlign(align)
+	available := r.MaxAvailableExtent()
+	if reserved >= available {
+		return 0
+	}
+	available -= reserved
+	// align down, avoid claiming more than what we really can serve
+	available /= realalign
+	available *= realalign
+	overhead := namespaceSize(available, align) - available
+	if overhead >= available {
+		return 0
+	}
+	// The namespace for a volume of that size gets rounded up
+	// to at most the available size.
+	return available - overhead
+}
+
 func getDevice(ndctx *ndctl.Context, volumeId string) (*PmemDeviceInfo, error) {
+	ns, err := getNamespace(ndctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	return namespaceToPmemInfo(ns), nil
+}
+
+// getNamespace finds the namespace of a volume. The metadata namespace
+// is not a volume.
+func getNamespace(ndctx *ndctl.Context, volumeId string) (*ndctl.Namespace, error) {
+	if volumeId == ndctlMetadataName {
+		return nil, ErrDeviceNotFound
+	}
 	ns, err := ndctx.GetNamespaceByName(volumeId)
 	if err != nil {
 		if errors.Is(err, ndctl.ErrNotExist) {
@@ -193,14 +637,26 @@ func getDevice(ndctx *ndctl.Context, volumeId string) (*PmemDeviceInfo, error) {
 		}
 		return nil, fmt.Errorf("error getting device %q: %v", volumeId, err)
 	}
-
-	return namespaceToPmemInfo(ns), nil
+	return ns, nil
 }
 
 func namespaceToPmemInfo(ns *ndctl.Namespace) *PmemDeviceInfo {
+	if ns.Mode() == ndctl.DaxMode {
+		return &PmemDeviceInfo{
+			VolumeId:  ns.Name(),
+			Path:      "/dev/" + ns.CharDeviceName(),
+			Size:      ns.Size(),
+			CharDev:   true,
+			NumaNode:  ns.Region().NumaNode(),
+			Badblocks: toBadblocks(ns.Badblocks()),
+		}
+	}
 	return &PmemDeviceInfo{
-		VolumeId: ns.Name(),
-		Path:     "/dev/" + ns.BlockDeviceName(),
-		Size:     ns.Size(),
+		VolumeId:  ns.Name(),
+		Path:      "/dev/" + ns.BlockDeviceName(),
+		Size:      ns.Size(),
+		Dax:       ns.Mode() == ndctl.FsdaxMode,
+		NumaNode:  ns.Region().NumaNode(),
+		Badblocks: toBadblocks(ns.Badblocks()),
 	}
 }
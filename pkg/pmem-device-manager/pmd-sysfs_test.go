@@ -0,0 +1,168 @@
+// +build !cgo sysfs
+
+/*
+Copyright 2020  Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package pmdmanager
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	"github.com/intel/pmem-csi/pkg/pmem-exec/fake"
+	pmemlvm "github.com/intel/pmem-csi/pkg/pmem-lvm"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Simulated sysfs", func() {
+	const (
+		mb = uint64(1024 * 1024)
+		gb = 1024 * mb
+	)
+	var prevSysfsRoot string
+	var tmp string
+	var sysfs *ndctlfake.Sysfs
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "pmd-sysfs-")
+		Expect(err).Should(BeNil(), "create sysfs directory")
+		sysfs, err = ndctlfake.NewSysfs(tmp)
+		Expect(err).Should(BeNil(), "create sysfs tree")
+		prevSysfsRoot = SetSysfsRoot(tmp)
+	})
+
+	AfterEach(func() {
+		SetSysfsRoot(prevSysfsRoot)
+		os.RemoveAll(tmp)
+	})
+
+	It("Should find namespaces in direct mode", func() {
+		dm, err := NewPmemDeviceManagerNdctl(nil)
+		Expect(err).Should(BeNil(), "create device manager")
+
+		capacity, err := dm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "get capacity")
+		Expect(capacity.Total).Should(Equal(15*gb), "free space of region0")
+		Expect(capacity.Largest).Should(BeNumerically(">", 0), "largest volume")
+		Expect(capacity.Largest).Should(BeNumerically("<=", capacity.Total), "largest volume")
+		numaNode := 0
+		capacity, err = dm.GetCapacity(CapacityOpts{NumaNode: &numaNode})
+		Expect(err).Should(BeNil(), "get capacity on NUMA node 0")
+		Expect(capacity).Should(Equal(Capacity{}), "region0 is on NUMA node 1")
+
+		dev, err := dm.GetDevice(ndctlfake.NamespaceName)
+		Expect(err).Should(BeNil(), "get device")
+		Expect(dev.Path).Should(Equal("/dev/pmem0"))
+		Expect(dev.NumaNode).Should(Equal(1))
+		devices, err := dm.ListDevices()
+		Expect(err).Should(BeNil(), "list devices")
+		Expect(devices).Should(HaveLen(1))
+	})
+
+	It("Should hide the metadata namespace", func() {
+		dm, err := NewPmemDeviceManagerNdctl(nil)
+		Expect(err).Should(BeNil(), "create device manager")
+		capacity, err := dm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "get capacity")
+
+		Expect(sysfs.Attrs(sysfs.Dir("region0", "namespace0.2"), map[string]string{
+			"alt_name":     ndctlMetadataName,
+			"uuid":         "0b6b3e7c-4f5e-4d8a-a3b0-8f3c2e1d9a7b",
+			"size":         "16777216",
+			"nstype":       "5",
+			"mode":         "safe",
+			"holder":       "btt0.1",
+			"holder_class": "btt",
+		})).Should(Succeed(), "metadata namespace")
+		Expect(sysfs.Enable("region0", "namespace0.2")).Should(Succeed(), "enable namespace")
+		Expect(sysfs.Attrs(sysfs.Dir("region0", "btt0.1"), map[string]string{
+			"uuid":        "6f1d0c2a-9b7e-4c3d-8e5f-1a2b3c4d5e6f",
+			"sector_size": "512 [4096]",
+			"namespace":   "namespace0.2",
+			"size":        "16642048",
+		})).Should(Succeed(), "btt")
+		Expect(sysfs.Enable("region0", "btt0.1")).Should(Succeed(), "enable btt")
+		Expect(sysfs.AddBlockDevice("pmem0.2s", "region0", "btt0.1")).Should(Succeed(), "add pmem0.2s")
+
+		devices, err := dm.ListDevices()
+		Expect(err).Should(BeNil(), "list devices")
+		Expect(devices).Should(HaveLen(1), "only the volume")
+		Expect(devices[0].Metadata).Should(BeNil(), "metadata not readable")
+		_, err = dm.GetDevice(ndctlMetadataName)
+		Expect(errors.Is(err, ErrDeviceNotFound)).Should(BeTrue(), "get metadata namespace: %v", err)
+		Expect(dm.DeleteDevice(ndctlMetadataName, EraseOpts{Policy: EraseNone})).Should(Succeed(), "delete metadata namespace")
+		Expect(filepath.Join(sysfs.Dir("region0", "namespace0.2"), "alt_name")).Should(BeARegularFile(), "metadata namespace kept")
+
+		withMetadata, err := dm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "get capacity")
+		Expect(withMetadata.Largest).Should(BeNumerically(">", capacity.Largest), "no space reserved for metadata")
+	})
+
+	It("Should default to the 2 MiB alignment", func() {
+		dm, err := NewPmemDeviceManagerNdctl(nil)
+		Expect(err).Should(BeNil(), "create device manager")
+		capacity, err := dm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "get capacity")
+		Expect(capacity.Largest).Should(BeNumerically(">", 14*gb), "little space lost to the alignment")
+		Expect(capacity.Largest%(2*mb)).Should(BeZero(), "largest volume aligned")
+	})
+
+	It("Should only report bad blocks of managed devices", func() {
+		dm, err := NewPmemDeviceManagerNdctl(nil)
+		Expect(err).Should(BeNil(), "create device manager")
+		Expect(sysfs.Attrs(sysfs.Dir("region0"), map[string]string{"badblocks": "1024 8"})).Should(Succeed(), "region bad blocks")
+		Expect(sysfs.Attrs(sysfs.Dir("region0", "namespace0.0"), map[string]string{"resource": "0x240000000"})).Should(Succeed(), "namespace location")
+		Expect(sysfs.Attrs(filepath.Join(tmp, "block", "pmem0"), map[string]string{"badblocks": "1000 8"})).Should(Succeed(), "namespace bad blocks")
+
+		managed := map[string]bool{}
+		collector := NewBadblocksCollector(dm, func(volumeID string) bool { return managed[volumeID] })
+		Expect(testutil.CollectAndCompare(collector, strings.NewReader(""), "pmem_volume_badblocks_bytes")).Should(Succeed(), "foreign namespace")
+		managed[ndctlfake.NamespaceName] = true
+		Expect(testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP pmem_volume_badblocks_bytes Amount of PMEM with known media errors inside the volume.
+# TYPE pmem_volume_badblocks_bytes gauge
+pmem_volume_badblocks_bytes{volume_id="pmem-csi-test-volume"} 4096
+`), "pmem_volume_badblocks_bytes")).Should(Succeed(), "managed namespace")
+	})
+
+	It("Should find the regions of physical volumes", func() {
+		Expect(sysfs.AddBlockDevice("pmem1", "region1", "namespace1.0")).Should(Succeed(), "add pmem1")
+		Expect(pvRegion("/dev/pmem0")).Should(Equal("region0"))
+		Expect(pvNumaNode("/dev/pmem0")).Should(Equal(1))
+		Expect(pvRegion("/dev/pmem1")).Should(Equal("region1"))
+		Expect(pvNumaNode("/dev/pmem1")).Should(Equal(0))
+		Expect(pvRegion("/dev/sda")).Should(BeEmpty(), "not PMEM")
+
+		executor := fake.New()
+		executor.DevDir = tmp
+		executor.AddDevice("/dev/pmem0", gb+mb)
+		executor.AddDevice("/dev/pmem1", gb/2+mb)
+		prevExecutor := pmemexec.SetExecutor(executor)
+		defer pmemexec.SetExecutor(prevExecutor)
+		_, err := pmemexec.RunCommand("vgcreate", "--force", "span", "/dev/pmem0", "/dev/pmem1")
+		Expect(err).Should(BeNil(), "create volume group")
+		lvm, err := newPmemDeviceManagerLVM(pmemlvm.New(nil), []string{"span"}, nil)
+		Expect(err).Should(BeNil(), "create device manager")
+
+		capacity, err := lvm.GetCapacity(CapacityOpts{})
+		Expect(err).Should(BeNil(), "region capacity")
+		Expect(capacity).Should(Equal(Capacity{Total: gb + gb/2, Largest: gb}), "largest region")
+		capacity, err = lvm.GetCapacity(CapacityOpts{Layout: LinearLayout})
+		Expect(err).Should(BeNil(), "linear capacity")
+		Expect(capacity).Should(Equal(Capacity{Total: gb + gb/2, Largest: gb + gb/2}), "all regions")
+		numaNode := 0
+		capacity, err = lvm.GetCapacity(CapacityOpts{NumaNode: &numaNode})
+		Expect(err).Should(BeNil(), "NUMA capacity")
+		Expect(capacity).Should(Equal(Capacity{Total: gb / 2, Largest: gb / 2}), "region1")
+	})
+})
@@ -0,0 +1,378 @@
+package pmdmanager
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
+	pmemlvm "github.com/intel/pmem-csi/pkg/pmem-lvm"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+)
+
+var (
+	thinPoolLabels = []string{"volume_group"}
+
+	thinPoolSize = prometheus.NewDesc(
+		"pmem_thin_pool_size_bytes",
+		"Size of the LVM thin pool.",
+		thinPoolLabels, nil,
+	)
+	thinPoolProvisioned = prometheus.NewDesc(
+		"pmem_thin_pool_provisioned_bytes",
+		"Total size of the volumes in the LVM thin pool, larger than the pool when overcommitting.",
+		thinPoolLabels, nil,
+	)
+	thinPoolDataUsage = prometheus.NewDesc(
+		"pmem_thin_pool_data_percent",
+		"Used part of the data space of the LVM thin pool in percent.",
+		thinPoolLabels, nil,
+	)
+	thinPoolMetadataUsage = prometheus.NewDesc(
+		"pmem_thin_pool_metadata_percent",
+		"Used part of the metadata space of the LVM thin pool in percent.",
+		thinPoolLabels, nil,
+	)
+	thinPoolAlarm = prometheus.NewDesc(
+		"pmem_thin_pool_alarm",
+		"Usage of the LVM thin pool: 0 = ok, 1 = above the warning watermark, 2 = above the high watermark, no new volumes.",
+		thinPoolLabels, nil,
+	)
+)
+
+//ThinOpts configures thin provisioning in LVM mode
+type ThinOpts struct {
+	//Overcommit is how much larger the total size of the volumes in a thin pool may be than the pool itself, 1 disables overcommitting
+	Overcommit float64
+	//WarningWatermark is the usage of a thin pool in percent above which an alarm gets raised
+	WarningWatermark float64
+	//HighWatermark is the usage of a thin pool in percent above which no new volumes get created in it
+	HighWatermark float64
+}
+
+//ThinPoolAlarm tells how full a thin pool is
+type ThinPoolAlarm int
+
+const (
+	//ThinPoolOK usage below the warning watermark
+	ThinPoolOK ThinPoolAlarm = iota
+	//ThinPoolWarning usage above the warning watermark
+	ThinPoolWarning
+	//ThinPoolFull usage above the high watermark
+	ThinPoolFull
+)
+
+//ThinPool describes a LVM thin pool
+type ThinPool struct {
+	//VolumeGroup contains the pool
+	VolumeGroup string
+	//Size of the pool in bytes
+	Size uint64
+	//Provisioned is the total size of the volumes in the pool
+	Provisioned uint64
+	//DataPercent and MetadataPercent is the used part of the pool
+	DataPercent, MetadataPercent float64
+	//Alarm is based on the higher of the two percentages
+	Alarm ThinPoolAlarm
+}
+
+//PmemThinPoolManager is implemented by device managers which may use thin pools
+type PmemThinPoolManager interface {
+	// ThinPools returns the thin pools, none if thin provisioning is not used.
+	ThinPools() ([]ThinPool, error)
+}
+
+//NewPmemDeviceManagerLVMThin does the same as NewPmemDeviceManagerLVMForRegions,
+//but creates thin volumes in the thin pools of the volume groups. Volume groups
+//without a thin pool are not used.
+func NewPmemDeviceManagerLVMThin(regions RegionFilter, opts ThinOpts) (PmemDeviceManager, error) {
+	client := pmemlvm.New(nil)
+	volumeGroups, sectorVolumeGroups, err := findVolumeGroups(client, regions)
+	if err != nil {
+		return nil, err
+	}
+	return newPmemDeviceManagerLVMThin(client, volumeGroups, sectorVolumeGroups, opts)
+}
+
+func newPmemDeviceManagerLVMThin(client *pmemlvm.Client, volumeGroups []string, sectorVolumeGroups []string, opts ThinOpts) (*pmemLvm, error) {
+	if opts.Overcommit < 1 {
+		return nil, fmt.Errorf("thin pool overcommit ratio %v less than 1: %w", opts.Overcommit, ErrInvalid)
+	}
+	if opts.WarningWatermark <= 0 || opts.WarningWatermark > opts.HighWatermark || opts.HighWatermark > 100 {
+		return nil, fmt.Errorf("thin pool watermarks %v%% and %v%% not in increasing order between 0%% and 100%%: %w",
+			opts.WarningWatermark, opts.HighWatermark, ErrInvalid)
+	}
+	withPool := func(vgs []string) []string {
+		result := []string{}
+		for _, vg := range vgs {
+			if _, err := client.LogicalVolumes(vg + "/" + pmemcommon.ThinPoolName); err != nil {
+				klog.Warningf("NewPmemDeviceManagerLVMThin: VG %v has no thin pool, skip", vg)
+				continue
+			}
+			result = append(result, vg)
+		}
+		return result
+	}
+	numVGs := len(volumeGroups) + len(sectorVolumeGroups)
+	volumeGroups = withPool(volumeGroups)
+	sectorVolumeGroups = withPool(sectorVolumeGroups)
+	if numVGs > 0 && len(volumeGroups)+len(sectorVolumeGroups) == 0 {
+		return nil, fmt.Errorf("no thin pool found, volume groups must be prepared with pmem-vgm -thinpool: %w", ErrInvalid)
+	}
+
+	lvm, err := newPmemDeviceManagerLVM(client, volumeGroups, sectorVolumeGroups)
+	if err != nil {
+		return nil, err
+	}
+	lvm.thin = &opts
+	return lvm, nil
+}
+
+// ThinPools returns the thin pools of all volume groups.
+func (lvm *pmemLvm) ThinPools() ([]ThinPool, error) {
+	pools := []ThinPool{}
+	if lvm.thin == nil {
+		return pools, nil
+	}
+	for _, vgName := range append(append([]string{}, lvm.volumeGroups...), lvm.sectorVolumeGroups...) {
+		pool, err := lvm.getThinPool(vgName)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, *pool)
+	}
+	return pools, nil
+}
+
+// getThinCapacity returns how much more can be provisioned in the
+// thin pools, which includes the overcommitted space. Pools above the
+// high watermark have no capacity.
+func (lvm *pmemLvm) getThinCapacity(opts CapacityOpts) (Capacity, error) {
+	var capacity Capacity
+	if opts.Layout == StripedLayout {
+		return capacity, nil
+	}
+	for _, vgName := range lvm.volumeGroups {
+		suitable, err := lvm.thinPoolSuitable(vgName, CreateDeviceOpts{NumaNode: opts.NumaNode})
+		if err != nil {
+			return capacity, err
+		}
+		if !suitable {
+			continue
+		}
+		pool, err := lvm.getThinPool(vgName)
+		if err != nil {
+			return capacity, err
+		}
+		available := lvm.thin.available(pool)
+		capacity.Total += available
+		if available > capacity.Largest {
+			capacity.Largest = available
+		}
+	}
+	return capacity, nil
+}
+
+// createThinLV creates the thin volume for CreateDevice inside the
+// thin pool of the volume group. The result is nil if the pool cannot
+// provide the volume.
+func (lvm *pmemLvm) createThinLV(volumeId string, vgName string, size uint64, tags []string, opts CreateDeviceOpts) (*PmemDeviceInfo, error) {
+	unlock := lvm.vgLocks.lock(vgName)
+	defer unlock()
+
+	suitable, err := lvm.thinPoolSuitable(vgName, opts)
+	if err != nil || !suitable {
+		return nil, err
+	}
+	pool, err := lvm.getThinPool(vgName)
+	if err != nil {
+		return nil, err
+	}
+	if !lvm.thinPoolFits(pool, size) {
+		klog.V(5).Infof("CreateDevice: no space for %d bytes in thin pool of %s", size, vgName)
+		return nil, nil
+	}
+	err = lvm.client.CreateLV(pmemlvm.CreateLVOpts{
+		Name:     volumeId,
+		VGName:   vgName,
+		Size:     size,
+		Tags:     tags,
+		ThinPool: pmemcommon.ThinPoolName,
+	})
+	if errors.Is(err, pmemlvm.ErrExists) {
+		return nil, ErrDeviceExists
+	}
+	if err != nil {
+		klog.V(3).Infof("lvcreate failed with error: %v, trying for next thin pool", err)
+		return nil, nil
+	}
+	return lvm.getUncachedDevice(volumeId, vgName)
+}
+
+// thinPoolSuitable checks the NUMA node and bad blocks of the
+// physical volumes which provide the thin pool. Blocks for thin
+// volumes may come from any of them.
+func (lvm *pmemLvm) thinPoolSuitable(vgName string, opts CreateDeviceOpts) (bool, error) {
+	if opts.NumaNode == nil && !opts.AvoidBadblocks {
+		return true, nil
+	}
+	pvs, err := lvm.getPhysicalVolumes(vgName)
+	if err != nil {
+		return false, err
+	}
+	names := []string{}
+	for _, pv := range pvs {
+		if opts.AvoidBadblocks && len(lvm.getPVBadblocks(pv.Name)) > 0 {
+			klog.V(3).Infof("Skipping thin pool in %s because %s has bad blocks", vgName, pv.Name)
+			return false, nil
+		}
+		names = append(names, pv.Name)
+	}
+	if opts.NumaNode != nil && lvNumaNode(names) != *opts.NumaNode {
+		return false, nil
+	}
+	return true, nil
+}
+
+// thinPoolFits checks whether volumes with the given total size may
+// still be added to the thin pool.
+func (lvm *pmemLvm) thinPoolFits(pool *ThinPool, size uint64) bool {
+	opts := lvm.thinOpts()
+	switch pool.Alarm {
+	case ThinPoolFull:
+		klog.Warningf("Thin pool in %s is above the high watermark of %v%% (data %v%%, metadata %v%%), no new volumes",
+			pool.VolumeGroup, opts.HighWatermark, pool.DataPercent, pool.MetadataPercent)
+		return false
+	case ThinPoolWarning:
+		klog.Warningf("Thin pool in %s is above the warning watermark of %v%% (data %v%%, metadata %v%%)",
+			pool.VolumeGroup, opts.WarningWatermark, pool.DataPercent, pool.MetadataPercent)
+	}
+	return opts.available(pool) >= size
+}
+
+// getThinPool looks up the thin pool of the volume group and the
+// volumes inside it.
+func (lvm *pmemLvm) getThinPool(vgName string) (*ThinPool, error) {
+	lvs, err := lvm.client.LogicalVolumes(vgName)
+	if err != nil {
+		return nil, fmt.Errorf("lvs failure: %v", err)
+	}
+	pool := &ThinPool{VolumeGroup: vgName}
+	found := false
+	for _, lv := range lvs {
+		switch {
+		case lv.ThinPool && lv.Name == pmemcommon.ThinPoolName:
+			found = true
+			pool.Size = lv.Size
+			pool.DataPercent = lv.DataPercent
+			pool.MetadataPercent = lv.MetadataPercent
+		case lv.Pool == pmemcommon.ThinPoolName:
+			pool.Provisioned += lv.Size
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("thin pool %s/%s: %w", vgName, pmemcommon.ThinPoolName, ErrDeviceNotFound)
+	}
+	pool.Alarm = lvm.thinOpts().alarm(pool)
+	return pool, nil
+}
+
+// thinOpts returns the thin provisioning options. Thin volumes from an
+// earlier configuration also get resized and copied without thin
+// provisioning, then without overcommitting.
+func (lvm *pmemLvm) thinOpts() ThinOpts {
+	if lvm.thin == nil {
+		return ThinOpts{Overcommit: 1, WarningWatermark: 100, HighWatermark: 100}
+	}
+	return *lvm.thin
+}
+
+func (opts ThinOpts) alarm(pool *ThinPool) ThinPoolAlarm {
+	usage := math.Max(pool.DataPercent, pool.MetadataPercent)
+	switch {
+	case usage >= opts.HighWatermark:
+		return ThinPoolFull
+	case usage >= opts.WarningWatermark:
+		return ThinPoolWarning
+	}
+	return ThinPoolOK
+}
+
+// available returns how much more may be provisioned in the thin pool.
+func (opts ThinOpts) available(pool *ThinPool) uint64 {
+	if pool.Alarm == ThinPoolFull {
+		return 0
+	}
+	limit := uint64(float64(pool.Size) * opts.Overcommit)
+	if pool.Provisioned >= limit {
+		return 0
+	}
+	available := limit - pool.Provisioned
+	return available - available%lvmAlign
+}
+
+// thinErase avoids overwriting thin volumes entirely, because that
+// would allocate pool space for the whole volume. The pool zeroes
+// blocks before they get used again, so wiping the header suffices.
+// Volumes which explicitly asked for such a policy are rejected by
+// CreateDevice, so this only affects the default policy.
+func thinErase(device *PmemDeviceInfo, erase EraseOpts) EraseOpts {
+	if device.pool == "" {
+		return erase
+	}
+	if overwritesThinVolume(erase.Policy) {
+		klog.V(3).Infof("%s is a thin volume, only wiping the header instead of %s erasing", device.VolumeId, erase.Policy)
+		erase.Policy = EraseHeader
+	}
+	return erase
+}
+
+// overwritesThinVolume is true for erase policies which would
+// allocate the entire thin volume from its pool.
+func overwritesThinVolume(policy ErasePolicy) bool {
+	switch policy {
+	case EraseRandom, EraseZero, EraseDiscard:
+		return true
+	default:
+		return false
+	}
+}
+
+type thinPoolCollector struct {
+	pools PmemThinPoolManager
+}
+
+var _ prometheus.Collector = thinPoolCollector{}
+
+//NewThinPoolCollector returns a Prometheus collector which reports
+//size, usage and alarm state of the thin pools.
+func NewThinPoolCollector(pools PmemThinPoolManager) prometheus.Collector {
+	return thinPoolCollector{pools: pools}
+}
+
+func (c thinPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- thinPoolSize
+	ch <- thinPoolProvisioned
+	ch <- thinPoolDataUsage
+	ch <- thinPoolMetadataUsage
+	ch <- thinPoolAlarm
+}
+
+func (c thinPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	pools, err := c.pools.ThinPools()
+	if err != nil {
+		klog.Errorf("thin pools: %v", err)
+		return
+	}
+	for _, pool := range pools {
+		gauge := func(desc *prometheus.Desc, value float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, pool.VolumeGroup)
+		}
+		gauge(thinPoolSize, float64(pool.Size))
+		gauge(thinPoolProvisioned, float64(pool.Provisioned))
+		gauge(thinPoolDataUsage, pool.DataPercent)
+		gauge(thinPoolMetadataUsage, pool.MetadataPercent)
+		gauge(thinPoolAlarm, float64(pool.Alarm))
+	}
+}
@@ -2,70 +2,171 @@ package pmdmanager
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/intel/pmem-csi/pkg/ndctl"
 	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
 	"golang.org/x/sys/unix"
 	"k8s.io/klog"
+	"k8s.io/utils/mount"
 )
 
 const (
 	retryStatTimeout time.Duration = 100 * time.Millisecond
 )
 
-func clearDevice(dev *PmemDeviceInfo, flush bool) error {
-	klog.V(4).Infof("ClearDevice: path: %v flush:%v", dev.Path, flush)
-	// by default, clear 4 kbytes to avoid recognizing file system by next volume seeing data area
-	var blocks uint64 = 4
-	if flush {
-		// clear all data if "erase all" asked specifically
-		blocks = 0
+// copyDevice copies the entire content of the source device to the
+// beginning of the destination device. The destination must be at
+// least as large as the source and must not be in use.
+func copyDevice(src, dst *PmemDeviceInfo) error {
+	klog.V(4).Infof("copyDevice: %s (size %v) -> %s (size %v)", src.Path, src.Size, dst.Path, dst.Size)
+	if src.Size > dst.Size {
+		return fmt.Errorf("copy %s to %s: destination is smaller than source", src.Path, dst.Path)
+	}
+	if src.CharDev || dst.CharDev {
+		return fmt.Errorf("copy %s to %s: not supported for devdax devices: %w", src.Path, dst.Path, ErrInvalid)
 	}
 
-	// erase data on block device.
-	// zero number of blocks causes overwriting whole device with random data.
-	// nonzero number of blocks clears blocks*1024 bytes.
-	// Before action, check that dev.Path exists and is device
-	fileinfo, err := os.Stat(dev.Path)
+	fd, err := unix.Open(dst.Path, unix.O_RDONLY|unix.O_EXCL|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("copy to device %q: %w", dst.Path, ErrDeviceInUse)
+	}
+	defer unix.Close(fd) // nolint: errcheck
+
+	thaw, err := freezeDevice(src)
 	if err != nil {
-		klog.Errorf("clearDevice: %s does not exist", dev.Path)
 		return err
 	}
+	defer thaw()
 
-	// Check if device
-	if (fileinfo.Mode() & os.ModeDevice) == 0 {
-		klog.Errorf("clearDevice: %s is not device", dev.Path)
-		return fmt.Errorf("%s is not device", dev.Path)
+	count := "count=" + strconv.FormatUint(src.Size, 10)
+	if _, err := pmemexec.RunCommand("dd", "if="+src.Path, "of="+dst.Path, "bs=1M", count, "iflag=count_bytes", "conv=fsync"); err != nil {
+		return fmt.Errorf("device copy failure: %v", err.Error())
 	}
+	return nil
+}
 
-	fd, err := unix.Open(dev.Path, unix.O_RDONLY|unix.O_EXCL|unix.O_CLOEXEC, 0)
-	defer unix.Close(fd)
+// freezeDevice makes the content of a device consistent for copying
+// it. A mounted file system gets frozen until the returned function is
+// called. A device without mounted file system must not be in use,
+// because then there is no way to stop writes.
+func freezeDevice(dev *PmemDeviceInfo) (func(), error) {
+	mountPoint, err := findMountPoint(dev.Path)
+	if err != nil {
+		return nil, err
+	}
+	if mountPoint == "" {
+		if deviceInUse(dev) {
+			return nil, fmt.Errorf("copy from device %q without file system: %w", dev.Path, ErrDeviceInUse)
+		}
+		return func() {}, nil
+	}
 
+	klog.V(4).Infof("freezeDevice: freezing file system of %s at %s", dev.Path, mountPoint)
+	if _, err := pmemexec.RunCommand("fsfreeze", "--freeze", mountPoint); err != nil {
+		return nil, fmt.Errorf("freeze file system of %s: %v", dev.Path, err)
+	}
+	return func() {
+		if _, err := pmemexec.RunCommand("fsfreeze", "--unfreeze", mountPoint); err != nil {
+			klog.Errorf("freezeDevice: unfreezing file system of %s at %s failed: %v", dev.Path, mountPoint, err)
+		}
+	}, nil
+}
+
+// findMountPoint returns one mount point of the device, empty if it is
+// not mounted. LVM devices are mounted under different names, so
+// symlinks get resolved before comparing.
+func findMountPoint(path string) (string, error) {
+	device, err := filepath.EvalSymlinks(path)
 	if err != nil {
-		return fmt.Errorf("failed to clear device %q: %w", dev.Path, ErrDeviceInUse)
+		return "", fmt.Errorf("resolve %s: %v", path, err)
+	}
+	mounts, err := mount.New("").List()
+	if err != nil {
+		return "", fmt.Errorf("list mounts: %v", err)
+	}
+	for _, mnt := range mounts {
+		if !strings.HasPrefix(mnt.Device, "/dev/") {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(mnt.Device); err == nil && resolved == device {
+			return mnt.Path, nil
+		}
 	}
+	return "", nil
+}
 
-	if blocks == 0 {
-		klog.V(5).Infof("Wiping entire device: %s", dev.Path)
-		// use one iteration instead of shred's default=3 for speed
-		if _, err := pmemexec.RunCommand("shred", "-n", "1", dev.Path); err != nil {
-			return fmt.Errorf("device shred failure: %v", err.Error())
+// deviceInUse checks whether the device is mounted, open or mapped.
+// Block devices get opened exclusively, which fails while they are
+// mounted or otherwise claimed. O_EXCL has no effect for character
+// devices and does not detect normal opens, so in addition all
+// processes get checked.
+func deviceInUse(dev *PmemDeviceInfo) bool {
+	if !dev.CharDev {
+		fd, err := unix.Open(dev.Path, unix.O_RDONLY|unix.O_EXCL|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return true
 		}
-	} else {
-		klog.V(5).Infof("Zeroing %d 1k blocks at start of device: %s Size %v", blocks, dev.Path, dev.Size)
-		of := "of=" + dev.Path
-		// guard against writing more than volume size
-		if blocks*1024 > dev.Size {
-			blocks = dev.Size / 1024
+		unix.Close(fd) // nolint: errcheck
+	}
+	return deviceOpenedByProcess(dev.Path)
+}
+
+// procRoot is where deviceOpenedByProcess looks for processes.
+var procRoot = "/proc"
+
+// sysfsRoot is where the device managers find sysfs, see SetSysfsRoot.
+var sysfsRoot = ndctl.DefaultSysfsRoot
+
+//SetSysfsRoot changes the directory in which device managers and
+//metrics collectors look for sysfs and returns the previous one. It
+//must be called before creating them. Directories other than /sys
+//need the pure Go implementation of the ndctl package.
+func SetSysfsRoot(root string) string {
+	prev := sysfsRoot
+	sysfsRoot = root
+	return prev
+}
+
+// newNdctlContext returns a context for the sysfs root.
+func newNdctlContext() (*ndctl.Context, error) {
+	return ndctl.NewSysfsContext(sysfsRoot)
+}
+
+// deviceOpenedByProcess checks whether some process has the device
+// open or mapped. The kernel reports the real device node, which is
+// different from the path for LVM devices. Processes which exit while
+// being checked are ignored.
+func deviceOpenedByProcess(path string) bool {
+	paths := map[string]bool{path: true}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		paths[resolved] = true
+	}
+	pids, _ := filepath.Glob(filepath.Join(procRoot, "[0-9]*"))
+	for _, pid := range pids {
+		if maps, err := ioutil.ReadFile(filepath.Join(pid, "maps")); err == nil {
+			for _, line := range strings.Split(string(maps), "\n") {
+				// address perms offset dev inode pathname
+				if fields := strings.Fields(line); len(fields) >= 6 && paths[fields[5]] {
+					klog.V(4).Infof("%s is mapped by %s", path, pid)
+					return true
+				}
+			}
 		}
-		count := "count=" + strconv.FormatUint(blocks, 10)
-		if _, err := pmemexec.RunCommand("dd", "if=/dev/zero", of, "bs=1024", count); err != nil {
-			return fmt.Errorf("device zeroing failure: %v", err.Error())
+		fds, _ := ioutil.ReadDir(filepath.Join(pid, "fd"))
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join(pid, "fd", fd.Name())); err == nil && paths[target] {
+				klog.V(4).Infof("%s is opened by %s", path, pid)
+				return true
+			}
 		}
 	}
-	return nil
+	return false
 }
 
 func waitDeviceAppears(dev *PmemDeviceInfo) error {
@@ -80,3 +181,21 @@ func waitDeviceAppears(dev *PmemDeviceInfo) error {
 	}
 	return fmt.Errorf("%s: %w", dev.Path, ErrDeviceNotReady)
 }
+
+// toBadblocks converts the bad blocks reported by ndctl.
+func toBadblocks(badblocks []ndctl.Badblock) []Badblock {
+	var result []Badblock
+	for _, bb := range badblocks {
+		result = append(result, Badblock(bb))
+	}
+	return result
+}
+
+// fromBadblocks converts bad blocks for ndctl.
+func fromBadblocks(badblocks []Badblock) []ndctl.Badblock {
+	var result []ndctl.Badblock
+	for _, bb := range badblocks {
+		result = append(result, ndctl.Badblock(bb))
+	}
+	return result
+}
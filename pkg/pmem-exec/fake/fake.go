@@ -0,0 +1,293 @@
+/*
+Copyright 2020  Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package fake provides an in-memory implementation of
+// pmemexec.Executor. It simulates the LVM and file system tools that
+// PMEM-CSI invokes, so code using them can be tested without root
+// privileges and real PMEM.
+package fake
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+)
+
+const defaultExtentSize uint64 = 4 * 1024 * 1024
+
+// Executor simulates commands on top of block devices which get
+// added with AddDevice. All state is kept in memory.
+type Executor struct {
+	// DevDir is the directory in which logical volumes appear as
+	// <DevDir>/<vg>/<lv>, /dev by default. When set, the executor
+	// creates symlinks to /dev/null there, which is good enough
+	// for code that checks for a device node.
+	DevDir string
+
+	// ExtentSize of new volume groups, 4 MiB by default.
+	ExtentSize uint64
+
+	mutex       sync.Mutex
+	commands    []string
+	devices     map[string]*device
+	vgs         map[string]*volumeGroup
+	filesystems map[string]string
+	inUse       map[string]bool
+	failures    map[string][]string
+}
+
+var _ pmemexec.Executor = &Executor{}
+
+// device is a block device which may be used as physical volume.
+type device struct {
+	path string
+	size uint64
+	// vg is the volume group that the physical volume belongs to,
+	// empty if not used by LVM or not in a volume group
+	vg   string
+	isPV bool
+	// extents of the physical volume, with the name of the
+	// logical volume which uses it or empty if free
+	extents []string
+}
+
+type volumeGroup struct {
+	name       string
+	extentSize uint64
+	pvs        []string
+	lvs        []*logicalVolume
+}
+
+type logicalVolume struct {
+	name     string
+	tags     []string
+	segments []segment
+
+	// thinPool is set for thin pools. Their metadata is not
+	// simulated, usage only changes with SetThinPoolUsage.
+	thinPool                     bool
+	dataPercent, metadataPercent float64
+	// pool is the thin pool of a thin volume, which has no
+	// segments and only a virtual size in bytes.
+	pool        string
+	virtualSize uint64
+}
+
+// segment is measured in extents.
+type segment struct {
+	start, count uint64
+	areas        []area
+}
+
+type area struct {
+	pv     string
+	extent uint64
+}
+
+// exitError is returned for failed commands, like exec.ExitError.
+type exitError struct {
+	code int
+}
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// New returns an executor without any devices.
+func New() *Executor {
+	return &Executor{
+		devices:     map[string]*device{},
+		vgs:         map[string]*volumeGroup{},
+		filesystems: map[string]string{},
+		inUse:       map[string]bool{},
+		failures:    map[string][]string{},
+	}
+}
+
+// AddDevice adds a block device with the given size.
+func (e *Executor) AddDevice(path string, size uint64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.devices[path] = &device{path: path, size: size}
+}
+
+// Fail makes the next invocation of the command fail with the given
+// error output.
+func (e *Executor) Fail(cmd string, stderr string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.failures[cmd] = append(e.failures[cmd], stderr)
+}
+
+// SetInUse marks a logical volume as in use (opened or mounted),
+// which prevents removing it.
+func (e *Executor) SetInUse(path string, inUse bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.inUse[path] = inUse
+}
+
+// SetThinPoolUsage sets the data and metadata usage in percent of a
+// thin pool, given as <vg>/<pool>. Unknown pools are ignored.
+func (e *Executor) SetThinPoolUsage(name string, data, metadata float64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if _, lv := e.findLV(name); lv != nil && lv.thinPool {
+		lv.dataPercent = data
+		lv.metadataPercent = metadata
+	}
+}
+
+// Filesystem returns the type of the file system on the device,
+// empty if none.
+func (e *Executor) Filesystem(path string) string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.filesystems[path]
+}
+
+// SetFilesystem creates or, with an empty type, removes a file
+// system without running mkfs.
+func (e *Executor) SetFilesystem(path string, fsType string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.setFilesystem(path, fsType)
+}
+
+// Commands returns all commands that were executed so far.
+func (e *Executor) Commands() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]string{}, e.commands...)
+}
+
+// Run implements pmemexec.Executor.
+func (e *Executor) Run(cmd string, args ...string) (string, string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.commands = append(e.commands, strings.TrimSpace(cmd+" "+strings.Join(args, " ")))
+	if failures := e.failures[cmd]; len(failures) > 0 {
+		e.failures[cmd] = failures[1:]
+		return "", failures[0], exitError{code: 5}
+	}
+
+	var stdout string
+	var err error
+	switch cmd {
+	case "pvcreate":
+		err = e.pvcreate(args)
+	case "vgcreate":
+		err = e.vgcreate(args)
+	case "vgextend":
+		err = e.vgextend(args)
+	case "vgdisplay":
+		stdout, err = e.vgdisplay(args)
+	case "vgs", "pvs", "lvs":
+		stdout, err = e.report(cmd, args)
+	case "lvcreate":
+		err = e.lvcreate(args)
+	case "lvextend":
+		err = e.lvextend(args)
+	case "lvremove":
+		err = e.lvremove(args)
+	case "mkfs.ext4", "mkfs.xfs":
+		err = e.mkfs(strings.TrimPrefix(cmd, "mkfs."), args)
+	case "blkid":
+		stdout, err = e.blkid(args)
+	case "file":
+		stdout, err = e.file(args)
+	case "dd":
+		err = e.dd(args)
+	case "shred":
+		err = e.shred(args)
+	case "blkdiscard":
+		err = e.blkdiscard(args)
+	case "resize2fs":
+		err = e.resize2fs(args)
+	case "xfs_growfs":
+		// Operates on a mount point, which is not simulated.
+	default:
+		return "", "", fmt.Errorf("exec: %q: executable file not found in $PATH", cmd)
+	}
+	if err != nil {
+		var failure commandFailure
+		if errors.As(err, &failure) {
+			return stdout, failure.stderr + "\n", exitError{code: failure.code}
+		}
+		return stdout, "", err
+	}
+	return stdout, "", nil
+}
+
+// commandFailure is a failure that gets reported like the real
+// command does it, through the exit code and error output.
+type commandFailure struct {
+	code   int
+	stderr string
+}
+
+func (f commandFailure) Error() string {
+	return f.stderr
+}
+
+func failed(code int, format string, a ...interface{}) error {
+	return commandFailure{code: code, stderr: "  " + fmt.Sprintf(format, a...)}
+}
+
+// exists checks whether the path is a known device or logical volume.
+func (e *Executor) exists(path string) bool {
+	if _, ok := e.devices[path]; ok {
+		return true
+	}
+	_, lv := e.findLV(path)
+	return lv != nil
+}
+
+func (e *Executor) setFilesystem(path string, fsType string) {
+	if fsType == "" {
+		delete(e.filesystems, path)
+	} else {
+		e.filesystems[path] = fsType
+	}
+}
+
+func (e *Executor) devDir() string {
+	if e.DevDir == "" {
+		return "/dev"
+	}
+	return e.DevDir
+}
+
+func (e *Executor) lvPath(vg *volumeGroup, lv *logicalVolume) string {
+	return filepath.Join(e.devDir(), vg.name, lv.name)
+}
+
+// createDeviceNode creates the symlink for a new logical volume.
+func (e *Executor) createDeviceNode(path string) error {
+	if e.DevDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Symlink("/dev/null", path)
+}
+
+func (e *Executor) removeDeviceNode(path string) error {
+	if e.DevDir == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
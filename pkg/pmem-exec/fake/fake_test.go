@@ -0,0 +1,196 @@
+/*
+Copyright 2020  Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package fake_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	"github.com/intel/pmem-csi/pkg/pmem-exec/fake"
+	pmemlvm "github.com/intel/pmem-csi/pkg/pmem-lvm"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	mb = uint64(1024 * 1024)
+	gb = 1024 * mb
+)
+
+func TestFake(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Fake Executor Suite")
+}
+
+var _ = Describe("fake executor", func() {
+	var e *fake.Executor
+	var client *pmemlvm.Client
+	var devDir string
+
+	BeforeEach(func() {
+		var err error
+		devDir, err = ioutil.TempDir("", "fake-exec-")
+		Expect(err).NotTo(HaveOccurred())
+		e = fake.New()
+		e.DevDir = devDir
+		e.AddDevice("/dev/pmem0", gb+mb)
+		e.AddDevice("/dev/pmem1", gb+mb)
+		client = pmemlvm.New(e)
+		_, _, err = e.Run("vgcreate", "--force", "vg", "/dev/pmem0", "/dev/pmem1")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(devDir)
+	})
+
+	It("reports volume groups and physical volumes", func() {
+		vgs, err := client.VolumeGroups("vg")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vgs).To(Equal([]pmemlvm.VolumeGroup{{Name: "vg", Size: 2 * gb, Free: 2 * gb, ExtentSize: 4 * mb}}))
+
+		pvs, err := client.PhysicalVolumes()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pvs).To(HaveLen(2))
+		Expect(pvs[0]).To(Equal(pmemlvm.PhysicalVolume{Name: "/dev/pmem0", VGName: "vg", Size: gb, Free: gb, PEStart: mb}))
+
+		_, err = client.VolumeGroups("no-such-vg")
+		Expect(errors.Is(err, pmemlvm.ErrNotFound)).To(BeTrue(), "unknown volume group: %v", err)
+
+		var executor pmemexec.Executor = e
+		stdout, _, err := executor.Run("pvs", "--noheadings", "-o", "vg_name", "/dev/pmem1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stdout).To(Equal("  vg\n"), "column output")
+	})
+
+	It("creates and removes logical volumes", func() {
+		Expect(client.CreateLV(pmemlvm.CreateLVOpts{Name: "lv1", VGName: "vg", Size: gb - 16*mb})).To(Succeed())
+		Expect(client.CreateLV(pmemlvm.CreateLVOpts{Name: "striped", VGName: "vg", Size: 16 * mb, Stripes: 2, StripeSize: "2m"})).To(Succeed())
+		Expect(client.CreateLV(pmemlvm.CreateLVOpts{Name: "lv2", VGName: "vg", Size: 10 * mb, Tags: []string{"tag"}})).To(Succeed())
+
+		lvs, err := client.LogicalVolumes("vg")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lvs).To(HaveLen(3))
+		Expect(lvs[0].Path).To(Equal(filepath.Join(devDir, "vg", "lv1")))
+		Expect(lvs[1].Segments).To(Equal([]pmemlvm.Segment{
+			{Start: 0, Size: 16 * mb, ExtentSize: 4 * mb, Areas: []pmemlvm.Area{{PV: "/dev/pmem0", Extent: 252}, {PV: "/dev/pmem1", Extent: 0}}},
+		}), "striped")
+		Expect(lvs[2].Size).To(Equal(12*mb), "rounded up to extents")
+		Expect(lvs[2].Tags).To(Equal([]string{"tag"}))
+		Expect(lvs[2].Segments).To(Equal([]pmemlvm.Segment{
+			{Start: 0, Size: 8 * mb, ExtentSize: 4 * mb, Areas: []pmemlvm.Area{{PV: "/dev/pmem0", Extent: 254}}},
+			{Start: 8 * mb, Size: 4 * mb, ExtentSize: 4 * mb, Areas: []pmemlvm.Area{{PV: "/dev/pmem1", Extent: 2}}},
+		}), "spans physical volumes")
+		_, err = os.Stat(lvs[0].Path)
+		Expect(err).NotTo(HaveOccurred(), "device node")
+
+		Expect(client.ExtendLV(lvs[2].Path, 20*mb)).To(Succeed())
+		lvs, err = client.LogicalVolumes(lvs[2].Path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lvs).To(HaveLen(1))
+		Expect(lvs[0].Size).To(Equal(20 * mb))
+
+		e.SetInUse(lvs[0].Path, true)
+		err = client.RemoveLV(lvs[0].Path)
+		Expect(errors.Is(err, pmemlvm.ErrBusy)).To(BeTrue(), "in use: %v", err)
+		e.SetInUse(lvs[0].Path, false)
+		Expect(client.RemoveLV(lvs[0].Path)).To(Succeed())
+		err = client.RemoveLV(lvs[0].Path)
+		Expect(errors.Is(err, pmemlvm.ErrNotFound)).To(BeTrue(), "removed: %v", err)
+		_, err = os.Stat(lvs[0].Path)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "device node removed")
+	})
+
+	It("fails like LVM", func() {
+		err := client.CreateLV(pmemlvm.CreateLVOpts{Name: "lv1", VGName: "vg", Size: 3 * gb})
+		Expect(errors.Is(err, pmemlvm.ErrNoSpace)).To(BeTrue(), "too large: %v", err)
+		Expect(client.CreateLV(pmemlvm.CreateLVOpts{Name: "lv1", VGName: "vg", Size: gb})).To(Succeed())
+		err = client.CreateLV(pmemlvm.CreateLVOpts{Name: "lv1", VGName: "vg", Size: gb})
+		Expect(errors.Is(err, pmemlvm.ErrExists)).To(BeTrue(), "same name: %v", err)
+		err = client.CreateLV(pmemlvm.CreateLVOpts{Name: "lv2", VGName: "vg", Size: 8 * mb, Stripes: 2, PVs: []string{"/dev/pmem0", "/dev/pmem1"}})
+		Expect(errors.Is(err, pmemlvm.ErrNoSpace)).To(BeTrue(), "no space for stripe: %v", err)
+
+		e.Fail("lvcreate", "  Some injected failure.")
+		err = client.CreateLV(pmemlvm.CreateLVOpts{Name: "lv2", VGName: "vg", Size: 8 * mb})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Some injected failure."))
+		Expect(client.CreateLV(pmemlvm.CreateLVOpts{Name: "lv2", VGName: "vg", Size: 8 * mb})).To(Succeed(), "only fails once")
+	})
+
+	It("simulates thin provisioning", func() {
+		Expect(client.CreateThinPool("vg", "pool", 50)).To(Succeed())
+		Expect(client.CreateLV(pmemlvm.CreateLVOpts{Name: "thin", VGName: "vg", Size: 3 * gb, ThinPool: "pool"})).To(Succeed())
+		err := client.CreateLV(pmemlvm.CreateLVOpts{Name: "other", VGName: "vg", Size: gb, ThinPool: "no-such-pool"})
+		Expect(err).To(HaveOccurred(), "unknown pool")
+
+		vgs, err := client.VolumeGroups("vg")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vgs[0].Free).To(Equal(gb), "thin volume does not use extents")
+
+		e.SetThinPoolUsage("vg/pool", 12.5, 1)
+		lvs, err := client.LogicalVolumes("vg")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lvs).To(HaveLen(2))
+		pool, thin := lvs[0], lvs[1]
+		Expect(pool.ThinPool).To(BeTrue(), "thin pool")
+		Expect(pool.Size).To(Equal(gb))
+		Expect(pool.DataPercent).To(Equal(12.5))
+		Expect(pool.MetadataPercent).To(Equal(1.0))
+		Expect(thin.Pool).To(Equal("pool"))
+		Expect(thin.Size).To(Equal(3*gb), "virtual size")
+		Expect(thin.PVs()).To(BeEmpty())
+		_, err = os.Stat(thin.Path)
+		Expect(err).NotTo(HaveOccurred(), "device node")
+
+		Expect(client.ExtendLV(thin.Path, 4*gb)).To(Succeed())
+		lvs, err = client.LogicalVolumes(thin.Path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lvs[0].Size).To(Equal(4 * gb))
+
+		Expect(client.RemoveLV("vg/pool")).NotTo(Succeed(), "pool in use")
+		Expect(client.RemoveLV(thin.Path)).To(Succeed())
+		Expect(client.RemoveLV("vg/pool")).To(Succeed())
+		vgs, err = client.VolumeGroups("vg")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vgs[0].Free).To(Equal(2*gb), "pool removed")
+	})
+
+	It("simulates file systems", func() {
+		Expect(client.CreateLV(pmemlvm.CreateLVOpts{Name: "lv1", VGName: "vg", Size: gb})).To(Succeed())
+		path := filepath.Join(devDir, "vg", "lv1")
+
+		stdout, _, err := e.Run("file", "-bsL", path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stdout).To(Equal("data\n"))
+		_, _, err = e.Run("blkid", "-c", "/dev/null", "-o", "full", path)
+		Expect(err).To(HaveOccurred(), "blkid without file system")
+
+		_, _, err = e.Run("mkfs.ext4", "-b 4096", "-F", path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(e.Filesystem(path)).To(Equal("ext4"))
+		stdout, _, err = e.Run("blkid", "-c", "/dev/null", "-o", "full", path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stdout).To(ContainSubstring(`TYPE="ext4"`))
+
+		_, _, err = e.Run("dd", "if=/dev/zero", "of="+path, "bs=1024", "count=4")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(e.Filesystem(path)).To(BeEmpty(), "wiped")
+		e.SetFilesystem(path, "xfs")
+		_, _, err = e.Run("blkdiscard", "--zeroout", path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(e.Filesystem(path)).To(BeEmpty(), "discarded")
+
+		_, _, err = e.Run("mkfs.xfs", "-f", "/dev/no-such-device")
+		Expect(err).To(HaveOccurred())
+		_, _, err = e.Run("no-such-command")
+		Expect(err).To(HaveOccurred())
+		Expect(e.Commands()).To(HaveLen(10))
+	})
+})
@@ -0,0 +1,124 @@
+/*
+Copyright 2020  Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fake
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fsUUID is the UUID reported for all file systems.
+const fsUUID = "5e8e3a3c-1f0b-4d43-a8a0-0c2f3ad5a2e1"
+
+func (e *Executor) mkfs(fsType string, args []string) error {
+	if len(args) == 0 {
+		return failed(1, "Usage: mkfs.%s [options] device", fsType)
+	}
+	path := args[len(args)-1]
+	if !e.exists(path) {
+		return failed(1, "The file %s does not exist and no size was specified.", path)
+	}
+	e.setFilesystem(path, fsType)
+	return nil
+}
+
+// blkid with -o full.
+func (e *Executor) blkid(args []string) (string, error) {
+	_, positional := parseArgs(args, "-c", "-o", "-s")
+	var out strings.Builder
+	for _, path := range positional {
+		if fsType, ok := e.filesystems[path]; ok {
+			fmt.Fprintf(&out, "%s: UUID=\"%s\" TYPE=\"%s\"\n", path, fsUUID, fsType)
+		}
+	}
+	if out.Len() == 0 {
+		// Nothing found.
+		return "", exitError{code: 2}
+	}
+	return out.String(), nil
+}
+
+// file with -bsL.
+func (e *Executor) file(args []string) (string, error) {
+	_, positional := parseArgs(args)
+	var out strings.Builder
+	for _, path := range positional {
+		if !e.exists(path) {
+			fmt.Fprintf(&out, "cannot open `%s' (No such file or directory)\n", path)
+			continue
+		}
+		switch e.filesystems[path] {
+		case "":
+			out.WriteString("data\n")
+		case "ext4":
+			fmt.Fprintf(&out, "Linux rev 1.0 ext4 filesystem data, UUID=%s (extents) (64bit) (large files) (huge files)\n", fsUUID)
+		case "xfs":
+			out.WriteString("SGI XFS filesystem data (blksz 4096, inosz 512, v2 dirs)\n")
+		default:
+			fmt.Fprintf(&out, "%s filesystem data\n", e.filesystems[path])
+		}
+	}
+	return out.String(), nil
+}
+
+// dd only supports zeroing the start of a device and copying one
+// device to another, which is what PMEM-CSI uses it for. Both
+// overwrite the file system signature.
+func (e *Executor) dd(args []string) error {
+	var input, output string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "if=") {
+			input = strings.TrimPrefix(arg, "if=")
+		} else if strings.HasPrefix(arg, "of=") {
+			output = strings.TrimPrefix(arg, "of=")
+		}
+	}
+	if input != "/dev/zero" && !e.exists(input) {
+		return failed(1, "dd: failed to open '%s': No such file or directory", input)
+	}
+	if !e.exists(output) {
+		return failed(1, "dd: failed to open '%s': No such file or directory", output)
+	}
+	e.setFilesystem(output, e.filesystems[input])
+	return nil
+}
+
+func (e *Executor) shred(args []string) error {
+	_, positional := parseArgs(args, "-n")
+	for _, path := range positional {
+		if !e.exists(path) {
+			return failed(1, "shred: %s: failed to open for writing: No such file or directory", path)
+		}
+		e.setFilesystem(path, "")
+	}
+	return nil
+}
+
+func (e *Executor) blkdiscard(args []string) error {
+	_, positional := parseArgs(args, "-o", "-l", "-p")
+	if len(positional) != 1 {
+		return failed(1, "blkdiscard: no device specified")
+	}
+	path := positional[0]
+	if !e.exists(path) {
+		return failed(1, "blkdiscard: cannot open %s: No such file or directory", path)
+	}
+	e.setFilesystem(path, "")
+	return nil
+}
+
+func (e *Executor) resize2fs(args []string) error {
+	_, positional := parseArgs(args)
+	if len(positional) == 0 {
+		return failed(1, "Usage: resize2fs device")
+	}
+	path := positional[0]
+	if e.filesystems[path] != "ext4" {
+		return failed(1, "resize2fs: Bad magic number in super-block while trying to open %s", path)
+	}
+	return nil
+}
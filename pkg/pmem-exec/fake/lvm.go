@@ -0,0 +1,789 @@
+/*
+Copyright 2020  Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// peStart is the offset of the first physical extent in a physical
+// volume, the default of LVM.
+const peStart uint64 = 1024 * 1024
+
+// parseArgs splits the arguments into options and positional
+// arguments. The options listed in withValue consume the next
+// argument, short ones also accept the value directly appended
+// (like -Zn).
+func parseArgs(args []string, withValue ...string) (map[string][]string, []string) {
+	options := map[string][]string{}
+	var positional []string
+	hasValue := map[string]bool{}
+	for _, opt := range withValue {
+		hasValue[opt] = true
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case hasValue[arg] && i+1 < len(args):
+			options[arg] = append(options[arg], args[i+1])
+			i++
+		case len(arg) > 2 && arg[0] == '-' && arg[1] != '-' && hasValue[arg[:2]]:
+			options[arg[:2]] = append(options[arg[:2]], arg[2:])
+		case strings.HasPrefix(arg, "-"):
+			options[arg] = append(options[arg], "")
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	return options, positional
+}
+
+// parseSize parses a lvcreate size, which is in MiB without unit.
+func parseSize(value string) (uint64, error) {
+	units := map[byte]uint64{
+		'b': 1, 'B': 1,
+		'k': 1 << 10, 'K': 1 << 10,
+		'm': 1 << 20, 'M': 1 << 20,
+		'g': 1 << 30, 'G': 1 << 30,
+		't': 1 << 40, 'T': 1 << 40,
+	}
+	multiplier := units['m']
+	if len(value) > 0 {
+		if unit, ok := units[value[len(value)-1]]; ok {
+			multiplier = unit
+			value = value[:len(value)-1]
+		}
+	}
+	size, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, failed(3, "Invalid argument for --size: %s", value)
+	}
+	return size * multiplier, nil
+}
+
+func (e *Executor) pvcreate(args []string) error {
+	_, devices := parseArgs(args)
+	for _, path := range devices {
+		dev, ok := e.devices[path]
+		if !ok {
+			return failed(5, "Device %s not found.", path)
+		}
+		if dev.vg != "" {
+			return failed(5, "Can't initialize physical volume %q of volume group %q without -ff", path, dev.vg)
+		}
+		if dev.size <= peStart {
+			return failed(5, "%s: device is too small.", path)
+		}
+		dev.isPV = true
+	}
+	return nil
+}
+
+func (e *Executor) vgcreate(args []string) error {
+	_, positional := parseArgs(args, "-s")
+	if len(positional) < 2 {
+		return failed(3, "Please provide volume group name and physical volumes")
+	}
+	name := positional[0]
+	if _, ok := e.vgs[name]; ok {
+		return failed(5, "A volume group called %s already exists.", name)
+	}
+	vg := &volumeGroup{name: name, extentSize: e.ExtentSize}
+	if vg.extentSize == 0 {
+		vg.extentSize = defaultExtentSize
+	}
+	if err := e.addPVs(vg, positional[1:]); err != nil {
+		return err
+	}
+	e.vgs[name] = vg
+	return nil
+}
+
+func (e *Executor) vgextend(args []string) error {
+	_, positional := parseArgs(args)
+	if len(positional) < 2 {
+		return failed(3, "Please enter volume group name and physical volumes")
+	}
+	vg, ok := e.vgs[positional[0]]
+	if !ok {
+		return failed(5, "Volume group %q not found", positional[0])
+	}
+	return e.addPVs(vg, positional[1:])
+}
+
+// addPVs initializes the devices as physical volumes, if necessary,
+// and adds them to the volume group.
+func (e *Executor) addPVs(vg *volumeGroup, paths []string) error {
+	for _, path := range paths {
+		dev, ok := e.devices[path]
+		if !ok {
+			return failed(5, "Device %s not found.", path)
+		}
+		if dev.vg != "" {
+			return failed(5, "Physical volume '%s' is already in volume group '%s'", path, dev.vg)
+		}
+		if dev.size < peStart+vg.extentSize {
+			return failed(5, "%s: device is too small.", path)
+		}
+	}
+	for _, path := range paths {
+		dev := e.devices[path]
+		dev.isPV = true
+		dev.vg = vg.name
+		dev.extents = make([]string, (dev.size-peStart)/vg.extentSize)
+		vg.pvs = append(vg.pvs, path)
+	}
+	return nil
+}
+
+func (e *Executor) vgdisplay(args []string) (string, error) {
+	_, names := parseArgs(args)
+	var out strings.Builder
+	for _, name := range names {
+		vg, ok := e.vgs[name]
+		if !ok {
+			return "", failed(5, "Volume group %q not found", name)
+		}
+		fmt.Fprintf(&out, "  --- Volume group ---\n  VG Name               %s\n", vg.name)
+	}
+	return out.String(), nil
+}
+
+// pvFree returns the number of free extents of a physical volume.
+func (dev *device) pvFree() uint64 {
+	var free uint64
+	for _, lv := range dev.extents {
+		if lv == "" {
+			free++
+		}
+	}
+	return free
+}
+
+func (e *Executor) vgFree(vg *volumeGroup) uint64 {
+	var free uint64
+	for _, pv := range vg.pvs {
+		free += e.devices[pv].pvFree()
+	}
+	return free
+}
+
+func (e *Executor) vgSize(vg *volumeGroup) uint64 {
+	var size uint64
+	for _, pv := range vg.pvs {
+		size += uint64(len(e.devices[pv].extents))
+	}
+	return size
+}
+
+// findLV looks up a logical volume by path or <vg>/<lv>.
+func (e *Executor) findLV(path string) (*volumeGroup, *logicalVolume) {
+	path = strings.TrimPrefix(path, e.devDir()+"/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	vg, ok := e.vgs[parts[0]]
+	if !ok {
+		return nil, nil
+	}
+	for _, lv := range vg.lvs {
+		if lv.name == parts[1] {
+			return vg, lv
+		}
+	}
+	return vg, nil
+}
+
+func (lv *logicalVolume) extents() uint64 {
+	var extents uint64
+	for _, seg := range lv.segments {
+		extents += seg.count
+	}
+	return extents
+}
+
+// size returns the size in bytes, the virtual one for thin volumes.
+func (lv *logicalVolume) size(vg *volumeGroup) uint64 {
+	if lv.pool != "" {
+		return lv.virtualSize
+	}
+	return lv.extents() * vg.extentSize
+}
+
+// roundUp rounds the size up to full extents.
+func (vg *volumeGroup) roundUp(size uint64) uint64 {
+	return (size + vg.extentSize - 1) / vg.extentSize * vg.extentSize
+}
+
+// parseExtents parses a lvcreate extent count, either absolute
+// or relative to the free extents (like 95%FREE).
+func parseExtents(value string, free uint64) (uint64, error) {
+	if strings.HasSuffix(value, "%FREE") {
+		percent, err := strconv.ParseUint(strings.TrimSuffix(value, "%FREE"), 10, 64)
+		if err != nil || percent == 0 || percent > 100 {
+			return 0, failed(3, "Invalid argument for --extents: %s", value)
+		}
+		return free * percent / 100, nil
+	}
+	extents, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, failed(3, "Invalid argument for --extents: %s", value)
+	}
+	return extents, nil
+}
+
+func (e *Executor) lvcreate(args []string) error {
+	options, positional := parseArgs(args, "-L", "--size", "-l", "--extents", "-V", "--virtualsize", "--type", "--thinpool", "-n", "--name", "-i", "--stripes", "-I", "--stripesize", "--addtag", "-Z", "--zero")
+	value := func(names ...string) string {
+		for _, name := range names {
+			if values := options[name]; len(values) > 0 {
+				return values[len(values)-1]
+			}
+		}
+		return ""
+	}
+	name := value("-n", "--name")
+	sizeStr := value("-L", "--size")
+	extentsStr := value("-l", "--extents")
+	virtualSizeStr := value("-V", "--virtualsize")
+	if name == "" || sizeStr == "" && extentsStr == "" && virtualSizeStr == "" || len(positional) == 0 {
+		return failed(3, "Please specify name, size and volume group")
+	}
+	vg, ok := e.vgs[positional[0]]
+	if !ok {
+		return failed(5, "Volume group %q not found", positional[0])
+	}
+	for _, lv := range vg.lvs {
+		if lv.name == name {
+			return failed(5, "Logical Volume %q already exists in volume group %q", name, vg.name)
+		}
+	}
+	lv := &logicalVolume{name: name, tags: append([]string{}, options["--addtag"]...)}
+
+	if pool := value("--thinpool"); pool != "" {
+		// Thin volumes only have a virtual size, the pool
+		// provides the space once data gets written.
+		if virtualSizeStr == "" {
+			return failed(3, "Please specify the virtual size of the thin volume")
+		}
+		if _, poolLV := e.findLV(vg.name + "/" + pool); poolLV == nil || !poolLV.thinPool {
+			return failed(5, "Thin pool %s not found in volume group %s.", pool, vg.name)
+		}
+		size, err := parseSize(virtualSizeStr)
+		if err != nil {
+			return err
+		}
+		lv.pool = pool
+		lv.virtualSize = vg.roundUp(size)
+	} else {
+		if err := e.allocateNewLV(vg, lv, value, positional[1:]); err != nil {
+			return err
+		}
+	}
+	vg.lvs = append(vg.lvs, lv)
+	if lv.thinPool {
+		// Pools are not usable as block devices.
+		return nil
+	}
+	if err := e.createDeviceNode(e.lvPath(vg, lv)); err != nil {
+		return failed(5, "Failed to create device node: %v", err)
+	}
+	return nil
+}
+
+// allocateNewLV allocates the extents of a new linear or striped
+// logical volume or thin pool.
+func (e *Executor) allocateNewLV(vg *volumeGroup, lv *logicalVolume, value func(names ...string) string, pvNames []string) error {
+	switch lvType := value("--type"); lvType {
+	case "", "linear", "striped":
+	case "thin-pool":
+		lv.thinPool = true
+	default:
+		return failed(3, "Invalid argument for --type: %s", lvType)
+	}
+	stripes := uint64(1)
+	if str := value("-i", "--stripes"); str != "" {
+		var err error
+		if stripes, err = strconv.ParseUint(str, 10, 64); err != nil || stripes == 0 {
+			return failed(3, "Invalid argument for --stripes: %s", str)
+		}
+	}
+	pvs, err := e.allocatablePVs(vg, pvNames)
+	if err != nil {
+		return err
+	}
+
+	var extents uint64
+	if str := value("-l", "--extents"); str != "" {
+		var free uint64
+		for _, pv := range pvs {
+			free += e.devices[pv].pvFree()
+		}
+		if extents, err = parseExtents(str, free); err != nil {
+			return err
+		}
+		extents = (extents + stripes - 1) / stripes * stripes
+	} else {
+		size, err := parseSize(value("-L", "--size"))
+		if err != nil {
+			return err
+		}
+		// Round up to full extents, for each stripe.
+		unit := vg.extentSize * stripes
+		extents = (size + unit - 1) / unit * stripes
+	}
+	return e.allocate(vg, lv, pvs, extents, stripes)
+}
+
+func (e *Executor) lvextend(args []string) error {
+	options, positional := parseArgs(args, "-L", "--size")
+	sizeStr := ""
+	for _, name := range []string{"-L", "--size"} {
+		if values := options[name]; len(values) > 0 {
+			sizeStr = values[len(values)-1]
+		}
+	}
+	if sizeStr == "" || len(positional) == 0 {
+		return failed(3, "Please specify size and logical volume")
+	}
+	size, err := parseSize(strings.TrimPrefix(sizeStr, "+"))
+	if err != nil {
+		return err
+	}
+	vg, lv := e.findLV(positional[0])
+	if lv == nil {
+		return failed(5, "Failed to find logical volume %q", positional[0])
+	}
+	if lv.pool != "" {
+		size = vg.roundUp(size)
+		if strings.HasPrefix(sizeStr, "+") {
+			size += lv.virtualSize
+		}
+		if size <= lv.virtualSize {
+			return failed(5, "New size given (%d bytes) not larger than existing size (%d bytes)", size, lv.virtualSize)
+		}
+		lv.virtualSize = size
+		return nil
+	}
+	extents := (size + vg.extentSize - 1) / vg.extentSize
+	if strings.HasPrefix(sizeStr, "+") {
+		extents += lv.extents()
+	}
+	if extents <= lv.extents() {
+		return failed(5, "New size (%d extents) matches existing size (%d extents).", extents, lv.extents())
+	}
+	pvs, err := e.allocatablePVs(vg, positional[1:])
+	if err != nil {
+		return err
+	}
+	return e.allocate(vg, lv, pvs, extents-lv.extents(), 1)
+}
+
+func (e *Executor) lvremove(args []string) error {
+	_, paths := parseArgs(args)
+	for _, path := range paths {
+		vg, lv := e.findLV(path)
+		if lv == nil {
+			return failed(5, "Failed to find logical volume %q", strings.TrimPrefix(path, e.devDir()+"/"))
+		}
+		lvPath := e.lvPath(vg, lv)
+		if e.inUse[lvPath] {
+			return failed(5, "Logical volume %s/%s in use.", vg.name, lv.name)
+		}
+		if lv.thinPool {
+			for _, other := range vg.lvs {
+				if other.pool == lv.name {
+					return failed(5, "Logical volume %s/%s is used by thin volume %s.", vg.name, lv.name, other.name)
+				}
+			}
+		}
+		for _, pv := range vg.pvs {
+			dev := e.devices[pv]
+			for i, owner := range dev.extents {
+				if owner == lv.name {
+					dev.extents[i] = ""
+				}
+			}
+		}
+		for i, other := range vg.lvs {
+			if other == lv {
+				vg.lvs = append(vg.lvs[:i], vg.lvs[i+1:]...)
+				break
+			}
+		}
+		delete(e.filesystems, lvPath)
+		if err := e.removeDeviceNode(lvPath); err != nil {
+			return failed(5, "Failed to remove device node: %v", err)
+		}
+	}
+	return nil
+}
+
+// allocatablePVs returns the physical volumes that may be used,
+// all of the volume group if none are given.
+func (e *Executor) allocatablePVs(vg *volumeGroup, pvs []string) ([]string, error) {
+	if len(pvs) == 0 {
+		return vg.pvs, nil
+	}
+	for _, pv := range pvs {
+		if dev, ok := e.devices[pv]; !ok || dev.vg != vg.name {
+			return nil, failed(5, "Physical Volume %q not found in Volume Group %q.", pv, vg.name)
+		}
+	}
+	return pvs, nil
+}
+
+// allocate adds the given number of extents to the logical volume.
+// Linear volumes use free extents of the physical volumes in order,
+// striped volumes need a contiguous area on each stripe.
+func (e *Executor) allocate(vg *volumeGroup, lv *logicalVolume, pvs []string, extents uint64, stripes uint64) error {
+	var free uint64
+	for _, pv := range pvs {
+		free += e.devices[pv].pvFree()
+	}
+	if free < extents {
+		return failed(5, "Volume group %q has insufficient free space (%d extents): %d required.", vg.name, e.vgFree(vg), extents)
+	}
+	start := lv.extents()
+
+	if stripes > 1 {
+		perStripe := extents / stripes
+		var areas []area
+		for _, pv := range pvs {
+			if uint64(len(areas)) == stripes {
+				break
+			}
+			if first, ok := findRun(e.devices[pv].extents, perStripe); ok {
+				areas = append(areas, area{pv: pv, extent: first})
+			}
+		}
+		if uint64(len(areas)) < stripes {
+			return failed(5, "Insufficient suitable allocatable extents for logical volume %s: %d more required", lv.name, extents)
+		}
+		for _, a := range areas {
+			dev := e.devices[a.pv]
+			for i := a.extent; i < a.extent+perStripe; i++ {
+				dev.extents[i] = lv.name
+			}
+		}
+		lv.segments = append(lv.segments, segment{start: start, count: extents, areas: areas})
+		return nil
+	}
+
+	remaining := extents
+	for _, pv := range pvs {
+		dev := e.devices[pv]
+		for i := uint64(0); i < uint64(len(dev.extents)) && remaining > 0; i++ {
+			if dev.extents[i] != "" {
+				continue
+			}
+			first := i
+			for i < uint64(len(dev.extents)) && dev.extents[i] == "" && remaining > 0 {
+				dev.extents[i] = lv.name
+				i++
+				remaining--
+			}
+			count := i - first
+			lv.segments = append(lv.segments, segment{start: start, count: count, areas: []area{{pv: pv, extent: first}}})
+			start += count
+		}
+	}
+	return nil
+}
+
+// findRun returns the first extent of a run of free extents with the given length.
+func findRun(extents []string, length uint64) (uint64, bool) {
+	var run uint64
+	for i, owner := range extents {
+		if owner != "" {
+			run = 0
+			continue
+		}
+		run++
+		if run == length {
+			return uint64(i) + 1 - length, true
+		}
+	}
+	return 0, false
+}
+
+// report implements vgs, pvs and lvs.
+func (e *Executor) report(cmd string, args []string) (string, error) {
+	options, names := parseArgs(args, "-o", "--options", "--units", "--reportformat")
+	var fields []string
+	for _, name := range []string{"-o", "--options"} {
+		for _, value := range options[name] {
+			fields = append(fields, strings.Split(value, ",")...)
+		}
+	}
+	var rows []map[string]string
+	var err error
+	var key string
+	switch cmd {
+	case "vgs":
+		key = "vg"
+		if len(fields) == 0 {
+			fields = []string{"vg_name", "vg_size", "vg_free"}
+		}
+		rows, err = e.vgRows(names)
+	case "pvs":
+		key = "pv"
+		if len(fields) == 0 {
+			fields = []string{"pv_name", "vg_name", "pv_size", "pv_free"}
+		}
+		rows, err = e.pvRows(names)
+	case "lvs":
+		key = "lv"
+		if len(fields) == 0 {
+			fields = []string{"lv_name", "vg_name", "lv_size"}
+		}
+		segments := false
+		for _, field := range fields {
+			if field == "devices" || strings.HasPrefix(field, "seg_") {
+				segments = true
+			}
+		}
+		rows, err = e.lvRows(names, segments)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	suffix := "B"
+	if _, ok := options["--nosuffix"]; ok {
+		suffix = ""
+	}
+	selected := make([]map[string]string, 0, len(rows))
+	for _, row := range rows {
+		sel := map[string]string{}
+		for _, field := range fields {
+			value, ok := row[field]
+			if !ok {
+				return "", failed(5, "Unrecognised field: %s", field)
+			}
+			if isSize(field) {
+				value += suffix
+			}
+			sel[field] = value
+		}
+		selected = append(selected, sel)
+	}
+
+	if formats := options["--reportformat"]; len(formats) > 0 && formats[0] == "json" {
+		data, err := json.MarshalIndent(map[string][]map[string][]map[string]string{
+			"report": {{key: selected}},
+		}, "  ", "    ")
+		if err != nil {
+			return "", err
+		}
+		return "  " + string(data) + "\n", nil
+	}
+
+	var out strings.Builder
+	if _, ok := options["--noheadings"]; !ok {
+		fmt.Fprintf(&out, "  %s\n", strings.ToUpper(strings.Join(fields, " ")))
+	}
+	for _, row := range selected {
+		var values []string
+		for _, field := range fields {
+			values = append(values, row[field])
+		}
+		fmt.Fprintf(&out, "  %s\n", strings.Join(values, " "))
+	}
+	return out.String(), nil
+}
+
+func isSize(field string) bool {
+	switch field {
+	case "vg_size", "vg_free", "vg_extent_size", "pv_size", "pv_free", "pe_start", "lv_size", "seg_start", "seg_size":
+		return true
+	}
+	return false
+}
+
+func (e *Executor) vgRows(names []string) ([]map[string]string, error) {
+	if len(names) == 0 {
+		for name := range e.vgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var rows []map[string]string
+	for _, name := range names {
+		vg, ok := e.vgs[name]
+		if !ok {
+			return nil, failed(5, "Volume group %q not found", name)
+		}
+		rows = append(rows, e.vgRow(vg))
+	}
+	return rows, nil
+}
+
+func (e *Executor) vgRow(vg *volumeGroup) map[string]string {
+	return map[string]string{
+		"vg_name":        vg.name,
+		"vg_size":        fmt.Sprint(e.vgSize(vg) * vg.extentSize),
+		"vg_free":        fmt.Sprint(e.vgFree(vg) * vg.extentSize),
+		"vg_extent_size": fmt.Sprint(vg.extentSize),
+	}
+}
+
+func (e *Executor) pvRows(names []string) ([]map[string]string, error) {
+	if len(names) == 0 {
+		for path, dev := range e.devices {
+			if dev.isPV {
+				names = append(names, path)
+			}
+		}
+		sort.Strings(names)
+	}
+	var rows []map[string]string
+	for _, name := range names {
+		dev, ok := e.devices[name]
+		if !ok || !dev.isPV {
+			return nil, failed(5, "Failed to find physical volume %q.", name)
+		}
+		row := map[string]string{
+			"pv_name":  dev.path,
+			"vg_name":  dev.vg,
+			"pv_size":  fmt.Sprint(dev.size - peStart),
+			"pv_free":  fmt.Sprint(dev.size - peStart),
+			"pe_start": fmt.Sprint(peStart),
+		}
+		if vg, ok := e.vgs[dev.vg]; ok {
+			row["pv_size"] = fmt.Sprint(uint64(len(dev.extents)) * vg.extentSize)
+			row["pv_free"] = fmt.Sprint(dev.pvFree() * vg.extentSize)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (e *Executor) lvRows(names []string, segments bool) ([]map[string]string, error) {
+	type selectedLV struct {
+		vg *volumeGroup
+		lv *logicalVolume
+	}
+	var lvs []selectedLV
+	if len(names) == 0 {
+		for name := range e.vgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		if vg, ok := e.vgs[name]; ok {
+			for _, lv := range vg.lvs {
+				lvs = append(lvs, selectedLV{vg, lv})
+			}
+			continue
+		}
+		vg, lv := e.findLV(name)
+		if vg == nil {
+			return nil, failed(5, "Volume group %q not found", strings.Split(strings.TrimPrefix(name, e.devDir()+"/"), "/")[0])
+		}
+		if lv == nil {
+			return nil, failed(5, "Failed to find logical volume %q", strings.TrimPrefix(name, e.devDir()+"/"))
+		}
+		lvs = append(lvs, selectedLV{vg, lv})
+	}
+
+	var rows []map[string]string
+	for _, sel := range lvs {
+		vg, lv := sel.vg, sel.lv
+		base := map[string]string{
+			"lv_name":          lv.name,
+			"lv_path":          e.lvPath(vg, lv),
+			"vg_name":          vg.name,
+			"lv_size":          fmt.Sprint(lv.size(vg)),
+			"lv_tags":          strings.Join(lv.tags, ","),
+			"lv_layout":        "linear",
+			"pool_lv":          lv.pool,
+			"data_percent":     "",
+			"metadata_percent": "",
+			"vg_extent_size":   fmt.Sprint(vg.extentSize),
+		}
+		for _, seg := range lv.segments {
+			if len(seg.areas) > 1 {
+				base["lv_layout"] = "striped"
+			}
+		}
+		switch {
+		case lv.thinPool:
+			base["lv_path"] = ""
+			base["lv_layout"] = "thin,pool"
+			base["data_percent"] = fmt.Sprintf("%.2f", lv.dataPercent)
+			base["metadata_percent"] = fmt.Sprintf("%.2f", lv.metadataPercent)
+		case lv.pool != "":
+			base["lv_layout"] = "thin,sparse"
+			base["data_percent"] = "0.00"
+		}
+		if !segments {
+			var devices []string
+			for _, seg := range e.lvSegments(vg, lv) {
+				devices = append(devices, seg["devices"])
+			}
+			base["devices"] = strings.Join(devices, ",")
+			rows = append(rows, base)
+			continue
+		}
+		for _, seg := range e.lvSegments(vg, lv) {
+			row := map[string]string{}
+			for k, v := range base {
+				row[k] = v
+			}
+			for k, v := range seg {
+				row[k] = v
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// lvSegments returns the segment fields of a logical volume. Thin
+// pools are reported with their hidden data volume as device, thin
+// volumes with one virtual segment without devices.
+func (e *Executor) lvSegments(vg *volumeGroup, lv *logicalVolume) []map[string]string {
+	switch {
+	case lv.thinPool:
+		return []map[string]string{{
+			"devices":   lv.name + "_tdata(0)",
+			"seg_start": "0",
+			"seg_size":  fmt.Sprint(lv.size(vg)),
+		}}
+	case lv.pool != "":
+		return []map[string]string{{
+			"devices":   "",
+			"seg_start": "0",
+			"seg_size":  fmt.Sprint(lv.size(vg)),
+		}}
+	}
+	var segs []map[string]string
+	for _, seg := range lv.segments {
+		segs = append(segs, map[string]string{
+			"devices":   seg.devices(),
+			"seg_start": fmt.Sprint(seg.start * vg.extentSize),
+			"seg_size":  fmt.Sprint(seg.count * vg.extentSize),
+		})
+	}
+	return segs
+}
+
+// devices formats the areas like the lvs devices field.
+func (seg segment) devices() string {
+	var devices []string
+	for _, a := range seg.areas {
+		devices = append(devices, fmt.Sprintf("%s(%d)", a.pv, a.extent))
+	}
+	return strings.Join(devices, ",")
+}
@@ -1,18 +1,80 @@
 package pmemexec
 
 import (
+	"bytes"
 	"os/exec"
 	"strings"
+	"sync"
 
 	"k8s.io/klog"
 )
 
-// RunCommand wrapper around exec.Command()
-func RunCommand(cmd string, args ...string) (string, error) {
+// Executor runs external commands. The default executes them with
+// os/exec, tests can replace it with SetExecutor.
+type Executor interface {
+	// Run executes the command and returns what it printed on
+	// standard output and standard error. The error is non-nil
+	// if the command could not be started or failed.
+	Run(cmd string, args ...string) (stdout string, stderr string, err error)
+}
+
+// ExecutorFunc turns a function into an Executor.
+type ExecutorFunc func(cmd string, args ...string) (string, string, error)
+
+// Run calls the function.
+func (f ExecutorFunc) Run(cmd string, args ...string) (string, string, error) {
+	return f(cmd, args...)
+}
+
+type osExecutor struct{}
+
+func (osExecutor) Run(cmd string, args ...string) (string, string, error) {
 	klog.V(5).Infof("Executing: %s %s", cmd, strings.Join(args, " "))
-	output, err := exec.Command(cmd, args...).CombinedOutput()
-	strOutput := string(output)
-	klog.V(5).Infof("Output: %s", output)
+	var stdout, stderr bytes.Buffer
+	c := exec.Command(cmd, args...)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	klog.V(5).Infof("Output: %s%s", stdout.String(), stderr.String())
+
+	return stdout.String(), stderr.String(), err
+}
+
+var (
+	executorMutex sync.RWMutex
+	executor      Executor = osExecutor{}
+)
+
+// SetExecutor replaces the executor used by this package and returns
+// the previous one. nil restores the default.
+func SetExecutor(e Executor) Executor {
+	if e == nil {
+		e = osExecutor{}
+	}
+	executorMutex.Lock()
+	defer executorMutex.Unlock()
+	prev := executor
+	executor = e
+	return prev
+}
+
+// GetExecutor returns the executor that is currently in use.
+func GetExecutor() Executor {
+	executorMutex.RLock()
+	defer executorMutex.RUnlock()
+	return executor
+}
+
+// Run executes the command with the current executor and returns
+// standard output and standard error separately.
+func Run(cmd string, args ...string) (string, string, error) {
+	return GetExecutor().Run(cmd, args...)
+}
+
+// RunCommand executes the command with the current executor and
+// returns standard output followed by standard error.
+func RunCommand(cmd string, args ...string) (string, error) {
+	stdout, stderr, err := Run(cmd, args...)
 
-	return strOutput, err
+	return stdout + stderr, err
 }
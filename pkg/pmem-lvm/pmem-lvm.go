@@ -0,0 +1,371 @@
+/*
+Copyright 2020  Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package pmemlvm is a client for the LVM command line tools. The
+// reporting commands get invoked with JSON output and the results are
+// returned as typed structs. Failures of the other commands are
+// classified by the errors defined in this package.
+package pmemlvm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+)
+
+var (
+	//ErrNotFound the volume group or logical volume does not exist
+	ErrNotFound = errors.New("not found")
+
+	//ErrExists a logical volume with the same name exists already
+	ErrExists = errors.New("already exists")
+
+	//ErrNoSpace the volume group has not enough free space
+	ErrNoSpace = errors.New("insufficient free space")
+
+	//ErrBusy the logical volume is in use
+	ErrBusy = errors.New("in use")
+)
+
+// Messages printed by the LVM commands for the errors above.
+var errorMessages = []struct {
+	substring string
+	err       error
+}{
+	{"insufficient free space", ErrNoSpace},
+	{"insufficient suitable allocatable extents", ErrNoSpace},
+	{"already exists", ErrExists},
+	{"in use", ErrBusy},
+	{"can't remove open logical volume", ErrBusy},
+	{"not found", ErrNotFound},
+	{"failed to find", ErrNotFound},
+}
+
+//CommandError is returned for failed LVM commands. errors.Is
+//checks it against the errors of this package.
+type CommandError struct {
+	Cmd    string
+	Args   []string
+	Stderr string
+	Err    error
+	// kind is one of the errors of this package, nil if unknown
+	kind error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s %s: %v: %s", e.Cmd, strings.Join(e.Args, " "), e.Err, strings.TrimSpace(e.Stderr))
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+//Is checks whether the failure is of the given kind
+func (e *CommandError) Is(target error) bool {
+	return e.kind != nil && e.kind == target
+}
+
+func newCommandError(cmd string, args []string, stderr string, err error) *CommandError {
+	e := &CommandError{Cmd: cmd, Args: args, Stderr: stderr, Err: err}
+	lower := strings.ToLower(stderr)
+	for _, msg := range errorMessages {
+		if strings.Contains(lower, msg.substring) {
+			e.kind = msg.err
+			break
+		}
+	}
+	return e
+}
+
+// commandMutex serializes all LVM commands. LVM was found to behave
+// inconsistently when invoked concurrently in stress tests. One
+// should revisit this and choose better suitable synchronization policy.
+var commandMutex sync.Mutex
+
+//Client invokes LVM commands. Commands of all clients run one at a
+//time, callers need their own locking only when a sequence of
+//commands must not be interrupted.
+type Client struct {
+	executor pmemexec.Executor
+}
+
+//New returns a client which uses the given executor, nil for the
+//one that pmemexec currently uses
+func New(executor pmemexec.Executor) *Client {
+	return &Client{executor: executor}
+}
+
+func (c *Client) exec(cmd string, args ...string) (string, string, error) {
+	commandMutex.Lock()
+	defer commandMutex.Unlock()
+	if c.executor == nil {
+		return pmemexec.Run(cmd, args...)
+	}
+	return c.executor.Run(cmd, args...)
+}
+
+//VolumeGroup describes a LVM volume group, sizes are in bytes
+type VolumeGroup struct {
+	Name       string
+	Size       uint64
+	Free       uint64
+	ExtentSize uint64
+}
+
+//PhysicalVolume describes a LVM physical volume, sizes are in bytes
+type PhysicalVolume struct {
+	Name string
+	//VGName is empty for physical volumes without volume group
+	VGName string
+	Size   uint64
+	Free   uint64
+	//PEStart is the offset of the first physical extent
+	PEStart uint64
+}
+
+//LogicalVolume describes a LVM logical volume, sizes are in bytes
+type LogicalVolume struct {
+	Name   string
+	Path   string
+	VGName string
+	//Size is the virtual size for thin volumes
+	Size     uint64
+	Tags     []string
+	Segments []Segment
+	//ThinPool is true for thin pools
+	ThinPool bool
+	//Pool is the thin pool of a thin volume, empty otherwise
+	Pool string
+	//DataPercent is the used part of a thin pool or thin volume,
+	//MetadataPercent that of the thin pool metadata, both are zero
+	//for other logical volumes
+	DataPercent, MetadataPercent float64
+}
+
+//Segment is a part of a logical volume
+type Segment struct {
+	//Start and Size inside the logical volume
+	Start, Size uint64
+	//ExtentSize of the volume group
+	ExtentSize uint64
+	//Areas on physical volumes, more than one for striped segments
+	Areas []Area
+}
+
+//Area is the part of a segment on one physical volume
+type Area struct {
+	PV string
+	//Extent is the first physical extent of the area
+	Extent uint64
+}
+
+//HasTag checks whether the logical volume has the tag
+func (lv LogicalVolume) HasTag(tag string) bool {
+	for _, t := range lv.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+//PVs returns the physical volumes used by the logical volume
+func (lv LogicalVolume) PVs() []string {
+	pvs := []string{}
+	seen := map[string]bool{}
+	for _, seg := range lv.Segments {
+		for _, area := range seg.Areas {
+			if !seen[area.PV] {
+				seen[area.PV] = true
+				pvs = append(pvs, area.PV)
+			}
+		}
+	}
+	return pvs
+}
+
+//CreateLVOpts contains the parameters for a new logical volume
+type CreateLVOpts struct {
+	Name   string
+	VGName string
+	Size   uint64
+	Tags   []string
+	//Stripes > 1 creates a striped volume with the given StripeSize (like "2m")
+	Stripes    uint64
+	StripeSize string
+	//PVs restricts allocation to these physical volumes, all if empty
+	PVs []string
+	//Zero makes LVM clear the start of the new volume
+	Zero bool
+	//ThinPool creates a thin volume in the given pool of the volume
+	//group. Size is the virtual size, Stripes and PVs are ignored.
+	ThinPool string
+}
+
+var reportArgs = []string{"--reportformat", "json", "--units", "b", "--nosuffix"}
+
+//VolumeGroups lists the given volume groups, all if none are given.
+//Possible errors: ErrNotFound
+func (c *Client) VolumeGroups(names ...string) ([]VolumeGroup, error) {
+	args := append(append([]string{}, reportArgs...), "-o", "vg_name,vg_size,vg_free,vg_extent_size")
+	var rep report
+	if err := c.report("vgs", append(args, names...), &rep); err != nil {
+		return nil, err
+	}
+	vgs := []VolumeGroup{}
+	for _, row := range rep.rows(func(r reportEntry) []map[string]string { return r.VG }) {
+		vg := VolumeGroup{Name: row["vg_name"]}
+		if err := parseSizes(row, map[string]*uint64{
+			"vg_size":        &vg.Size,
+			"vg_free":        &vg.Free,
+			"vg_extent_size": &vg.ExtentSize,
+		}); err != nil {
+			return nil, fmt.Errorf("vgs: volume group %q: %v", vg.Name, err)
+		}
+		vgs = append(vgs, vg)
+	}
+	return vgs, nil
+}
+
+//PhysicalVolumes lists the given physical volumes, all if none are given
+func (c *Client) PhysicalVolumes(names ...string) ([]PhysicalVolume, error) {
+	args := append(append([]string{}, reportArgs...), "-o", "pv_name,vg_name,pv_size,pv_free,pe_start")
+	var rep report
+	if err := c.report("pvs", append(args, names...), &rep); err != nil {
+		return nil, err
+	}
+	pvs := []PhysicalVolume{}
+	for _, row := range rep.rows(func(r reportEntry) []map[string]string { return r.PV }) {
+		pv := PhysicalVolume{Name: row["pv_name"], VGName: row["vg_name"]}
+		if err := parseSizes(row, map[string]*uint64{
+			"pv_size":  &pv.Size,
+			"pv_free":  &pv.Free,
+			"pe_start": &pv.PEStart,
+		}); err != nil {
+			return nil, fmt.Errorf("pvs: physical volume %q: %v", pv.Name, err)
+		}
+		pvs = append(pvs, pv)
+	}
+	return pvs, nil
+}
+
+//LogicalVolumes lists the logical volumes in the given volume groups
+//or the given logical volumes, all if none are given.
+//Possible errors: ErrNotFound
+func (c *Client) LogicalVolumes(names ...string) ([]LogicalVolume, error) {
+	args := append(append([]string{}, reportArgs...), "-o", "lv_name,lv_path,vg_name,lv_size,lv_tags,lv_layout,pool_lv,data_percent,metadata_percent,devices,seg_start,seg_size,vg_extent_size")
+	var rep report
+	if err := c.report("lvs", append(args, names...), &rep); err != nil {
+		return nil, err
+	}
+	lvs := []LogicalVolume{}
+	index := map[string]int{}
+	// Segment fields turn the report into one row per segment.
+	for _, row := range rep.rows(func(r reportEntry) []map[string]string { return append(r.LV, r.Seg...) }) {
+		lv := LogicalVolume{Name: row["lv_name"], Path: row["lv_path"], VGName: row["vg_name"], Pool: row["pool_lv"]}
+		seg, err := parseSegment(row)
+		if err == nil {
+			err = parseSizes(row, map[string]*uint64{"lv_size": &lv.Size})
+		}
+		if err == nil {
+			err = parsePercents(row, map[string]*float64{
+				"data_percent":     &lv.DataPercent,
+				"metadata_percent": &lv.MetadataPercent,
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lvs: logical volume %q: %v", lv.Name, err)
+		}
+		key := lv.VGName + "/" + lv.Name
+		if i, ok := index[key]; ok {
+			lvs[i].Segments = append(lvs[i].Segments, seg)
+			continue
+		}
+		if tags := row["lv_tags"]; tags != "" {
+			lv.Tags = strings.Split(tags, ",")
+		}
+		// "thin,pool" for pools, "thin,sparse" for thin volumes.
+		lv.ThinPool = row["lv_layout"] == "thin,pool"
+		lv.Segments = []Segment{seg}
+		index[key] = len(lvs)
+		lvs = append(lvs, lv)
+	}
+	return lvs, nil
+}
+
+//CreateLV creates a new logical volume.
+//Possible errors: ErrExists, ErrNoSpace, ErrNotFound
+func (c *Client) CreateLV(opts CreateLVOpts) error {
+	zero := "n"
+	if opts.Zero {
+		zero = "y"
+	}
+	size := strconv.FormatUint(opts.Size, 10) + "B"
+	args := []string{"-Z" + zero, "-L", size}
+	if opts.ThinPool != "" {
+		args = []string{"-Z" + zero, "-V", size, "--thinpool", opts.ThinPool}
+	} else if opts.Stripes > 1 {
+		args = append(args, "-i", strconv.FormatUint(opts.Stripes, 10))
+		if opts.StripeSize != "" {
+			args = append(args, "-I", opts.StripeSize)
+		}
+	}
+	for _, tag := range opts.Tags {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, "-n", opts.Name, opts.VGName)
+	if opts.ThinPool == "" {
+		args = append(args, opts.PVs...)
+	}
+	return c.run("lvcreate", args...)
+}
+
+//CreateThinPool creates a thin pool which uses the given percentage of
+//the free space in the volume group. LVM allocates the pool metadata
+//in addition to that.
+//Possible errors: ErrExists, ErrNoSpace, ErrNotFound
+func (c *Client) CreateThinPool(vgName string, name string, percentFree uint) error {
+	// Newly provisioned blocks get zeroed, so thin volumes never
+	// expose data of deleted volumes.
+	return c.run("lvcreate", "--type", "thin-pool", "-Zy", "-l", fmt.Sprintf("%d%%FREE", percentFree), "-n", name, vgName)
+}
+
+//ExtendLV grows the logical volume to the given size, optionally only
+//using the given physical volumes.
+//Possible errors: ErrNoSpace, ErrNotFound
+func (c *Client) ExtendLV(path string, size uint64, pvs ...string) error {
+	args := append([]string{"-L", strconv.FormatUint(size, 10) + "B", path}, pvs...)
+	return c.run("lvextend", args...)
+}
+
+//RemoveLV removes the logical volume.
+//Possible errors: ErrBusy, ErrNotFound
+func (c *Client) RemoveLV(path string) error {
+	return c.run("lvremove", "-fy", path)
+}
+
+func (c *Client) run(cmd string, args ...string) error {
+	_, stderr, err := c.exec(cmd, args...)
+	if err != nil {
+		return newCommandError(cmd, args, stderr, err)
+	}
+	return nil
+}
+
+func (c *Client) report(cmd string, args []string, rep *report) error {
+	stdout, stderr, err := c.exec(cmd, args...)
+	if err != nil {
+		return newCommandError(cmd, args, stderr, err)
+	}
+	if err := parseReport(stdout, rep); err != nil {
+		return fmt.Errorf("%s: %v", cmd, err)
+	}
+	return nil
+}
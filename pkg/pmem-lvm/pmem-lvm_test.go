@@ -0,0 +1,183 @@
+/*
+Copyright 2020  Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package pmemlvm_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	pmemlvm "github.com/intel/pmem-csi/pkg/pmem-lvm"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPmemLVM(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PMEM LVM Suite")
+}
+
+// recorded replays the output of the reporting commands from
+// testdata/<cmd>.json and fails the other commands with the given
+// error output, if any.
+type recorded struct {
+	stderr   string
+	commands []string
+}
+
+func (r *recorded) Run(cmd string, args ...string) (string, string, error) {
+	r.commands = append(r.commands, cmd+" "+strings.Join(args, " "))
+	switch cmd {
+	case "vgs", "pvs", "lvs":
+		data, err := ioutil.ReadFile(filepath.Join("testdata", cmd+".json"))
+		Expect(err).NotTo(HaveOccurred())
+		return string(data), "", nil
+	}
+	if r.stderr != "" {
+		return "", r.stderr, errors.New("exit status 5")
+	}
+	return "", "", nil
+}
+
+var _ = Describe("pmem lvm", func() {
+	var runner *recorded
+	var client *pmemlvm.Client
+
+	BeforeEach(func() {
+		runner = &recorded{}
+		client = pmemlvm.New(runner)
+	})
+
+	It("lists volume groups", func() {
+		vgs, err := client.VolumeGroups("ndbus0region0fsdax", "ndbus0region1fsdax")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vgs).To(Equal([]pmemlvm.VolumeGroup{
+			{Name: "ndbus0region0fsdax", Size: 33285996544, Free: 31138512896, ExtentSize: 4194304},
+			{Name: "ndbus0region1fsdax", Size: 33285996544, Free: 33285996544, ExtentSize: 4194304},
+		}))
+		Expect(runner.commands).To(HaveLen(1))
+		Expect(runner.commands[0]).To(ContainSubstring("--reportformat json"))
+		Expect(runner.commands[0]).To(HaveSuffix(" ndbus0region0fsdax ndbus0region1fsdax"))
+	})
+
+	It("lists physical volumes", func() {
+		pvs, err := client.PhysicalVolumes()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pvs).To(HaveLen(3))
+		Expect(pvs[0]).To(Equal(pmemlvm.PhysicalVolume{
+			Name: "/dev/pmem0", VGName: "ndbus0region0fsdax", Size: 33285996544, Free: 31138512896, PEStart: 1048576,
+		}))
+		Expect(pvs[2].VGName).To(BeEmpty(), "physical volume without volume group")
+	})
+
+	It("lists logical volumes", func() {
+		lvs, err := client.LogicalVolumes("ndbus0region0fsdax")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lvs).To(HaveLen(4))
+
+		lv := lvs[0]
+		Expect(lv.Name).To(Equal("pvc-1"))
+		Expect(lv.Path).To(Equal("/dev/ndbus0region0fsdax/pvc-1"))
+		Expect(lv.Size).To(Equal(uint64(2147483648)))
+		Expect(lv.Tags).To(BeEmpty())
+		Expect(lv.Segments).To(Equal([]pmemlvm.Segment{
+			{Start: 0, Size: 1073741824, ExtentSize: 4194304, Areas: []pmemlvm.Area{{PV: "/dev/pmem0", Extent: 0}}},
+			{Start: 1073741824, Size: 1073741824, ExtentSize: 4194304, Areas: []pmemlvm.Area{{PV: "/dev/pmem0", Extent: 512}}},
+		}), "one row per segment")
+		Expect(lv.PVs()).To(Equal([]string{"/dev/pmem0"}))
+
+		snap := lvs[1]
+		Expect(snap.HasTag("pmem-csi.snapshot")).To(BeTrue())
+		Expect(snap.HasTag("pmem-csi")).To(BeFalse())
+		Expect(snap.Segments[0].Areas).To(Equal([]pmemlvm.Area{{PV: "/dev/pmem0", Extent: 256}, {PV: "/dev/pmem1", Extent: 0}}), "striped")
+		Expect(snap.PVs()).To(Equal([]string{"/dev/pmem0", "/dev/pmem1"}))
+
+		pool := lvs[2]
+		Expect(pool.ThinPool).To(BeTrue(), "thin pool")
+		Expect(pool.DataPercent).To(Equal(12.5))
+		Expect(pool.MetadataPercent).To(Equal(1.08))
+
+		thin := lvs[3]
+		Expect(thin.ThinPool).To(BeFalse(), "thin volume")
+		Expect(thin.Pool).To(Equal("pmem-csi-thinpool"))
+		Expect(thin.Size).To(Equal(uint64(4294967296)), "virtual size")
+		Expect(thin.Segments[0].Areas).To(BeEmpty(), "virtual segment")
+		Expect(thin.PVs()).To(BeEmpty())
+		Expect(lv.ThinPool).To(BeFalse(), "linear volume")
+		Expect(lv.DataPercent).To(BeZero())
+	})
+
+	It("rejects invalid reports", func() {
+		bad := pmemlvm.New(pmemexec.ExecutorFunc(func(cmd string, args ...string) (string, string, error) {
+			return `{"report": [{"vg": [{"vg_name":"vg", "vg_size":"1.5g", "vg_free":"0", "vg_extent_size":"4194304"}]}]}`, "", nil
+		}))
+		_, err := bad.VolumeGroups()
+		Expect(err).To(HaveOccurred(), "size with unit")
+
+		bad = pmemlvm.New(pmemexec.ExecutorFunc(func(cmd string, args ...string) (string, string, error) {
+			return "  vg 1 0\n", "", nil
+		}))
+		_, err = bad.VolumeGroups()
+		Expect(err).To(HaveOccurred(), "column output")
+	})
+
+	It("creates logical volumes", func() {
+		err := client.CreateLV(pmemlvm.CreateLVOpts{
+			Name:       "pvc-2",
+			VGName:     "vg",
+			Size:       8388608,
+			Tags:       []string{"a"},
+			Stripes:    2,
+			StripeSize: "2m",
+			PVs:        []string{"/dev/pmem0", "/dev/pmem1"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(runner.commands).To(Equal([]string{"lvcreate -Zn -L 8388608B -i 2 -I 2m --addtag a -n pvc-2 vg /dev/pmem0 /dev/pmem1"}))
+	})
+
+	It("creates thin volumes", func() {
+		Expect(client.CreateThinPool("vg", "pool", 95)).To(Succeed())
+		err := client.CreateLV(pmemlvm.CreateLVOpts{
+			Name:     "pvc-3",
+			VGName:   "vg",
+			Size:     8388608,
+			ThinPool: "pool",
+			PVs:      []string{"/dev/pmem0"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(runner.commands).To(Equal([]string{
+			"lvcreate --type thin-pool -Zy -l 95%FREE -n pool vg",
+			"lvcreate -Zn -V 8388608B --thinpool pool -n pvc-3 vg",
+		}))
+	})
+
+	It("classifies errors", func() {
+		for stderr, expected := range map[string]error{
+			`  Volume group "vg" has insufficient free space (10 extents): 20 required.`:              pmemlvm.ErrNoSpace,
+			`  Insufficient suitable allocatable extents for logical volume pvc-2: 512 more required`: pmemlvm.ErrNoSpace,
+			`  Logical Volume "pvc-2" already exists in volume group "vg"`:                            pmemlvm.ErrExists,
+			`  Logical volume vg/pvc-2 contains a filesystem in use.`:                                 pmemlvm.ErrBusy,
+			`  Volume group "vg" not found`:                                                           pmemlvm.ErrNotFound,
+			`  Failed to find logical volume "vg/pvc-2"`:                                              pmemlvm.ErrNotFound,
+		} {
+			runner.stderr = stderr
+			err := client.CreateLV(pmemlvm.CreateLVOpts{Name: "pvc-2", VGName: "vg", Size: 4194304})
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, expected)).To(BeTrue(), "%q: %v", stderr, err)
+			Expect(err.Error()).To(ContainSubstring(strings.TrimSpace(stderr)))
+		}
+
+		runner.stderr = "  Something else went wrong."
+		err := client.RemoveLV("/dev/vg/pvc-2")
+		Expect(err).To(HaveOccurred())
+		for _, kind := range []error{pmemlvm.ErrNoSpace, pmemlvm.ErrExists, pmemlvm.ErrBusy, pmemlvm.ErrNotFound} {
+			Expect(errors.Is(err, kind)).To(BeFalse(), "unknown error must not be %v", kind)
+		}
+	})
+})
@@ -0,0 +1,111 @@
+/*
+Copyright 2020  Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemlvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// report is the output of the LVM reporting commands with
+// --reportformat json. All values are strings.
+type report struct {
+	Report []reportEntry `json:"report"`
+}
+
+type reportEntry struct {
+	VG  []map[string]string `json:"vg"`
+	PV  []map[string]string `json:"pv"`
+	LV  []map[string]string `json:"lv"`
+	Seg []map[string]string `json:"seg"`
+}
+
+func parseReport(output string, rep *report) error {
+	if err := json.Unmarshal([]byte(output), rep); err != nil {
+		return fmt.Errorf("parse JSON report: %v", err)
+	}
+	return nil
+}
+
+// rows returns the rows of all entries.
+func (rep report) rows(get func(reportEntry) []map[string]string) []map[string]string {
+	var rows []map[string]string
+	for _, entry := range rep.Report {
+		rows = append(rows, get(entry)...)
+	}
+	return rows
+}
+
+// parseSizes parses the fields with sizes in bytes.
+func parseSizes(row map[string]string, fields map[string]*uint64) error {
+	for field, value := range fields {
+		str, ok := row[field]
+		if !ok {
+			return fmt.Errorf("%s missing", field)
+		}
+		size, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+		*value = size
+	}
+	return nil
+}
+
+// parsePercents parses optional percentages like "12.50". They are
+// empty for logical volumes which do not have them.
+func parsePercents(row map[string]string, fields map[string]*float64) error {
+	for field, value := range fields {
+		str := row[field]
+		if str == "" {
+			*value = 0
+			continue
+		}
+		percent, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+		*value = percent
+	}
+	return nil
+}
+
+// parseSegment parses the fields "devices,seg_start,seg_size,vg_extent_size".
+// The devices field looks like "/dev/pmem0(0),/dev/pmem1(0)".
+func parseSegment(row map[string]string) (Segment, error) {
+	seg := Segment{}
+	if err := parseSizes(row, map[string]*uint64{
+		"seg_start":      &seg.Start,
+		"seg_size":       &seg.Size,
+		"vg_extent_size": &seg.ExtentSize,
+	}); err != nil {
+		return seg, err
+	}
+	// Virtual segments, for example of thin volumes, have no devices.
+	devices := row["devices"]
+	if devices == "" {
+		return seg, nil
+	}
+	for _, dev := range strings.Split(devices, ",") {
+		area := Area{PV: dev}
+		if i := strings.Index(dev, "("); i >= 0 {
+			if !strings.HasSuffix(dev, ")") {
+				return seg, fmt.Errorf("devices: invalid entry %q", dev)
+			}
+			extent, err := strconv.ParseUint(dev[i+1:len(dev)-1], 10, 64)
+			if err != nil {
+				return seg, fmt.Errorf("devices: %q: %v", dev, err)
+			}
+			area.PV = dev[:i]
+			area.Extent = extent
+		}
+		seg.Areas = append(seg.Areas, area)
+	}
+	return seg, nil
+}
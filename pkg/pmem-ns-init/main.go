@@ -14,8 +14,10 @@ var (
 	/* generic options */
 	//TODO: reading name configuration not yet supported
 	//configFile    = flag.String("configfile", "/etc/pmem-csi/config", "PMEM CSI driver namespace configuration file")
-	useforfsdax = flag.Int("useforfsdax", 100, "Percentage of total to use in Fsdax mode")
-	showVersion = flag.Bool("version", false, "Show release version and exit")
+	useforfsdax  = flag.Int("useforfsdax", 100, "Percentage of total to use in Fsdax mode")
+	useforsector = flag.Int("useforsector", 0, "Percentage of total to use in Sector mode")
+	showVersion  = flag.Bool("version", false, "Show release version and exit")
+	sysfsRoot    = flag.String("sysfsRoot", ndctl.DefaultSysfsRoot, "Directory where sysfs is mounted, other directories need a binary built without cgo or with the 'sysfs' build tag")
 
 	version = "unknown"
 )
@@ -33,47 +35,60 @@ func Main() int {
 
 	klog.V(3).Info("Version: ", version)
 
-	if err := CheckArgs(*useforfsdax); err != nil {
+	if err := CheckArgs(*useforfsdax, *useforsector); err != nil {
 		pmemcommon.ExitError("invalid arguments", err)
 		return 1
 	}
-	ctx, err := ndctl.NewContext()
+	ctx, err := ndctl.NewSysfsContext(*sysfsRoot)
 	if err != nil {
 		pmemcommon.ExitError("failed to initialize pmem context", err)
 		return 1
 	}
 
-	initNVdimms(ctx, *useforfsdax)
+	initNVdimms(ctx, *useforfsdax, *useforsector)
 	return 0
 }
 
-func CheckArgs(useforfsdax int) error {
+func CheckArgs(useforfsdax, useforsector int) error {
 	if useforfsdax < 0 || useforfsdax > 100 {
 		return fmt.Errorf("useforfsdax value must be 0..100")
 	}
+	if useforsector < 0 || useforsector > 100 {
+		return fmt.Errorf("useforsector value must be 0..100")
+	}
+	if useforfsdax+useforsector > 100 {
+		return fmt.Errorf("useforfsdax and useforsector combined must not be above 100")
+	}
 	return nil
 }
 
-func initNVdimms(ctx *ndctl.Context, useforfsdax int) {
+func initNVdimms(ctx *ndctl.Context, useforfsdax, useforsector int) {
 	for _, bus := range ctx.GetBuses() {
 		for _, r := range bus.ActiveRegions() {
-			createNS(r, useforfsdax)
+			// fsdax first: that way existing setups which give
+			// all space to fsdax remain unchanged.
+			createNS(r, useforfsdax, ndctl.FsdaxMode)
+			createNS(r, useforsector, ndctl.SectorMode)
 		}
 	}
 }
 
-func createNS(r *ndctl.Region, uselimit int) {
+func createNS(r *ndctl.Region, uselimit int, nsmode ndctl.NamespaceMode) {
 	const align uint64 = 1024 * 1024 * 1024
 	realalign := align * r.InterleaveWays()
 	// uselimit is the percentage we can use
 	canUse := uint64(uselimit) * r.Size() / 100
-	klog.V(3).Infof("Create fsdax-namespaces in %v, allowed %d %%, real align %d:\ntotal       : %16d\navail       : %16d\ncan use     : %16d",
-		r.DeviceName(), uselimit, realalign, r.Size(), r.AvailableSize(), canUse)
+	klog.V(3).Infof("Create %v-namespaces in %v, allowed %d %%, real align %d:\ntotal       : %16d\navail       : %16d\ncan use     : %16d",
+		nsmode, r.DeviceName(), uselimit, realalign, r.Size(), r.AvailableSize(), canUse)
 	// Subtract sizes of existing active namespaces with currently handled mode and owned by pmem-csi
 	for _, ns := range r.ActiveNamespaces() {
 		klog.V(5).Infof("createNS: Exists: Size %16d Mode:%v Device:%v Name:%v", ns.Size(), ns.Mode(), ns.DeviceName(), ns.Name())
-		if ns.Name() == "pmem-csi" {
-			canUse -= ns.Size()
+		if ns.Name() == "pmem-csi" && ns.Mode() == nsmode {
+			if ns.Size() > canUse {
+				canUse = 0
+			} else {
+				canUse -= ns.Size()
+			}
 		}
 	}
 	klog.V(4).Infof("Calculated canUse:%v, available by Region info:%v", canUse, r.AvailableSize())
@@ -93,10 +108,10 @@ func createNS(r *ndctl.Region, uselimit int) {
 	// If less than 2GB usable, don't attempt as creation would fail
 	const minsize uint64 = 2 * 1024 * 1024 * 1024
 	if canUse >= minsize {
-		klog.V(3).Infof("Create %v-bytes fsdax-namespace", canUse)
+		klog.V(3).Infof("Create %v-bytes %v-namespace", canUse, nsmode)
 		_, err := r.CreateNamespace(ndctl.CreateNamespaceOpts{
 			Name:  "pmem-csi",
-			Mode:  "fsdax",
+			Mode:  nsmode,
 			Size:  canUse,
 			Align: align,
 		})
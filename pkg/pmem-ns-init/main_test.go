@@ -26,29 +26,35 @@ var _ = AfterSuite(func() {
 var _ = Describe("pmem-ns-init", func() {
 	Context("Check arguments", func() {
 		type cases struct {
-			name        string
-			useforfsdax int
+			name         string
+			useforfsdax  int
+			useforsector int
 		}
 		goodcases := []cases{
-			{"useforfsdax below 100", 50},
-			{"useforfsdax 100", 100},
+			{"useforfsdax below 100", 50, 0},
+			{"useforfsdax 100", 100, 0},
+			{"useforsector 100", 0, 100},
+			{"useforfsdax and useforsector 100", 60, 40},
 		}
 		badcases := []cases{
-			{"useforfsdax negative", -1},
-			{"useforfsdax too large", 101},
+			{"useforfsdax negative", -1, 0},
+			{"useforfsdax too large", 101, 0},
+			{"useforsector negative", 0, -1},
+			{"useforsector too large", 0, 101},
+			{"useforfsdax and useforsector too large", 60, 50},
 		}
 
 		for _, c := range goodcases {
 			c := c
 			It(c.name, func() {
-				err := pmemnsinit.CheckArgs(c.useforfsdax)
+				err := pmemnsinit.CheckArgs(c.useforfsdax, c.useforsector)
 				Expect(err).NotTo(HaveOccurred())
 			})
 		}
 		for _, c := range badcases {
 			c := c
 			It(c.name, func() {
-				err := pmemnsinit.CheckArgs(c.useforfsdax)
+				err := pmemnsinit.CheckArgs(c.useforfsdax, c.useforsector)
 				Expect(err).To(HaveOccurred())
 			})
 		}
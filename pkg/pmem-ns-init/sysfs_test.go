@@ -0,0 +1,59 @@
+// +build !cgo sysfs
+
+package pmemnsinit_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/intel/pmem-csi/pkg/ndctl/fake"
+	"github.com/intel/pmem-csi/pkg/pmem-ns-init"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pmem-ns-init with simulated sysfs", func() {
+	var tmp string
+	var sysfs *fake.Sysfs
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "ns-init-")
+		Expect(err).NotTo(HaveOccurred())
+		sysfs, err = fake.NewSysfs(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(flag.Set("sysfsRoot", tmp)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(flag.Set("sysfsRoot", "/sys")).To(Succeed())
+		Expect(flag.Set("useforfsdax", "100")).To(Succeed())
+		os.RemoveAll(tmp)
+	})
+
+	attr := func(elem ...string) string {
+		data, err := ioutil.ReadFile(filepath.Join(elem...))
+		Expect(err).NotTo(HaveOccurred())
+		return strings.TrimSpace(string(data))
+	}
+
+	It("creates a namespace with the configured share of the region", func() {
+		Expect(flag.Set("useforfsdax", "50")).To(Succeed())
+		Expect(pmemnsinit.Main()).To(Equal(0))
+
+		ns := sysfs.Dir("region0", "namespace0.1")
+		Expect(attr(ns, "alt_name")).To(Equal("pmem-csi"))
+		Expect(attr(ns, "size")).To(Equal("8589934592"), "half of the 16 GiB region")
+		Expect(attr(ns, "holder_class")).To(Equal("pfn"))
+		Expect(attr(sysfs.Dir("region0", "pfn0.1"), "align")).To(Equal("1073741824"))
+	})
+
+	It("fails without sysfs", func() {
+		Expect(flag.Set("sysfsRoot", filepath.Join(tmp, "no-such-dir"))).To(Succeed())
+		Expect(pmemnsinit.Main()).To(Equal(1))
+	})
+})
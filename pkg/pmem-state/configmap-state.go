@@ -0,0 +1,277 @@
+/*
+Copyright 2020 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package pmemstate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// configMapState stores the entries as JSON strings in a ConfigMap,
+// one key per entry. Another state manager serves as local cache:
+// all reads are served by it and all changes get written to both.
+// That way the state survives a reinstallation of the node
+// while reads do not depend on the API server.
+type configMapState struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	cache     StateManager
+	// lock serializes all modifications
+	lock sync.Mutex
+}
+
+var _ StateManager = &configMapState{}
+
+// NewConfigMapState instantiates a state manager which stores its data
+// in the ConfigMap with the given name. The ConfigMap gets created when
+// needed. On startup, the cache gets updated with the content of the
+// ConfigMap and entries which only exist in the cache get copied
+// into the ConfigMap.
+func NewConfigMapState(client kubernetes.Interface, namespace, name string, cache StateManager) (StateManager, error) {
+	cs := &configMapState{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		cache:     cache,
+	}
+	if err := cs.sync(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Create adds the entry to the ConfigMap and the cache.
+func (cs *configMapState) Create(id string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "configmap-state: failed to encode metadata")
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if err := cs.modify(func(entries map[string]string) (bool, error) {
+		if _, ok := entries[id]; ok {
+			return false, errors.Errorf("configmap-state: entry %s already exists in %s", id, cs.configMapName())
+		}
+		entries[id] = string(raw)
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	if err := cs.cache.Create(id, json.RawMessage(raw)); err != nil {
+		// Keep both in sync.
+		if e := cs.remove(id); e != nil {
+			klog.Warningf("configmap-state: %v", e)
+		}
+		return err
+	}
+	return nil
+}
+
+// Update replaces the entry in the ConfigMap and the cache.
+func (cs *configMapState) Update(id string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "configmap-state: failed to encode metadata")
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if err := cs.modify(func(entries map[string]string) (bool, error) {
+		entries[id] = string(raw)
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	return cs.cache.Update(id, json.RawMessage(raw))
+}
+
+// Delete removes the entry from the ConfigMap and the cache.
+func (cs *configMapState) Delete(id string) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if err := cs.remove(id); err != nil {
+		return err
+	}
+	return cs.cache.Delete(id)
+}
+
+// Get reads from the cache. When that fails, the entry gets restored
+// from the ConfigMap, if it has it.
+func (cs *configMapState) Get(id string, dataPtr interface{}) error {
+	err := cs.cache.Get(id, dataPtr)
+	if err == nil {
+		return nil
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	entries, e := cs.entries()
+	if e != nil {
+		klog.Warningf("configmap-state: %v", e)
+		return err
+	}
+	raw, ok := entries[id]
+	if !ok {
+		return err
+	}
+	if e := json.Unmarshal([]byte(raw), dataPtr); e != nil {
+		return errors.Wrapf(e, "configmap-state: failed to decode entry %s from %s", id, cs.configMapName())
+	}
+	klog.Warningf("configmap-state: restoring entry %s from %s after cache error: %v", id, cs.configMapName(), err)
+	if e := cs.cache.Update(id, json.RawMessage(raw)); e != nil {
+		klog.Warningf("configmap-state: %v", e)
+	}
+	return nil
+}
+
+// GetAll returns the ids of the cache, which has the same entries as the
+// ConfigMap.
+func (cs *configMapState) GetAll() ([]string, error) {
+	return cs.cache.GetAll()
+}
+
+func (cs *configMapState) sync() error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	entries, err := cs.entries()
+	if err != nil {
+		return err
+	}
+	ids, err := cs.cache.GetAll()
+	if err != nil {
+		return err
+	}
+
+	missing := map[string]string{}
+	for _, id := range ids {
+		var raw json.RawMessage
+		if err := cs.cache.Get(id, &raw); err != nil {
+			klog.Warningf("configmap-state: %v", err)
+			continue
+		}
+		if _, ok := entries[id]; !ok {
+			missing[id] = string(raw)
+			continue
+		}
+		var cached bytes.Buffer
+		if err := json.Compact(&cached, raw); err == nil && cached.String() == entries[id] {
+			delete(entries, id)
+		}
+	}
+
+	// Restore entries which are missing or different in the cache.
+	for id, raw := range entries {
+		klog.V(3).Infof("configmap-state: restoring entry %s from %s", id, cs.configMapName())
+		if err := cs.cache.Update(id, json.RawMessage(raw)); err != nil {
+			return err
+		}
+	}
+
+	// Entries written while the state was only stored locally.
+	if len(missing) > 0 {
+		klog.V(3).Infof("configmap-state: adding %d entries to %s", len(missing), cs.configMapName())
+		return cs.modify(func(entries map[string]string) (bool, error) {
+			for id, raw := range missing {
+				entries[id] = raw
+			}
+			return true, nil
+		})
+	}
+	return nil
+}
+
+// entries returns the content of the ConfigMap, which is empty if it
+// does not exist yet.
+func (cs *configMapState) entries() (map[string]string, error) {
+	cm, err := cs.client.CoreV1().ConfigMaps(cs.namespace).Get(context.Background(), cs.name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return map[string]string{}, nil
+		}
+		return nil, errors.Wrapf(err, "configmap-state: failed to get %s", cs.configMapName())
+	}
+	entries := map[string]string{}
+	for id, raw := range cm.Data {
+		entries[id] = raw
+	}
+	return entries, nil
+}
+
+// modify applies the change to the ConfigMap, creating it if necessary.
+// The change function reports whether it modified the entries.
+// Conflicting updates get retried.
+func (cs *configMapState) modify(change func(entries map[string]string) (bool, error)) error {
+	configMaps := cs.client.CoreV1().ConfigMaps(cs.namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ctx := context.Background()
+		cm, err := configMaps.Get(ctx, cs.name, metav1.GetOptions{})
+		create := apierrors.IsNotFound(err)
+		if create {
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      cs.name,
+					Namespace: cs.namespace,
+				},
+			}
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		changed, err := change(cm.Data)
+		if err != nil || !changed {
+			return err
+		}
+		if create {
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Created concurrently, try again.
+				return apierrors.NewConflict(v1.Resource("configmaps"), cs.name, err)
+			}
+			return err
+		}
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "configmap-state: failed to update %s", cs.configMapName())
+	}
+	return nil
+}
+
+func (cs *configMapState) remove(id string) error {
+	return cs.modify(func(entries map[string]string) (bool, error) {
+		if _, ok := entries[id]; !ok {
+			return false, nil
+		}
+		delete(entries, id)
+		return true, nil
+	})
+}
+
+func (cs *configMapState) configMapName() string {
+	return "ConfigMap " + cs.namespace + "/" + cs.name
+}
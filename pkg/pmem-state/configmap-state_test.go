@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package pmemstate_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("configmap state", func() {
+	const namespace = "default"
+	const name = "pmem-csi-node-volumes"
+	var stateDir string
+	var client *fake.Clientset
+
+	BeforeEach(func() {
+		var err error
+		stateDir, err = ioutil.TempDir("", "pmemstate-")
+		Expect(err).NotTo(HaveOccurred())
+		client = fake.NewSimpleClientset()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stateDir)
+	})
+
+	newState := func() pmemstate.StateManager {
+		cache, err := pmemstate.NewFileState(stateDir)
+		Expect(err).NotTo(HaveOccurred())
+		cs, err := pmemstate.NewConfigMapState(client, namespace, name, cache)
+		Expect(err).NotTo(HaveOccurred())
+		return cs
+	}
+
+	configMapData := func() map[string]string {
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return cm.Data
+	}
+
+	data := testData{
+		Id:   "one",
+		Name: "test-data1",
+		Params: map[string]string{
+			"key1": "val1",
+		},
+	}
+
+	It("writes through", func() {
+		cs := newState()
+		err := cs.Create(data.Id, data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configMapData()).To(Equal(map[string]string{
+			"one": `{"Id":"one","Name":"test-data1","Params":{"key1":"val1"}}`,
+		}))
+		err = cs.Create(data.Id, data)
+		Expect(err).To(HaveOccurred(), "create existing entry")
+
+		updated := data
+		updated.Name = "test-data2"
+		err = cs.Update(data.Id, updated)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configMapData()).To(HaveKeyWithValue("one", `{"Id":"one","Name":"test-data2","Params":{"key1":"val1"}}`))
+
+		// The file state has the same content.
+		cache, err := pmemstate.NewFileState(stateDir)
+		Expect(err).NotTo(HaveOccurred())
+		rData := testData{}
+		err = cache.Get(data.Id, &rData)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(updated.IsEqual(rData)).To(Equal(true))
+
+		err = cs.Delete(data.Id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configMapData()).To(BeEmpty())
+		ids, err := cs.GetAll()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(BeEmpty())
+	})
+
+	It("restores lost state", func() {
+		cs := newState()
+		err := cs.Create(data.Id, data)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Reinstalled node.
+		err = os.RemoveAll(stateDir)
+		Expect(err).NotTo(HaveOccurred())
+		cs = newState()
+		ids, err := cs.GetAll()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{data.Id}))
+		rData := testData{}
+		err = cs.Get(data.Id, &rData)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data.IsEqual(rData)).To(Equal(true))
+
+		// Corrupted file.
+		err = ioutil.WriteFile(path.Join(stateDir, data.Id+".json"), []byte("{"), 0600)
+		Expect(err).NotTo(HaveOccurred())
+		rData = testData{}
+		err = cs.Get(data.Id, &rData)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data.IsEqual(rData)).To(Equal(true))
+		ids, err = cs.GetAll()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{data.Id}), "cache restored")
+	})
+
+	It("copies local state", func() {
+		cache, err := pmemstate.NewFileState(stateDir)
+		Expect(err).NotTo(HaveOccurred())
+		err = cache.Create(data.Id, data)
+		Expect(err).NotTo(HaveOccurred())
+
+		newState()
+		Expect(configMapData()).To(HaveKey(data.Id))
+	})
+
+	It("fails without API server", func() {
+		cs := newState()
+		client.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("fake API server failure")
+		})
+		err := cs.Create(data.Id, data)
+		Expect(err).To(HaveOccurred())
+		ids, err := cs.GetAll()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(BeEmpty(), "nothing stored locally")
+
+		cache, err := pmemstate.NewFileState(stateDir)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = pmemstate.NewConfigMapState(client, namespace, name, cache)
+		Expect(err).To(HaveOccurred())
+	})
+})
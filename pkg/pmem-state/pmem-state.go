@@ -6,6 +6,9 @@ SPDX-License-Identifier: Apache-2.0
 package pmemstate
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +16,7 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"k8s.io/klog"
@@ -22,14 +26,41 @@ import (
 type StateManager interface {
 	// Create creates an entry in the state with given id and data
 	Create(id string, data interface{}) error
+	// Update replaces the data of an entry, creating it if it does not exist yet
+	Update(id string, data interface{}) error
 	// Delete deletes an entry found with the id from the state
 	Delete(id string) error
 	// Get retrives the entry data into location pointed by dataPtr.
+	// Fails with an error that wraps ErrCorrupted if the entry
+	// exists but cannot be read back.
 	Get(id string, dataPtr interface{}) error
 	// GetAll retrieves ids of all entries found in the state
 	GetAll() ([]string, error)
 }
 
+const (
+	// formatVersion gets stored in each state file. Files without
+	// it were written by older releases and contain just the data.
+	formatVersion = 1
+
+	// quarantineDir is the sub-directory of the state directory
+	// which receives the files that cannot be read back.
+	quarantineDir = "quarantine"
+
+	tmpSuffix = ".tmp"
+)
+
+// ErrCorrupted is returned by Get for an entry with invalid content.
+var ErrCorrupted = errors.New("corrupted state entry")
+
+// fileEntry is the content of a state file.
+type fileEntry struct {
+	Version int `json:"version"`
+	// Checksum is the hex-encoded SHA-256 hash of Data.
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
 // fileState Persists the state information into a file.
 // This is is supposed to use by Nodes to persists the state.
 type fileState struct {
@@ -45,42 +76,43 @@ var _ StateManager = &fileState{}
 // NewFileState instantiates the file state manager with given directory
 // location. It ensures the provided directory exists.
 // Returns error, if fails to create the directory in case of not pre-existing.
+// Temporary files left behind by an interrupted write get removed.
 func NewFileState(directory string) (StateManager, error) {
 	if err := ensureLocation(directory); err != nil {
 		return nil, err
 	}
 
-	return &fileState{
+	fs := &fileState{
 		location: directory,
-	}, nil
+	}
+	if err := fs.removeTmpFiles(); err != nil {
+		return nil, err
+	}
+	return fs, nil
 }
 
-// Create saves the volume metadata to file named <id>.json
+// Create saves the volume metadata to file named <id>.json.
+// It fails if that file already exists.
 func (fs *fileState) Create(id string, data interface{}) error {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
 	file := path.Join(fs.location, id+".json")
-	// Create new file for synchronous writes
-	fp, err := os.OpenFile(file, os.O_WRONLY|os.O_SYNC|os.O_CREATE|os.O_EXCL, 0600)
-	if err != nil {
-		return errors.Wrapf(err, "file-state: failed to create metadata storage file %s", file)
+	if _, err := os.Lstat(file); err == nil {
+		return errors.Errorf("file-state: metadata storage file %s already exists", file)
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "file-state: failed to check metadata storage file %s", file)
 	}
 
-	if err := json.NewEncoder(fp).Encode(data); err != nil {
-		// cleanup file entry before returning error
-		fp.Close() //nolint: errcheck, gosec
-		if e := os.Remove(file); e != nil {
-			klog.Warningf("file-state: fail to remove file %s: %s", file, e.Error())
-		}
-		return errors.Wrap(err, "file-state: failed to encode metadata")
-	}
+	return fs.writeFileData(file, data)
+}
 
-	if err := fp.Close(); err != nil {
-		return errors.Wrapf(err, "file-state: failed to close metadata storage file %s", file)
-	}
+// Update replaces the volume metadata in file <id>.json
+func (fs *fileState) Update(id string, data interface{}) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
 
-	return fs.syncStateDir()
+	return fs.writeFileData(path.Join(fs.location, id+".json"), data)
 }
 
 // Delete deletes the metadata file saved for given volume id
@@ -96,9 +128,26 @@ func (fs *fileState) Delete(id string) error {
 	return fs.syncStateDir()
 }
 
-// Get retrieves metadata for given volume id to pointer location of dataPtr
+// Get retrieves metadata for given volume id to pointer location of dataPtr.
+// A file with invalid content gets moved into the quarantine directory,
+// so it no longer shows up in GetAll.
 func (fs *fileState) Get(id string, dataPtr interface{}) error {
-	return fs.readFileData(path.Join(fs.location, id+".json"), dataPtr)
+	file := path.Join(fs.location, id+".json")
+	corrupted, err := fs.readFileData(file, dataPtr)
+	if !corrupted {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	// The file might have been replaced in the meantime.
+	if corrupted, err = readFile(file, dataPtr); !corrupted {
+		return err
+	}
+	if e := fs.quarantine(id, file); e != nil {
+		klog.Warningf("file-state: %v", e)
+	}
+	return err
 }
 
 // GetAll retrieves the names of all .json files found in fileState.location directory
@@ -136,20 +185,123 @@ func ensureLocation(directory string) error {
 	return err
 }
 
-func (fs *fileState) readFileData(file string, dataPtr interface{}) error {
+// writeFileData writes the file atomically: the new content goes into a
+// temporary file first, which then replaces the file.
+func (fs *fileState) writeFileData(file string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "file-state: failed to encode metadata")
+	}
+	sum := sha256.Sum256(raw)
+	content, err := json.Marshal(fileEntry{
+		Version:  formatVersion,
+		Checksum: hex.EncodeToString(sum[:]),
+		Data:     raw,
+	})
+	if err != nil {
+		return errors.Wrap(err, "file-state: failed to encode metadata")
+	}
+
+	tmpFile := path.Join(fs.location, "."+path.Base(file)+tmpSuffix)
+	fp, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "file-state: failed to create temporary file %s", tmpFile)
+	}
+	_, err = fp.Write(append(content, '\n'))
+	if err == nil {
+		err = fp.Sync()
+	}
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, file)
+	}
+	if err != nil {
+		// cleanup temporary file before returning error
+		if e := os.Remove(tmpFile); e != nil && !os.IsNotExist(e) {
+			klog.Warningf("file-state: fail to remove file %s: %s", tmpFile, e.Error())
+		}
+		return errors.Wrapf(err, "file-state: failed to write metadata storage file %s", file)
+	}
+
+	return fs.syncStateDir()
+}
+
+func (fs *fileState) readFileData(file string, dataPtr interface{}) (bool, error) {
 	fs.lock.RLock()
 	defer fs.lock.RUnlock()
 
-	fp, err := os.OpenFile(file, os.O_RDONLY|os.O_SYNC, 0) //nolint: gosec
+	return readFile(file, dataPtr)
+}
+
+// readFile decodes and verifies the file content. The boolean is true
+// for invalid content, which is reported with an error that wraps
+// ErrCorrupted.
+func readFile(file string, dataPtr interface{}) (bool, error) {
+	content, err := ioutil.ReadFile(file) //nolint: gosec
 	if err != nil {
-		return errors.Wrapf(err, "file-state: failed to open file %s", file)
+		return false, errors.Wrapf(err, "file-state: failed to read file %s", file)
+	}
+
+	var entry fileEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return true, fmt.Errorf("file-state: failed to decode metadata from file %s: %v: %w", file, err, ErrCorrupted)
+	}
+	switch {
+	case entry.Version == 0 && entry.Checksum == "" && entry.Data == nil:
+		// Written by an older release.
+		entry.Data = content
+	case entry.Version > formatVersion:
+		return false, errors.Errorf("file-state: file %s has unsupported format version %d", file, entry.Version)
+	default:
+		sum := sha256.Sum256(entry.Data)
+		if entry.Checksum != hex.EncodeToString(sum[:]) {
+			return true, fmt.Errorf("file-state: checksum mismatch in file %s: %w", file, ErrCorrupted)
+		}
 	}
-	defer fp.Close() //nolint: errcheck
 
-	if err := json.NewDecoder(fp).Decode(dataPtr); err != nil {
-		return errors.Wrapf(err, "file-state: failed to decode metadata from file %s", file)
+	decoder := json.NewDecoder(bytes.NewReader(entry.Data))
+	if err := decoder.Decode(dataPtr); err != nil {
+		return true, fmt.Errorf("file-state: failed to decode metadata from file %s: %v: %w", file, err, ErrCorrupted)
 	}
 
+	return false, nil
+}
+
+// quarantine moves the file into the quarantine directory, where it is
+// kept for inspection by an admin. The current time gets appended to
+// the file name to keep older copies.
+func (fs *fileState) quarantine(id, file string) error {
+	dir := path.Join(fs.location, quarantineDir)
+	if err := ensureLocation(dir); err != nil {
+		return errors.Wrapf(err, "failed to create quarantine directory %s", dir)
+	}
+	target := path.Join(dir, fmt.Sprintf("%s.json.%s", id, time.Now().UTC().Format("20060102T150405.000000000")))
+	if err := os.Rename(file, target); err != nil {
+		return errors.Wrapf(err, "failed to quarantine %s", file)
+	}
+	klog.Warningf("file-state: moved unreadable file %s to %s", file, target)
+	return fs.syncStateDir()
+}
+
+// removeTmpFiles removes the temporary files of interrupted writes.
+func (fs *fileState) removeTmpFiles() error {
+	files, err := ioutil.ReadDir(fs.location)
+	if err != nil {
+		return errors.Wrapf(err, "file-state: failed to read metadata from %s", fs.location)
+	}
+	for _, fileInfo := range files {
+		fileName := fileInfo.Name()
+		if fileInfo.IsDir() || !strings.HasSuffix(fileName, tmpSuffix) {
+			continue
+		}
+		file := path.Join(fs.location, fileName)
+		klog.V(3).Infof("file-state: removing incomplete file %s", file)
+		if err := os.Remove(file); err != nil {
+			return errors.Wrapf(err, "file-state: failed to remove file %s", file)
+		}
+	}
 	return nil
 }
 
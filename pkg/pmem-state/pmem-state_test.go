@@ -6,6 +6,7 @@ SPDX-License-Identifier: Apache-2.0
 package pmemstate_test
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -327,6 +328,111 @@ var _ = Describe("pmem state", func() {
 			rData := testData{}
 			err = fs.Get(data.Id, &rData)
 			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, pmemstate.ErrCorrupted)).To(BeTrue(), "corrupted: %v", err)
+
+			// The file was moved into quarantine.
+			ids, err := fs.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(BeEmpty(), "records after quarantine")
+			files, err := ioutil.ReadDir(path.Join(stateDir, "quarantine"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1), "quarantined files")
+			Expect(files[0].Name()).To(HavePrefix(data.Id+".json."), "quarantined file")
+
+			// Can be written again.
+			err = fs.Update(data.Id, data)
+			Expect(err).NotTo(HaveOccurred())
+			err = fs.Get(data.Id, &rData)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data.IsEqual(rData)).To(Equal(true))
+		})
+
+		It("checksum mismatch", func() {
+			data := testData{
+				Id:   "one",
+				Name: "test-data1",
+			}
+
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			err = fs.Create(data.Id, data)
+			Expect(err).NotTo(HaveOccurred())
+
+			// modify the data without updating the checksum
+			file := path.Join(stateDir, data.Id+".json")
+			content, err := ioutil.ReadFile(file)
+			Expect(err).NotTo(HaveOccurred())
+			content = []byte(strings.Replace(string(content), "test-data1", "test-data2", 1))
+			err = ioutil.WriteFile(file, content, 0600)
+			Expect(err).NotTo(HaveOccurred())
+
+			rData := testData{}
+			err = fs.Get(data.Id, &rData)
+			Expect(errors.Is(err, pmemstate.ErrCorrupted)).To(BeTrue(), "corrupted: %v", err)
+			_, err = os.Stat(file)
+			Expect(os.IsNotExist(err)).To(BeTrue(), "file removed")
+		})
+
+		It("update", func() {
+			data := testData{
+				Id:   "one",
+				Name: "test-data1",
+				Params: map[string]string{
+					"key1": "val1",
+				},
+			}
+
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Update also creates.
+			err = fs.Update(data.Id, data)
+			Expect(err).NotTo(HaveOccurred())
+			err = fs.Create(data.Id, data)
+			Expect(err).To(HaveOccurred(), "create existing entry")
+
+			data.Params["key2"] = "val2"
+			err = fs.Update(data.Id, data)
+			Expect(err).NotTo(HaveOccurred())
+			rData := testData{}
+			err = fs.Get(data.Id, &rData)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data.IsEqual(rData)).To(Equal(true))
+
+			ids, err := fs.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{data.Id}), "no temporary files")
+		})
+
+		It("old format", func() {
+			data := testData{
+				Id:   "one",
+				Name: "test-data1",
+				Params: map[string]string{
+					"key1": "val1",
+				},
+			}
+
+			err := ioutil.WriteFile(path.Join(stateDir, data.Id+".json"),
+				[]byte(`{"Id":"one","Name":"test-data1","Params":{"key1":"val1"}}`+"\n"), 0600)
+			Expect(err).NotTo(HaveOccurred())
+			// left behind by an interrupted write
+			tmpFile := path.Join(stateDir, ".two.json.tmp")
+			err = ioutil.WriteFile(tmpFile, []byte(`{"version":1,`), 0600)
+			Expect(err).NotTo(HaveOccurred())
+
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = os.Stat(tmpFile)
+			Expect(os.IsNotExist(err)).To(BeTrue(), "temporary file removed")
+
+			ids, err := fs.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{data.Id}))
+			rData := testData{}
+			err = fs.Get(data.Id, &rData)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data.IsEqual(rData)).To(Equal(true))
 		})
 
 		It("able to read/write with different parameters", func() {
@@ -10,10 +10,14 @@ import (
 	"github.com/intel/pmem-csi/pkg/ndctl"
 	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	pmemlvm "github.com/intel/pmem-csi/pkg/pmem-lvm"
 )
 
 var (
 	showVersion = flag.Bool("version", false, "Show release version and exit")
+	spanRegions = flag.Bool("spanregions", false, "Create one volume group for all regions instead of one per region")
+	thinPool    = flag.Uint("thinpool", 0, "Percentage of the free space in each volume group which is used for a thin pool, 0 disables thin provisioning")
+	sysfsRoot   = flag.String("sysfsRoot", ndctl.DefaultSysfsRoot, "Directory where sysfs is mounted, other directories need a binary built without cgo or with the 'sysfs' build tag")
 
 	version = "unknown"
 )
@@ -31,13 +35,18 @@ func Main() int {
 
 	klog.V(3).Info("Version: ", version)
 
-	ctx, err := ndctl.NewContext()
+	ctx, err := ndctl.NewSysfsContext(*sysfsRoot)
 	if err != nil {
 		pmemcommon.ExitError("failed to initialize pmem context", err)
 		return 1
 	}
 
-	prepareVolumeGroups(ctx)
+	if *thinPool > 100 {
+		pmemcommon.ExitError("invalid -thinpool", fmt.Errorf("%d%% is more than the free space", *thinPool))
+		return 1
+	}
+
+	prepareVolumeGroups(ctx, *spanRegions, *thinPool)
 
 	return 0
 }
@@ -47,20 +56,58 @@ func Main() int {
 // - For all namespaces in region:
 //   - check that PVol exists provided by that namespace, is in current VG, add if does not exist
 // Edge cases are when no PVol or VG structures (or partially) dont exist yet
-func prepareVolumeGroups(ctx *ndctl.Context) {
+// With spanRegions, the same VG gets used for all regions.
+// With thinPool > 0, each VG also gets a thin pool.
+func prepareVolumeGroups(ctx *ndctl.Context, spanRegions bool, thinPool uint) {
+	vgNames := []string{}
 	for _, bus := range ctx.GetBuses() {
 		klog.V(5).Infof("CheckVG: Bus: %v", bus.DeviceName())
 		for _, r := range bus.ActiveRegions() {
 			klog.V(5).Infof("Region: %v", r.DeviceName())
-			vgName := pmemcommon.VgName(bus, r)
-			if err := createVolumesForRegion(r, vgName); err != nil {
-				klog.Errorf("Failed volumegroup creation: %s", err.Error())
+			for _, nsmode := range []ndctl.NamespaceMode{ndctl.FsdaxMode, ndctl.SectorMode} {
+				vgName := pmemcommon.VgName(bus, r, nsmode)
+				if spanRegions {
+					vgName = pmemcommon.VgNameAllRegions(nsmode)
+				}
+				if err := createVolumesForRegion(r, vgName, nsmode); err != nil {
+					klog.Errorf("Failed volumegroup creation: %s", err.Error())
+				}
+				vgNames = append(vgNames, vgName)
 			}
 		}
 	}
+	if thinPool == 0 {
+		return
+	}
+	client := pmemlvm.New(nil)
+	done := map[string]bool{}
+	for _, vgName := range vgNames {
+		if done[vgName] {
+			continue
+		}
+		done[vgName] = true
+		if err := createThinPool(client, vgName, thinPool); err != nil {
+			klog.Errorf("Failed thin pool creation: %s", err.Error())
+		}
+	}
+}
+
+// createThinPool creates the thin pool in the VG, unless the VG does
+// not exist or already has one. An existing pool is not resized.
+func createThinPool(client *pmemlvm.Client, vgName string, percentFree uint) error {
+	if _, err := client.VolumeGroups(vgName); err != nil {
+		klog.V(3).Infof("No Vgroup with name %v, no thin pool needed", vgName)
+		return nil
+	}
+	if _, err := client.LogicalVolumes(vgName + "/" + pmemcommon.ThinPoolName); err == nil {
+		klog.V(3).Infof("Thin pool exists in VolGroup '%v'", vgName)
+		return nil
+	}
+	klog.V(3).Infof("Creating thin pool with %d%% of the free space in VolGroup '%v'", percentFree, vgName)
+	return client.CreateThinPool(vgName, pmemcommon.ThinPoolName, percentFree)
 }
 
-func createVolumesForRegion(r *ndctl.Region, vgName string) error {
+func createVolumesForRegion(r *ndctl.Region, vgName string, nsmode ndctl.NamespaceMode) error {
 	cmd := ""
 	cmdArgs := []string{"--force", vgName}
 	nsArray := r.ActiveNamespaces()
@@ -70,7 +117,7 @@ func createVolumesForRegion(r *ndctl.Region, vgName string) error {
 	}
 	for _, ns := range nsArray {
 		// consider only namespaces having name given by this driver, to exclude foreign ones
-		if ns.Name() == "pmem-csi" {
+		if ns.Name() == "pmem-csi" && ns.Mode() == nsmode {
 			devName := "/dev/" + ns.BlockDeviceName()
 			/* check if this pv is already part of a group, if yes ignore this pv
 			if not add to arg list */
@@ -0,0 +1,13 @@
+package pmemvgm_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPmemVGM(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "VGM Suite")
+}
@@ -0,0 +1,70 @@
+// +build !cgo sysfs
+
+package pmemvgm_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/intel/pmem-csi/pkg/ndctl/fake"
+	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
+	execfake "github.com/intel/pmem-csi/pkg/pmem-exec/fake"
+	pmemlvm "github.com/intel/pmem-csi/pkg/pmem-lvm"
+	"github.com/intel/pmem-csi/pkg/pmem-vgm"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pmem-vgm with simulated sysfs", func() {
+	var tmp string
+	var sysfs *fake.Sysfs
+	var prevExecutor pmemexec.Executor
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "vgm-")
+		Expect(err).NotTo(HaveOccurred())
+		sysfs, err = fake.NewSysfs(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(flag.Set("sysfsRoot", tmp)).To(Succeed())
+		executor := execfake.New()
+		executor.DevDir = tmp
+		executor.AddDevice("/dev/pmem0", 1024*1024*1024)
+		prevExecutor = pmemexec.SetExecutor(executor)
+	})
+
+	AfterEach(func() {
+		pmemexec.SetExecutor(prevExecutor)
+		Expect(flag.Set("sysfsRoot", "/sys")).To(Succeed())
+		os.RemoveAll(tmp)
+	})
+
+	It("creates volume groups for PMEM-CSI namespaces", func() {
+		Expect(sysfs.Attrs(sysfs.Dir("region0", "namespace0.0"), map[string]string{"alt_name": "pmem-csi"})).To(Succeed())
+		Expect(pmemvgm.Main()).To(Equal(0))
+
+		vgs, err := pmemlvm.New(nil).VolumeGroups("ndbus0region0fsdax")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vgs).To(HaveLen(1))
+		pvs, err := pmemlvm.New(nil).PhysicalVolumes()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pvs).To(HaveLen(1))
+		Expect(pvs[0].Name).To(Equal("/dev/pmem0"))
+		Expect(pvs[0].VGName).To(Equal("ndbus0region0fsdax"))
+	})
+
+	It("ignores foreign namespaces", func() {
+		Expect(pmemvgm.Main()).To(Equal(0))
+
+		_, err := pmemlvm.New(nil).VolumeGroups("ndbus0region0fsdax")
+		Expect(err).To(HaveOccurred(), "no volume group")
+	})
+
+	It("fails without sysfs", func() {
+		Expect(flag.Set("sysfsRoot", filepath.Join(tmp, "no-such-dir"))).To(Succeed())
+		Expect(pmemvgm.Main()).To(Equal(1))
+	})
+})